@@ -9,16 +9,31 @@ import (
 )
 
 type Config struct {
-	Server ServerConfig
-	Queues QueuesConfig
-	Logger LoggerConfig
+	Server    ServerConfig
+	Queues    QueuesConfig
+	Exchanges ExchangesConfig
+	Storage   StorageConfig
+	Auth      AuthConfig
+	Logger    LoggerConfig
 }
 
 type ServerConfig struct {
-	Port              string
+	Port string
+	// gRPC API is not served when empty
+	GrpcPort          string
 	Mode              string
 	TimeoutSec        time.Duration
 	CtxDefaultTimeout time.Duration
+	// how often background maintenance of queues runs, 1 second by default
+	MaintenanceIntervalSec time.Duration
+	// time in-flight requests are given to finish on shutdown before their
+	// connections are closed, 30 seconds by default
+	ShutdownGraceSec time.Duration
+	// max size of request body of published message, 1 MiB by default
+	MaxMessageBytes int64
+	// origins of pages allowed to open websocket connections besides the
+	// server's own origin, * allows any origin
+	WSAllowedOrigins []string
 }
 
 type QueuesConfig []QueueConfig
@@ -27,6 +42,119 @@ type QueueConfig struct {
 	Name              string
 	Length            uint
 	SubscribersAmount uint
+	// time for which consumed message is hidden from subscriber until it's acknowledged
+	VisibilityTimeoutSec time.Duration
+	// subscribers which don't consume for this long are removed, 0 disables eviction
+	SubscriberIdleTimeoutSec time.Duration
+	// default time-to-live of messages, 0 means messages don't expire
+	MessageTTLSec time.Duration
+	// queue which receives expired, rejected and over-delivered messages
+	DeadLetterQueue string
+	// deliveries of message to subscriber after which it's dead-lettered, 0 means unlimited
+	MaxDeliveries uint
+	// number of message priority levels, 0 or 1 disables priorities
+	PriorityLevels uint
+	// waiting message is raised by one priority level every this long, 0 disables aging
+	PriorityAgingSec time.Duration
+	// fanout delivers every message to every subscriber, competing delivers it
+	// to one of them, fanout is used when empty
+	DeliveryMode string
+	// repeats of message with the same deduplication ID are not published for
+	// this long, 5 minutes when 0
+	DeduplicationWindowSec time.Duration
+}
+
+type ExchangesConfig []ExchangeConfig
+
+type ExchangeConfig struct {
+	Name     string
+	Bindings []BindingConfig
+}
+
+type BindingConfig struct {
+	Queue string
+	// dot-separated words of routing key, * matches exactly one word and # zero or more words
+	Pattern string
+}
+
+const (
+	StorageMemory = "memory"
+	StorageFile   = "file"
+)
+
+const (
+	FsyncAlways   = "always"
+	FsyncInterval = "interval"
+	FsyncNever    = "never"
+)
+
+type StorageConfig struct {
+	// memory (default) or file
+	Type string
+	// directory for write-ahead log and snapshots of file storage
+	Dir string
+	// always, interval (default) or never
+	FsyncPolicy      string
+	FsyncIntervalSec time.Duration
+	// amount of write-ahead log records after which snapshot is taken, 0 disables snapshots
+	SnapshotEvery uint
+}
+
+type AuthConfig struct {
+	// every request is allowed everything when disabled
+	Enabled bool
+	// signed requests with timestamp further than this from server time are
+	// rejected, 5 minutes when 0
+	SignatureMaxSkewSec time.Duration
+	// signed requests with larger body are rejected, 1 MiB when 0
+	MaxSignedBodyBytes int64
+	Principals         []PrincipalConfig
+	JWT                JWTConfig
+}
+
+// JWTConfig makes bearer tokens issued by identity provider valid credentials
+// when auth is enabled. Exactly one of key files is used, it's read at startup
+type JWTConfig struct {
+	Enabled bool
+	// file with HS256 secret
+	HMACSecretFile string
+	// PEM file with RS256 public key or certificate
+	RSAPublicKeyFile string
+	// JSON Web Key Set file with RSA and symmetric keys, selected by kid of token
+	JWKSFile string
+	// iss and aud claims of tokens, not checked when empty
+	Issuer   string
+	Audience string
+	// claim with subscriber name of token holder, sub when empty
+	SubscriberClaim string
+	// claim with space-separated string or array of scopes, scope when empty.
+	// Scope <action>:queue:<pattern> or <action>:exchange:<pattern> grants
+	// action as PermissionConfig does, other scopes are ignored
+	ScopesClaim string
+	// allowed clock difference with identity provider for exp and nbf claims
+	LeewaySec time.Duration
+}
+
+// PrincipalConfig is a client of the broker with its credentials and permissions
+type PrincipalConfig struct {
+	Name string
+	// keys sent in X-API-Key header or as bearer token
+	APIKeys []string
+	// secrets of HMAC-SHA256 signed requests
+	SigningSecrets []string
+	// patterns of subscriber names principal may act as, only its own name when empty
+	Subscribers []string
+	Permissions []PermissionConfig
+}
+
+// PermissionConfig grants actions on queues and exchanges whose names match
+// patterns. Patterns are globs as in path.Match, routes which work with all
+// queues or exchanges at once need a permission granted by * pattern
+type PermissionConfig struct {
+	Queues    []string
+	Exchanges []string
+	// publish, consume (with ack and nack), subscribe or admin
+	Actions []string
 }
 
 type LoggerConfig struct {
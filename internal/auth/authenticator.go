@@ -0,0 +1,275 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VladSatyshev/concurrent-queue/config"
+)
+
+const (
+	APIKeyHeader    = "X-API-Key"
+	TimestampHeader = "X-Auth-Timestamp"
+	// scheme of Authorization header of signed requests:
+	// HMAC-SHA256 <principal>:<hex signature>
+	SignatureScheme = "HMAC-SHA256"
+	bearerScheme    = "Bearer"
+
+	defaultSignatureMaxSkew = 5 * time.Minute
+	defaultMaxSignedBody    = 1 << 20
+)
+
+// Authenticator finds principals of requests by their credentials
+type Authenticator struct {
+	enabled bool
+	// principals by SHA-256 of their API keys, so keys are not compared one by one
+	keys map[[sha256.Size]byte]*Principal
+	// signing secrets of principals by their names
+	secrets    map[string][][]byte
+	principals map[string]*Principal
+	// verifies bearer tokens which look like JWTs, nil when JWT is disabled
+	jwt     *jwtVerifier
+	maxSkew time.Duration
+	// body of signed request is read into memory to be verified, so it's limited
+	maxSignedBody int64
+	now           func() time.Time
+}
+
+// NewAuthenticator builds principals from config, fails if any of them is invalid
+func NewAuthenticator(cfg config.AuthConfig) (*Authenticator, error) {
+	a := &Authenticator{
+		enabled:       cfg.Enabled,
+		keys:          map[[sha256.Size]byte]*Principal{},
+		secrets:       map[string][][]byte{},
+		principals:    map[string]*Principal{},
+		maxSkew:       cfg.SignatureMaxSkewSec * time.Second,
+		maxSignedBody: cfg.MaxSignedBodyBytes,
+		now:           time.Now,
+	}
+	if a.maxSkew <= 0 {
+		a.maxSkew = defaultSignatureMaxSkew
+	}
+	if a.maxSignedBody <= 0 {
+		a.maxSignedBody = defaultMaxSignedBody
+	}
+	if !a.enabled {
+		return a, nil
+	}
+	if len(cfg.Principals) == 0 && !cfg.JWT.Enabled {
+		return nil, errors.New("auth is enabled but no principals are configured")
+	}
+	if cfg.JWT.Enabled {
+		verifier, err := newJWTVerifier(cfg.JWT)
+		if err != nil {
+			return nil, err
+		}
+		a.jwt = verifier
+	}
+
+	for _, principalCfg := range cfg.Principals {
+		p, err := newPrincipal(principalCfg)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := a.principals[p.Name]; ok {
+			return nil, fmt.Errorf("principal %s is configured twice", p.Name)
+		}
+		a.principals[p.Name] = p
+
+		for _, key := range principalCfg.APIKeys {
+			if key == "" {
+				return nil, fmt.Errorf("principal %s has empty API key", p.Name)
+			}
+			hash := sha256.Sum256([]byte(key))
+			if _, ok := a.keys[hash]; ok {
+				return nil, fmt.Errorf("API key of principal %s is used by another principal", p.Name)
+			}
+			a.keys[hash] = p
+		}
+		for _, secret := range principalCfg.SigningSecrets {
+			if secret == "" {
+				return nil, fmt.Errorf("principal %s has empty signing secret", p.Name)
+			}
+			a.secrets[p.Name] = append(a.secrets[p.Name], []byte(secret))
+		}
+	}
+
+	return a, nil
+}
+
+func newPrincipal(cfg config.PrincipalConfig) (*Principal, error) {
+	if cfg.Name == "" {
+		return nil, errors.New("principal must have a name")
+	}
+
+	p := &Principal{Name: cfg.Name, subscribers: cfg.Subscribers}
+	if len(p.subscribers) == 0 {
+		p.subscribers = []string{cfg.Name}
+	}
+	if err := checkPatterns(p.subscribers); err != nil {
+		return nil, fmt.Errorf("principal %s: %w", cfg.Name, err)
+	}
+
+	for _, permission := range cfg.Permissions {
+		actions := make(map[Action]struct{}, len(permission.Actions))
+		for _, action := range permission.Actions {
+			if !validAction(Action(action)) {
+				return nil, fmt.Errorf("principal %s: unknown action %q", cfg.Name, action)
+			}
+			actions[Action(action)] = struct{}{}
+		}
+
+		for _, g := range []grant{
+			{kind: KindQueue, patterns: permission.Queues, actions: actions},
+			{kind: KindExchange, patterns: permission.Exchanges, actions: actions},
+		} {
+			if len(g.patterns) == 0 {
+				continue
+			}
+			if err := checkPatterns(g.patterns); err != nil {
+				return nil, fmt.Errorf("principal %s: %w", cfg.Name, err)
+			}
+			p.grants = append(p.grants, g)
+		}
+	}
+
+	return p, nil
+}
+
+func checkPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// AuthenticateKey returns principal of API key, Anonymous when auth is disabled
+func (a *Authenticator) AuthenticateKey(key string) (*Principal, error) {
+	if !a.enabled {
+		return Anonymous, nil
+	}
+	if key == "" {
+		return nil, fmt.Errorf("%w: no credentials", ErrUnauthenticated)
+	}
+
+	p, ok := a.keys[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, fmt.Errorf("%w: invalid API key", ErrUnauthenticated)
+	}
+
+	return p, nil
+}
+
+// AuthenticateToken returns principal of bearer token, which is either API key
+// or JWT, when they are enabled. API keys are looked up first, so keys which
+// contain dots stay valid. Anonymous is returned when auth is disabled
+func (a *Authenticator) AuthenticateToken(token string) (*Principal, error) {
+	p, err := a.AuthenticateKey(token)
+	if err == nil || a.jwt == nil || !isJWT(token) {
+		return p, err
+	}
+	return a.jwt.verify(token)
+}
+
+// AuthenticateRequest returns principal of request, which carries either API
+// key in X-API-Key header, bearer token or HMAC signature. Anonymous is
+// returned when auth is disabled
+func (a *Authenticator) AuthenticateRequest(r *http.Request) (*Principal, error) {
+	if !a.enabled {
+		return Anonymous, nil
+	}
+
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return a.AuthenticateKey(key)
+	}
+
+	scheme, credentials, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	switch {
+	case strings.EqualFold(scheme, bearerScheme):
+		return a.AuthenticateToken(strings.TrimSpace(credentials))
+	case strings.EqualFold(scheme, SignatureScheme):
+		return a.authenticateSignature(r, strings.TrimSpace(credentials))
+	default:
+		return nil, fmt.Errorf("%w: no credentials", ErrUnauthenticated)
+	}
+}
+
+// authenticateSignature checks HMAC-SHA256 signature of request made with one
+// of the signing secrets of principal, see StringToSign
+func (a *Authenticator) authenticateSignature(r *http.Request, credentials string) (*Principal, error) {
+	name, signature, ok := strings.Cut(credentials, ":")
+	if !ok {
+		return nil, fmt.Errorf("%w: signature must be <principal>:<signature>", ErrUnauthenticated)
+	}
+	mac, err := hex.DecodeString(signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature must be hex encoded", ErrUnauthenticated)
+	}
+
+	// nothing is read for principals which can't sign requests
+	p, ok := a.principals[name]
+	secrets := a.secrets[name]
+	if !ok || len(secrets) == 0 {
+		return nil, fmt.Errorf("%w: invalid signature", ErrUnauthenticated)
+	}
+
+	timestamp := r.Header.Get(TimestampHeader)
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: signed request must have unix time in %s header", ErrUnauthenticated, TimestampHeader)
+	}
+	skew := a.now().Sub(time.Unix(sec, 0))
+	if skew > a.maxSkew || skew < -a.maxSkew {
+		return nil, fmt.Errorf("%w: request timestamp is too far from server time", ErrUnauthenticated)
+	}
+
+	// body is read to be signed and restored for handlers
+	var body []byte
+	if r.Body != nil {
+		body, err = io.ReadAll(http.MaxBytesReader(nil, r.Body, a.maxSignedBody))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return nil, fmt.Errorf("%w: body of signed request must be at most %d bytes", ErrUnauthenticated, a.maxSignedBody)
+			}
+			return nil, fmt.Errorf("%w: failed to read body", ErrUnauthenticated)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	toSign := []byte(StringToSign(r.Method, r.URL.RequestURI(), timestamp, body))
+	for _, secret := range secrets {
+		if hmac.Equal(mac, Sign(secret, toSign)) {
+			return p, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: invalid signature", ErrUnauthenticated)
+}
+
+// StringToSign is what signature of request is computed of: method, request
+// URI with query, value of X-Auth-Timestamp header and hex encoded SHA-256 of
+// body, separated by new lines
+func StringToSign(method string, requestURI string, timestamp string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	return strings.Join([]string{method, requestURI, timestamp, hex.EncodeToString(bodyHash[:])}, "\n")
+}
+
+// Sign returns HMAC-SHA256 of data
+func Sign(secret []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,230 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VladSatyshev/concurrent-queue/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAuthenticator(t *testing.T, now time.Time) *Authenticator {
+	a, err := NewAuthenticator(config.AuthConfig{
+		Enabled:             true,
+		SignatureMaxSkewSec: 60,
+		MaxSignedBodyBytes:  16,
+		Principals: []config.PrincipalConfig{
+			{Name: "keyed", APIKeys: []string{"key-1", "key.with.dots"}},
+			// the first secret is being rotated out
+			{Name: "signer", SigningSecrets: []string{"old-secret", "new-secret"}},
+		},
+	})
+	require.NoError(t, err)
+	a.now = func() time.Time { return now }
+	return a
+}
+
+func TestStringToSign(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		method     string
+		requestURI string
+		timestamp  string
+		body       []byte
+		expected   string
+	}{
+		{
+			name:       "empty body",
+			method:     http.MethodGet,
+			requestURI: "/v1/queues/q/messages?wait=5",
+			timestamp:  "1700000000",
+			expected:   "GET\n/v1/queues/q/messages?wait=5\n1700000000\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		},
+		{
+			name:       "body",
+			method:     http.MethodPost,
+			requestURI: "/v1/queues/q/messages",
+			timestamp:  "1700000000",
+			body:       []byte("abc"),
+			expected:   "POST\n/v1/queues/q/messages\n1700000000\nba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, StringToSign(tt.method, tt.requestURI, tt.timestamp, tt.body))
+		})
+	}
+}
+
+// countingReader counts bytes read from body
+type countingReader struct {
+	r    io.Reader
+	read int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += n
+	return n, err
+}
+
+func TestAuthenticator_Signature(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+	a := newTestAuthenticator(t, now)
+
+	const path = "/v1/queues/q/messages"
+	body := []byte(`{"n": 1}`)
+	sign := func(secret string, method string, uri string, timestamp time.Time, body []byte) string {
+		ts := strconv.FormatInt(timestamp.Unix(), 10)
+		return hex.EncodeToString(Sign([]byte(secret), []byte(StringToSign(method, uri, ts, body))))
+	}
+
+	tests := []struct {
+		name       string
+		principal  string
+		signature  string
+		timestamp  time.Time
+		body       []byte
+		authorized bool
+	}{
+		{"new secret", "signer", sign("new-secret", http.MethodPost, path, now, body), now, body, true},
+		{"old secret during rotation", "signer", sign("old-secret", http.MethodPost, path, now, body), now, body, true},
+		{"unknown secret", "signer", sign("other-secret", http.MethodPost, path, now, body), now, body, false},
+		{"tampered body", "signer", sign("new-secret", http.MethodPost, path, now, body), now, []byte(`{"n": 2}`), false},
+		{"other method", "signer", sign("new-secret", http.MethodPut, path, now, body), now, body, false},
+		{"other path", "signer", sign("new-secret", http.MethodPost, "/v1/queues/other/messages", now, body), now, body, false},
+		{"signature of other principal", "keyed", sign("new-secret", http.MethodPost, path, now, body), now, body, false},
+		{"unknown principal", "unknown", sign("new-secret", http.MethodPost, path, now, body), now, body, false},
+		{"not hex", "signer", "zz", now, body, false},
+		{"oldest allowed timestamp", "signer", sign("new-secret", http.MethodPost, path, now.Add(-time.Minute), body), now.Add(-time.Minute), body, true},
+		{"newest allowed timestamp", "signer", sign("new-secret", http.MethodPost, path, now.Add(time.Minute), body), now.Add(time.Minute), body, true},
+		{"too old timestamp", "signer", sign("new-secret", http.MethodPost, path, now.Add(-time.Minute-time.Second), body), now.Add(-time.Minute - time.Second), body, false},
+		{"too new timestamp", "signer", sign("new-secret", http.MethodPost, path, now.Add(time.Minute+time.Second), body), now.Add(time.Minute + time.Second), body, false},
+		{"body at limit", "signer", sign("new-secret", http.MethodPost, path, now, bytes.Repeat([]byte("a"), 16)), now, bytes.Repeat([]byte("a"), 16), true},
+		{"body over limit", "signer", sign("new-secret", http.MethodPost, path, now, bytes.Repeat([]byte("a"), 17)), now, bytes.Repeat([]byte("a"), 17), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(tt.body))
+			req.Header.Set("Authorization", SignatureScheme+" "+tt.principal+":"+tt.signature)
+			req.Header.Set(TimestampHeader, strconv.FormatInt(tt.timestamp.Unix(), 10))
+
+			p, err := a.AuthenticateRequest(req)
+			if !tt.authorized {
+				assert.True(t, errors.Is(err, ErrUnauthenticated), err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "signer", p.Name)
+
+			// body is restored for handlers
+			restored, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.body, restored)
+		})
+	}
+}
+
+func TestAuthenticator_SignatureOfUnknownPrincipalDoesntReadBody(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+	a := newTestAuthenticator(t, now)
+
+	for _, name := range []string{"unknown", "keyed"} {
+		body := &countingReader{r: strings.NewReader(strings.Repeat("a", 1<<20))}
+		req := httptest.NewRequest(http.MethodPost, "/v1/queues/q/messages", body)
+		req.Header.Set("Authorization", SignatureScheme+" "+name+":00")
+		req.Header.Set(TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+
+		_, err := a.AuthenticateRequest(req)
+		assert.True(t, errors.Is(err, ErrUnauthenticated), err)
+		assert.Equal(t, 0, body.read, name)
+	}
+}
+
+func TestAuthenticator_Keys(t *testing.T) {
+	t.Parallel()
+
+	a := newTestAuthenticator(t, time.Now())
+
+	tests := []struct {
+		name      string
+		header    string
+		value     string
+		principal string
+	}{
+		{"API key header", APIKeyHeader, "key-1", "keyed"},
+		{"bearer API key", "Authorization", "Bearer key-1", "keyed"},
+		{"bearer API key with dots", "Authorization", "Bearer key.with.dots", "keyed"},
+		{"unknown API key", APIKeyHeader, "key-2", ""},
+		{"unknown bearer", "Authorization", "Bearer key-2", ""},
+		{"unknown scheme", "Authorization", "Basic a2V5LTE=", ""},
+		{"no credentials", "", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/queues/q/messages", nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+
+			p, err := a.AuthenticateRequest(req)
+			if tt.principal == "" {
+				assert.True(t, errors.Is(err, ErrUnauthenticated), err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.principal, p.Name)
+		})
+	}
+
+	// every request is anonymous without auth
+	disabled, err := NewAuthenticator(config.AuthConfig{})
+	require.NoError(t, err)
+	p, err := disabled.AuthenticateRequest(httptest.NewRequest(http.MethodGet, "/", nil))
+	require.NoError(t, err)
+	assert.Equal(t, Anonymous, p)
+}
+
+func TestNewAuthenticator_RejectsInvalidConfig(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		principals []config.PrincipalConfig
+	}{
+		{"no principals", nil},
+		{"no name", []config.PrincipalConfig{{APIKeys: []string{"k"}}}},
+		{"duplicate principal", []config.PrincipalConfig{{Name: "p"}, {Name: "p"}}},
+		{"duplicate key", []config.PrincipalConfig{{Name: "p1", APIKeys: []string{"k"}}, {Name: "p2", APIKeys: []string{"k"}}}},
+		{"empty key", []config.PrincipalConfig{{Name: "p", APIKeys: []string{""}}}},
+		{"empty secret", []config.PrincipalConfig{{Name: "p", SigningSecrets: []string{""}}}},
+		{"unknown action", []config.PrincipalConfig{{Name: "p", Permissions: []config.PermissionConfig{{Queues: []string{"q"}, Actions: []string{"read"}}}}}},
+		{"invalid pattern", []config.PrincipalConfig{{Name: "p", Permissions: []config.PermissionConfig{{Queues: []string{"[q"}, Actions: []string{"publish"}}}}}},
+		{"invalid subscriber pattern", []config.PrincipalConfig{{Name: "p", Subscribers: []string{"[s"}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewAuthenticator(config.AuthConfig{Enabled: true, Principals: tt.principals})
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/VladSatyshev/concurrent-queue/config"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	defaultSubscriberClaim = "sub"
+	defaultScopesClaim     = "scope"
+)
+
+// jwtVerifier authenticates holders of JWTs issued by identity provider.
+// Subscriber of principal is taken from a claim and permissions from scopes
+type jwtVerifier struct {
+	// keys by kid, key from HMACSecretFile or RSAPublicKeyFile has empty kid
+	hmacKeys map[string][]byte
+	rsaKeys  map[string]*rsa.PublicKey
+
+	parser          *jwt.Parser
+	subscriberClaim string
+	scopesClaim     string
+}
+
+func newJWTVerifier(cfg config.JWTConfig) (*jwtVerifier, error) {
+	v := &jwtVerifier{
+		hmacKeys:        map[string][]byte{},
+		rsaKeys:         map[string]*rsa.PublicKey{},
+		subscriberClaim: cfg.SubscriberClaim,
+		scopesClaim:     cfg.ScopesClaim,
+	}
+	if v.subscriberClaim == "" {
+		v.subscriberClaim = defaultSubscriberClaim
+	}
+	if v.scopesClaim == "" {
+		v.scopesClaim = defaultScopesClaim
+	}
+
+	keyFiles := 0
+	for _, file := range []string{cfg.HMACSecretFile, cfg.RSAPublicKeyFile, cfg.JWKSFile} {
+		if file != "" {
+			keyFiles++
+		}
+	}
+	if keyFiles != 1 {
+		return nil, errors.New("exactly one of JWT key files must be set")
+	}
+
+	switch {
+	case cfg.HMACSecretFile != "":
+		data, err := os.ReadFile(cfg.HMACSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JWT secret: %w", err)
+		}
+		secret := bytes.TrimSpace(data)
+		if len(secret) == 0 {
+			return nil, errors.New("JWT secret is empty")
+		}
+		v.hmacKeys[""] = secret
+	case cfg.RSAPublicKeyFile != "":
+		data, err := os.ReadFile(cfg.RSAPublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JWT public key: %w", err)
+		}
+		key, err := jwt.ParseRSAPublicKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse JWT public key: %w", err)
+		}
+		v.rsaKeys[""] = key
+	default:
+		if err := v.loadJWKS(cfg.JWKSFile); err != nil {
+			return nil, err
+		}
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg(), jwt.SigningMethodRS256.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(cfg.LeewaySec * time.Second),
+	}
+	if cfg.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(cfg.Audience))
+	}
+	v.parser = jwt.NewParser(opts...)
+
+	return v, nil
+}
+
+// jwk is a key of JSON Web Key Set, only RSA and symmetric keys are used
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA modulus and exponent
+	N string `json:"n"`
+	E string `json:"e"`
+	// symmetric key
+	K string `json:"k"`
+}
+
+func (v *jwtVerifier) loadJWKS(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read JWKS: %w", err)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+
+		switch key.Kty {
+		case "RSA":
+			n, err := decodeBase64URL(key.N)
+			if err != nil {
+				return fmt.Errorf("invalid modulus of JWKS key %q: %w", key.Kid, err)
+			}
+			e, err := decodeBase64URL(key.E)
+			if err != nil {
+				return fmt.Errorf("invalid exponent of JWKS key %q: %w", key.Kid, err)
+			}
+			exponent := new(big.Int).SetBytes(e)
+			if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+				return fmt.Errorf("invalid exponent of JWKS key %q", key.Kid)
+			}
+			v.rsaKeys[key.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+		case "oct":
+			k, err := decodeBase64URL(key.K)
+			if err != nil || len(k) == 0 {
+				return fmt.Errorf("invalid JWKS key %q", key.Kid)
+			}
+			v.hmacKeys[key.Kid] = k
+		}
+	}
+
+	if len(v.rsaKeys)+len(v.hmacKeys) == 0 {
+		return errors.New("JWKS has no RSA or symmetric signing keys")
+	}
+
+	return nil
+}
+
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// key returns key of token by its kid, of the type its algorithm needs, so
+// RSA public key is never used as HMAC secret
+func (v *jwtVerifier) key(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		return findKey(v.hmacKeys, kid)
+	case *jwt.SigningMethodRSA:
+		return findKey(v.rsaKeys, kid)
+	default:
+		return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+}
+
+// findKey returns key with kid, the key from key file, or the only key when
+// token has no kid
+func findKey[K any](keys map[string]K, kid string) (K, error) {
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	if key, ok := keys[""]; ok {
+		return key, nil
+	}
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, nil
+		}
+	}
+
+	var none K
+	return none, fmt.Errorf("no key for kid %q", kid)
+}
+
+// isJWT reports whether token has three parts and its first part is a JOSE
+// header with an algorithm, signature of token isn't checked
+func isJWT(token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	data, err := decodeBase64URL(parts[0])
+	if err != nil {
+		return false
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	return json.Unmarshal(data, &header) == nil && header.Alg != ""
+}
+
+// verify returns principal of token holder, named by its sub claim
+func (v *jwtVerifier) verify(token string) (*Principal, error) {
+	claims := jwt.MapClaims{}
+	if _, err := v.parser.ParseWithClaims(token, claims, v.key); err != nil {
+		return nil, fmt.Errorf("%w: invalid token: %s", ErrUnauthenticated, err.Error())
+	}
+
+	subscriber, _ := claims[v.subscriberClaim].(string)
+	if subscriber == "" {
+		return nil, fmt.Errorf("%w: token has no %s claim", ErrUnauthenticated, v.subscriberClaim)
+	}
+	name, _ := claims["sub"].(string)
+	if name == "" {
+		name = subscriber
+	}
+
+	return &Principal{
+		Name:       name,
+		subscriber: subscriber,
+		grants:     scopeGrants(claims[v.scopesClaim]),
+	}, nil
+}
+
+// scopeGrants parses scopes <action>:queue:<pattern> and
+// <action>:exchange:<pattern> of space-separated string or array, scopes of
+// other services are skipped
+func scopeGrants(claim interface{}) []grant {
+	var scopes []string
+	switch claim := claim.(type) {
+	case string:
+		scopes = strings.Fields(claim)
+	case []interface{}:
+		for _, scope := range claim {
+			if scope, ok := scope.(string); ok {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+
+	var grants []grant
+	for _, scope := range scopes {
+		parts := strings.SplitN(scope, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+
+		action, kind, pattern := Action(parts[0]), Kind(parts[1]), parts[2]
+		if !validAction(action) || (kind != KindQueue && kind != KindExchange) {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			continue
+		}
+
+		grants = append(grants, grant{kind: kind, patterns: []string{pattern}, actions: map[Action]struct{}{action: {}}})
+	}
+
+	return grants
+}
@@ -0,0 +1,354 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/VladSatyshev/concurrent-queue/config"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	file := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(file, data, 0o600))
+	return file
+}
+
+func writeJWKS(t *testing.T, keys ...map[string]string) string {
+	data, err := json.Marshal(map[string]interface{}{"keys": keys})
+	require.NoError(t, err)
+	return writeFile(t, "jwks.json", data)
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA", "kid": kid, "use": "sig",
+		"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func octJWK(kid string, key []byte) map[string]string {
+	return map[string]string{"kty": "oct", "kid": kid, "k": base64.RawURLEncoding.EncodeToString(key)}
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+	return signed
+}
+
+func TestLoadJWKS(t *testing.T) {
+	t.Parallel()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		keys    []map[string]string
+		rsaKids []string
+		octKids []string
+		valid   bool
+	}{
+		{
+			name:    "RSA and symmetric keys",
+			keys:    []map[string]string{rsaJWK("rsa1", &rsaKey.PublicKey), octJWK("hs1", []byte("secret"))},
+			rsaKids: []string{"rsa1"},
+			octKids: []string{"hs1"},
+			valid:   true,
+		},
+		{
+			name:    "padded base64",
+			keys:    []map[string]string{{"kty": "oct", "kid": "hs1", "k": "c2VjcmV0=="}},
+			octKids: []string{"hs1"},
+			valid:   true,
+		},
+		{
+			name:    "encryption keys and other key types are skipped",
+			keys:    []map[string]string{{"kty": "oct", "kid": "enc", "use": "enc", "k": "c2VjcmV0"}, {"kty": "EC", "kid": "ec1"}, octJWK("hs1", []byte("secret"))},
+			octKids: []string{"hs1"},
+			valid:   true,
+		},
+		{name: "no signing keys", keys: []map[string]string{{"kty": "EC", "kid": "ec1"}}},
+		{name: "empty symmetric key", keys: []map[string]string{{"kty": "oct", "kid": "hs1"}}},
+		{name: "invalid modulus", keys: []map[string]string{{"kty": "RSA", "kid": "rsa1", "n": "!", "e": "AQAB"}}},
+		{name: "too large exponent", keys: []map[string]string{{"kty": "RSA", "kid": "rsa1", "n": "AQAB", "e": "AQAAAAAA"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := newJWTVerifier(config.JWTConfig{JWKSFile: writeJWKS(t, tt.keys...)})
+			if !tt.valid {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			assert.Equal(t, len(tt.rsaKids), len(v.rsaKeys))
+			for _, kid := range tt.rsaKids {
+				require.Contains(t, v.rsaKeys, kid)
+				assert.Equal(t, 0, rsaKey.N.Cmp(v.rsaKeys[kid].N))
+				assert.Equal(t, rsaKey.E, v.rsaKeys[kid].E)
+			}
+			assert.Equal(t, len(tt.octKids), len(v.hmacKeys))
+			for _, kid := range tt.octKids {
+				assert.Equal(t, []byte("secret"), v.hmacKeys[kid])
+			}
+		})
+	}
+}
+
+func TestFindKey(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		keys     map[string]string
+		kid      string
+		expected string
+	}{
+		{"exact kid", map[string]string{"a": "key-a", "": "key-file"}, "a", "key-a"},
+		{"unknown kid falls back to key file", map[string]string{"a": "key-a", "": "key-file"}, "b", "key-file"},
+		{"no kid with key file", map[string]string{"a": "key-a", "": "key-file"}, "", "key-file"},
+		{"no kid with the only key", map[string]string{"a": "key-a"}, "", "key-a"},
+		{"no kid with several keys", map[string]string{"a": "key-a", "b": "key-b"}, "", ""},
+		{"unknown kid", map[string]string{"a": "key-a"}, "b", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := findKey(tt.keys, tt.kid)
+			if tt.expected == "" {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, key)
+		})
+	}
+}
+
+func TestJWTVerifier_Verify(t *testing.T) {
+	t.Parallel()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	hmacKey := []byte("jwt-hmac-secret")
+
+	v, err := newJWTVerifier(config.JWTConfig{
+		JWKSFile:        writeJWKS(t, rsaJWK("rsa1", &rsaKey.PublicKey), octJWK("hs1", hmacKey)),
+		Issuer:          "https://id.example.com",
+		SubscriberClaim: "subscriber",
+	})
+	require.NoError(t, err)
+
+	claims := func(extra jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"iss":        "https://id.example.com",
+			"sub":        "orders-service",
+			"subscriber": "orders-1",
+			"exp":        time.Now().Add(time.Hour).Unix(),
+		}
+		for name, value := range extra {
+			if value == nil {
+				delete(c, name)
+				continue
+			}
+			c[name] = value
+		}
+		return c
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		principal  string
+		subscriber string
+	}{
+		{"RS256", signToken(t, jwt.SigningMethodRS256, "rsa1", rsaKey, claims(nil)), "orders-service", "orders-1"},
+		{"HS256", signToken(t, jwt.SigningMethodHS256, "hs1", hmacKey, claims(nil)), "orders-service", "orders-1"},
+		{"name falls back to subscriber", signToken(t, jwt.SigningMethodHS256, "hs1", hmacKey, claims(jwt.MapClaims{"sub": nil})), "orders-1", "orders-1"},
+		{"no subscriber claim", signToken(t, jwt.SigningMethodHS256, "hs1", hmacKey, claims(jwt.MapClaims{"subscriber": nil})), "", ""},
+		{"subscriber claim isn't a string", signToken(t, jwt.SigningMethodHS256, "hs1", hmacKey, claims(jwt.MapClaims{"subscriber": 1})), "", ""},
+		{"no exp", signToken(t, jwt.SigningMethodHS256, "hs1", hmacKey, claims(jwt.MapClaims{"exp": nil})), "", ""},
+		{"expired", signToken(t, jwt.SigningMethodHS256, "hs1", hmacKey, claims(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})), "", ""},
+		{"wrong issuer", signToken(t, jwt.SigningMethodHS256, "hs1", hmacKey, claims(jwt.MapClaims{"iss": "https://other.example.com"})), "", ""},
+		{"wrong key", signToken(t, jwt.SigningMethodHS256, "hs1", []byte("other-secret"), claims(nil)), "", ""},
+		{"HS384", signToken(t, jwt.SigningMethodHS384, "hs1", hmacKey, claims(nil)), "", ""},
+		{"RS512", signToken(t, jwt.SigningMethodRS512, "rsa1", rsaKey, claims(nil)), "", ""},
+		{"none", signToken(t, jwt.SigningMethodNone, "", jwt.UnsafeAllowNoneSignatureType, claims(nil)), "", ""},
+		// RSA key is never used as HMAC secret
+		{"algorithm confusion", signToken(t, jwt.SigningMethodHS256, "rsa1", rsaKey.N.Bytes(), claims(nil)), "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := v.verify(tt.token)
+			if tt.principal == "" {
+				assert.True(t, errors.Is(err, ErrUnauthenticated), err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.principal, p.Name)
+			assert.Equal(t, tt.subscriber, p.Subscriber())
+		})
+	}
+}
+
+func TestJWTVerifier_KeyFile(t *testing.T) {
+	t.Parallel()
+
+	hmacKey := []byte("jwt-hmac-secret")
+	// trailing new line of secret file is ignored
+	v, err := newJWTVerifier(config.JWTConfig{HMACSecretFile: writeFile(t, "secret", append(hmacKey, '\n'))})
+	require.NoError(t, err)
+
+	// key of key file is used whatever kid token has
+	for _, kid := range []string{"", "rotated"} {
+		token := signToken(t, jwt.SigningMethodHS256, kid, hmacKey, jwt.MapClaims{"sub": "orders-1", "exp": time.Now().Add(time.Hour).Unix()})
+		p, err := v.verify(token)
+		require.NoError(t, err, kid)
+		assert.Equal(t, "orders-1", p.Subscriber())
+	}
+
+	_, err = newJWTVerifier(config.JWTConfig{})
+	assert.Error(t, err)
+	_, err = newJWTVerifier(config.JWTConfig{HMACSecretFile: writeFile(t, "secret", hmacKey), JWKSFile: writeJWKS(t, octJWK("hs1", hmacKey))})
+	assert.Error(t, err)
+	_, err = newJWTVerifier(config.JWTConfig{HMACSecretFile: writeFile(t, "secret", []byte(" \n"))})
+	assert.Error(t, err)
+}
+
+func TestScopeGrants(t *testing.T) {
+	t.Parallel()
+
+	type check struct {
+		action  Action
+		kind    Kind
+		name    string
+		allowed bool
+	}
+	tests := []struct {
+		name   string
+		claim  interface{}
+		grants int
+		checks []check
+	}{
+		{
+			name:   "space separated string",
+			claim:  "publish:queue:orders.* consume:exchange:events",
+			grants: 2,
+			checks: []check{
+				{ActionPublish, KindQueue, "orders.created", true},
+				{ActionConsume, KindQueue, "orders.created", false},
+				{ActionConsume, KindExchange, "events", true},
+				{ActionPublish, KindExchange, "events", false},
+			},
+		},
+		{
+			name:   "array",
+			claim:  []interface{}{"subscribe:queue:*", 1, "admin:exchange:events"},
+			grants: 2,
+			checks: []check{
+				{ActionSubscribe, KindQueue, "", true},
+				{ActionAdmin, KindExchange, "events", true},
+			},
+		},
+		{
+			name:   "pattern may contain colons",
+			claim:  "publish:queue:orders:created",
+			grants: 1,
+			checks: []check{{ActionPublish, KindQueue, "orders:created", true}},
+		},
+		{
+			name:  "scopes of other services and invalid scopes are skipped",
+			claim: "openid profile:read read:queue:orders publish:topic:orders publish:queue: publish:queue:[orders",
+		},
+		{name: "no claim", claim: nil},
+		{name: "claim of other type", claim: map[string]interface{}{"publish": "queue"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Principal{Name: "token", subscriber: "s", grants: scopeGrants(tt.claim)}
+			assert.Equal(t, tt.grants, len(p.grants))
+			for _, c := range tt.checks {
+				err := p.Authorize(c.action, c.kind, c.name)
+				assert.Equal(t, c.allowed, err == nil, c)
+			}
+		})
+	}
+}
+
+func TestAuthenticator_TokenWithJWTEnabled(t *testing.T) {
+	t.Parallel()
+
+	hmacKey := []byte("jwt-hmac-secret")
+	a, err := NewAuthenticator(config.AuthConfig{
+		Enabled:    true,
+		Principals: []config.PrincipalConfig{{Name: "keyed", APIKeys: []string{"key.with.dots", "eyJhbGciOiJIUzI1NiJ9.e30.sig"}}},
+		JWT:        config.JWTConfig{Enabled: true, HMACSecretFile: writeFile(t, "secret", hmacKey)},
+	})
+	require.NoError(t, err)
+
+	token := signToken(t, jwt.SigningMethodHS256, "", hmacKey, jwt.MapClaims{"sub": "orders-1", "exp": time.Now().Add(time.Hour).Unix()})
+
+	tests := []struct {
+		name      string
+		token     string
+		principal string
+	}{
+		{"dotted API key", "key.with.dots", "keyed"},
+		{"API key which looks like JWT", "eyJhbGciOiJIUzI1NiJ9.e30.sig", "keyed"},
+		{"JWT", token, "orders-1"},
+		{"unknown dotted key", "other.key.with", ""},
+		{"forged JWT", token + "x", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := a.AuthenticateToken(tt.token)
+			if tt.principal == "" {
+				assert.True(t, errors.Is(err, ErrUnauthenticated), err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.principal, p.Name)
+		})
+	}
+}
+
+func TestIsJWT(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		token string
+		isJWT bool
+	}{
+		{"eyJhbGciOiJIUzI1NiJ9.e30.sig", true},
+		{"eyJhbGciOiJIUzI1NiJ9.e30", false},
+		{"key.with.dots", false},
+		// header without algorithm
+		{"e30.e30.sig", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.isJWT, isJWT(tt.token), tt.token)
+	}
+}
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+)
+
+var (
+	ErrUnauthenticated = errors.New("unauthenticated")
+	ErrForbidden       = errors.New("permission denied")
+)
+
+// Action is what principal does with a queue or exchange
+type Action string
+
+const (
+	ActionPublish Action = "publish"
+	// consume, ack and nack messages
+	ActionConsume   Action = "consume"
+	ActionSubscribe Action = "subscribe"
+	// manage queues and exchanges and read their state
+	ActionAdmin Action = "admin"
+)
+
+func validAction(action Action) bool {
+	switch action {
+	case ActionPublish, ActionConsume, ActionSubscribe, ActionAdmin:
+		return true
+	default:
+		return false
+	}
+}
+
+// Kind is a kind of resource permissions are granted on
+type Kind string
+
+const (
+	KindQueue    Kind = "queue"
+	KindExchange Kind = "exchange"
+)
+
+// anyName is the pattern which grants permission on all resources of a kind
+const anyName = "*"
+
+// grant allows actions on resources of kind whose names match one of patterns
+type grant struct {
+	kind     Kind
+	patterns []string
+	actions  map[Action]struct{}
+}
+
+// Principal is an authenticated client of the broker
+type Principal struct {
+	Name string
+	// the only subscriber principal acts as, when it's taken from credentials
+	subscriber string
+	// patterns of subscriber names principal may act as
+	subscribers []string
+	grants      []grant
+	// principal of server without auth is allowed everything
+	unrestricted bool
+}
+
+// Anonymous makes every request when auth is disabled
+var Anonymous = &Principal{Name: "anonymous", unrestricted: true}
+
+// Authorize checks that principal may take action on resource of kind. Empty
+// name stands for all resources of kind, which is allowed by * pattern only
+func (p *Principal) Authorize(action Action, kind Kind, name string) error {
+	if p.unrestricted {
+		return nil
+	}
+
+	for _, g := range p.grants {
+		if g.kind != kind {
+			continue
+		}
+		if _, ok := g.actions[action]; !ok {
+			continue
+		}
+		for _, pattern := range g.patterns {
+			if name == "" && pattern == anyName {
+				return nil
+			}
+			if name == "" {
+				continue
+			}
+			if ok, _ := path.Match(pattern, name); ok {
+				return nil
+			}
+		}
+	}
+
+	if name == "" {
+		return fmt.Errorf("%w: %s can't %s all %ss", ErrForbidden, p.Name, action, kind)
+	}
+	return fmt.Errorf("%w: %s can't %s %s %s", ErrForbidden, p.Name, action, kind, name)
+}
+
+// AuthorizeSubscriber checks that principal may act as subscriber, so clients
+// can't consume messages of each other
+func (p *Principal) AuthorizeSubscriber(subscriberName string) error {
+	if p.unrestricted {
+		return nil
+	}
+
+	if p.subscriber != "" {
+		if subscriberName == p.subscriber {
+			return nil
+		}
+		return fmt.Errorf("%w: %s can act only as subscriber %s", ErrForbidden, p.Name, p.subscriber)
+	}
+
+	for _, pattern := range p.subscribers {
+		if ok, _ := path.Match(pattern, subscriberName); ok {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s can't act as subscriber %s", ErrForbidden, p.Name, subscriberName)
+}
+
+// Subscriber returns subscriber bound to principal by its credentials, empty
+// if principal may act as several subscribers
+func (p *Principal) Subscriber() string {
+	return p.subscriber
+}
+
+type principalKey struct{}
+
+// NewContext returns context which carries principal of request
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns principal of request, if it has been authenticated
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+// Authorize checks that principal of ctx may take action on resource of kind
+func Authorize(ctx context.Context, action Action, kind Kind, name string) error {
+	p, ok := FromContext(ctx)
+	if !ok {
+		return ErrUnauthenticated
+	}
+	return p.Authorize(action, kind, name)
+}
+
+// AuthorizeSubscriber checks that principal of ctx may act as subscriber
+func AuthorizeSubscriber(ctx context.Context, subscriberName string) error {
+	p, ok := FromContext(ctx)
+	if !ok {
+		return ErrUnauthenticated
+	}
+	return p.AuthorizeSubscriber(subscriberName)
+}
@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/VladSatyshev/concurrent-queue/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrincipal_Authorize(t *testing.T) {
+	t.Parallel()
+
+	p, err := newPrincipal(config.PrincipalConfig{
+		Name: "orders",
+		Permissions: []config.PermissionConfig{
+			{Queues: []string{"orders.*", "q?", "[ab]x"}, Actions: []string{"publish", "consume"}},
+			{Exchanges: []string{"events"}, Actions: []string{"publish"}},
+			{Queues: []string{"*"}, Exchanges: []string{"*"}, Actions: []string{"subscribe"}},
+		},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		action  Action
+		kind    Kind
+		object  string
+		allowed bool
+	}{
+		{"pattern matches", ActionPublish, KindQueue, "orders.created", true},
+		{"second action of grant", ActionConsume, KindQueue, "orders.created", true},
+		{"pattern needs the dot", ActionPublish, KindQueue, "orders", false},
+		{"star doesn't cross separators", ActionPublish, KindQueue, "orders.created/x", false},
+		{"other queue", ActionPublish, KindQueue, "billing", false},
+		{"action not granted", ActionAdmin, KindQueue, "orders.created", false},
+		{"question mark matches one character", ActionPublish, KindQueue, "q1", true},
+		{"question mark doesn't match two characters", ActionPublish, KindQueue, "q12", false},
+		{"character class", ActionPublish, KindQueue, "bx", true},
+		{"character class mismatch", ActionPublish, KindQueue, "cx", false},
+		{"exchange grant", ActionPublish, KindExchange, "events", true},
+		{"exchange grant doesn't apply to queue", ActionConsume, KindExchange, "events", false},
+		{"queue grant doesn't apply to exchange", ActionPublish, KindExchange, "orders.created", false},
+		{"collection needs star pattern", ActionPublish, KindQueue, "", false},
+		{"star pattern grants collection", ActionSubscribe, KindQueue, "", true},
+		{"star pattern grants any name", ActionSubscribe, KindExchange, "anything", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.Authorize(tt.action, tt.kind, tt.object)
+			if tt.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.True(t, errors.Is(err, ErrForbidden), err)
+			}
+		})
+	}
+}
+
+func TestPrincipal_AuthorizeSubscriber(t *testing.T) {
+	t.Parallel()
+
+	patterns, err := newPrincipal(config.PrincipalConfig{Name: "orders", Subscribers: []string{"orders-*", "audit"}})
+	require.NoError(t, err)
+	own, err := newPrincipal(config.PrincipalConfig{Name: "billing"})
+	require.NoError(t, err)
+	bound := &Principal{Name: "token", subscriber: "sub-*"}
+
+	tests := []struct {
+		name       string
+		principal  *Principal
+		subscriber string
+		allowed    bool
+	}{
+		{"pattern matches", patterns, "orders-1", true},
+		{"second pattern", patterns, "audit", true},
+		{"pattern mismatch", patterns, "billing", false},
+		{"own name by default", own, "billing", true},
+		{"only own name by default", own, "billing-1", false},
+		{"bound subscriber", bound, "sub-*", true},
+		{"bound subscriber is not a pattern", bound, "sub-1", false},
+		{"anonymous", Anonymous, "anyone", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.principal.AuthorizeSubscriber(tt.subscriber)
+			if tt.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.True(t, errors.Is(err, ErrForbidden), err)
+			}
+		})
+	}
+}
+
+func TestAuthorize_RequiresPrincipalInContext(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	assert.True(t, errors.Is(Authorize(ctx, ActionPublish, KindQueue, "q"), ErrUnauthenticated))
+	assert.True(t, errors.Is(AuthorizeSubscriber(ctx, "s"), ErrUnauthenticated))
+
+	ctx = NewContext(ctx, Anonymous)
+	assert.NoError(t, Authorize(ctx, ActionAdmin, KindQueue, ""))
+	assert.NoError(t, AuthorizeSubscriber(ctx, "s"))
+}
@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/VladSatyshev/concurrent-queue/internal/queues"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "concurrent_queue"
+
+// Metrics keeps Prometheus metrics of the broker in its own registry, so every
+// server has a separate set of them
+type Metrics struct {
+	registry   *prometheus.Registry
+	queuesRepo queues.Repository
+
+	published    *prometheus.CounterVec
+	consumed     *prometheus.CounterVec
+	rejected     *prometheus.CounterVec
+	expired      *prometheus.CounterVec
+	deleted      *prometheus.CounterVec
+	httpRequests *prometheus.HistogramVec
+}
+
+// NewMetrics registers metrics of the broker. State of queues is read from
+// repository on every scrape
+func NewMetrics(queuesRepo queues.Repository) *Metrics {
+	m := &Metrics{
+		registry:   prometheus.NewRegistry(),
+		queuesRepo: queuesRepo,
+		published: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_published_total",
+			Help:      "Messages added to queue by publishers, dead-lettering and redrive.",
+		}, []string{"queue"}),
+		consumed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_consumed_total",
+			Help:      "Messages delivered to subscribers of queue, redeliveries included.",
+		}, []string{"queue"}),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "publish_rejected_full_total",
+			Help:      "Publishes rejected because queue has reached its max length.",
+		}, []string{"queue"}),
+		expired: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_expired_total",
+			Help:      "Messages deleted from queue because their time-to-live has passed.",
+		}, []string{"queue"}),
+		deleted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_deleted_total",
+			Help:      "Messages deleted from queue because all consumers have acknowledged them.",
+		}, []string{"queue"}),
+		httpRequests: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Duration of HTTP requests by route and status, queue is empty for routes without one and for requests to unknown queues.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route", "status", "queue"}),
+	}
+
+	m.registry.MustRegister(
+		m.published,
+		m.consumed,
+		m.rejected,
+		m.expired,
+		m.deleted,
+		m.httpRequests,
+		newQueuesCollector(queuesRepo),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// Handler serves metrics in Prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *Metrics) MessagesPublished(queueName string, count int) {
+	m.published.WithLabelValues(queueName).Add(float64(count))
+}
+
+func (m *Metrics) MessagesConsumed(queueName string, count int) {
+	m.consumed.WithLabelValues(queueName).Add(float64(count))
+}
+
+func (m *Metrics) PublishRejected(queueName string) {
+	m.rejected.WithLabelValues(queueName).Inc()
+}
+
+func (m *Metrics) MessagesExpired(queueName string, count int) {
+	m.expired.WithLabelValues(queueName).Add(float64(count))
+}
+
+func (m *Metrics) MessagesDeleted(queueName string, count int) {
+	m.deleted.WithLabelValues(queueName).Add(float64(count))
+}
+
+func (m *Metrics) QueueDeleted(queueName string) {
+	labels := prometheus.Labels{"queue": queueName}
+	for _, counter := range []*prometheus.CounterVec{m.published, m.consumed, m.rejected, m.expired, m.deleted} {
+		counter.Delete(labels)
+	}
+	m.httpRequests.DeletePartialMatch(labels)
+}
+
+// ObserveRequest records duration of HTTP request. Route is the pattern of
+// matched route, so paths with different queue names don't multiply series.
+// Queue is labelled only while it exists, so requests to unknown queues don't
+// create series either
+func (m *Metrics) ObserveRequest(method string, route string, status int, queueName string, duration time.Duration) {
+	if queueName != "" {
+		if _, err := m.queuesRepo.GetByName(context.Background(), queueName); err != nil {
+			queueName = ""
+		}
+	}
+	m.httpRequests.WithLabelValues(method, route, strconv.Itoa(status), queueName).Observe(duration.Seconds())
+}
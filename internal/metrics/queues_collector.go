@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/VladSatyshev/concurrent-queue/internal/models"
+	"github.com/VladSatyshev/concurrent-queue/internal/queues"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	queueDepthDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "queue", "depth"),
+		"Messages in queue, including the ones delivered but not acknowledged yet.",
+		[]string{"queue"}, nil,
+	)
+	queueUtilizationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "queue", "max_length_utilization"),
+		"Share of queue's max length taken by messages, it's above 1 when max length has been lowered.",
+		[]string{"queue"}, nil,
+	)
+	queueSubscribersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "queue", "subscribers"),
+		"Subscribers of queue.",
+		[]string{"queue"}, nil,
+	)
+	queueOldestMessageAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "queue", "oldest_message_age_seconds"),
+		"Time since the oldest message of queue has been published, 0 for empty queue.",
+		[]string{"queue"}, nil,
+	)
+	subscriberLagDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "subscriber", "lag"),
+		"Messages subscriber hasn't acknowledged yet, members of consumer group share the lag of the group.",
+		[]string{"queue", "subscriber"}, nil,
+	)
+)
+
+// queuesCollector reads state of queues on scrape, so gauges never fall behind
+// changes made by any of the protocols or by maintenance
+type queuesCollector struct {
+	queuesRepo queues.Repository
+	now        func() time.Time
+}
+
+func newQueuesCollector(queuesRepo queues.Repository) *queuesCollector {
+	return &queuesCollector{
+		queuesRepo: queuesRepo,
+		now:        func() time.Time { return time.Now().UTC() },
+	}
+}
+
+func (c *queuesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+	ch <- queueUtilizationDesc
+	ch <- queueSubscribersDesc
+	ch <- queueOldestMessageAgeDesc
+	ch <- subscriberLagDesc
+}
+
+func (c *queuesCollector) Collect(ch chan<- prometheus.Metric) {
+	now := c.now()
+	for _, queue := range c.queuesRepo.GetAll(context.Background()) {
+		queue.RLock()
+		if !queue.IsDeleted() {
+			collectQueue(ch, queue, now)
+		}
+		queue.RUnlock()
+	}
+}
+
+// expects queue lock to be held
+func collectQueue(ch chan<- prometheus.Metric, queue *models.Queue, now time.Time) {
+	depth := len(queue.Messages)
+	ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(depth), queue.Name)
+	if queue.MaxLength > 0 {
+		ch <- prometheus.MustNewConstMetric(queueUtilizationDesc, prometheus.GaugeValue, float64(depth)/float64(queue.MaxLength), queue.Name)
+	}
+	ch <- prometheus.MustNewConstMetric(queueSubscribersDesc, prometheus.GaugeValue, float64(len(queue.Subscribers)), queue.Name)
+
+	// messages are kept in publish order
+	age := 0.0
+	if depth > 0 {
+		age = now.Sub(queue.Messages[0].PublishedAt).Seconds()
+	}
+	ch <- prometheus.MustNewConstMetric(queueOldestMessageAgeDesc, prometheus.GaugeValue, age, queue.Name)
+
+	for subscriber := range queue.Subscribers {
+		ch <- prometheus.MustNewConstMetric(subscriberLagDesc, prometheus.GaugeValue, float64(queue.GetSubscriberLag(subscriber)), queue.Name, subscriber)
+	}
+}
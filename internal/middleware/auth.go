@@ -0,0 +1,165 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/VladSatyshev/concurrent-queue/internal/auth"
+	"github.com/VladSatyshev/concurrent-queue/pkg/utils"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// AuthMiddleware authenticates request and keeps its principal in request
+// context. Without auth every request is made by anonymous principal, which
+// is allowed everything
+func (mw *MiddlewareManager) AuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal, err := mw.authenticator.AuthenticateRequest(c.Request)
+		if err != nil {
+			c.Header("WWW-Authenticate", `Bearer, `+auth.SignatureScheme)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		c.Request = c.Request.WithContext(auth.NewContext(c.Request.Context(), principal))
+		if subscriberName := principal.Subscriber(); subscriberName != "" {
+			c.Set(utils.SubscriberKey, subscriberName)
+		}
+		c.Next()
+	}
+}
+
+// QueueAccess allows request if its principal may take action on queue of the
+// route, or on all queues if route has no queue. Subscriber named by request
+// must be one of the principal's subscribers
+func (mw *MiddlewareManager) QueueAccess(action auth.Action) gin.HandlerFunc {
+	return mw.access(action, auth.KindQueue, "queue_name")
+}
+
+// ExchangeAccess allows request if its principal may take action on exchange
+// of the route, or on all exchanges if route has no exchange
+func (mw *MiddlewareManager) ExchangeAccess(action auth.Action) gin.HandlerFunc {
+	return mw.access(action, auth.KindExchange, "exchange_name")
+}
+
+func (mw *MiddlewareManager) access(action auth.Action, kind auth.Kind, param string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		if err := auth.Authorize(ctx, action, kind, c.Param(param)); err != nil {
+			abortWithAuthError(c, err)
+			return
+		}
+		if err := authorizeSubscribers(c); err != nil {
+			abortWithAuthError(c, err)
+			return
+		}
+		c.Next()
+	}
+}
+
+// SubscriberAccess allows request only if principal may act as subscriber
+// named by request, for routes which get queues from their messages
+func (mw *MiddlewareManager) SubscriberAccess() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := authorizeSubscribers(c); err != nil {
+			abortWithAuthError(c, err)
+			return
+		}
+		c.Next()
+	}
+}
+
+// authorizeSubscribers checks every place subscriber is taken from: X-Subscriber
+// header, subscriber query parameter of websockets and subscriber route parameter
+func authorizeSubscribers(c *gin.Context) error {
+	subscribers := c.Request.Header.Values("X-Subscriber")
+	if subscriber, ok := c.GetQuery("subscriber"); ok {
+		subscribers = append(subscribers, subscriber)
+	}
+	if subscriber := c.Param("subscriber"); subscriber != "" {
+		subscribers = append(subscribers, subscriber)
+	}
+
+	for _, subscriber := range subscribers {
+		if err := auth.AuthorizeSubscriber(c.Request.Context(), subscriber); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func abortWithAuthError(c *gin.Context, err error) {
+	if errors.Is(err, auth.ErrUnauthenticated) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, err.Error())
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusForbidden, err.Error())
+}
+
+// AuthUnaryInterceptor authenticates gRPC calls by API key in x-api-key or by
+// bearer token in authorization metadata, handlers authorize them by principal
+// of context
+func (mw *MiddlewareManager) AuthUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := mw.authenticateGrpc(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// AuthStreamInterceptor authenticates streaming gRPC calls the same way as
+// AuthUnaryInterceptor does
+func (mw *MiddlewareManager) AuthStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := mw.authenticateGrpc(ss.Context())
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+func (mw *MiddlewareManager) authenticateGrpc(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	var (
+		principal *auth.Principal
+		err       error
+	)
+	if values := md.Get(strings.ToLower(auth.APIKeyHeader)); len(values) > 0 {
+		principal, err = mw.authenticator.AuthenticateKey(values[0])
+	} else {
+		var token string
+		if values := md.Get("authorization"); len(values) > 0 {
+			scheme, credentials, _ := strings.Cut(values[0], " ")
+			if strings.EqualFold(scheme, "Bearer") {
+				token = strings.TrimSpace(credentials)
+			}
+		}
+		principal, err = mw.authenticator.AuthenticateToken(token)
+	}
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	return auth.NewContext(ctx, principal), nil
+}
+
+// authenticatedStream replaces context of stream with the one carrying principal
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"github.com/VladSatyshev/concurrent-queue/internal/auth"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
@@ -9,6 +10,6 @@ func (mw *MiddlewareManager) CORSMiddleware() gin.HandlerFunc {
 	mw.logger.Info("Setting CORS")
 	config := cors.DefaultConfig()
 	config.AllowAllOrigins = true
-	config.AllowHeaders = append(config.AllowHeaders, "X-Subscriber")
+	config.AllowHeaders = append(config.AllowHeaders, "X-Subscriber", "Authorization", auth.APIKeyHeader, auth.TimestampHeader)
 	return cors.New(config)
 }
@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// unmatchedRoute labels requests which haven't matched any route, so unknown
+// paths don't create new series
+const unmatchedRoute = "unmatched"
+
+// MetricsMiddleware records duration and status of HTTP requests by route
+// pattern and queue name. Streaming requests are recorded once they are closed.
+// Requests rejected by auth are not labelled with queue, as anyone can make them
+func (mw *MiddlewareManager) MetricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = unmatchedRoute
+		}
+		status := c.Writer.Status()
+		queueName := c.Param("queue_name")
+		if status == http.StatusUnauthorized || status == http.StatusForbidden {
+			queueName = ""
+		}
+		mw.metrics.ObserveRequest(c.Request.Method, route, status, queueName, time.Since(start))
+	}
+}
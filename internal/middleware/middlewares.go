@@ -2,17 +2,23 @@ package middleware
 
 import (
 	"github.com/VladSatyshev/concurrent-queue/config"
+	"github.com/VladSatyshev/concurrent-queue/internal/auth"
+	"github.com/VladSatyshev/concurrent-queue/internal/metrics"
 	"github.com/VladSatyshev/concurrent-queue/pkg/logger"
 )
 
 type MiddlewareManager struct {
-	cfg    *config.Config
-	logger logger.Logger
+	cfg           *config.Config
+	metrics       *metrics.Metrics
+	authenticator *auth.Authenticator
+	logger        logger.Logger
 }
 
-func NewMiddlewareManager(cfg *config.Config, logger logger.Logger) *MiddlewareManager {
+func NewMiddlewareManager(cfg *config.Config, metrics *metrics.Metrics, authenticator *auth.Authenticator, logger logger.Logger) *MiddlewareManager {
 	return &MiddlewareManager{
-		cfg:    cfg,
-		logger: logger,
+		cfg:           cfg,
+		metrics:       metrics,
+		authenticator: authenticator,
+		logger:        logger,
 	}
 }
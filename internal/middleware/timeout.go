@@ -1,21 +1,27 @@
 package middleware
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"time"
 
-	"github.com/gin-contrib/timeout"
 	"github.com/gin-gonic/gin"
 )
 
+// TimeoutMiddleware bounds request context by Server.TimeoutSec. Handlers run in
+// the request goroutine and are expected to honour the context, so the gin
+// context is never used after the request is finished
 func (mw *MiddlewareManager) TimeoutMiddleware() gin.HandlerFunc {
-	return timeout.New(
-		timeout.WithTimeout(mw.cfg.Server.TimeoutSec*time.Second),
-		timeout.WithHandler(func(c *gin.Context) {
-			c.Next()
-		}),
-		timeout.WithResponse(func(c *gin.Context) {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), mw.cfg.Server.TimeoutSec*time.Second)
+		defer cancel()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		if !c.Writer.Written() && errors.Is(ctx.Err(), context.DeadlineExceeded) {
 			c.String(http.StatusRequestTimeout, "timeout")
-		}),
-	)
+		}
+	}
 }
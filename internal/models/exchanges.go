@@ -0,0 +1,106 @@
+package models
+
+import (
+	"sort"
+	"strings"
+)
+
+// Exchange routes published messages to queues bound to it by routing key.
+// Exchanges are replaced rather than changed in place, so they can be used
+// without locking
+type Exchange struct {
+	Name     string
+	Bindings []Binding
+}
+
+// Binding routes messages whose routing key matches Pattern to Queue. Pattern
+// consists of dot-separated words, where * stands for exactly one word and #
+// for zero or more words, e.g. orders.*.created or logs.#
+type Binding struct {
+	Queue   string
+	Pattern string
+}
+
+// Copy returns a deep copy of the exchange
+func (e *Exchange) Copy() *Exchange {
+	res := &Exchange{
+		Name:     e.Name,
+		Bindings: make([]Binding, len(e.Bindings)),
+	}
+	copy(res.Bindings, e.Bindings)
+	return res
+}
+
+func (e *Exchange) HasBinding(binding Binding) bool {
+	for _, b := range e.Bindings {
+		if b == binding {
+			return true
+		}
+	}
+	return false
+}
+
+// Bind adds binding to the exchange, existing binding is ignored
+func (e *Exchange) Bind(binding Binding) {
+	if !e.HasBinding(binding) {
+		e.Bindings = append(e.Bindings, binding)
+	}
+}
+
+// Unbind removes binding from the exchange, missing binding is ignored
+func (e *Exchange) Unbind(binding Binding) {
+	kept := e.Bindings[:0]
+	for _, b := range e.Bindings {
+		if b != binding {
+			kept = append(kept, b)
+		}
+	}
+	e.Bindings = kept
+}
+
+// Route returns sorted names of queues whose bindings match routing key
+func (e *Exchange) Route(routingKey string) []string {
+	queues := map[string]struct{}{}
+	for _, binding := range e.Bindings {
+		if MatchRoutingKey(binding.Pattern, routingKey) {
+			queues[binding.Queue] = struct{}{}
+		}
+	}
+
+	res := make([]string, 0, len(queues))
+	for queue := range queues {
+		res = append(res, queue)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// MatchRoutingKey reports whether routing key matches binding pattern
+func MatchRoutingKey(pattern string, routingKey string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(routingKey, "."))
+}
+
+func matchWords(pattern []string, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		// consecutive # match the same as a single one
+		rest := pattern[1:]
+		for len(rest) > 0 && rest[0] == "#" {
+			rest = rest[1:]
+		}
+		for i := 0; i <= len(words); i++ {
+			if matchWords(rest, words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchWords(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && words[0] == pattern[0] && matchWords(pattern[1:], words[1:])
+	}
+}
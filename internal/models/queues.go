@@ -1,70 +1,1057 @@
 package models
 
 import (
-	"github.com/VladSatyshev/concurrent-queue/pkg/logger"
+	"encoding/json"
+	"mime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/VladSatyshev/concurrent-queue/pkg/utils"
 )
 
+// Queue is not safe for concurrent use by itself: callers must hold the queue
+// lock (Lock/RLock) for as long as they read or mutate its fields
 type Queue struct {
-	Name           string
-	MaxLength      uint
-	MaxSubscribers uint
-	Subscribers    map[string]struct{}
-	Messages       map[string]QueueMessage
+	mu sync.RWMutex
+	// closed on the next change of messages
+	changed chan struct{}
+	// set when queue is removed from repository
+	deleted bool
+	// last time subscribers consumed or acknowledged messages, not persisted
+	activity map[string]time.Time
+
+	Name              string
+	MaxLength         uint
+	MaxSubscribers    uint
+	VisibilityTimeout time.Duration
+	// subscribers which don't consume for this long are removed, 0 disables eviction
+	SubscriberIdleTimeout time.Duration
+	// time-to-live of messages published without their own, 0 means forever
+	MessageTTL time.Duration
+	// queue which receives expired, rejected and over-delivered messages,
+	// they are dropped when empty
+	DeadLetterQueue string
+	// message is dead-lettered for subscriber after this many deliveries, 0 means unlimited
+	MaxDeliveries uint
+	// messages have priorities from 0 to PriorityLevels-1 and higher ones are
+	// delivered first, 0 or 1 disables priorities
+	PriorityLevels uint
+	// waiting message is raised by one priority level every PriorityAging, so
+	// low-priority messages don't starve, 0 disables aging
+	PriorityAging time.Duration
+	// DeliveryFanout or DeliveryCompeting, empty means fanout
+	DeliveryMode string
+	Subscribers  map[string]struct{}
+	// consumer group of subscriber, subscribers without group are left out.
+	// Every group receives every message once and its members share them
+	SubscriberGroups map[string]string
+	// messages in publish order
+	Messages []*QueueMessage
+	// sequence number of the last published message
+	LastSeq uint64
+	// draining queue doesn't accept new messages and subscribers and is
+	// deleted as soon as all its messages are acknowledged
+	Draining bool
+	// repeats of message with the same deduplication ID are not published
+	// for this long
+	DeduplicationWindow time.Duration
+	// messages published with deduplication ID by the ID, entries are kept
+	// after messages are deleted until their window passes
+	Deduplication map[string]DeduplicationEntry
+	// earliest time some deduplication entry may expire, not persisted
+	deduplicationPruneAt time.Time
+	Stats                QueueStats
+}
+
+// DeduplicationEntry remembers message published with deduplication ID
+type DeduplicationEntry struct {
+	PublishedMessage
+	ExpiresAt time.Time
+}
+
+type QueueStats struct {
+	// messages deleted because their time-to-live has passed
+	Expired uint64
+}
+
+// QueueLimits is a partial update of queue limits, nil fields are left unchanged
+type QueueLimits struct {
+	MaxLength             *uint
+	MaxSubscribers        *uint
+	VisibilityTimeout     *time.Duration
+	SubscriberIdleTimeout *time.Duration
+	MessageTTL            *time.Duration
+	DeadLetterQueue       *string
+	MaxDeliveries         *uint
+	PriorityLevels        *uint
+	PriorityAging         *time.Duration
+	DeduplicationWindow   *time.Duration
+}
+
+// PublishOptions are optional parameters of a published message
+type PublishOptions struct {
+	// message expires after TTL, queue's MessageTTL is used when zero
+	TTL time.Duration
+	// message is hidden from subscribers for Delay or until DeliverAt,
+	// at most one of them can be set
+	Delay     time.Duration
+	DeliverAt time.Time
+	// must be below queue's PriorityLevels
+	Priority uint
+	// stored with message as is
+	Attributes MessageAttributes
+	// repeated publish with the same ID returns the original message during
+	// queue's DeduplicationWindow, empty disables deduplication
+	DeduplicationID string
+}
+
+// MessageAttributes is metadata of message set by publisher, it's kept apart
+// from body and passed on to consumers
+type MessageAttributes struct {
+	Headers       map[string]string `json:"headers,omitempty"`
+	ContentType   string            `json:"content_type,omitempty"`
+	CorrelationID string            `json:"correlation_id,omitempty"`
+	PublisherID   string            `json:"publisher_id,omitempty"`
+}
+
+// PublishedMessage is returned to publisher of message
+type PublishedMessage struct {
+	Queue       string    `json:"queue"`
+	ID          string    `json:"id"`
+	Seq         uint64    `json:"seq"`
+	PublishedAt time.Time `json:"published_at"`
+	// set when message has been published before with the same deduplication ID
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+// content types of messages
+const (
+	ContentTypeJSON  = "application/json"
+	ContentTypeBytes = "application/octet-stream"
+)
+
+// IsJSON reports whether content type is JSON, e.g. application/json or
+// application/vnd.order+json
+func IsJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == ContentTypeJSON || strings.HasSuffix(mediaType, "+json")
 }
 
 type QueueMessage struct {
-	Body   map[string]interface{}
+	ID  string
+	Seq uint64
+	// payload as published, its format is defined by content type of attributes
+	Payload     []byte
+	Attributes  MessageAttributes
+	PublishedAt time.Time
+	Priority    uint
+	// message isn't delivered before this time, zero time means right away
+	DeliverAt time.Time
+	// message is deleted after this time even if it hasn't been seen by all
+	// subscribers, zero time means never
+	ExpiresAt time.Time
+	// set for messages of dead-letter queue
+	DeadLetter *DeadLetter
+	// set for messages published with deduplication ID
+	Deduplication *Deduplication `json:",omitempty"`
+	// set in snapshots for messages which are not due yet, not persisted
+	Scheduled bool `json:",omitempty"`
+	// subscribers which have acknowledged the message
 	SeenBy map[string]struct{}
+	// deliveries of not yet acknowledged message by subscriber
+	Deliveries map[string]*Delivery
+}
+
+type Delivery struct {
+	Count uint
+	// message is not redelivered to subscriber until lease expires
+	LeasedUntil time.Time
 }
 
-func (q *Queue) AddMessage(jsonBody map[string]interface{}) {
-	messageID := utils.GenerateMessageID()
+// delivery modes of queue
+const (
+	// every message is delivered to every subscriber and deleted when all of them have acknowledged it
+	DeliveryFanout = "fanout"
+	// every message is delivered to one of subscribers at a time and deleted when one of them has acknowledged it
+	DeliveryCompeting = "competing"
+)
+
+// reasons of dead-lettering
+const (
+	DeadLetterExpired       = "expired"
+	DeadLetterRejected      = "rejected"
+	DeadLetterMaxDeliveries = "max_deliveries"
+)
 
-	q.Messages[messageID] = QueueMessage{
-		Body:   jsonBody,
-		SeenBy: map[string]struct{}{},
+// Deduplication is deduplication ID of message and the end of its window
+type Deduplication struct {
+	ID        string
+	ExpiresAt time.Time
+}
+
+// DeadLetter describes where message has been moved to dead-letter queue from and why
+type DeadLetter struct {
+	SourceQueue string `json:"source_queue"`
+	Reason      string `json:"reason"`
+	// subscriber which message has been dead-lettered for, empty if for all of them
+	Subscriber          string    `json:"subscriber,omitempty"`
+	DeliveryCount       uint      `json:"delivery_count"`
+	OriginalID          string    `json:"original_id"`
+	OriginalPublishedAt time.Time `json:"original_published_at"`
+	DeadLetteredAt      time.Time `json:"dead_lettered_at"`
+	// options of the original message, it's published with them on redrive.
+	// Remaining delay and TTL are counted from the time of dead-lettering
+	Priority        uint          `json:"priority,omitempty"`
+	RemainingDelay  time.Duration `json:"remaining_delay_ns,omitempty"`
+	RemainingTTL    time.Duration `json:"remaining_ttl_ns,omitempty"`
+	DeduplicationID string        `json:"deduplication_id,omitempty"`
+}
+
+// RedriveOptions returns options the original message is published with again,
+// priority is lowered to the highest one of queue. Expired message gets TTL of
+// queue
+func (d *DeadLetter) RedriveOptions(attributes MessageAttributes, priorityLevels uint) PublishOptions {
+	opts := PublishOptions{
+		TTL:             d.RemainingTTL,
+		Delay:           d.RemainingDelay,
+		Priority:        d.Priority,
+		Attributes:      attributes,
+		DeduplicationID: d.DeduplicationID,
+	}
+	if opts.Priority > 0 && opts.Priority >= priorityLevels {
+		opts.Priority = 0
+		if priorityLevels > 0 {
+			opts.Priority = priorityLevels - 1
+		}
 	}
+	return opts
 }
 
-func (q *Queue) AddSubscriber(name string) {
-	q.Subscribers[name] = struct{}{}
+// ConsumerGroup describes state of consumer group of queue
+type ConsumerGroup struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+	// messages which haven't been acknowledged by the group yet
+	Lag int `json:"lag"`
+	// messages leased to members of the group at the moment
+	InFlight int `json:"in_flight"`
 }
 
-func (q *Queue) HasSubscriber(name string) bool {
+// ConsumedMessage is a message as it is returned to subscribers
+type ConsumedMessage struct {
+	ID  string `json:"id"`
+	Seq uint64 `json:"seq"`
+	// encoded in JSON as body if it's JSON and as base64 body_base64 otherwise
+	Payload []byte `json:"-"`
+	MessageAttributes
+	PublishedAt   time.Time   `json:"published_at"`
+	Priority      uint        `json:"priority,omitempty"`
+	ExpiresAt     *time.Time  `json:"expires_at,omitempty"`
+	DeliveryCount uint        `json:"delivery_count"`
+	DeadLetter    *DeadLetter `json:"dead_letter,omitempty"`
+}
+
+func (m ConsumedMessage) MarshalJSON() ([]byte, error) {
+	type message ConsumedMessage
+	res := struct {
+		message
+		Body       json.RawMessage `json:"body,omitempty"`
+		BodyBase64 []byte          `json:"body_base64,omitempty"`
+	}{message: message(m)}
+
+	if IsJSON(m.ContentType) && json.Valid(m.Payload) {
+		res.Body = m.Payload
+	} else {
+		res.BodyBase64 = m.Payload
+	}
+
+	return json.Marshal(res)
+}
+
+// UnmarshalJSON reads messages persisted before payloads were kept as bytes:
+// their JSON body becomes payload
+func (m *QueueMessage) UnmarshalJSON(data []byte) error {
+	type message QueueMessage
+	legacy := struct {
+		*message
+		Body json.RawMessage
+	}{message: (*message)(m)}
+
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return err
+	}
+
+	if m.Payload == nil && legacy.Body != nil {
+		m.Payload = legacy.Body
+		m.Attributes.ContentType = ContentTypeJSON
+	}
+
+	return nil
+}
+
+func (q *Queue) Lock() {
+	q.mu.Lock()
+}
+
+func (q *Queue) Unlock() {
+	q.mu.Unlock()
+}
+
+func (q *Queue) RLock() {
+	q.mu.RLock()
+}
+
+func (q *Queue) RUnlock() {
+	q.mu.RUnlock()
+}
+
+func (q *Queue) TryLock() bool {
+	return q.mu.TryLock()
+}
+
+func (q *Queue) IsCompeting() bool {
+	return q.DeliveryMode == DeliveryCompeting
+}
+
+// Changed returns channel which is closed when messages are added or released
+// for redelivery
+func (q *Queue) Changed() <-chan struct{} {
+	if q.changed == nil {
+		q.changed = make(chan struct{})
+	}
+	return q.changed
+}
+
+// MarkDeleted wakes up everyone waiting for the queue, so they notice that it's gone
+func (q *Queue) MarkDeleted() {
+	q.deleted = true
+	q.notifyChanged()
+}
+
+func (q *Queue) IsDeleted() bool {
+	return q.deleted
+}
+
+func (q *Queue) notifyChanged() {
+	if q.changed != nil {
+		close(q.changed)
+		q.changed = nil
+	}
+}
+
+// Snapshot returns a deep copy of the queue which can be used without holding the lock
+func (q *Queue) Snapshot() *Queue {
+	res := &Queue{
+		Name:                  q.Name,
+		MaxLength:             q.MaxLength,
+		MaxSubscribers:        q.MaxSubscribers,
+		VisibilityTimeout:     q.VisibilityTimeout,
+		SubscriberIdleTimeout: q.SubscriberIdleTimeout,
+		MessageTTL:            q.MessageTTL,
+		DeadLetterQueue:       q.DeadLetterQueue,
+		MaxDeliveries:         q.MaxDeliveries,
+		PriorityLevels:        q.PriorityLevels,
+		PriorityAging:         q.PriorityAging,
+		DeliveryMode:          q.DeliveryMode,
+		Subscribers:           make(map[string]struct{}, len(q.Subscribers)),
+		SubscriberGroups:      make(map[string]string, len(q.SubscriberGroups)),
+		Messages:              make([]*QueueMessage, 0, len(q.Messages)),
+		LastSeq:               q.LastSeq,
+		Draining:              q.Draining,
+		DeduplicationWindow:   q.DeduplicationWindow,
+		Deduplication:         make(map[string]DeduplicationEntry, len(q.Deduplication)),
+		Stats:                 q.Stats,
+	}
+
 	for sub := range q.Subscribers {
-		if sub == name {
+		res.Subscribers[sub] = struct{}{}
+	}
+	for sub, group := range q.SubscriberGroups {
+		res.SubscriberGroups[sub] = group
+	}
+	for id, entry := range q.Deduplication {
+		res.Deduplication[id] = entry
+	}
+
+	for _, message := range q.Messages {
+		res.Messages = append(res.Messages, message.copy())
+	}
+
+	return res
+}
+
+// MarkScheduled flags messages of snapshot which are not due yet
+func (q *Queue) MarkScheduled(now time.Time) {
+	for _, message := range q.Messages {
+		message.Scheduled = message.IsScheduled(now)
+	}
+}
+
+func (m *QueueMessage) copy() *QueueMessage {
+	res := *m
+	res.SeenBy = make(map[string]struct{}, len(m.SeenBy))
+	for sub := range m.SeenBy {
+		res.SeenBy[sub] = struct{}{}
+	}
+	res.Deliveries = make(map[string]*Delivery, len(m.Deliveries))
+	for sub, delivery := range m.Deliveries {
+		d := *delivery
+		res.Deliveries[sub] = &d
+	}
+	return &res
+}
+
+// Consumed returns message as it is delivered to subscriber
+func (m *QueueMessage) Consumed(name string) ConsumedMessage {
+	res := ConsumedMessage{
+		ID:                m.ID,
+		Seq:               m.Seq,
+		Payload:           m.Payload,
+		MessageAttributes: m.Attributes,
+		PublishedAt:       m.PublishedAt,
+		Priority:          m.Priority,
+		DeadLetter:        m.DeadLetter,
+	}
+	if !m.ExpiresAt.IsZero() {
+		expiresAt := m.ExpiresAt
+		res.ExpiresAt = &expiresAt
+	}
+	if delivery, ok := m.Deliveries[name]; ok {
+		res.DeliveryCount = delivery.Count
+	}
+	return res
+}
+
+func (m *QueueMessage) Published(queueName string) PublishedMessage {
+	return PublishedMessage{
+		Queue:       queueName,
+		ID:          m.ID,
+		Seq:         m.Seq,
+		PublishedAt: m.PublishedAt,
+	}
+}
+
+// IsScheduled reports whether message is not due for delivery yet
+func (m *QueueMessage) IsScheduled(now time.Time) bool {
+	return m.DeliverAt.After(now)
+}
+
+// IsExpired reports whether time-to-live of message has passed
+func (m *QueueMessage) IsExpired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && !m.ExpiresAt.After(now)
+}
+
+// GetDeliveryCount returns how many times message has been delivered to
+// subscriber, or to any subscriber when name is empty
+func (m *QueueMessage) GetDeliveryCount(name string) uint {
+	if name != "" {
+		if delivery, ok := m.Deliveries[name]; ok {
+			return delivery.Count
+		}
+		return 0
+	}
+
+	var res uint
+	for _, delivery := range m.Deliveries {
+		if delivery.Count > res {
+			res = delivery.Count
+		}
+	}
+	return res
+}
+
+// GetDeliveryCount returns how many times message has been delivered to
+// subscriber and its peers together
+func (q *Queue) GetDeliveryCount(message *QueueMessage, name string) uint {
+	peers := q.GetPeers(name)
+	if len(peers) <= 1 {
+		return message.GetDeliveryCount(name)
+	}
+
+	var res uint
+	for sub, delivery := range message.Deliveries {
+		if _, ok := peers[sub]; ok {
+			res += delivery.Count
+		}
+	}
+	return res
+}
+
+// isLeasedToPeers reports whether message is leased to any of peers but the given subscriber
+func (m *QueueMessage) isLeasedToPeers(name string, peers map[string]struct{}, now time.Time) bool {
+	for sub, delivery := range m.Deliveries {
+		if _, ok := peers[sub]; ok && sub != name && delivery.LeasedUntil.After(now) {
 			return true
 		}
 	}
 	return false
 }
 
-func (q *Queue) GetNotSeenMessages(name string) map[string]interface{} {
-	res := map[string]interface{}{}
+// IsDeliveredTo reports whether message has been delivered to subscriber and not acknowledged yet
+func (m *QueueMessage) IsDeliveredTo(name string) bool {
+	_, ok := m.Deliveries[name]
+	return ok
+}
+
+// NewMessage builds the next message of the queue without adding it
+func (q *Queue) NewMessage(payload []byte) *QueueMessage {
+	return &QueueMessage{
+		ID:          utils.GenerateMessageID(),
+		Seq:         q.LastSeq + 1,
+		Payload:     payload,
+		PublishedAt: time.Now().UTC(),
+		SeenBy:      map[string]struct{}{},
+		Deliveries:  map[string]*Delivery{},
+	}
+}
+
+// AddMessage appends message to the queue. Messages with already used sequence
+// numbers are ignored, so the same message can be safely added twice
+func (q *Queue) AddMessage(message *QueueMessage) {
+	if message.Seq <= q.LastSeq {
+		return
+	}
+
+	message.init()
 
-	for messageID, message := range q.Messages {
-		if _, ok := message.SeenBy[name]; !ok {
-			res[messageID] = message.Body
+	q.Messages = append(q.Messages, message)
+	q.LastSeq = message.Seq
+
+	if message.Deduplication != nil {
+		q.rememberDeduplication(message)
+	}
+
+	q.notifyChanged()
+}
+
+func (q *Queue) rememberDeduplication(message *QueueMessage) {
+	if q.Deduplication == nil {
+		q.Deduplication = map[string]DeduplicationEntry{}
+	}
+	q.Deduplication[message.Deduplication.ID] = DeduplicationEntry{
+		PublishedMessage: message.Published(q.Name),
+		ExpiresAt:        message.Deduplication.ExpiresAt,
+	}
+	if !q.deduplicationPruneAt.IsZero() && message.Deduplication.ExpiresAt.Before(q.deduplicationPruneAt) {
+		q.deduplicationPruneAt = message.Deduplication.ExpiresAt
+	}
+}
+
+// FindDuplicate returns message published with deduplication ID if its window
+// hasn't passed yet
+func (q *Queue) FindDuplicate(deduplicationID string, now time.Time) (PublishedMessage, bool) {
+	entry, ok := q.Deduplication[deduplicationID]
+	if !ok || !entry.ExpiresAt.After(now) {
+		return PublishedMessage{}, false
+	}
+	res := entry.PublishedMessage
+	res.Duplicate = true
+	return res, true
+}
+
+// PruneDeduplication forgets deduplication IDs whose window has passed. It only
+// scans entries when the earliest of them may have expired
+func (q *Queue) PruneDeduplication(now time.Time) {
+	if q.deduplicationPruneAt.After(now) {
+		return
+	}
+
+	next := time.Time{}
+	for id, entry := range q.Deduplication {
+		if !entry.ExpiresAt.After(now) {
+			delete(q.Deduplication, id)
+			continue
+		}
+		if next.IsZero() || entry.ExpiresAt.Before(next) {
+			next = entry.ExpiresAt
 		}
 	}
+	q.deduplicationPruneAt = next
+}
+
+// GetMessageIDs returns IDs of all messages of the queue
+func (q *Queue) GetMessageIDs() []string {
+	res := make([]string, 0, len(q.Messages))
+	for _, message := range q.Messages {
+		res = append(res, message.ID)
+	}
+	return res
+}
 
+// AddSubscriber adds subscriber to the queue, as a member of consumer group
+// when group isn't empty
+func (q *Queue) AddSubscriber(name string, group string) {
+	q.Subscribers[name] = struct{}{}
+	if group != "" {
+		if q.SubscriberGroups == nil {
+			q.SubscriberGroups = map[string]string{}
+		}
+		q.SubscriberGroups[name] = group
+	}
+}
+
+// GetGroup returns consumer group of subscriber or empty string if it has none
+func (q *Queue) GetGroup(name string) string {
+	return q.SubscriberGroups[name]
+}
+
+// HasGroup reports whether consumer group has any members
+func (q *Queue) HasGroup(group string) bool {
+	for _, g := range q.SubscriberGroups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// GetGroupMembers returns sorted members of consumer group
+func (q *Queue) GetGroupMembers(group string) []string {
+	res := []string{}
+	for sub, g := range q.SubscriberGroups {
+		if g == group {
+			res = append(res, sub)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// GetGroupNames returns sorted names of consumer groups of the queue
+func (q *Queue) GetGroupNames() []string {
+	groups := map[string]struct{}{}
+	for _, group := range q.SubscriberGroups {
+		groups[group] = struct{}{}
+	}
+
+	res := make([]string, 0, len(groups))
+	for group := range groups {
+		res = append(res, group)
+	}
+	sort.Strings(res)
 	return res
 }
 
-func (q *Queue) SetMessagesSeenBy(name string) {
+// consumerOf returns the name under which subscriber acknowledges messages:
+// its consumer group if it has one, otherwise its own name
+func (q *Queue) consumerOf(name string) string {
+	if group, ok := q.SubscriberGroups[name]; ok {
+		return group
+	}
+	return name
+}
+
+// countConsumers returns the number of consumers every message is delivered
+// to: consumer groups and subscribers without group
+func (q *Queue) countConsumers() int {
+	groups := map[string]struct{}{}
+	for _, group := range q.SubscriberGroups {
+		groups[group] = struct{}{}
+	}
+	return len(q.Subscribers) - len(q.SubscriberGroups) + len(groups)
+}
+
+// GetPeers returns subscribers which share messages with subscriber, including
+// itself: all subscribers in competing mode, members of its consumer group
+// otherwise. Every message is leased to one of peers at a time
+func (q *Queue) GetPeers(name string) map[string]struct{} {
+	if q.IsCompeting() {
+		return q.Subscribers
+	}
+
+	group, ok := q.SubscriberGroups[name]
+	if !ok {
+		return map[string]struct{}{name: {}}
+	}
+
+	res := map[string]struct{}{}
+	for sub, g := range q.SubscriberGroups {
+		if g == group {
+			res[sub] = struct{}{}
+		}
+	}
+	return res
+}
+
+// GetLag returns the number of messages consumer group or subscriber hasn't acknowledged yet
+func (q *Queue) GetLag(consumer string) int {
+	res := 0
+	for _, message := range q.Messages {
+		if _, ok := message.SeenBy[consumer]; !ok {
+			res++
+		}
+	}
+	return res
+}
+
+// GetSubscriberLag returns the number of messages subscriber hasn't acknowledged
+// yet, members of consumer group share the lag of their group
+func (q *Queue) GetSubscriberLag(name string) int {
+	return q.GetLag(q.consumerOf(name))
+}
+
+func (q *Queue) HasSubscriber(name string) bool {
+	_, ok := q.Subscribers[name]
+	return ok
+}
+
+// RemoveSubscriber forgets subscriber together with its acknowledgements and
+// leases, so it no longer holds messages in the queue. Acknowledgements of
+// consumer group are kept until its last member is removed, while leases of
+// the removed member are given over to the rest of them
+func (q *Queue) RemoveSubscriber(name string) {
+	consumer := q.consumerOf(name)
+
+	delete(q.Subscribers, name)
+	delete(q.SubscriberGroups, name)
+	delete(q.activity, name)
+
+	keepSeen := consumer != name && q.HasGroup(consumer)
 	for _, message := range q.Messages {
-		if _, ok := message.SeenBy[name]; !ok {
-			message.SeenBy[name] = struct{}{}
+		if !keepSeen {
+			delete(message.SeenBy, consumer)
 		}
+		delete(message.Deliveries, name)
+	}
+
+	q.notifyChanged()
+}
+
+// TouchSubscriber records that subscriber is active at the moment
+func (q *Queue) TouchSubscriber(name string, now time.Time) {
+	if q.activity == nil {
+		q.activity = map[string]time.Time{}
 	}
+	q.activity[name] = now
 }
 
-func (q *Queue) DeleteSeenByAllMessages(logger logger.Logger) {
-	for messageID, message := range q.Messages {
-		if len(message.SeenBy) == len(q.Subscribers) {
-			logger.Warnf("message with message ID %s has been deleted from queue %s", messageID, q.Name)
-			delete(q.Messages, messageID)
+// GetIdleSubscribers returns subscribers which haven't been active for
+// SubscriberIdleTimeout. Activity isn't persisted, so subscribers restored
+// from storage are considered active since the first check
+func (q *Queue) GetIdleSubscribers(now time.Time) []string {
+	res := []string{}
+	if q.SubscriberIdleTimeout <= 0 {
+		return res
+	}
+
+	for name := range q.Subscribers {
+		lastActive, ok := q.activity[name]
+		if !ok {
+			q.TouchSubscriber(name, now)
+			continue
+		}
+		if now.Sub(lastActive) >= q.SubscriberIdleTimeout {
+			res = append(res, name)
 		}
 	}
+
+	return res
+}
+
+func (m *QueueMessage) init() {
+	if m.SeenBy == nil {
+		m.SeenBy = map[string]struct{}{}
+	}
+	if m.Deliveries == nil {
+		m.Deliveries = map[string]*Delivery{}
+	}
+}
+
+// GetMessage returns message by ID or nil if there is no such message
+func (q *Queue) GetMessage(messageID string) *QueueMessage {
+	for _, message := range q.Messages {
+		if message.ID == messageID {
+			return message
+		}
+	}
+	return nil
+}
+
+// GetDeliverableMessages returns due messages which are neither acknowledged by
+// subscriber or its group nor leased to it at the moment, in delivery order.
+// Messages leased to peers of subscriber are left out as well
+func (q *Queue) GetDeliverableMessages(name string, now time.Time) []*QueueMessage {
+	res := []*QueueMessage{}
+
+	consumer := q.consumerOf(name)
+	peers := q.GetPeers(name)
+	for _, message := range q.Messages {
+		if _, ok := message.SeenBy[consumer]; ok || message.IsExpired(now) || message.IsScheduled(now) {
+			continue
+		}
+		if len(peers) > 1 && message.isLeasedToPeers(name, peers, now) {
+			continue
+		}
+		if delivery, ok := message.Deliveries[name]; ok && delivery.LeasedUntil.After(now) {
+			continue
+		}
+		res = append(res, message)
+	}
+
+	q.sortByPriority(res, now)
+
+	return res
+}
+
+// GetStreamMessages returns due messages not acknowledged by subscriber or its
+// group which are either published after cursor or not leased to it at the
+// moment, in delivery order. Messages leased to peers of subscriber are left out as well
+func (q *Queue) GetStreamMessages(name string, cursor uint64, now time.Time) []*QueueMessage {
+	res := []*QueueMessage{}
+
+	consumer := q.consumerOf(name)
+	peers := q.GetPeers(name)
+	for _, message := range q.Messages {
+		if _, ok := message.SeenBy[consumer]; ok || message.IsExpired(now) || message.IsScheduled(now) {
+			continue
+		}
+		if len(peers) > 1 && message.isLeasedToPeers(name, peers, now) {
+			continue
+		}
+		if delivery, ok := message.Deliveries[name]; ok && delivery.LeasedUntil.After(now) && message.Seq <= cursor {
+			continue
+		}
+		res = append(res, message)
+	}
+
+	q.sortByPriority(res, now)
+
+	return res
+}
+
+// GetPriority returns priority of message raised by aging, bounded by the top level
+func (q *Queue) GetPriority(message *QueueMessage, now time.Time) uint {
+	priority := message.Priority
+	if q.PriorityAging > 0 {
+		since := message.PublishedAt
+		if message.DeliverAt.After(since) {
+			since = message.DeliverAt
+		}
+		if waited := now.Sub(since); waited > 0 {
+			priority += uint(waited / q.PriorityAging)
+		}
+	}
+	if q.PriorityLevels > 0 && priority >= q.PriorityLevels {
+		priority = q.PriorityLevels - 1
+	}
+	return priority
+}
+
+// sortByPriority orders messages by priority keeping publish order within a level
+func (q *Queue) sortByPriority(messages []*QueueMessage, now time.Time) {
+	if q.PriorityLevels <= 1 {
+		return
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return q.GetPriority(messages[i], now) > q.GetPriority(messages[j], now)
+	})
+}
+
+// GetLeasedCount returns the number of messages leased to any of subscribers at the moment
+func (q *Queue) GetLeasedCount(names map[string]struct{}, now time.Time) int {
+	res := 0
+	for _, message := range q.Messages {
+		for sub, delivery := range message.Deliveries {
+			if _, ok := names[sub]; ok && delivery.LeasedUntil.After(now) {
+				res++
+			}
+		}
+	}
+	return res
+}
+
+// GetLeasedMessageIDs returns IDs of messages up to seq which are leased to
+// subscriber at the moment
+func (q *Queue) GetLeasedMessageIDs(name string, seq uint64, now time.Time) []string {
+	res := []string{}
+	for _, message := range q.Messages {
+		if message.Seq > seq {
+			break
+		}
+		if delivery, ok := message.Deliveries[name]; ok && delivery.LeasedUntil.After(now) {
+			res = append(res, message.ID)
+		}
+	}
+	return res
+}
+
+// LeaseMessages hides messages from subscriber until leasedUntil and counts the
+// delivery. Repeated lease with the same leasedUntil is ignored
+func (q *Queue) LeaseMessages(name string, messageIDs []string, leasedUntil time.Time) {
+	ids := toSet(messageIDs)
+	for _, message := range q.Messages {
+		if _, ok := ids[message.ID]; !ok {
+			continue
+		}
+
+		delivery, ok := message.Deliveries[name]
+		if !ok {
+			delivery = &Delivery{}
+			message.Deliveries[name] = delivery
+		}
+		if delivery.LeasedUntil.Equal(leasedUntil) {
+			continue
+		}
+		delivery.Count++
+		delivery.LeasedUntil = leasedUntil
+	}
+}
+
+// ReleaseMessages makes leased messages available for redelivery to subscriber
+func (q *Queue) ReleaseMessages(name string, messageIDs []string) {
+	ids := toSet(messageIDs)
+	for _, message := range q.Messages {
+		if _, ok := ids[message.ID]; !ok {
+			continue
+		}
+		if delivery, ok := message.Deliveries[name]; ok {
+			delivery.LeasedUntil = time.Time{}
+		}
+	}
+
+	q.notifyChanged()
+}
+
+// GetNextDeliveryTime returns the earliest time after now when a leased or
+// scheduled message becomes deliverable to subscriber, or zero time if there is none
+func (q *Queue) GetNextDeliveryTime(name string, now time.Time) time.Time {
+	var res time.Time
+	consumer := q.consumerOf(name)
+	peers := q.GetPeers(name)
+	for _, message := range q.Messages {
+		if _, ok := message.SeenBy[consumer]; ok {
+			continue
+		}
+
+		next := message.DeliverAt
+		if delivery, ok := message.Deliveries[name]; ok && delivery.LeasedUntil.After(next) {
+			next = delivery.LeasedUntil
+		}
+		if len(peers) > 1 {
+			for sub, delivery := range message.Deliveries {
+				if _, ok := peers[sub]; ok && delivery.LeasedUntil.After(next) {
+					next = delivery.LeasedUntil
+				}
+			}
+		}
+		if !next.After(now) {
+			continue
+		}
+		if res.IsZero() || next.Before(res) {
+			res = next
+		}
+	}
+	return res
+}
+
+// SetMessagesSeenBy marks messages with given IDs as acknowledged by subscriber
+// or its consumer group, so they are not delivered to any of its members again
+func (q *Queue) SetMessagesSeenBy(name string, messageIDs []string) {
+	ids := toSet(messageIDs)
+	consumer := q.consumerOf(name)
+	peers := q.GetPeers(name)
+	for _, message := range q.Messages {
+		if _, ok := ids[message.ID]; ok {
+			message.SeenBy[consumer] = struct{}{}
+			for sub := range peers {
+				delete(message.Deliveries, sub)
+			}
+		}
+	}
+}
+
+// GetSeenByAllMessageIDs returns IDs of messages seen by every consumer group
+// and subscriber without group, or by any of them in competing mode
+func (q *Queue) GetSeenByAllMessageIDs() []string {
+	res := []string{}
+	consumers := q.countConsumers()
+	for _, message := range q.Messages {
+		if len(message.SeenBy) >= consumers || q.IsCompeting() && len(message.SeenBy) > 0 {
+			res = append(res, message.ID)
+		}
+	}
+	return res
+}
+
+// GetMessages returns messages with given IDs in publish order
+func (q *Queue) GetMessages(messageIDs []string) []*QueueMessage {
+	ids := toSet(messageIDs)
+	res := make([]*QueueMessage, 0, len(ids))
+	for _, message := range q.Messages {
+		if _, ok := ids[message.ID]; ok {
+			res = append(res, message)
+		}
+	}
+	return res
+}
+
+// GetExpiredMessageIDs returns IDs of messages whose time-to-live has passed
+func (q *Queue) GetExpiredMessageIDs(now time.Time) []string {
+	res := []string{}
+	for _, message := range q.Messages {
+		if message.IsExpired(now) {
+			res = append(res, message.ID)
+		}
+	}
+	return res
+}
+
+// GetLength returns how many messages take capacity of the queue. Expired ones
+// don't, though they're kept until dead-letter queue accepts them
+func (q *Queue) GetLength(now time.Time) int {
+	res := 0
+	for _, message := range q.Messages {
+		if !message.IsExpired(now) {
+			res++
+		}
+	}
+	return res
+}
+
+// ExpireMessages deletes messages with given IDs and counts them as expired.
+// Messages which are already deleted are not counted
+func (q *Queue) ExpireMessages(messageIDs []string) {
+	ids := toSet(messageIDs)
+	for _, message := range q.Messages {
+		if _, ok := ids[message.ID]; ok {
+			q.Stats.Expired++
+		}
+	}
+
+	q.DeleteMessages(messageIDs)
+}
+
+// DeleteMessages removes messages with given IDs keeping the order of the rest
+func (q *Queue) DeleteMessages(messageIDs []string) {
+	ids := toSet(messageIDs)
+
+	kept := q.Messages[:0]
+	for _, message := range q.Messages {
+		if _, ok := ids[message.ID]; !ok {
+			kept = append(kept, message)
+		}
+	}
+
+	for i := len(kept); i < len(q.Messages); i++ {
+		q.Messages[i] = nil
+	}
+	q.Messages = kept
+
+	// in competing mode subscribers may be waiting for their share of messages to get smaller
+	if q.IsCompeting() {
+		q.notifyChanged()
+	}
+}
+
+func toSet(values []string) map[string]struct{} {
+	res := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		res[v] = struct{}{}
+	}
+	return res
 }
@@ -1,14 +1,43 @@
 package queues
 
-import "github.com/gin-gonic/gin"
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+)
 
 type Handlers interface {
 	// int
 	GetAll() func(*gin.Context)
 	GetQueueByName() func(*gin.Context)
+	GetGroups() func(*gin.Context)
+	CreateQueue() func(*gin.Context)
+	UpdateQueue() func(*gin.Context)
+	PurgeQueue() func(*gin.Context)
+	Redrive() func(*gin.Context)
+	DeleteQueue() func(*gin.Context)
+	GetExchanges() func(*gin.Context)
+	GetExchange() func(*gin.Context)
+	CreateExchange() func(*gin.Context)
+	DeleteExchange() func(*gin.Context)
+	Bind() func(*gin.Context)
+	Unbind() func(*gin.Context)
 
 	// public
 	Subscribe() func(*gin.Context)
+	Unsubscribe() func(*gin.Context)
 	AddMessage() func(*gin.Context)
 	Consume() func(*gin.Context)
+	Ack() func(*gin.Context)
+	Nack() func(*gin.Context)
+	Reject() func(*gin.Context)
+	Stream() func(*gin.Context)
+	PublishToExchange() func(*gin.Context)
+}
+
+type WSHandlers interface {
+	Connect() func(*gin.Context)
+	// Shutdown closes open connections, waiting for them to finish until ctx
+	// is done, and rejects new ones
+	Shutdown(ctx context.Context) error
 }
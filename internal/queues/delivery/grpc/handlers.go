@@ -0,0 +1,300 @@
+package grpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/VladSatyshev/concurrent-queue/config"
+	"github.com/VladSatyshev/concurrent-queue/internal/auth"
+	"github.com/VladSatyshev/concurrent-queue/internal/models"
+	"github.com/VladSatyshev/concurrent-queue/internal/queues"
+	"github.com/VladSatyshev/concurrent-queue/pkg/api/queuespb"
+	"github.com/VladSatyshev/concurrent-queue/pkg/logger"
+	"github.com/VladSatyshev/concurrent-queue/pkg/utils"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// how long stream waits for messages before checking whether the call is still alive
+const streamWait = 15 * time.Second
+
+type queuesGRPCHandlers struct {
+	queuespb.UnimplementedQueuesServer
+
+	cfg      *config.Config
+	queuesUC queues.UseCase
+	logger   logger.Logger
+}
+
+func NewQueuesGRPCHandlers(cfg *config.Config, queuesUC queues.UseCase, log logger.Logger) queuespb.QueuesServer {
+	return &queuesGRPCHandlers{cfg: cfg, queuesUC: queuesUC, logger: log}
+}
+
+func handleError(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+	if errors.Is(err, auth.ErrUnauthenticated) {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	if errors.Is(err, auth.ErrForbidden) {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	qErr, ok := err.(*queues.QueueErr)
+	if !ok {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	switch qErr.ErrType {
+	case queues.UseCaseNotFoundErr:
+		return status.Error(codes.NotFound, err.Error())
+	case queues.UseCaseConflictErr:
+		return status.Error(codes.AlreadyExists, err.Error())
+	case queues.UseCaseErr:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case queues.UseCaseUnavailableErr:
+		return status.Error(codes.Unavailable, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func checkSubscriber(subscriberName string) error {
+	if subscriberName == "" {
+		return status.Error(codes.InvalidArgument, "subscriber must not be empty")
+	}
+	return nil
+}
+
+// authorize checks that principal of call may take action on queue, or on all
+// queues when queue name is empty, and act as subscriber unless it's empty
+func authorize(ctx context.Context, action auth.Action, queueName string, subscriberName string) error {
+	err := auth.Authorize(ctx, action, auth.KindQueue, queueName)
+	if err == nil && subscriberName != "" {
+		err = auth.AuthorizeSubscriber(ctx, subscriberName)
+	}
+	if err != nil {
+		return handleError(err)
+	}
+	return nil
+}
+
+func toQueue(queue *models.Queue) *queuespb.Queue {
+	res := &queuespb.Queue{
+		Name:                 queue.Name,
+		MaxLength:            uint64(queue.MaxLength),
+		MaxSubscribers:       uint64(queue.MaxSubscribers),
+		VisibilityTimeoutSec: uint64(queue.VisibilityTimeout / time.Second),
+		Subscribers:          make([]string, 0, len(queue.Subscribers)),
+		Length:               uint64(len(queue.Messages)),
+		LastSeq:              queue.LastSeq,
+		DeliveryMode:         queue.DeliveryMode,
+	}
+	for sub := range queue.Subscribers {
+		res.Subscribers = append(res.Subscribers, sub)
+	}
+	return res
+}
+
+func toMessage(message models.ConsumedMessage) *queuespb.Message {
+	var body *structpb.Struct
+	if models.IsJSON(message.ContentType) {
+		// payloads other than JSON objects are only sent as bytes
+		body = &structpb.Struct{}
+		if err := protojson.Unmarshal(message.Payload, body); err != nil {
+			body = nil
+		}
+	}
+
+	return &queuespb.Message{
+		Id:            message.ID,
+		Seq:           message.Seq,
+		Body:          body,
+		Payload:       message.Payload,
+		PublishedAt:   timestamppb.New(message.PublishedAt),
+		DeliveryCount: uint64(message.DeliveryCount),
+		Headers:       message.Headers,
+		ContentType:   message.ContentType,
+		CorrelationId: message.CorrelationID,
+		PublisherId:   message.PublisherID,
+	}
+}
+
+func (h *queuesGRPCHandlers) CreateQueue(ctx context.Context, req *queuespb.CreateQueueRequest) (*queuespb.Queue, error) {
+	if err := authorize(ctx, auth.ActionAdmin, "", ""); err != nil {
+		return nil, err
+	}
+
+	if _, ok := utils.SecondsToDuration(float64(req.GetVisibilityTimeoutSec())); !ok {
+		return nil, status.Error(codes.InvalidArgument, "visibility_timeout_sec is too large")
+	}
+
+	queue, err := h.queuesUC.CreateQueue(ctx, config.QueueConfig{
+		Name:                 req.GetName(),
+		Length:               uint(req.GetMaxLength()),
+		SubscribersAmount:    uint(req.GetMaxSubscribers()),
+		VisibilityTimeoutSec: time.Duration(req.GetVisibilityTimeoutSec()),
+		DeliveryMode:         req.GetDeliveryMode(),
+	})
+	if err != nil {
+		return nil, handleError(err)
+	}
+
+	return toQueue(queue), nil
+}
+
+func (h *queuesGRPCHandlers) Publish(ctx context.Context, req *queuespb.PublishRequest) (*queuespb.PublishResponse, error) {
+	if err := authorize(ctx, auth.ActionPublish, req.GetQueue(), ""); err != nil {
+		return nil, err
+	}
+
+	payload := req.GetPayload()
+	contentType := req.GetContentType()
+	if req.GetBody() != nil {
+		if len(payload) > 0 {
+			return nil, status.Error(codes.InvalidArgument, "only one of body and payload can be set")
+		}
+
+		var err error
+		payload, err = json.Marshal(req.GetBody().AsMap())
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "failed to encode body: %s", err.Error())
+		}
+		if contentType == "" {
+			contentType = models.ContentTypeJSON
+		}
+	}
+
+	published, err := h.queuesUC.PublishMessage(ctx, req.GetQueue(), payload, models.PublishOptions{
+		Attributes: models.MessageAttributes{
+			Headers:       req.GetHeaders(),
+			ContentType:   contentType,
+			CorrelationID: req.GetCorrelationId(),
+			PublisherID:   req.GetPublisherId(),
+		},
+		DeduplicationID: req.GetDeduplicationId(),
+	})
+	if err != nil {
+		return nil, handleError(err)
+	}
+
+	return &queuespb.PublishResponse{
+		Id:          published.ID,
+		Seq:         published.Seq,
+		PublishedAt: timestamppb.New(published.PublishedAt),
+		Duplicate:   published.Duplicate,
+	}, nil
+}
+
+func (h *queuesGRPCHandlers) Subscribe(ctx context.Context, req *queuespb.SubscribeRequest) (*queuespb.SubscribeResponse, error) {
+	if err := checkSubscriber(req.GetSubscriber()); err != nil {
+		return nil, err
+	}
+	if err := authorize(ctx, auth.ActionSubscribe, req.GetQueue(), req.GetSubscriber()); err != nil {
+		return nil, err
+	}
+
+	if err := h.queuesUC.AddGroupSubscriber(ctx, req.GetQueue(), req.GetSubscriber(), req.GetGroup()); err != nil {
+		return nil, handleError(err)
+	}
+
+	return &queuespb.SubscribeResponse{}, nil
+}
+
+func (h *queuesGRPCHandlers) Consume(ctx context.Context, req *queuespb.ConsumeRequest) (*queuespb.ConsumeResponse, error) {
+	if err := checkSubscriber(req.GetSubscriber()); err != nil {
+		return nil, err
+	}
+	if err := authorize(ctx, auth.ActionConsume, req.GetQueue(), req.GetSubscriber()); err != nil {
+		return nil, err
+	}
+
+	// compared in seconds, as huge wait_sec overflows time.Duration
+	wait := h.cfg.Server.TimeoutSec * time.Second
+	if waitSec := req.GetWaitSec(); waitSec < uint64(h.cfg.Server.TimeoutSec) {
+		wait = time.Duration(waitSec) * time.Second
+	}
+
+	messages, err := h.queuesUC.ConsumeMessages(ctx, req.GetQueue(), req.GetSubscriber(), wait)
+	if err != nil {
+		return nil, handleError(err)
+	}
+
+	res := &queuespb.ConsumeResponse{Messages: make([]*queuespb.Message, 0, len(messages))}
+	for _, message := range messages {
+		res.Messages = append(res.Messages, toMessage(message))
+	}
+
+	return res, nil
+}
+
+func (h *queuesGRPCHandlers) ConsumeStream(req *queuespb.ConsumeStreamRequest, srv queuespb.Queues_ConsumeStreamServer) error {
+	if err := checkSubscriber(req.GetSubscriber()); err != nil {
+		return err
+	}
+
+	queueName := req.GetQueue()
+	subscriberName := req.GetSubscriber()
+	ctx := srv.Context()
+
+	if err := authorize(ctx, auth.ActionConsume, queueName, subscriberName); err != nil {
+		return err
+	}
+
+	stream, err := h.queuesUC.OpenStream(ctx, queueName, subscriberName, req.LastSeq)
+	if err != nil {
+		return handleError(err)
+	}
+
+	h.logger.Infof("Subscriber %s opened gRPC stream of queue %s", subscriberName, queueName)
+	defer h.logger.Infof("Subscriber %s closed gRPC stream of queue %s", subscriberName, queueName)
+
+	for {
+		messages, err := stream.Next(ctx, streamWait)
+		if err != nil {
+			return handleError(err)
+		}
+
+		for _, message := range messages {
+			if err := srv.Send(toMessage(message)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (h *queuesGRPCHandlers) Ack(ctx context.Context, req *queuespb.AckRequest) (*queuespb.AckResponse, error) {
+	if err := checkSubscriber(req.GetSubscriber()); err != nil {
+		return nil, err
+	}
+	if err := authorize(ctx, auth.ActionConsume, req.GetQueue(), req.GetSubscriber()); err != nil {
+		return nil, err
+	}
+
+	if err := h.queuesUC.AckMessage(ctx, req.GetQueue(), req.GetSubscriber(), req.GetMessageId()); err != nil {
+		return nil, handleError(err)
+	}
+
+	return &queuespb.AckResponse{}, nil
+}
+
+func (h *queuesGRPCHandlers) Nack(ctx context.Context, req *queuespb.NackRequest) (*queuespb.NackResponse, error) {
+	if err := checkSubscriber(req.GetSubscriber()); err != nil {
+		return nil, err
+	}
+	if err := authorize(ctx, auth.ActionConsume, req.GetQueue(), req.GetSubscriber()); err != nil {
+		return nil, err
+	}
+
+	if err := h.queuesUC.NackMessage(ctx, req.GetQueue(), req.GetSubscriber(), req.GetMessageId()); err != nil {
+		return nil, handleError(err)
+	}
+
+	return &queuespb.NackResponse{}, nil
+}
@@ -0,0 +1,10 @@
+package grpc
+
+import (
+	"github.com/VladSatyshev/concurrent-queue/pkg/api/queuespb"
+	"google.golang.org/grpc"
+)
+
+func MapQueueService(s *grpc.Server, h queuespb.QueuesServer) {
+	queuespb.RegisterQueuesServer(s, h)
+}
@@ -0,0 +1,162 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/VladSatyshev/concurrent-queue/config"
+	"github.com/VladSatyshev/concurrent-queue/internal/models"
+	"github.com/VladSatyshev/concurrent-queue/pkg/utils"
+	"github.com/gin-gonic/gin"
+)
+
+type bindingRequest struct {
+	Queue   string `json:"queue" binding:"required"`
+	Pattern string `json:"pattern" binding:"required"`
+}
+
+type createExchangeRequest struct {
+	Name     string           `json:"name" binding:"required"`
+	Bindings []bindingRequest `json:"bindings" binding:"dive"`
+}
+
+type publishToExchangeResponse struct {
+	Queues   []string                  `json:"queues"`
+	Messages []models.PublishedMessage `json:"messages"`
+}
+
+func (h *queuesHandlers) GetExchanges() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		exchanges := h.queuesUC.GetExchanges(c.Request.Context())
+		c.JSON(http.StatusOK, exchanges)
+	}
+}
+
+func (h *queuesHandlers) GetExchange() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		name := c.Param("exchange_name")
+
+		exchange, err := h.queuesUC.GetExchange(c.Request.Context(), name)
+		if err != nil {
+			handleError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, exchange)
+	}
+}
+
+func (h *queuesHandlers) CreateExchange() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var req createExchangeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			h.logger.Errorf("failed to parse json body: %s", err.Error())
+			c.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		exchangeCfg := config.ExchangeConfig{
+			Name:     req.Name,
+			Bindings: make([]config.BindingConfig, 0, len(req.Bindings)),
+		}
+		for _, binding := range req.Bindings {
+			exchangeCfg.Bindings = append(exchangeCfg.Bindings, config.BindingConfig{Queue: binding.Queue, Pattern: binding.Pattern})
+		}
+
+		exchange, err := h.queuesUC.CreateExchange(c.Request.Context(), exchangeCfg)
+		if err != nil {
+			handleError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusCreated, exchange)
+	}
+}
+
+func (h *queuesHandlers) DeleteExchange() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		name := c.Param("exchange_name")
+
+		if err := h.queuesUC.DeleteExchange(c.Request.Context(), name); err != nil {
+			handleError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, fmt.Sprintf("exchange %s has been deleted", name))
+	}
+}
+
+func (h *queuesHandlers) Bind() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		name := c.Param("exchange_name")
+
+		var req bindingRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			h.logger.Errorf("failed to parse json body: %s", err.Error())
+			c.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		err := h.queuesUC.BindQueue(c.Request.Context(), name, models.Binding{Queue: req.Queue, Pattern: req.Pattern})
+		if err != nil {
+			handleError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, fmt.Sprintf("queue %s has been bound to exchange %s by %s", req.Queue, name, req.Pattern))
+	}
+}
+
+// Unbind takes binding from queue and pattern query parameters
+func (h *queuesHandlers) Unbind() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		name := c.Param("exchange_name")
+
+		binding := models.Binding{Queue: c.Query("queue"), Pattern: c.Query("pattern")}
+		if binding.Queue == "" || binding.Pattern == "" {
+			c.JSON(http.StatusBadRequest, "queue and pattern query parameters are required")
+			return
+		}
+
+		if err := h.queuesUC.UnbindQueue(c.Request.Context(), name, binding); err != nil {
+			handleError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, fmt.Sprintf("queue %s has been unbound from exchange %s by %s", binding.Queue, name, binding.Pattern))
+	}
+}
+
+// PublishToExchange accepts the same message and options as publishing to a
+// queue, plus the routing key in X-Routing-Key header
+func (h *queuesHandlers) PublishToExchange() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		name := c.Param("exchange_name")
+
+		routingKey, err := utils.GetRoutingKey(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		payload, opts, err := parseMessage(c, h.maxMessageBytes())
+		if err != nil {
+			h.logger.Errorf("failed to parse message: %s", err.Error())
+			c.JSON(publishErrorStatus(err), err.Error())
+			return
+		}
+
+		routed, err := h.queuesUC.PublishToExchange(c.Request.Context(), name, routingKey, payload, opts)
+		if err != nil {
+			handleError(c, err)
+			return
+		}
+
+		res := publishToExchangeResponse{Queues: make([]string, 0, len(routed)), Messages: routed}
+		for _, message := range routed {
+			res.Queues = append(res.Queues, message.Queue)
+		}
+
+		c.JSON(http.StatusOK, res)
+	}
+}
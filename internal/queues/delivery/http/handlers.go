@@ -3,14 +3,20 @@ package http
 import (
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/VladSatyshev/concurrent-queue/config"
+	"github.com/VladSatyshev/concurrent-queue/internal/models"
 	"github.com/VladSatyshev/concurrent-queue/internal/queues"
 	"github.com/VladSatyshev/concurrent-queue/pkg/logger"
 	"github.com/VladSatyshev/concurrent-queue/pkg/utils"
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
 )
 
+const streamKeepAliveInterval = 15 * time.Second
+
 type queuesHandlers struct {
 	cfg      *config.Config
 	queuesUC queues.UseCase
@@ -21,17 +27,54 @@ func NewQueuesHndlers(cfg *config.Config, queuesUC queues.UseCase, log logger.Lo
 	return &queuesHandlers{cfg: cfg, queuesUC: queuesUC, logger: log}
 }
 
+type createQueueRequest struct {
+	Name                     string `json:"name" binding:"required"`
+	MaxLength                uint   `json:"max_length"`
+	MaxSubscribers           uint   `json:"max_subscribers"`
+	VisibilityTimeoutSec     uint   `json:"visibility_timeout_sec"`
+	SubscriberIdleTimeoutSec uint   `json:"subscriber_idle_timeout_sec"`
+	MessageTTLSec            uint   `json:"message_ttl_sec"`
+	DeadLetterQueue          string `json:"dead_letter_queue"`
+	MaxDeliveries            uint   `json:"max_deliveries"`
+	PriorityLevels           uint   `json:"priority_levels"`
+	PriorityAgingSec         uint   `json:"priority_aging_sec"`
+	DeliveryMode             string `json:"delivery_mode"`
+	DeduplicationWindowSec   uint   `json:"deduplication_window_sec"`
+}
+
+type updateQueueRequest struct {
+	MaxLength                *uint   `json:"max_length"`
+	MaxSubscribers           *uint   `json:"max_subscribers"`
+	VisibilityTimeoutSec     *uint   `json:"visibility_timeout_sec"`
+	SubscriberIdleTimeoutSec *uint   `json:"subscriber_idle_timeout_sec"`
+	MessageTTLSec            *uint   `json:"message_ttl_sec"`
+	DeadLetterQueue          *string `json:"dead_letter_queue"`
+	MaxDeliveries            *uint   `json:"max_deliveries"`
+	PriorityLevels           *uint   `json:"priority_levels"`
+	PriorityAgingSec         *uint   `json:"priority_aging_sec"`
+	DeduplicationWindowSec   *uint   `json:"deduplication_window_sec"`
+}
+
+// subscription body is optional, consumer group can be set with X-Consumer-Group header as well
+type subscribeRequest struct {
+	Group string `json:"group"`
+}
+
 func handleError(c *gin.Context, err error) {
 	if qErr, ok := err.(*queues.QueueErr); !ok {
 		c.JSON(http.StatusInternalServerError, err.Error())
 	} else {
 		switch qErr.ErrType {
-		case queues.RepositoryErr, queues.RepositoryNotFoundErr:
+		case queues.RepositoryErr, queues.RepositoryNotFoundErr, queues.RepositoryConflictErr:
 			c.JSON(http.StatusInternalServerError, err.Error())
 		case queues.UseCaseNotFoundErr:
 			c.JSON(http.StatusNotFound, err.Error())
+		case queues.UseCaseConflictErr:
+			c.JSON(http.StatusConflict, err.Error())
 		case queues.UseCaseErr:
 			c.JSON(http.StatusBadRequest, err.Error())
+		case queues.UseCaseUnavailableErr:
+			c.JSON(http.StatusServiceUnavailable, err.Error())
 		}
 	}
 }
@@ -57,6 +100,203 @@ func (h *queuesHandlers) GetQueueByName() func(c *gin.Context) {
 	}
 }
 
+func (h *queuesHandlers) CreateQueue() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var req createQueueRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			h.logger.Errorf("failed to parse json body: %s", err.Error())
+			c.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		for _, d := range []struct {
+			field string
+			sec   uint
+		}{
+			{"visibility_timeout_sec", req.VisibilityTimeoutSec},
+			{"subscriber_idle_timeout_sec", req.SubscriberIdleTimeoutSec},
+			{"message_ttl_sec", req.MessageTTLSec},
+			{"priority_aging_sec", req.PriorityAgingSec},
+			{"deduplication_window_sec", req.DeduplicationWindowSec},
+		} {
+			if _, err := secondsToDuration(d.field, d.sec); err != nil {
+				c.JSON(http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+
+		queue, err := h.queuesUC.CreateQueue(c.Request.Context(), config.QueueConfig{
+			Name:                     req.Name,
+			Length:                   req.MaxLength,
+			SubscribersAmount:        req.MaxSubscribers,
+			VisibilityTimeoutSec:     time.Duration(req.VisibilityTimeoutSec),
+			SubscriberIdleTimeoutSec: time.Duration(req.SubscriberIdleTimeoutSec),
+			MessageTTLSec:            time.Duration(req.MessageTTLSec),
+			DeadLetterQueue:          req.DeadLetterQueue,
+			MaxDeliveries:            req.MaxDeliveries,
+			PriorityLevels:           req.PriorityLevels,
+			PriorityAgingSec:         time.Duration(req.PriorityAgingSec),
+			DeliveryMode:             req.DeliveryMode,
+			DeduplicationWindowSec:   time.Duration(req.DeduplicationWindowSec),
+		})
+		if err != nil {
+			handleError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusCreated, queue)
+	}
+}
+
+func (h *queuesHandlers) UpdateQueue() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		name := c.Param("queue_name")
+
+		var req updateQueueRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			h.logger.Errorf("failed to parse json body: %s", err.Error())
+			c.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		limits := models.QueueLimits{
+			MaxLength:       req.MaxLength,
+			MaxSubscribers:  req.MaxSubscribers,
+			DeadLetterQueue: req.DeadLetterQueue,
+			MaxDeliveries:   req.MaxDeliveries,
+			PriorityLevels:  req.PriorityLevels,
+		}
+		if req.VisibilityTimeoutSec != nil {
+			visibilityTimeout, err := secondsToDuration("visibility_timeout_sec", *req.VisibilityTimeoutSec)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, err.Error())
+				return
+			}
+			limits.VisibilityTimeout = &visibilityTimeout
+		}
+		if req.SubscriberIdleTimeoutSec != nil {
+			subscriberIdleTimeout, err := secondsToDuration("subscriber_idle_timeout_sec", *req.SubscriberIdleTimeoutSec)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, err.Error())
+				return
+			}
+			limits.SubscriberIdleTimeout = &subscriberIdleTimeout
+		}
+		if req.MessageTTLSec != nil {
+			messageTTL, err := secondsToDuration("message_ttl_sec", *req.MessageTTLSec)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, err.Error())
+				return
+			}
+			limits.MessageTTL = &messageTTL
+		}
+		if req.PriorityAgingSec != nil {
+			priorityAging, err := secondsToDuration("priority_aging_sec", *req.PriorityAgingSec)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, err.Error())
+				return
+			}
+			limits.PriorityAging = &priorityAging
+		}
+		if req.DeduplicationWindowSec != nil {
+			deduplicationWindow, err := secondsToDuration("deduplication_window_sec", *req.DeduplicationWindowSec)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, err.Error())
+				return
+			}
+			limits.DeduplicationWindow = &deduplicationWindow
+		}
+
+		queue, err := h.queuesUC.UpdateQueue(c.Request.Context(), name, limits)
+		if err != nil {
+			handleError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, queue)
+	}
+}
+
+// secondsToDuration converts number of seconds of request field, huge numbers
+// would overflow time.Duration
+func secondsToDuration(field string, sec uint) (time.Duration, error) {
+	d, ok := utils.SecondsToDuration(float64(sec))
+	if !ok {
+		return 0, fmt.Errorf("%s is too large", field)
+	}
+	return d, nil
+}
+
+func (h *queuesHandlers) PurgeQueue() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		name := c.Param("queue_name")
+
+		if err := h.queuesUC.PurgeQueue(c.Request.Context(), name); err != nil {
+			handleError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, fmt.Sprintf("queue %s has been purged", name))
+	}
+}
+
+// Redrive moves dead-lettered messages back to their source queues, all of
+// them or up to limit query parameter
+func (h *queuesHandlers) Redrive() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		name := c.Param("queue_name")
+
+		limit := 0
+		if limitParam := c.Query("limit"); limitParam != "" {
+			var err error
+			limit, err = strconv.Atoi(limitParam)
+			if err != nil || limit <= 0 {
+				c.JSON(http.StatusBadRequest, "limit must be a positive number of messages")
+				return
+			}
+		}
+
+		redriven, err := h.queuesUC.RedriveMessages(c.Request.Context(), name, limit)
+		if err != nil {
+			handleError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, fmt.Sprintf("%d messages have been redriven from queue %s", redriven, name))
+	}
+}
+
+// DeleteQueue deletes queue right away, or with mode=drain once all its
+// messages are acknowledged
+func (h *queuesHandlers) DeleteQueue() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		name := c.Param("queue_name")
+
+		var drain bool
+		switch mode := c.Query("mode"); mode {
+		case "", "force":
+		case "drain":
+			drain = true
+		default:
+			c.JSON(http.StatusBadRequest, fmt.Sprintf("unknown delete mode %q: must be force or drain", mode))
+			return
+		}
+
+		deleted, err := h.queuesUC.DeleteQueue(c.Request.Context(), name, drain)
+		if err != nil {
+			handleError(c, err)
+			return
+		}
+
+		if !deleted {
+			c.JSON(http.StatusAccepted, fmt.Sprintf("queue %s will be deleted once all its messages are acknowledged", name))
+			return
+		}
+
+		c.JSON(http.StatusOK, fmt.Sprintf("queue %s has been deleted", name))
+	}
+}
+
 func (h *queuesHandlers) Subscribe() func(c *gin.Context) {
 	return func(c *gin.Context) {
 
@@ -68,34 +308,85 @@ func (h *queuesHandlers) Subscribe() func(c *gin.Context) {
 			return
 		}
 
-		err = h.queuesUC.AddSubscriber(c.Request.Context(), queueName, subscriberName)
+		groupName, err := utils.GetConsumerGroup(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if c.Request.ContentLength != 0 {
+			var req subscribeRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				h.logger.Errorf("failed to parse json body: %s", err.Error())
+				c.JSON(http.StatusBadRequest, err.Error())
+				return
+			}
+			if req.Group != "" {
+				groupName = req.Group
+			}
+		}
+
+		err = h.queuesUC.AddGroupSubscriber(c.Request.Context(), queueName, subscriberName, groupName)
 		if err != nil {
 			handleError(c, err)
 			return
 		}
 
+		if groupName != "" {
+			c.JSON(http.StatusOK, fmt.Sprintf("user %v has joined consumer group %s of queue %s", subscriberName, groupName, queueName))
+			return
+		}
 		c.JSON(http.StatusOK, fmt.Sprintf("user %v has subscribed to queue %s", subscriberName, queueName))
 	}
 }
 
-func (h *queuesHandlers) AddMessage() func(c *gin.Context) {
+func (h *queuesHandlers) GetGroups() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		name := c.Param("queue_name")
+
+		groups, err := h.queuesUC.GetGroups(c.Request.Context(), name)
+		if err != nil {
+			handleError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, groups)
+	}
+}
+
+func (h *queuesHandlers) Unsubscribe() func(c *gin.Context) {
 	return func(c *gin.Context) {
 		queueName := c.Param("queue_name")
+		subscriberName := c.Param("subscriber")
 
-		var jsonBody map[string]interface{}
-		if err := c.Bind(&jsonBody); err != nil {
-			h.logger.Errorf("failed to parse json body: %s", err.Error())
+		err := h.queuesUC.RemoveSubscriber(c.Request.Context(), queueName, subscriberName)
+		if err != nil {
 			handleError(c, err)
 			return
 		}
 
-		err := h.queuesUC.AddMessage(c.Request.Context(), queueName, jsonBody)
+		c.JSON(http.StatusOK, fmt.Sprintf("user %v has unsubscribed from queue %s", subscriberName, queueName))
+	}
+}
+
+func (h *queuesHandlers) AddMessage() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		queueName := c.Param("queue_name")
+
+		payload, opts, err := parseMessage(c, h.maxMessageBytes())
+		if err != nil {
+			h.logger.Errorf("failed to parse message: %s", err.Error())
+			c.JSON(publishErrorStatus(err), err.Error())
+			return
+		}
+
+		published, err := h.queuesUC.PublishMessage(c.Request.Context(), queueName, payload, opts)
 		if err != nil {
 			handleError(c, err)
 			return
 		}
 
-		c.JSON(http.StatusOK, fmt.Sprintf("message has been added to queue %s", queueName))
+		c.JSON(http.StatusOK, published)
 	}
 }
 
@@ -109,7 +400,30 @@ func (h *queuesHandlers) Consume() func(c *gin.Context) {
 			return
 		}
 
-		messages, err := h.queuesUC.ConsumeMessages(c.Request.Context(), queueName, subscriberName)
+		wait, err := utils.GetWaitTime(c, h.cfg.Server.TimeoutSec*time.Second)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		raw, err := utils.GetRawConsume(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if raw {
+			message, err := h.queuesUC.ConsumeMessage(c.Request.Context(), queueName, subscriberName, wait)
+			if err != nil {
+				handleError(c, err)
+				return
+			}
+
+			writeRawMessage(c, message)
+			return
+		}
+
+		messages, err := h.queuesUC.ConsumeMessages(c.Request.Context(), queueName, subscriberName, wait)
 		if err != nil {
 			handleError(c, err)
 			return
@@ -118,3 +432,168 @@ func (h *queuesHandlers) Consume() func(c *gin.Context) {
 		c.JSON(http.StatusOK, messages)
 	}
 }
+
+// writeRawMessage responds with payload of message as is and its metadata in
+// headers, or with no content if there is no message
+func writeRawMessage(c *gin.Context, message *models.ConsumedMessage) {
+	if message == nil {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	c.Header("X-Message-ID", message.ID)
+	c.Header("X-Message-Seq", strconv.FormatUint(message.Seq, 10))
+	c.Header("X-Message-Published-At", message.PublishedAt.Format(time.RFC3339Nano))
+	c.Header("X-Delivery-Count", strconv.FormatUint(uint64(message.DeliveryCount), 10))
+	if message.Priority > 0 {
+		c.Header("X-Message-Priority", strconv.FormatUint(uint64(message.Priority), 10))
+	}
+	if message.ExpiresAt != nil {
+		c.Header("X-Message-Expires-At", message.ExpiresAt.Format(time.RFC3339Nano))
+	}
+	if message.CorrelationID != "" {
+		c.Header("X-Correlation-ID", message.CorrelationID)
+	}
+	if message.PublisherID != "" {
+		c.Header("X-Publisher-ID", message.PublisherID)
+	}
+	for name, value := range message.Headers {
+		c.Header(utils.MessageHeaderPrefix+name, value)
+	}
+	if message.DeadLetter != nil {
+		c.Header("X-Dead-Letter-Source-Queue", message.DeadLetter.SourceQueue)
+		c.Header("X-Dead-Letter-Reason", message.DeadLetter.Reason)
+	}
+
+	c.Data(http.StatusOK, message.ContentType, message.Payload)
+}
+
+func (h *queuesHandlers) Ack() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		queueName := c.Param("queue_name")
+		messageID := c.Param("message_id")
+
+		subscriberName, err := utils.GetSubscriber(c)
+		if err != nil {
+			handleError(c, err)
+			return
+		}
+
+		err = h.queuesUC.AckMessage(c.Request.Context(), queueName, subscriberName, messageID)
+		if err != nil {
+			handleError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, fmt.Sprintf("message %s has been acknowledged", messageID))
+	}
+}
+
+func (h *queuesHandlers) Nack() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		queueName := c.Param("queue_name")
+		messageID := c.Param("message_id")
+
+		subscriberName, err := utils.GetSubscriber(c)
+		if err != nil {
+			handleError(c, err)
+			return
+		}
+
+		err = h.queuesUC.NackMessage(c.Request.Context(), queueName, subscriberName, messageID)
+		if err != nil {
+			handleError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, fmt.Sprintf("message %s has been released for redelivery", messageID))
+	}
+}
+
+func (h *queuesHandlers) Reject() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		queueName := c.Param("queue_name")
+		messageID := c.Param("message_id")
+
+		subscriberName, err := utils.GetSubscriber(c)
+		if err != nil {
+			handleError(c, err)
+			return
+		}
+
+		err = h.queuesUC.RejectMessage(c.Request.Context(), queueName, subscriberName, messageID)
+		if err != nil {
+			handleError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, fmt.Sprintf("message %s has been rejected", messageID))
+	}
+}
+
+func (h *queuesHandlers) Stream() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		queueName := c.Param("queue_name")
+
+		subscriberName, err := utils.GetSubscriber(c)
+		if err != nil {
+			handleError(c, err)
+			return
+		}
+
+		lastSeq, err := utils.GetLastEventID(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		ctx := c.Request.Context()
+
+		stream, err := h.queuesUC.OpenStream(ctx, queueName, subscriberName, lastSeq)
+		if err != nil {
+			handleError(c, err)
+			return
+		}
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+		c.Writer.Flush()
+
+		h.logger.Infof("Subscriber %s opened stream of queue %s", subscriberName, queueName)
+		defer h.logger.Infof("Subscriber %s closed stream of queue %s", subscriberName, queueName)
+
+		for {
+			messages, err := stream.Next(ctx, streamKeepAliveInterval)
+			if err != nil {
+				if ctx.Err() == nil {
+					h.logger.Errorf("stream of queue %s for subscriber %s failed: %s", queueName, subscriberName, err.Error())
+					_ = sse.Encode(c.Writer, sse.Event{Event: "error", Data: err.Error()})
+					c.Writer.Flush()
+				}
+				return
+			}
+
+			// comment line keeps idle connection open through proxies
+			if len(messages) == 0 {
+				if _, err := c.Writer.WriteString(": keep-alive\n\n"); err != nil {
+					return
+				}
+			}
+
+			for _, message := range messages {
+				event := sse.Event{
+					Id:    strconv.FormatUint(message.Seq, 10),
+					Event: "message",
+					Data:  message,
+				}
+				if err := sse.Encode(c.Writer, event); err != nil {
+					return
+				}
+			}
+			c.Writer.Flush()
+		}
+	}
+}
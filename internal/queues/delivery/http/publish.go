@@ -0,0 +1,227 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/VladSatyshev/concurrent-queue/internal/models"
+	"github.com/VladSatyshev/concurrent-queue/pkg/utils"
+	"github.com/gin-gonic/gin"
+)
+
+const defaultMaxMessageBytes = 1 << 20
+
+// errMessageTooLarge is returned for request bodies above max message size
+var errMessageTooLarge = errors.New("message is too large")
+
+// fields of message envelope besides body
+var envelopeOptions = map[string]struct{}{
+	"ttl":        {},
+	"delay":      {},
+	"deliver_at": {},
+	"priority":   {},
+
+	"headers":        {},
+	"content_type":   {},
+	"correlation_id": {},
+	"publisher_id":   {},
+
+	"deduplication_id": {},
+}
+
+// parseMessage returns payload and options of published message. Request body
+// of any content type is the payload as is, content type of message is taken
+// from X-Message-Content-Type header or Content-Type of request. Options are
+// taken from headers and can be overridden by an envelope: a JSON object with
+// body object and nothing but known options, e.g. {"body": {...}, "ttl": 30,
+// "delay": 60, "priority": 2}. Any other JSON is the message payload itself. Delay or
+// delivery time of envelope replaces both of them from headers, message headers
+// of envelope are added to the ones from X-Message-Header-<name> headers.
+// Request body is read up to maxBytes, errMessageTooLarge is returned above it
+func parseMessage(c *gin.Context, maxBytes int64) ([]byte, models.PublishOptions, error) {
+	var opts models.PublishOptions
+
+	ttl, err := utils.GetMessageTTL(c)
+	if err != nil {
+		return nil, opts, err
+	}
+	opts.TTL = ttl
+
+	delay, err := utils.GetMessageDelay(c)
+	if err != nil {
+		return nil, opts, err
+	}
+	opts.Delay = delay
+
+	deliverAt, err := utils.GetDeliverAt(c)
+	if err != nil {
+		return nil, opts, err
+	}
+	opts.DeliverAt = deliverAt
+
+	priority, err := utils.GetMessagePriority(c)
+	if err != nil {
+		return nil, opts, err
+	}
+	opts.Priority = priority
+
+	deduplicationID, err := utils.GetDeduplicationID(c)
+	if err != nil {
+		return nil, opts, err
+	}
+	opts.DeduplicationID = deduplicationID
+
+	opts.Attributes = models.MessageAttributes{
+		Headers:       utils.GetMessageHeaders(c),
+		ContentType:   c.GetHeader("X-Message-Content-Type"),
+		CorrelationID: c.GetHeader("X-Correlation-ID"),
+		PublisherID:   c.GetHeader("X-Publisher-ID"),
+	}
+
+	requestContentType := c.GetHeader("Content-Type")
+	if opts.Attributes.ContentType == "" {
+		opts.Attributes.ContentType = requestContentType
+	}
+	if opts.Attributes.ContentType == "" {
+		opts.Attributes.ContentType = models.ContentTypeBytes
+	}
+
+	payload, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, opts, fmt.Errorf("%w: request body must be at most %d bytes", errMessageTooLarge, maxBytes)
+		}
+		return nil, opts, err
+	}
+
+	if !models.IsJSON(requestContentType) {
+		return payload, opts, nil
+	}
+	if !json.Valid(payload) {
+		return nil, opts, errors.New("request body is not valid JSON")
+	}
+
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return payload, opts, nil
+	}
+	body, ok := envelope["body"]
+	if !ok || !bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		return payload, opts, nil
+	}
+	for key := range envelope {
+		if _, ok := envelopeOptions[key]; !ok && key != "body" {
+			return payload, opts, nil
+		}
+	}
+
+	if err := parseEnvelope(envelope, &opts); err != nil {
+		return nil, opts, err
+	}
+
+	return body, opts, nil
+}
+
+// publishErrorStatus is the status of response to message which can't be parsed
+func publishErrorStatus(err error) int {
+	if errors.Is(err, errMessageTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// maxMessageBytes limits request bodies of published messages
+func (h *queuesHandlers) maxMessageBytes() int64 {
+	if h.cfg.Server.MaxMessageBytes > 0 {
+		return h.cfg.Server.MaxMessageBytes
+	}
+	return defaultMaxMessageBytes
+}
+
+func parseEnvelope(envelope map[string]json.RawMessage, opts *models.PublishOptions) error {
+	if value, ok := envelope["ttl"]; ok {
+		var ttlSec float64
+		if err := json.Unmarshal(value, &ttlSec); err != nil {
+			return errors.New("ttl must be a positive number of seconds")
+		}
+		ttl, ok := utils.SecondsToDuration(ttlSec)
+		if !ok || ttl <= 0 {
+			return errors.New("ttl must be a positive number of seconds")
+		}
+		opts.TTL = ttl
+	}
+
+	_, hasDelay := envelope["delay"]
+	_, hasDeliverAt := envelope["deliver_at"]
+	if hasDelay || hasDeliverAt {
+		opts.Delay = 0
+		opts.DeliverAt = time.Time{}
+	}
+
+	if value, ok := envelope["delay"]; ok {
+		var delaySec float64
+		if err := json.Unmarshal(value, &delaySec); err != nil {
+			return errors.New("delay must be a non-negative number of seconds")
+		}
+		delay, ok := utils.SecondsToDuration(delaySec)
+		if !ok {
+			return errors.New("delay must be a non-negative number of seconds")
+		}
+		opts.Delay = delay
+	}
+
+	if value, ok := envelope["deliver_at"]; ok {
+		var deliverAt string
+		if err := json.Unmarshal(value, &deliverAt); err != nil {
+			return errors.New("deliver_at must be a time in RFC 3339 format")
+		}
+		parsed, err := time.Parse(time.RFC3339, deliverAt)
+		if err != nil {
+			return errors.New("deliver_at must be a time in RFC 3339 format")
+		}
+		opts.DeliverAt = parsed
+	}
+
+	if value, ok := envelope["priority"]; ok {
+		var priority float64
+		if err := json.Unmarshal(value, &priority); err != nil || priority < 0 || priority != math.Trunc(priority) || priority > math.MaxUint32 {
+			return errors.New("priority must be a non-negative integer")
+		}
+		opts.Priority = uint(priority)
+	}
+
+	if value, ok := envelope["headers"]; ok {
+		var headers map[string]string
+		if err := json.Unmarshal(value, &headers); err != nil {
+			return errors.New("headers must be an object with string values")
+		}
+		for name, value := range headers {
+			if opts.Attributes.Headers == nil {
+				opts.Attributes.Headers = make(map[string]string, len(headers))
+			}
+			opts.Attributes.Headers[name] = value
+		}
+	}
+
+	for key, attr := range map[string]*string{
+		"content_type":     &opts.Attributes.ContentType,
+		"correlation_id":   &opts.Attributes.CorrelationID,
+		"publisher_id":     &opts.Attributes.PublisherID,
+		"deduplication_id": &opts.DeduplicationID,
+	} {
+		if value, ok := envelope[key]; ok {
+			if err := json.Unmarshal(value, attr); err != nil {
+				return errors.New(key + " must be a string")
+			}
+		}
+	}
+
+	return nil
+}
@@ -1,18 +1,47 @@
 package http
 
 import (
+	"github.com/VladSatyshev/concurrent-queue/internal/auth"
 	"github.com/VladSatyshev/concurrent-queue/internal/middleware"
 	"github.com/VladSatyshev/concurrent-queue/internal/queues"
 	"github.com/gin-gonic/gin"
 )
 
 func MapIntQueueRoutes(intQueueGroup *gin.RouterGroup, h queues.Handlers, mw *middleware.MiddlewareManager) {
-	intQueueGroup.GET("/", h.GetAll())
-	intQueueGroup.GET("/:queue_name", h.GetQueueByName())
+	intQueueGroup.GET("/", mw.QueueAccess(auth.ActionAdmin), h.GetAll())
+	intQueueGroup.GET("/:queue_name", mw.QueueAccess(auth.ActionAdmin), h.GetQueueByName())
+	intQueueGroup.GET("/:queue_name/groups", mw.QueueAccess(auth.ActionAdmin), h.GetGroups())
+	intQueueGroup.POST("/", mw.QueueAccess(auth.ActionAdmin), h.CreateQueue())
+	intQueueGroup.PATCH("/:queue_name", mw.QueueAccess(auth.ActionAdmin), h.UpdateQueue())
+	intQueueGroup.POST("/:queue_name/purge", mw.QueueAccess(auth.ActionAdmin), h.PurgeQueue())
+	intQueueGroup.POST("/:queue_name/redrive", mw.QueueAccess(auth.ActionAdmin), h.Redrive())
+	intQueueGroup.DELETE("/:queue_name", mw.QueueAccess(auth.ActionAdmin), h.DeleteQueue())
 }
 
 func MapQueueRoutes(queueGroup *gin.RouterGroup, h queues.Handlers, mw *middleware.MiddlewareManager) {
-	queueGroup.POST("/:queue_name/subscriptions", h.Subscribe())
-	queueGroup.POST("/:queue_name/messages", h.AddMessage())
-	queueGroup.GET("/:queue_name/messages", h.Consume())
+	queueGroup.POST("/:queue_name/subscriptions", mw.QueueAccess(auth.ActionSubscribe), h.Subscribe())
+	queueGroup.DELETE("/:queue_name/subscriptions/:subscriber", mw.QueueAccess(auth.ActionSubscribe), h.Unsubscribe())
+	queueGroup.POST("/:queue_name/messages", mw.QueueAccess(auth.ActionPublish), h.AddMessage())
+	queueGroup.GET("/:queue_name/messages", mw.QueueAccess(auth.ActionConsume), h.Consume())
+	queueGroup.POST("/:queue_name/messages/:message_id/ack", mw.QueueAccess(auth.ActionConsume), h.Ack())
+	queueGroup.POST("/:queue_name/messages/:message_id/nack", mw.QueueAccess(auth.ActionConsume), h.Nack())
+	queueGroup.POST("/:queue_name/messages/:message_id/reject", mw.QueueAccess(auth.ActionConsume), h.Reject())
+}
+
+func MapIntExchangeRoutes(intExchangeGroup *gin.RouterGroup, h queues.Handlers, mw *middleware.MiddlewareManager) {
+	intExchangeGroup.GET("/", mw.ExchangeAccess(auth.ActionAdmin), h.GetExchanges())
+	intExchangeGroup.GET("/:exchange_name", mw.ExchangeAccess(auth.ActionAdmin), h.GetExchange())
+	intExchangeGroup.POST("/", mw.ExchangeAccess(auth.ActionAdmin), h.CreateExchange())
+	intExchangeGroup.DELETE("/:exchange_name", mw.ExchangeAccess(auth.ActionAdmin), h.DeleteExchange())
+	intExchangeGroup.POST("/:exchange_name/bindings", mw.ExchangeAccess(auth.ActionAdmin), h.Bind())
+	intExchangeGroup.DELETE("/:exchange_name/bindings", mw.ExchangeAccess(auth.ActionAdmin), h.Unbind())
+}
+
+func MapExchangeRoutes(exchangeGroup *gin.RouterGroup, h queues.Handlers, mw *middleware.MiddlewareManager) {
+	exchangeGroup.POST("/:exchange_name/messages", mw.ExchangeAccess(auth.ActionPublish), h.PublishToExchange())
+}
+
+// MapQueueStreamRoutes maps long-lived routes, so group must not limit request time
+func MapQueueStreamRoutes(queueGroup *gin.RouterGroup, h queues.Handlers, mw *middleware.MiddlewareManager) {
+	queueGroup.GET("/:queue_name/stream", mw.QueueAccess(auth.ActionConsume), h.Stream())
 }
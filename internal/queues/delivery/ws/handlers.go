@@ -0,0 +1,409 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VladSatyshev/concurrent-queue/config"
+	"github.com/VladSatyshev/concurrent-queue/internal/auth"
+	"github.com/VladSatyshev/concurrent-queue/internal/models"
+	"github.com/VladSatyshev/concurrent-queue/internal/queues"
+	"github.com/VladSatyshev/concurrent-queue/pkg/logger"
+	"github.com/VladSatyshev/concurrent-queue/pkg/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	writeWait      = 10 * time.Second
+	pongWait       = 60 * time.Second
+	pingPeriod     = pongWait * 9 / 10
+	maxFrameSize   = 1 << 20
+	outboundFrames = 64
+)
+
+type queuesWSHandlers struct {
+	cfg      *config.Config
+	queuesUC queues.UseCase
+	logger   logger.Logger
+	upgrader websocket.Upgrader
+
+	mu sync.Mutex
+	// open connections, they are closed on shutdown
+	conns map[*wsConn]struct{}
+	// set on shutdown, new connections are rejected afterwards
+	closing bool
+	wg      sync.WaitGroup
+}
+
+func NewQueuesWSHandlers(cfg *config.Config, queuesUC queues.UseCase, log logger.Logger) queues.WSHandlers {
+	h := &queuesWSHandlers{
+		cfg:      cfg,
+		queuesUC: queuesUC,
+		logger:   log,
+		conns:    map[*wsConn]struct{}{},
+	}
+	h.upgrader = websocket.Upgrader{CheckOrigin: h.checkOrigin}
+	return h
+}
+
+// checkOrigin allows connections from pages of the server's own origin and of
+// the configured ones, so other sites can't open connections with credentials
+// of their visitors. Clients other than browsers don't send Origin header
+func (h *queuesWSHandlers) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, allowed := range h.cfg.Server.WSAllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// Connect upgrades connection to websocket. Subscriber is the one bound to
+// credentials of request, or it's taken from X-Subscriber header or subscriber
+// query parameter, as browsers can't set headers of websocket requests
+func (h *queuesWSHandlers) Connect() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		subscriberName := c.GetString(utils.SubscriberKey)
+		if subscriberName == "" {
+			subscriberName = c.GetHeader("X-Subscriber")
+		}
+		if subscriberName == "" {
+			subscriberName = c.Query("subscriber")
+		}
+
+		h.mu.Lock()
+		if h.closing {
+			h.mu.Unlock()
+			c.JSON(http.StatusServiceUnavailable, "server is shutting down")
+			return
+		}
+		h.wg.Add(1)
+		h.mu.Unlock()
+		defer h.wg.Done()
+
+		conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			h.logger.Errorf("failed to upgrade connection to websocket: %s", err.Error())
+			return
+		}
+
+		// frames are authorized by principal of the request which opened connection
+		principal, _ := auth.FromContext(c.Request.Context())
+		ctx, cancel := context.WithCancel(auth.NewContext(context.Background(), principal))
+		wsConn := &wsConn{
+			h:          h,
+			conn:       conn,
+			subscriber: subscriberName,
+			ctx:        ctx,
+			cancel:     cancel,
+			out:        make(chan frame, outboundFrames),
+			streams:    map[string]struct{}{},
+		}
+
+		h.mu.Lock()
+		h.conns[wsConn] = struct{}{}
+		h.mu.Unlock()
+
+		h.logger.Infof("Websocket connection of subscriber %q opened", subscriberName)
+		wsConn.serve()
+		h.logger.Infof("Websocket connection of subscriber %q closed", subscriberName)
+
+		h.mu.Lock()
+		delete(h.conns, wsConn)
+		h.mu.Unlock()
+	}
+}
+
+// Shutdown asks clients to close their connections with going away close
+// frame. Connections which are still open when ctx is done are dropped
+func (h *queuesWSHandlers) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	h.closing = true
+	for conn := range h.conns {
+		conn.cancel()
+	}
+	h.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	h.mu.Lock()
+	for conn := range h.conns {
+		conn.abort()
+	}
+	h.mu.Unlock()
+	<-done
+
+	return ctx.Err()
+}
+
+func (h *queuesWSHandlers) isClosing() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.closing
+}
+
+// wsConn is a single websocket connection. Frames are read by serve, written
+// by writeLoop, and messages of every subscribed queue are delivered by their
+// own goroutine
+type wsConn struct {
+	h          *queuesWSHandlers
+	conn       *websocket.Conn
+	subscriber string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	out    chan frame
+	wg     sync.WaitGroup
+
+	mu sync.Mutex
+	// queues delivered over the connection
+	streams map[string]struct{}
+}
+
+func (c *wsConn) serve() {
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		c.writeLoop()
+	}()
+
+	c.readLoop()
+
+	c.cancel()
+	c.wg.Wait()
+	<-writerDone
+	c.conn.Close()
+}
+
+func (c *wsConn) readLoop() {
+	c.conn.SetReadLimit(maxFrameSize)
+	_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				c.h.logger.Errorf("failed to read websocket frame: %s", err.Error())
+			}
+			return
+		}
+
+		var f frame
+		if err := json.Unmarshal(data, &f); err != nil {
+			c.send(frame{Type: frameError, Error: fmt.Sprintf("invalid frame: %s", err.Error())})
+			continue
+		}
+
+		c.handle(f)
+	}
+}
+
+func (c *wsConn) writeLoop() {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case f := <-c.out:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteJSON(f); err != nil {
+				c.h.logger.Errorf("failed to write websocket frame: %s", err.Error())
+				c.abort()
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				c.abort()
+				return
+			}
+		case <-c.ctx.Done():
+			code := websocket.CloseNormalClosure
+			if c.h.isClosing() {
+				code = websocket.CloseGoingAway
+			}
+			_ = c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), time.Now().Add(writeWait))
+			return
+		}
+	}
+}
+
+// abort stops connection when it can't be written to anymore, closing it unblocks reader
+func (c *wsConn) abort() {
+	c.cancel()
+	c.conn.Close()
+}
+
+// send queues frame for writing, returns false if connection is closed
+func (c *wsConn) send(f frame) bool {
+	select {
+	case c.out <- f:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+func (c *wsConn) reply(request frame, err error) {
+	if err != nil {
+		c.send(frame{Type: frameError, ID: request.ID, Queue: request.Queue, MessageID: request.MessageID, Error: err.Error()})
+		return
+	}
+	c.send(frame{Type: frameOK, ID: request.ID, Queue: request.Queue, MessageID: request.MessageID})
+}
+
+func (c *wsConn) handle(f frame) {
+	switch f.Type {
+	case framePing:
+		c.send(frame{Type: framePong, ID: f.ID})
+	case framePublish:
+		// publish sets message id of the reply
+		err := c.publish(&f)
+		c.reply(f, err)
+	case frameSubscribe:
+		c.reply(f, c.subscribe(f.Queue, f.Group))
+	case frameAck:
+		c.reply(f, c.withSubscriber(func() error {
+			if err := auth.Authorize(c.ctx, auth.ActionConsume, auth.KindQueue, f.Queue); err != nil {
+				return err
+			}
+			return c.h.queuesUC.AckMessage(c.ctx, f.Queue, c.subscriber, f.MessageID)
+		}))
+	case frameNack:
+		c.reply(f, c.withSubscriber(func() error {
+			if err := auth.Authorize(c.ctx, auth.ActionConsume, auth.KindQueue, f.Queue); err != nil {
+				return err
+			}
+			return c.h.queuesUC.NackMessage(c.ctx, f.Queue, c.subscriber, f.MessageID)
+		}))
+	default:
+		c.reply(f, fmt.Errorf("unknown frame type %q", f.Type))
+	}
+}
+
+// publish sets message ID of frame to the ID of published message
+func (c *wsConn) publish(f *frame) error {
+	if len(f.Body) > 0 && len(f.BodyBase64) > 0 {
+		return fmt.Errorf("only one of body and body_base64 can be set")
+	}
+
+	if err := auth.Authorize(c.ctx, auth.ActionPublish, auth.KindQueue, f.Queue); err != nil {
+		return err
+	}
+
+	payload, contentType := []byte(f.Body), f.ContentType
+	if len(f.BodyBase64) > 0 {
+		payload = f.BodyBase64
+	} else if contentType == "" {
+		contentType = models.ContentTypeJSON
+	}
+
+	published, err := c.h.queuesUC.PublishMessage(c.ctx, f.Queue, payload, models.PublishOptions{
+		Attributes:      models.MessageAttributes{ContentType: contentType},
+		DeduplicationID: f.DeduplicationID,
+	})
+	if err != nil {
+		return err
+	}
+
+	f.MessageID = published.ID
+	return nil
+}
+
+func (c *wsConn) withSubscriber(fn func() error) error {
+	if c.subscriber == "" {
+		return fmt.Errorf("connection has no subscriber")
+	}
+	return fn()
+}
+
+// subscribe adds subscriber to queue, as a member of consumer group if it's
+// set, unless it's already subscribed and starts delivery of queue messages
+// over the connection
+func (c *wsConn) subscribe(queueName string, groupName string) error {
+	return c.withSubscriber(func() error {
+		for _, action := range []auth.Action{auth.ActionSubscribe, auth.ActionConsume} {
+			if err := auth.Authorize(c.ctx, action, auth.KindQueue, queueName); err != nil {
+				return err
+			}
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if _, ok := c.streams[queueName]; ok {
+			return fmt.Errorf("queue %s is already delivered over this connection", queueName)
+		}
+
+		err := c.h.queuesUC.AddGroupSubscriber(c.ctx, queueName, c.subscriber, groupName)
+		if qErr, ok := err.(*queues.QueueErr); err != nil && (!ok || qErr.ErrType != queues.UseCaseConflictErr) {
+			return err
+		}
+
+		stream, err := c.h.queuesUC.OpenStream(c.ctx, queueName, c.subscriber, nil)
+		if err != nil {
+			return err
+		}
+
+		c.streams[queueName] = struct{}{}
+
+		c.wg.Add(1)
+		go c.deliver(queueName, stream)
+
+		return nil
+	})
+}
+
+func (c *wsConn) deliver(queueName string, stream queues.Stream) {
+	defer c.wg.Done()
+
+	for {
+		messages, err := stream.Next(c.ctx, pongWait)
+		if err != nil {
+			if c.ctx.Err() == nil {
+				c.h.logger.Errorf("delivery of queue %s to subscriber %s failed: %s", queueName, c.subscriber, err.Error())
+				c.send(frame{Type: frameError, Queue: queueName, Error: err.Error()})
+
+				c.mu.Lock()
+				delete(c.streams, queueName)
+				c.mu.Unlock()
+			}
+			return
+		}
+
+		for i := range messages {
+			if !c.send(frame{Type: frameDeliver, Queue: queueName, Message: &messages[i]}) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package ws
+
+import (
+	"encoding/json"
+
+	"github.com/VladSatyshev/concurrent-queue/internal/models"
+)
+
+// frame types sent by client
+const (
+	frameSubscribe = "subscribe"
+	framePublish   = "publish"
+	frameAck       = "ack"
+	frameNack      = "nack"
+	framePing      = "ping"
+)
+
+// frame types sent by server
+const (
+	frameDeliver = "deliver"
+	frameOK      = "ok"
+	frameError   = "error"
+	framePong    = "pong"
+)
+
+// frame is a single JSON message of websocket protocol. Replies to client
+// frames carry the ID of the frame they answer
+type frame struct {
+	Type      string `json:"type"`
+	ID        string `json:"id,omitempty"`
+	Queue     string `json:"queue,omitempty"`
+	Group     string `json:"group,omitempty"`
+	MessageID string `json:"message_id,omitempty"`
+	// published payload is either JSON body or base64 body_base64 of content type
+	Body        json.RawMessage `json:"body,omitempty"`
+	BodyBase64  []byte          `json:"body_base64,omitempty"`
+	ContentType string          `json:"content_type,omitempty"`
+	// repeated publish with the same ID returns the original message ID
+	DeduplicationID string                  `json:"deduplication_id,omitempty"`
+	Message         *models.ConsumedMessage `json:"message,omitempty"`
+	Error           string                  `json:"error,omitempty"`
+}
@@ -0,0 +1,12 @@
+package ws
+
+import (
+	"github.com/VladSatyshev/concurrent-queue/internal/middleware"
+	"github.com/VladSatyshev/concurrent-queue/internal/queues"
+	"github.com/gin-gonic/gin"
+)
+
+// MapWSRoutes maps long-lived routes, so group must not limit request time
+func MapWSRoutes(group *gin.RouterGroup, h queues.WSHandlers, mw *middleware.MiddlewareManager) {
+	group.GET("/ws", mw.SubscriberAccess(), h.Connect())
+}
@@ -5,6 +5,10 @@ const (
 	RepositoryNotFoundErr
 	UseCaseErr
 	UseCaseNotFoundErr
+	UseCaseConflictErr
+	RepositoryConflictErr
+	// usecase doesn't accept the request at the moment, e.g. while shutting down
+	UseCaseUnavailableErr
 )
 
 type QueueErr struct {
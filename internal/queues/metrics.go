@@ -0,0 +1,18 @@
+package queues
+
+// Metrics counts events of queues for monitoring, all of them are labeled with
+// queue name
+type Metrics interface {
+	// messages added to queue by publishers, dead-lettering and redrive
+	MessagesPublished(queueName string, count int)
+	// messages delivered to subscribers, redeliveries included
+	MessagesConsumed(queueName string, count int)
+	// publish rejected because queue has reached its max length
+	PublishRejected(queueName string)
+	// messages deleted because their time-to-live has passed
+	MessagesExpired(queueName string, count int)
+	// messages deleted because all consumers have acknowledged them
+	MessagesDeleted(queueName string, count int)
+	// drops metrics of deleted queue
+	QueueDeleted(queueName string)
+}
@@ -7,7 +7,9 @@ package mock
 import (
 	context "context"
 	reflect "reflect"
+	time "time"
 
+	config "github.com/VladSatyshev/concurrent-queue/config"
 	models "github.com/VladSatyshev/concurrent-queue/internal/models"
 	gomock "github.com/golang/mock/gomock"
 )
@@ -35,54 +37,195 @@ func (m *MockRepository) EXPECT() *MockRepositoryMockRecorder {
 	return m.recorder
 }
 
+// AckMessages mocks base method.
+func (m *MockRepository) AckMessages(ctx context.Context, queueName, subscriberName string, messageIDs []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AckMessages", ctx, queueName, subscriberName, messageIDs)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AckMessages indicates an expected call of AckMessages.
+func (mr *MockRepositoryMockRecorder) AckMessages(ctx, queueName, subscriberName, messageIDs interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AckMessages", reflect.TypeOf((*MockRepository)(nil).AckMessages), ctx, queueName, subscriberName, messageIDs)
+}
+
 // AddMessage mocks base method.
-func (m *MockRepository) AddMessage(ctx context.Context, name string, jsonBody map[string]interface{}) error {
+func (m *MockRepository) AddMessage(ctx context.Context, name string, message *models.QueueMessage) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "AddMessage", ctx, name, jsonBody)
+	ret := m.ctrl.Call(m, "AddMessage", ctx, name, message)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // AddMessage indicates an expected call of AddMessage.
-func (mr *MockRepositoryMockRecorder) AddMessage(ctx, name, jsonBody interface{}) *gomock.Call {
+func (mr *MockRepositoryMockRecorder) AddMessage(ctx, name, message interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddMessage", reflect.TypeOf((*MockRepository)(nil).AddMessage), ctx, name, jsonBody)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddMessage", reflect.TypeOf((*MockRepository)(nil).AddMessage), ctx, name, message)
+}
+
+// AddMessages mocks base method.
+func (m *MockRepository) AddMessages(ctx context.Context, messages map[string]*models.QueueMessage) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddMessages", ctx, messages)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddMessages indicates an expected call of AddMessages.
+func (mr *MockRepositoryMockRecorder) AddMessages(ctx, messages interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddMessages", reflect.TypeOf((*MockRepository)(nil).AddMessages), ctx, messages)
 }
 
 // AddSubscriber mocks base method.
-func (m *MockRepository) AddSubscriber(ctx context.Context, queueName, subscriberName string) error {
+func (m *MockRepository) AddSubscriber(ctx context.Context, queueName, subscriberName, groupName string) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "AddSubscriber", ctx, queueName, subscriberName)
+	ret := m.ctrl.Call(m, "AddSubscriber", ctx, queueName, subscriberName, groupName)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // AddSubscriber indicates an expected call of AddSubscriber.
-func (mr *MockRepositoryMockRecorder) AddSubscriber(ctx, queueName, subscriberName interface{}) *gomock.Call {
+func (mr *MockRepositoryMockRecorder) AddSubscriber(ctx, queueName, subscriberName, groupName interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddSubscriber", reflect.TypeOf((*MockRepository)(nil).AddSubscriber), ctx, queueName, subscriberName, groupName)
+}
+
+// Bind mocks base method.
+func (m *MockRepository) Bind(ctx context.Context, exchangeName string, binding models.Binding) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Bind", ctx, exchangeName, binding)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Bind indicates an expected call of Bind.
+func (mr *MockRepositoryMockRecorder) Bind(ctx, exchangeName, binding interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddSubscriber", reflect.TypeOf((*MockRepository)(nil).AddSubscriber), ctx, queueName, subscriberName)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Bind", reflect.TypeOf((*MockRepository)(nil).Bind), ctx, exchangeName, binding)
+}
+
+// Close mocks base method.
+func (m *MockRepository) Close() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Close")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Close indicates an expected call of Close.
+func (mr *MockRepositoryMockRecorder) Close() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockRepository)(nil).Close))
 }
 
 // Create mocks base method.
-func (m *MockRepository) Create(ctx context.Context, name string, maxLength, maxSubscribers uint) (models.Queue, error) {
+func (m *MockRepository) Create(ctx context.Context, queueCfg config.QueueConfig) (*models.Queue, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Create", ctx, name, maxLength, maxSubscribers)
-	ret0, _ := ret[0].(models.Queue)
+	ret := m.ctrl.Call(m, "Create", ctx, queueCfg)
+	ret0, _ := ret[0].(*models.Queue)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // Create indicates an expected call of Create.
-func (mr *MockRepositoryMockRecorder) Create(ctx, name, maxLength, maxSubscribers interface{}) *gomock.Call {
+func (mr *MockRepositoryMockRecorder) Create(ctx, queueCfg interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockRepository)(nil).Create), ctx, queueCfg)
+}
+
+// CreateExchange mocks base method.
+func (m *MockRepository) CreateExchange(ctx context.Context, exchangeCfg config.ExchangeConfig) (*models.Exchange, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateExchange", ctx, exchangeCfg)
+	ret0, _ := ret[0].(*models.Exchange)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateExchange indicates an expected call of CreateExchange.
+func (mr *MockRepositoryMockRecorder) CreateExchange(ctx, exchangeCfg interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateExchange", reflect.TypeOf((*MockRepository)(nil).CreateExchange), ctx, exchangeCfg)
+}
+
+// Delete mocks base method.
+func (m *MockRepository) Delete(ctx context.Context, name string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delete", ctx, name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Delete indicates an expected call of Delete.
+func (mr *MockRepositoryMockRecorder) Delete(ctx, name interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockRepository)(nil).Delete), ctx, name)
+}
+
+// DeleteExchange mocks base method.
+func (m *MockRepository) DeleteExchange(ctx context.Context, name string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteExchange", ctx, name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteExchange indicates an expected call of DeleteExchange.
+func (mr *MockRepositoryMockRecorder) DeleteExchange(ctx, name interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockRepository)(nil).Create), ctx, name, maxLength, maxSubscribers)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteExchange", reflect.TypeOf((*MockRepository)(nil).DeleteExchange), ctx, name)
+}
+
+// DeleteMessages mocks base method.
+func (m *MockRepository) DeleteMessages(ctx context.Context, queueName string, messageIDs []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteMessages", ctx, queueName, messageIDs)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteMessages indicates an expected call of DeleteMessages.
+func (mr *MockRepositoryMockRecorder) DeleteMessages(ctx, queueName, messageIDs interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteMessages", reflect.TypeOf((*MockRepository)(nil).DeleteMessages), ctx, queueName, messageIDs)
+}
+
+// Drain mocks base method.
+func (m *MockRepository) Drain(ctx context.Context, name string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Drain", ctx, name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Drain indicates an expected call of Drain.
+func (mr *MockRepositoryMockRecorder) Drain(ctx, name interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Drain", reflect.TypeOf((*MockRepository)(nil).Drain), ctx, name)
+}
+
+// ExpireMessages mocks base method.
+func (m *MockRepository) ExpireMessages(ctx context.Context, queueName string, messageIDs []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ExpireMessages", ctx, queueName, messageIDs)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ExpireMessages indicates an expected call of ExpireMessages.
+func (mr *MockRepositoryMockRecorder) ExpireMessages(ctx, queueName, messageIDs interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExpireMessages", reflect.TypeOf((*MockRepository)(nil).ExpireMessages), ctx, queueName, messageIDs)
 }
 
 // GetAll mocks base method.
-func (m *MockRepository) GetAll(ctx context.Context) []models.Queue {
+func (m *MockRepository) GetAll(ctx context.Context) []*models.Queue {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "GetAll", ctx)
-	ret0, _ := ret[0].([]models.Queue)
+	ret0, _ := ret[0].([]*models.Queue)
 	return ret0
 }
 
@@ -93,10 +236,10 @@ func (mr *MockRepositoryMockRecorder) GetAll(ctx interface{}) *gomock.Call {
 }
 
 // GetByName mocks base method.
-func (m *MockRepository) GetByName(ctx context.Context, name string) (models.Queue, error) {
+func (m *MockRepository) GetByName(ctx context.Context, name string) (*models.Queue, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "GetByName", ctx, name)
-	ret0, _ := ret[0].(models.Queue)
+	ret0, _ := ret[0].(*models.Queue)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
@@ -106,3 +249,102 @@ func (mr *MockRepositoryMockRecorder) GetByName(ctx, name interface{}) *gomock.C
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetByName", reflect.TypeOf((*MockRepository)(nil).GetByName), ctx, name)
 }
+
+// GetExchange mocks base method.
+func (m *MockRepository) GetExchange(ctx context.Context, name string) (*models.Exchange, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetExchange", ctx, name)
+	ret0, _ := ret[0].(*models.Exchange)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetExchange indicates an expected call of GetExchange.
+func (mr *MockRepositoryMockRecorder) GetExchange(ctx, name interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetExchange", reflect.TypeOf((*MockRepository)(nil).GetExchange), ctx, name)
+}
+
+// GetExchanges mocks base method.
+func (m *MockRepository) GetExchanges(ctx context.Context) []*models.Exchange {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetExchanges", ctx)
+	ret0, _ := ret[0].([]*models.Exchange)
+	return ret0
+}
+
+// GetExchanges indicates an expected call of GetExchanges.
+func (mr *MockRepositoryMockRecorder) GetExchanges(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetExchanges", reflect.TypeOf((*MockRepository)(nil).GetExchanges), ctx)
+}
+
+// LeaseMessages mocks base method.
+func (m *MockRepository) LeaseMessages(ctx context.Context, queueName, subscriberName string, messageIDs []string, leasedUntil time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LeaseMessages", ctx, queueName, subscriberName, messageIDs, leasedUntil)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// LeaseMessages indicates an expected call of LeaseMessages.
+func (mr *MockRepositoryMockRecorder) LeaseMessages(ctx, queueName, subscriberName, messageIDs, leasedUntil interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LeaseMessages", reflect.TypeOf((*MockRepository)(nil).LeaseMessages), ctx, queueName, subscriberName, messageIDs, leasedUntil)
+}
+
+// ReleaseMessages mocks base method.
+func (m *MockRepository) ReleaseMessages(ctx context.Context, queueName, subscriberName string, messageIDs []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReleaseMessages", ctx, queueName, subscriberName, messageIDs)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReleaseMessages indicates an expected call of ReleaseMessages.
+func (mr *MockRepositoryMockRecorder) ReleaseMessages(ctx, queueName, subscriberName, messageIDs interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleaseMessages", reflect.TypeOf((*MockRepository)(nil).ReleaseMessages), ctx, queueName, subscriberName, messageIDs)
+}
+
+// RemoveSubscriber mocks base method.
+func (m *MockRepository) RemoveSubscriber(ctx context.Context, queueName, subscriberName string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RemoveSubscriber", ctx, queueName, subscriberName)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RemoveSubscriber indicates an expected call of RemoveSubscriber.
+func (mr *MockRepositoryMockRecorder) RemoveSubscriber(ctx, queueName, subscriberName interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveSubscriber", reflect.TypeOf((*MockRepository)(nil).RemoveSubscriber), ctx, queueName, subscriberName)
+}
+
+// Unbind mocks base method.
+func (m *MockRepository) Unbind(ctx context.Context, exchangeName string, binding models.Binding) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Unbind", ctx, exchangeName, binding)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Unbind indicates an expected call of Unbind.
+func (mr *MockRepositoryMockRecorder) Unbind(ctx, exchangeName, binding interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Unbind", reflect.TypeOf((*MockRepository)(nil).Unbind), ctx, exchangeName, binding)
+}
+
+// Update mocks base method.
+func (m *MockRepository) Update(ctx context.Context, queueCfg config.QueueConfig) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Update", ctx, queueCfg)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Update indicates an expected call of Update.
+func (mr *MockRepositoryMockRecorder) Update(ctx, queueCfg interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Update", reflect.TypeOf((*MockRepository)(nil).Update), ctx, queueCfg)
+}
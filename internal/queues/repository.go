@@ -2,15 +2,46 @@ package queues
 
 import (
 	"context"
+	"time"
 
+	"github.com/VladSatyshev/concurrent-queue/config"
 	"github.com/VladSatyshev/concurrent-queue/internal/models"
 )
 
+// Repository is safe for concurrent use. Queues returned by it are shared, so
+// callers must hold the queue lock while working with them; mutating methods
+// (Update, Drain, Delete, AddMessage, AddMessages, AddSubscriber, RemoveSubscriber,
+// LeaseMessages, ReleaseMessages, AckMessages, DeleteMessages, ExpireMessages)
+// expect the caller to hold the queue write lock. Exchanges are replaced
+// rather than changed, so they are used without locks
+//
 //go:generate mockgen -source repository.go -destination mock/repository_mock.go -package mock
 type Repository interface {
-	Create(ctx context.Context, name string, maxLength uint, maxSubscribers uint) (models.Queue, error)
-	GetByName(ctx context.Context, name string) (models.Queue, error)
-	GetAll(ctx context.Context) []models.Queue
-	AddMessage(ctx context.Context, name string, jsonBody map[string]interface{}) error
-	AddSubscriber(ctx context.Context, queueName string, subscriberName string) error
+	Create(ctx context.Context, queueCfg config.QueueConfig) (*models.Queue, error)
+	Update(ctx context.Context, queueCfg config.QueueConfig) error
+	Drain(ctx context.Context, name string) error
+	Delete(ctx context.Context, name string) error
+	GetByName(ctx context.Context, name string) (*models.Queue, error)
+	GetAll(ctx context.Context) []*models.Queue
+	AddMessage(ctx context.Context, name string, message *models.QueueMessage) error
+	// AddMessages adds messages to queues they're keyed by, either to all of
+	// them or to none
+	AddMessages(ctx context.Context, messages map[string]*models.QueueMessage) error
+	// subscriber joins consumer group when groupName isn't empty
+	AddSubscriber(ctx context.Context, queueName string, subscriberName string, groupName string) error
+	RemoveSubscriber(ctx context.Context, queueName string, subscriberName string) error
+	LeaseMessages(ctx context.Context, queueName string, subscriberName string, messageIDs []string, leasedUntil time.Time) error
+	ReleaseMessages(ctx context.Context, queueName string, subscriberName string, messageIDs []string) error
+	AckMessages(ctx context.Context, queueName string, subscriberName string, messageIDs []string) error
+	DeleteMessages(ctx context.Context, queueName string, messageIDs []string) error
+	// ExpireMessages deletes messages and counts them in queue stats
+	ExpireMessages(ctx context.Context, queueName string, messageIDs []string) error
+	CreateExchange(ctx context.Context, exchangeCfg config.ExchangeConfig) (*models.Exchange, error)
+	DeleteExchange(ctx context.Context, name string) error
+	GetExchange(ctx context.Context, name string) (*models.Exchange, error)
+	GetExchanges(ctx context.Context) []*models.Exchange
+	// Bind ignores existing binding and Unbind ignores missing one
+	Bind(ctx context.Context, exchangeName string, binding models.Binding) error
+	Unbind(ctx context.Context, exchangeName string, binding models.Binding) error
+	Close() error
 }
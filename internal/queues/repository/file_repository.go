@@ -0,0 +1,825 @@
+package repository
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VladSatyshev/concurrent-queue/config"
+	"github.com/VladSatyshev/concurrent-queue/internal/models"
+	"github.com/VladSatyshev/concurrent-queue/internal/queues"
+	"github.com/VladSatyshev/concurrent-queue/pkg/logger"
+)
+
+const (
+	snapshotFileName = "snapshot.json"
+	segmentPrefix    = "wal-"
+	segmentSuffix    = ".log"
+
+	defaultFsyncInterval = time.Second
+)
+
+// write-ahead log record types
+const (
+	walCreate      = "create"
+	walUpdate      = "update"
+	walDrain       = "drain"
+	walDrop        = "drop"
+	walPublish     = "publish"
+	walPublishMany = "publish_many"
+	walSubscribe   = "subscribe"
+	walUnsubscribe = "unsubscribe"
+	walLease       = "lease"
+	walRelease     = "release"
+	walAck         = "ack"
+	walDelete      = "delete"
+	walExpire      = "expire"
+
+	walCreateExchange = "create_exchange"
+	walDropExchange   = "drop_exchange"
+	walBind           = "bind"
+	walUnbind         = "unbind"
+)
+
+// walRecord is a single line of the write-ahead log. Applying records is
+// idempotent, so records already included into snapshot can be replayed again
+type walRecord struct {
+	Type        string               `json:"type"`
+	Queue       string               `json:"queue"`
+	QueueConfig *config.QueueConfig  `json:"queue_config,omitempty"`
+	Subscriber  string               `json:"subscriber,omitempty"`
+	Group       string               `json:"group,omitempty"`
+	Message     *models.QueueMessage `json:"message,omitempty"`
+	// messages of publish_many record by their queues
+	Messages       map[string]*models.QueueMessage `json:"messages,omitempty"`
+	MessageIDs     []string                        `json:"message_ids,omitempty"`
+	LeasedUntil    *time.Time                      `json:"leased_until,omitempty"`
+	Exchange       string                          `json:"exchange,omitempty"`
+	ExchangeConfig *config.ExchangeConfig          `json:"exchange_config,omitempty"`
+	Binding        *models.Binding                 `json:"binding,omitempty"`
+}
+
+type snapshot struct {
+	// first write-ahead log segment which has to be replayed on top of snapshot
+	Segment   uint64             `json:"segment"`
+	Queues    []*models.Queue    `json:"queues"`
+	Exchanges []*models.Exchange `json:"exchanges,omitempty"`
+}
+
+// fileQueuesRepo keeps queues in memory and makes every change durable in an
+// append-only write-ahead log, which is periodically compacted into snapshot.
+// Every change is written to the log before it's applied to memory
+type fileQueuesRepo struct {
+	*queuesRepo
+	cfg    config.StorageConfig
+	logger logger.Logger
+
+	// makes existence check, logging and insert of Create atomic and keeps
+	// queues created during snapshot out of the rotated segments. Exchange
+	// changes hold it too, so snapshot gets exchanges as of the segment switch
+	createMu sync.Mutex
+	// serializes snapshots
+	snapshotMu sync.Mutex
+
+	walMu   sync.Mutex
+	wal     *os.File
+	segment uint64
+	records uint
+	// error of the last failed write or sync, cleared by the next successful write
+	walErr error
+
+	snapshotCh chan struct{}
+	done       chan struct{}
+	wg         sync.WaitGroup
+}
+
+func NewFileQueuesRepository(cfg *config.Config, logger logger.Logger) (queues.Repository, error) {
+	if err := os.MkdirAll(cfg.Storage.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	return &fileQueuesRepo{
+		queuesRepo: newQueuesRepo(cfg),
+		cfg:        cfg.Storage,
+		logger:     logger,
+		snapshotCh: make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}, nil
+}
+
+// Recover loads the last snapshot, replays write-ahead log on top of it and
+// opens a new log segment for writing
+func (r *fileQueuesRepo) Recover(ctx context.Context) error {
+	snap, err := r.readSnapshot()
+	if err != nil {
+		return err
+	}
+
+	for _, q := range snap.Queues {
+		r.restore(q)
+	}
+	for _, e := range snap.Exchanges {
+		r.restoreExchange(e)
+	}
+
+	segments, err := r.listSegments()
+	if err != nil {
+		return err
+	}
+
+	next := snap.Segment
+	for _, segment := range segments {
+		if segment < snap.Segment {
+			continue
+		}
+		if err := r.replaySegment(ctx, segment); err != nil {
+			return err
+		}
+		next = segment + 1
+	}
+
+	r.logger.Infof("storage recovered from %s: %d queues, %d exchanges", r.cfg.Dir, len(r.queues), len(r.exchanges))
+
+	// never append to replayed segments: the last one may end with a torn record
+	r.walMu.Lock()
+	err = r.openSegment(next)
+	r.walMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	r.removeSegmentsBefore(snap.Segment)
+
+	r.wg.Add(1)
+	go r.snapshotLoop()
+
+	if r.cfg.FsyncPolicy != config.FsyncAlways && r.cfg.FsyncPolicy != config.FsyncNever {
+		r.wg.Add(1)
+		go r.fsyncLoop()
+	}
+
+	return nil
+}
+
+func (r *fileQueuesRepo) Create(ctx context.Context, queueCfg config.QueueConfig) (*models.Queue, error) {
+	r.createMu.Lock()
+	defer r.createMu.Unlock()
+
+	if _, err := r.queuesRepo.GetByName(ctx, queueCfg.Name); err == nil {
+		return nil, queues.NewQueueErr(queues.RepositoryConflictErr, fmt.Sprintf("queue with name %v already exists", queueCfg.Name))
+	}
+
+	if err := r.append(walRecord{Type: walCreate, Queue: queueCfg.Name, QueueConfig: &queueCfg}); err != nil {
+		return nil, err
+	}
+
+	return r.queuesRepo.Create(ctx, queueCfg)
+}
+
+func (r *fileQueuesRepo) Update(ctx context.Context, queueCfg config.QueueConfig) error {
+	if _, err := r.queuesRepo.GetByName(ctx, queueCfg.Name); err != nil {
+		return err
+	}
+
+	if err := r.append(walRecord{Type: walUpdate, Queue: queueCfg.Name, QueueConfig: &queueCfg}); err != nil {
+		return err
+	}
+
+	return r.queuesRepo.Update(ctx, queueCfg)
+}
+
+func (r *fileQueuesRepo) Drain(ctx context.Context, name string) error {
+	if _, err := r.queuesRepo.GetByName(ctx, name); err != nil {
+		return err
+	}
+
+	if err := r.append(walRecord{Type: walDrain, Queue: name}); err != nil {
+		return err
+	}
+
+	return r.queuesRepo.Drain(ctx, name)
+}
+
+// Delete holds createMu, so deleted queue never gets into snapshot taken after
+// the segment with its drop record is rotated
+func (r *fileQueuesRepo) Delete(ctx context.Context, name string) error {
+	r.createMu.Lock()
+	defer r.createMu.Unlock()
+
+	if _, err := r.queuesRepo.GetByName(ctx, name); err != nil {
+		return err
+	}
+
+	if err := r.append(walRecord{Type: walDrop, Queue: name}); err != nil {
+		return err
+	}
+
+	return r.queuesRepo.Delete(ctx, name)
+}
+
+func (r *fileQueuesRepo) AddMessage(ctx context.Context, name string, message *models.QueueMessage) error {
+	if _, err := r.queuesRepo.GetByName(ctx, name); err != nil {
+		return err
+	}
+
+	if err := r.append(walRecord{Type: walPublish, Queue: name, Message: message}); err != nil {
+		return err
+	}
+
+	return r.queuesRepo.AddMessage(ctx, name, message)
+}
+
+// AddMessages writes a single record, so messages are recovered either for
+// all queues or for none
+func (r *fileQueuesRepo) AddMessages(ctx context.Context, messages map[string]*models.QueueMessage) error {
+	for name := range messages {
+		if _, err := r.queuesRepo.GetByName(ctx, name); err != nil {
+			return err
+		}
+	}
+
+	if err := r.append(walRecord{Type: walPublishMany, Messages: messages}); err != nil {
+		return err
+	}
+
+	return r.queuesRepo.AddMessages(ctx, messages)
+}
+
+func (r *fileQueuesRepo) AddSubscriber(ctx context.Context, queueName string, subscriberName string, groupName string) error {
+	if _, err := r.queuesRepo.GetByName(ctx, queueName); err != nil {
+		return err
+	}
+
+	if err := r.append(walRecord{Type: walSubscribe, Queue: queueName, Subscriber: subscriberName, Group: groupName}); err != nil {
+		return err
+	}
+
+	return r.queuesRepo.AddSubscriber(ctx, queueName, subscriberName, groupName)
+}
+
+func (r *fileQueuesRepo) RemoveSubscriber(ctx context.Context, queueName string, subscriberName string) error {
+	if _, err := r.queuesRepo.GetByName(ctx, queueName); err != nil {
+		return err
+	}
+
+	if err := r.append(walRecord{Type: walUnsubscribe, Queue: queueName, Subscriber: subscriberName}); err != nil {
+		return err
+	}
+
+	return r.queuesRepo.RemoveSubscriber(ctx, queueName, subscriberName)
+}
+
+func (r *fileQueuesRepo) LeaseMessages(ctx context.Context, queueName string, subscriberName string, messageIDs []string, leasedUntil time.Time) error {
+	if _, err := r.queuesRepo.GetByName(ctx, queueName); err != nil {
+		return err
+	}
+
+	if err := r.append(walRecord{Type: walLease, Queue: queueName, Subscriber: subscriberName, MessageIDs: messageIDs, LeasedUntil: &leasedUntil}); err != nil {
+		return err
+	}
+
+	return r.queuesRepo.LeaseMessages(ctx, queueName, subscriberName, messageIDs, leasedUntil)
+}
+
+func (r *fileQueuesRepo) ReleaseMessages(ctx context.Context, queueName string, subscriberName string, messageIDs []string) error {
+	if _, err := r.queuesRepo.GetByName(ctx, queueName); err != nil {
+		return err
+	}
+
+	if err := r.append(walRecord{Type: walRelease, Queue: queueName, Subscriber: subscriberName, MessageIDs: messageIDs}); err != nil {
+		return err
+	}
+
+	return r.queuesRepo.ReleaseMessages(ctx, queueName, subscriberName, messageIDs)
+}
+
+func (r *fileQueuesRepo) AckMessages(ctx context.Context, queueName string, subscriberName string, messageIDs []string) error {
+	if _, err := r.queuesRepo.GetByName(ctx, queueName); err != nil {
+		return err
+	}
+
+	if err := r.append(walRecord{Type: walAck, Queue: queueName, Subscriber: subscriberName, MessageIDs: messageIDs}); err != nil {
+		return err
+	}
+
+	return r.queuesRepo.AckMessages(ctx, queueName, subscriberName, messageIDs)
+}
+
+func (r *fileQueuesRepo) ExpireMessages(ctx context.Context, queueName string, messageIDs []string) error {
+	if _, err := r.queuesRepo.GetByName(ctx, queueName); err != nil {
+		return err
+	}
+
+	if err := r.append(walRecord{Type: walExpire, Queue: queueName, MessageIDs: messageIDs}); err != nil {
+		return err
+	}
+
+	return r.queuesRepo.ExpireMessages(ctx, queueName, messageIDs)
+}
+
+func (r *fileQueuesRepo) DeleteMessages(ctx context.Context, queueName string, messageIDs []string) error {
+	if _, err := r.queuesRepo.GetByName(ctx, queueName); err != nil {
+		return err
+	}
+
+	if err := r.append(walRecord{Type: walDelete, Queue: queueName, MessageIDs: messageIDs}); err != nil {
+		return err
+	}
+
+	return r.queuesRepo.DeleteMessages(ctx, queueName, messageIDs)
+}
+
+func (r *fileQueuesRepo) CreateExchange(ctx context.Context, exchangeCfg config.ExchangeConfig) (*models.Exchange, error) {
+	r.createMu.Lock()
+	defer r.createMu.Unlock()
+
+	if _, err := r.queuesRepo.GetExchange(ctx, exchangeCfg.Name); err == nil {
+		return nil, queues.NewQueueErr(queues.RepositoryConflictErr, fmt.Sprintf("exchange with name %v already exists", exchangeCfg.Name))
+	}
+
+	if err := r.append(walRecord{Type: walCreateExchange, Exchange: exchangeCfg.Name, ExchangeConfig: &exchangeCfg}); err != nil {
+		return nil, err
+	}
+
+	return r.queuesRepo.CreateExchange(ctx, exchangeCfg)
+}
+
+func (r *fileQueuesRepo) DeleteExchange(ctx context.Context, name string) error {
+	r.createMu.Lock()
+	defer r.createMu.Unlock()
+
+	if _, err := r.queuesRepo.GetExchange(ctx, name); err != nil {
+		return err
+	}
+
+	if err := r.append(walRecord{Type: walDropExchange, Exchange: name}); err != nil {
+		return err
+	}
+
+	return r.queuesRepo.DeleteExchange(ctx, name)
+}
+
+func (r *fileQueuesRepo) Bind(ctx context.Context, exchangeName string, binding models.Binding) error {
+	r.createMu.Lock()
+	defer r.createMu.Unlock()
+
+	if _, err := r.queuesRepo.GetExchange(ctx, exchangeName); err != nil {
+		return err
+	}
+
+	if err := r.append(walRecord{Type: walBind, Exchange: exchangeName, Binding: &binding}); err != nil {
+		return err
+	}
+
+	return r.queuesRepo.Bind(ctx, exchangeName, binding)
+}
+
+func (r *fileQueuesRepo) Unbind(ctx context.Context, exchangeName string, binding models.Binding) error {
+	r.createMu.Lock()
+	defer r.createMu.Unlock()
+
+	if _, err := r.queuesRepo.GetExchange(ctx, exchangeName); err != nil {
+		return err
+	}
+
+	if err := r.append(walRecord{Type: walUnbind, Exchange: exchangeName, Binding: &binding}); err != nil {
+		return err
+	}
+
+	return r.queuesRepo.Unbind(ctx, exchangeName, binding)
+}
+
+// Close stops background work and flushes write-ahead log to disk
+func (r *fileQueuesRepo) Close() error {
+	r.walMu.Lock()
+	if r.wal == nil {
+		r.walMu.Unlock()
+		return nil
+	}
+	close(r.done)
+	r.walMu.Unlock()
+
+	r.wg.Wait()
+
+	r.walMu.Lock()
+	defer r.walMu.Unlock()
+
+	err := r.closeSegment()
+	r.wal = nil
+
+	return err
+}
+
+// Check reports whether write-ahead log accepts changes: it's open, the last
+// write to it has succeeded and storage directory is still in place
+func (r *fileQueuesRepo) Check(ctx context.Context) error {
+	r.walMu.Lock()
+	wal, walErr := r.wal, r.walErr
+	r.walMu.Unlock()
+
+	if wal == nil {
+		return errors.New("write-ahead log is not open")
+	}
+	if walErr != nil {
+		return fmt.Errorf("failed to write to write-ahead log: %w", walErr)
+	}
+	if _, err := os.Stat(r.cfg.Dir); err != nil {
+		return fmt.Errorf("storage directory is not available: %w", err)
+	}
+
+	return nil
+}
+
+func (r *fileQueuesRepo) append(record walRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return queues.NewQueueErr(queues.RepositoryErr, fmt.Sprintf("failed to encode %s record: %s", record.Type, err))
+	}
+	data = append(data, '\n')
+
+	r.walMu.Lock()
+	defer r.walMu.Unlock()
+
+	if r.wal == nil {
+		return queues.NewQueueErr(queues.RepositoryErr, "storage is not available")
+	}
+
+	if _, err := r.wal.Write(data); err != nil {
+		r.walErr = err
+		r.logger.Errorf("failed to write %s record to write-ahead log: %s", record.Type, err.Error())
+		return queues.NewQueueErr(queues.RepositoryErr, "failed to persist change")
+	}
+
+	if r.cfg.FsyncPolicy == config.FsyncAlways {
+		if err := r.wal.Sync(); err != nil {
+			r.walErr = err
+			r.logger.Errorf("failed to sync write-ahead log: %s", err.Error())
+			return queues.NewQueueErr(queues.RepositoryErr, "failed to persist change")
+		}
+	}
+	r.walErr = nil
+
+	r.records++
+	if r.cfg.SnapshotEvery > 0 && r.records >= r.cfg.SnapshotEvery {
+		r.records = 0
+		select {
+		case r.snapshotCh <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// apply replays a single write-ahead log record
+func (r *fileQueuesRepo) apply(ctx context.Context, record walRecord) error {
+	var err error
+
+	switch record.Type {
+	case walCreate:
+		if _, getErr := r.queuesRepo.GetByName(ctx, record.Queue); getErr == nil {
+			return nil
+		}
+		if record.QueueConfig == nil {
+			return fmt.Errorf("create record without queue config")
+		}
+		_, err = r.queuesRepo.Create(ctx, *record.QueueConfig)
+	case walUpdate:
+		if record.QueueConfig == nil {
+			return fmt.Errorf("update record without queue config")
+		}
+		err = r.queuesRepo.Update(ctx, *record.QueueConfig)
+	case walDrain:
+		err = r.queuesRepo.Drain(ctx, record.Queue)
+	case walDrop:
+		err = r.queuesRepo.Delete(ctx, record.Queue)
+	case walPublish:
+		if record.Message == nil {
+			return fmt.Errorf("publish record without message")
+		}
+		err = r.queuesRepo.AddMessage(ctx, record.Queue, record.Message)
+	case walPublishMany:
+		// queues deleted after the record was written are skipped
+		for name, message := range record.Messages {
+			if err := r.apply(ctx, walRecord{Type: walPublish, Queue: name, Message: message}); err != nil {
+				return err
+			}
+		}
+	case walSubscribe:
+		err = r.queuesRepo.AddSubscriber(ctx, record.Queue, record.Subscriber, record.Group)
+	case walUnsubscribe:
+		err = r.queuesRepo.RemoveSubscriber(ctx, record.Queue, record.Subscriber)
+	case walLease:
+		if record.LeasedUntil == nil {
+			return fmt.Errorf("lease record without lease time")
+		}
+		err = r.queuesRepo.LeaseMessages(ctx, record.Queue, record.Subscriber, record.MessageIDs, *record.LeasedUntil)
+	case walRelease:
+		err = r.queuesRepo.ReleaseMessages(ctx, record.Queue, record.Subscriber, record.MessageIDs)
+	case walAck:
+		err = r.queuesRepo.AckMessages(ctx, record.Queue, record.Subscriber, record.MessageIDs)
+	case walDelete:
+		err = r.queuesRepo.DeleteMessages(ctx, record.Queue, record.MessageIDs)
+	case walExpire:
+		err = r.queuesRepo.ExpireMessages(ctx, record.Queue, record.MessageIDs)
+	case walCreateExchange:
+		if _, getErr := r.queuesRepo.GetExchange(ctx, record.Exchange); getErr == nil {
+			return nil
+		}
+		if record.ExchangeConfig == nil {
+			return fmt.Errorf("create_exchange record without exchange config")
+		}
+		_, err = r.queuesRepo.CreateExchange(ctx, *record.ExchangeConfig)
+	case walDropExchange:
+		err = r.queuesRepo.DeleteExchange(ctx, record.Exchange)
+	case walBind:
+		if record.Binding == nil {
+			return fmt.Errorf("bind record without binding")
+		}
+		err = r.queuesRepo.Bind(ctx, record.Exchange, *record.Binding)
+	case walUnbind:
+		if record.Binding == nil {
+			return fmt.Errorf("unbind record without binding")
+		}
+		err = r.queuesRepo.Unbind(ctx, record.Exchange, *record.Binding)
+	default:
+		return fmt.Errorf("unknown record type %q", record.Type)
+	}
+
+	if qErr, ok := err.(*queues.QueueErr); ok && qErr.ErrType == queues.RepositoryNotFoundErr {
+		r.logger.Warnf("skipping %s record: %s", record.Type, qErr.Error())
+		return nil
+	}
+
+	return err
+}
+
+func (r *fileQueuesRepo) replaySegment(ctx context.Context, segment uint64) error {
+	path := r.segmentPath(segment)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(data) > 0 {
+				r.logger.Warnf("ignoring torn record at %s:%d", path, line)
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+
+		var record walRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return fmt.Errorf("corrupted record at %s:%d: %w", path, line, err)
+		}
+
+		if err := r.apply(ctx, record); err != nil {
+			return fmt.Errorf("failed to replay record at %s:%d: %w", path, line, err)
+		}
+	}
+}
+
+func (r *fileQueuesRepo) snapshotLoop() {
+	defer r.wg.Done()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-r.snapshotCh:
+			if err := r.snapshot(context.Background()); err != nil {
+				r.logger.Errorf("failed to take snapshot: %s", err.Error())
+			}
+		}
+	}
+}
+
+func (r *fileQueuesRepo) fsyncLoop() {
+	defer r.wg.Done()
+
+	interval := r.cfg.FsyncIntervalSec * time.Second
+	if interval <= 0 {
+		interval = defaultFsyncInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			r.walMu.Lock()
+			if r.wal != nil {
+				if err := r.wal.Sync(); err != nil {
+					r.walErr = err
+					r.logger.Errorf("failed to sync write-ahead log: %s", err.Error())
+				}
+			}
+			r.walMu.Unlock()
+		}
+	}
+}
+
+// snapshot switches write-ahead log to a new segment, writes state of all
+// queues and removes segments which are covered by the snapshot. Changes made
+// after the switch may be both in snapshot and in the new segment, which is
+// fine as replay is idempotent
+func (r *fileQueuesRepo) snapshot(ctx context.Context) error {
+	r.snapshotMu.Lock()
+	defer r.snapshotMu.Unlock()
+
+	r.createMu.Lock()
+
+	r.walMu.Lock()
+	if r.wal == nil {
+		r.walMu.Unlock()
+		r.createMu.Unlock()
+		return errors.New("storage is closed")
+	}
+	next := r.segment + 1
+	if err := r.closeSegment(); err != nil {
+		r.walMu.Unlock()
+		r.createMu.Unlock()
+		return err
+	}
+	err := r.openSegment(next)
+	r.walMu.Unlock()
+
+	qs := r.queuesRepo.GetAll(ctx)
+	exchanges := r.queuesRepo.GetExchanges(ctx)
+	r.createMu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	snap := snapshot{Segment: next, Queues: make([]*models.Queue, 0, len(qs)), Exchanges: exchanges}
+	for _, q := range qs {
+		q.RLock()
+		snap.Queues = append(snap.Queues, q.Snapshot())
+		q.RUnlock()
+	}
+
+	if err := r.writeSnapshot(snap); err != nil {
+		return err
+	}
+
+	r.removeSegmentsBefore(next)
+
+	return nil
+}
+
+func (r *fileQueuesRepo) readSnapshot() (snapshot, error) {
+	var snap snapshot
+
+	data, err := os.ReadFile(filepath.Join(r.cfg.Dir, snapshotFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return snap, nil
+	}
+	if err != nil {
+		return snap, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return snap, fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+
+	return snap, nil
+}
+
+func (r *fileQueuesRepo) writeSnapshot(snap snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+
+	path := filepath.Join(r.cfg.Dir, snapshotFileName)
+	tmpPath := path + ".tmp"
+
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close snapshot: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace snapshot: %w", err)
+	}
+
+	return r.syncDir()
+}
+
+// openSegment expects walMu to be held
+func (r *fileQueuesRepo) openSegment(segment uint64) error {
+	f, err := os.OpenFile(r.segmentPath(segment), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open write-ahead log segment: %w", err)
+	}
+
+	r.wal = f
+	r.segment = segment
+
+	return r.syncDir()
+}
+
+// closeSegment expects walMu to be held
+func (r *fileQueuesRepo) closeSegment() error {
+	if err := r.wal.Sync(); err != nil {
+		r.wal.Close()
+		return fmt.Errorf("failed to sync write-ahead log segment: %w", err)
+	}
+	if err := r.wal.Close(); err != nil {
+		return fmt.Errorf("failed to close write-ahead log segment: %w", err)
+	}
+	return nil
+}
+
+func (r *fileQueuesRepo) listSegments() ([]uint64, error) {
+	entries, err := os.ReadDir(r.cfg.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read storage directory: %w", err)
+	}
+
+	res := []uint64{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+
+		segment, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		res = append(res, segment)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+
+	return res, nil
+}
+
+func (r *fileQueuesRepo) removeSegmentsBefore(segment uint64) {
+	segments, err := r.listSegments()
+	if err != nil {
+		r.logger.Errorf("failed to list write-ahead log segments: %s", err.Error())
+		return
+	}
+
+	for _, s := range segments {
+		if s >= segment {
+			continue
+		}
+		if err := os.Remove(r.segmentPath(s)); err != nil {
+			r.logger.Errorf("failed to remove write-ahead log segment: %s", err.Error())
+		}
+	}
+}
+
+func (r *fileQueuesRepo) segmentPath(segment uint64) string {
+	return filepath.Join(r.cfg.Dir, fmt.Sprintf("%s%020d%s", segmentPrefix, segment, segmentSuffix))
+}
+
+func (r *fileQueuesRepo) syncDir() error {
+	dir, err := os.Open(r.cfg.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to open storage directory: %w", err)
+	}
+	defer dir.Close()
+
+	if err := dir.Sync(); err != nil {
+		return fmt.Errorf("failed to sync storage directory: %w", err)
+	}
+
+	return nil
+}
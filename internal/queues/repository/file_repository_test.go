@@ -0,0 +1,316 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/VladSatyshev/concurrent-queue/config"
+	"github.com/VladSatyshev/concurrent-queue/internal/models"
+	"github.com/VladSatyshev/concurrent-queue/internal/queues"
+	"github.com/VladSatyshev/concurrent-queue/pkg/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestConfig(dir string) *config.Config {
+	return &config.Config{
+		Logger: config.LoggerConfig{Encoding: "json", Level: "error"},
+		Queues: []config.QueueConfig{
+			{Name: "queue1", Length: 10, SubscribersAmount: 2},
+			{Name: "queue2", Length: 10, SubscribersAmount: 2},
+		},
+		Storage: config.StorageConfig{
+			Type:        config.StorageFile,
+			Dir:         dir,
+			FsyncPolicy: config.FsyncAlways,
+		},
+	}
+}
+
+func openFileRepo(t *testing.T, cfg *config.Config) queues.Repository {
+	apiLogger := logger.NewAPILogger(cfg)
+	apiLogger.InitLogger()
+
+	r, err := NewFileQueuesRepository(cfg, apiLogger)
+	require.NoError(t, err)
+	require.NoError(t, InitQueues(context.Background(), cfg, r))
+
+	return r
+}
+
+func publish(t *testing.T, r queues.Repository, queueName string, body map[string]interface{}) *models.QueueMessage {
+	ctx := context.Background()
+
+	q, err := r.GetByName(ctx, queueName)
+	require.NoError(t, err)
+
+	q.Lock()
+	defer q.Unlock()
+
+	payload, err := json.Marshal(body)
+	require.NoError(t, err)
+
+	message := q.NewMessage(payload)
+	message.Attributes.ContentType = models.ContentTypeJSON
+	require.NoError(t, r.AddMessage(ctx, queueName, message))
+
+	return message
+}
+
+func dumpState(t *testing.T, r queues.Repository) string {
+	qs := r.GetAll(context.Background())
+	sort.Slice(qs, func(i, j int) bool { return qs[i].Name < qs[j].Name })
+
+	snapshots := make([]*models.Queue, 0, len(qs))
+	for _, q := range qs {
+		q.RLock()
+		snapshots = append(snapshots, q.Snapshot())
+		q.RUnlock()
+	}
+
+	exchanges := r.GetExchanges(context.Background())
+	sort.Slice(exchanges, func(i, j int) bool { return exchanges[i].Name < exchanges[j].Name })
+
+	data, err := json.Marshal(snapshot{Queues: snapshots, Exchanges: exchanges})
+	require.NoError(t, err)
+
+	return string(data)
+}
+
+func populate(t *testing.T, r queues.Repository) {
+	ctx := context.Background()
+
+	require.NoError(t, r.AddSubscriber(ctx, "queue1", "subscriber1", ""))
+	require.NoError(t, r.AddSubscriber(ctx, "queue1", "subscriber2", ""))
+
+	m1 := publish(t, r, "queue1", map[string]interface{}{"msg": "hello1"})
+	m2 := publish(t, r, "queue1", map[string]interface{}{"msg": "hello2"})
+	m3 := publish(t, r, "queue1", map[string]interface{}{"msg": "hello3"})
+	publish(t, r, "queue2", map[string]interface{}{"msg": "hello4"})
+	expired := publish(t, r, "queue2", map[string]interface{}{"msg": "expired"})
+	require.NoError(t, r.ExpireMessages(ctx, "queue2", []string{expired.ID}))
+
+	require.NoError(t, r.AckMessages(ctx, "queue1", "subscriber1", []string{m1.ID, m2.ID}))
+	require.NoError(t, r.AckMessages(ctx, "queue1", "subscriber2", []string{m1.ID}))
+	require.NoError(t, r.DeleteMessages(ctx, "queue1", []string{m1.ID}))
+
+	require.NoError(t, r.LeaseMessages(ctx, "queue1", "subscriber1", []string{m3.ID}, time.Now().Add(time.Minute).UTC()))
+
+	_, err := r.Create(ctx, config.QueueConfig{Name: "runtime", Length: 5, SubscribersAmount: 1, VisibilityTimeoutSec: 10})
+	require.NoError(t, err)
+	require.NoError(t, r.AddSubscriber(ctx, "runtime", "subscriber3", ""))
+	require.NoError(t, r.Update(ctx, config.QueueConfig{Name: "runtime", Length: 7, SubscribersAmount: 2, VisibilityTimeoutSec: 20}))
+
+	// deduplication ID is remembered after its message is deleted
+	runtime, err := r.GetByName(ctx, "runtime")
+	require.NoError(t, err)
+	runtime.Lock()
+	deduplicated := runtime.NewMessage([]byte("deduplicated"))
+	deduplicated.Deduplication = &models.Deduplication{ID: "key1", ExpiresAt: deduplicated.PublishedAt.Add(time.Hour)}
+	require.NoError(t, r.AddMessage(ctx, "runtime", deduplicated))
+	runtime.Unlock()
+	require.NoError(t, r.DeleteMessages(ctx, "runtime", []string{deduplicated.ID}))
+
+	require.NoError(t, r.Drain(ctx, "queue2"))
+	require.NoError(t, r.AddSubscriber(ctx, "runtime", "subscriber5", ""))
+	require.NoError(t, r.RemoveSubscriber(ctx, "runtime", "subscriber3"))
+	require.NoError(t, r.AddSubscriber(ctx, "queue1", "member1", "group1"))
+	require.NoError(t, r.AddSubscriber(ctx, "queue1", "member2", "group1"))
+	require.NoError(t, r.AckMessages(ctx, "queue1", "member2", []string{m2.ID}))
+
+	// queue recreated after delete starts from scratch
+	_, err = r.Create(ctx, config.QueueConfig{Name: "deleted", Length: 5, SubscribersAmount: 1})
+	require.NoError(t, err)
+	publish(t, r, "deleted", map[string]interface{}{"msg": "hello6"})
+	require.NoError(t, r.Delete(ctx, "deleted"))
+	_, err = r.Create(ctx, config.QueueConfig{Name: "deleted", Length: 5, SubscribersAmount: 1})
+	require.NoError(t, err)
+
+	_, err = r.CreateExchange(ctx, config.ExchangeConfig{Name: "events", Bindings: []config.BindingConfig{{Queue: "queue1", Pattern: "orders.#"}}})
+	require.NoError(t, err)
+	require.NoError(t, r.Bind(ctx, "events", models.Binding{Queue: "runtime", Pattern: "orders.*.created"}))
+	require.NoError(t, r.Bind(ctx, "events", models.Binding{Queue: "queue2", Pattern: "logs.#"}))
+	require.NoError(t, r.Unbind(ctx, "events", models.Binding{Queue: "queue1", Pattern: "orders.#"}))
+	_, err = r.CreateExchange(ctx, config.ExchangeConfig{Name: "dropped"})
+	require.NoError(t, err)
+	require.NoError(t, r.DeleteExchange(ctx, "dropped"))
+}
+
+func TestFileQueuesRepo_RecoversStateAfterRestart(t *testing.T) {
+	t.Parallel()
+
+	cfg := newTestConfig(t.TempDir())
+
+	r := openFileRepo(t, cfg)
+	populate(t, r)
+	expected := dumpState(t, r)
+	require.NoError(t, r.Close())
+
+	restored := openFileRepo(t, cfg)
+	defer restored.Close()
+
+	assert.JSONEq(t, expected, dumpState(t, restored))
+
+	q, err := restored.GetByName(context.Background(), "queue1")
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(q.Messages))
+	assert.Equal(t, uint64(3), q.LastSeq)
+
+	// sequence numbers continue after restart
+	m := publish(t, restored, "queue1", map[string]interface{}{"msg": "hello5"})
+	assert.Equal(t, uint64(4), m.Seq)
+
+	q, err = restored.GetByName(context.Background(), "runtime")
+	require.NoError(t, err)
+	assert.Equal(t, uint(7), q.MaxLength)
+	assert.Equal(t, 20*time.Second, q.VisibilityTimeout)
+	assert.Equal(t, 0, len(q.Messages))
+	duplicate, ok := q.FindDuplicate("key1", time.Now())
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), duplicate.Seq)
+
+	q, err = restored.GetByName(context.Background(), "queue2")
+	require.NoError(t, err)
+	assert.True(t, q.Draining)
+	assert.Equal(t, uint64(1), q.Stats.Expired)
+	assert.Equal(t, 1, len(q.Messages))
+
+	q, err = restored.GetByName(context.Background(), "deleted")
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(q.Messages))
+	assert.Equal(t, uint64(0), q.LastSeq)
+
+	e, err := restored.GetExchange(context.Background(), "events")
+	require.NoError(t, err)
+	assert.Equal(t, []models.Binding{{Queue: "runtime", Pattern: "orders.*.created"}, {Queue: "queue2", Pattern: "logs.#"}}, e.Bindings)
+
+	_, err = restored.GetExchange(context.Background(), "dropped")
+	assert.NotNil(t, err)
+}
+
+func TestFileQueuesRepo_RecoversFromSnapshot(t *testing.T) {
+	t.Parallel()
+
+	cfg := newTestConfig(t.TempDir())
+	cfg.Storage.SnapshotEvery = 1000
+
+	r := openFileRepo(t, cfg)
+	populate(t, r)
+	require.NoError(t, r.(*fileQueuesRepo).snapshot(context.Background()))
+
+	// changes after snapshot are only in the new segment
+	publish(t, r, "queue2", map[string]interface{}{"msg": "after snapshot"})
+	require.NoError(t, r.AddSubscriber(context.Background(), "queue2", "subscriber4", ""))
+	require.NoError(t, r.Bind(context.Background(), "events", models.Binding{Queue: "queue1", Pattern: "#"}))
+
+	expected := dumpState(t, r)
+	require.NoError(t, r.Close())
+
+	segments, err := r.(*fileQueuesRepo).listSegments()
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1}, segments)
+
+	restored := openFileRepo(t, cfg)
+	defer restored.Close()
+
+	assert.JSONEq(t, expected, dumpState(t, restored))
+}
+
+func TestFileQueuesRepo_IgnoresTornRecord(t *testing.T) {
+	t.Parallel()
+
+	cfg := newTestConfig(t.TempDir())
+
+	r := openFileRepo(t, cfg)
+	populate(t, r)
+	expected := dumpState(t, r)
+	require.NoError(t, r.Close())
+
+	// process was killed in the middle of writing a record
+	f, err := os.OpenFile(filepath.Join(cfg.Storage.Dir, "wal-00000000000000000000.log"), os.O_APPEND|os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"type":"publish","queue":"queue1","mess`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	restored := openFileRepo(t, cfg)
+	assert.JSONEq(t, expected, dumpState(t, restored))
+
+	publish(t, restored, "queue2", map[string]interface{}{"msg": "after restart"})
+	expected = dumpState(t, restored)
+	require.NoError(t, restored.Close())
+
+	restoredAgain := openFileRepo(t, cfg)
+	defer restoredAgain.Close()
+
+	assert.JSONEq(t, expected, dumpState(t, restoredAgain))
+}
+
+func TestFileQueuesRepo_ReadsLegacyJSONBody(t *testing.T) {
+	t.Parallel()
+
+	cfg := newTestConfig(t.TempDir())
+
+	// message persisted before payloads were kept as bytes
+	segment := `{"type":"create","queue":"queue1","queue_config":{"Name":"queue1","Length":10,"SubscribersAmount":2}}` + "\n" +
+		`{"type":"publish","queue":"queue1","message":{"ID":"legacy","Seq":1,"Body":{"msg":"hello"},"PublishedAt":"2024-01-01T00:00:00Z"}}` + "\n"
+	require.NoError(t, os.WriteFile(filepath.Join(cfg.Storage.Dir, "wal-00000000000000000000.log"), []byte(segment), 0o644))
+
+	r := openFileRepo(t, cfg)
+	defer r.Close()
+
+	q, err := r.GetByName(context.Background(), "queue1")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(q.Messages))
+	assert.JSONEq(t, `{"msg":"hello"}`, string(q.Messages[0].Payload))
+	assert.Equal(t, models.ContentTypeJSON, q.Messages[0].Attributes.ContentType)
+}
+
+func TestFileQueuesRepo_RecoversMessageAddedToSeveralQueues(t *testing.T) {
+	t.Parallel()
+
+	cfg := newTestConfig(t.TempDir())
+	ctx := context.Background()
+
+	r := openFileRepo(t, cfg)
+	_, err := r.Create(ctx, config.QueueConfig{Name: "runtime", Length: 5, SubscribersAmount: 1})
+	require.NoError(t, err)
+
+	newMessages := func(names ...string) map[string]*models.QueueMessage {
+		messages := map[string]*models.QueueMessage{}
+		for _, name := range names {
+			q, err := r.GetByName(ctx, name)
+			require.NoError(t, err)
+			messages[name] = q.NewMessage([]byte(name))
+		}
+		return messages
+	}
+
+	require.NoError(t, r.AddMessages(ctx, newMessages("queue1", "queue2", "runtime")))
+
+	// message is added to none of the queues if one of them doesn't exist
+	messages := newMessages("queue1", "queue2")
+	messages["unknown"] = messages["queue1"]
+	assert.NotNil(t, r.AddMessages(ctx, messages))
+
+	// queue deleted after the message has been added to it is skipped on restore
+	require.NoError(t, r.Delete(ctx, "runtime"))
+	expected := dumpState(t, r)
+	require.NoError(t, r.Close())
+
+	restored := openFileRepo(t, cfg)
+	defer restored.Close()
+
+	assert.JSONEq(t, expected, dumpState(t, restored))
+	for _, name := range []string{"queue1", "queue2"} {
+		q, err := restored.GetByName(ctx, name)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(q.Messages), name)
+		assert.Equal(t, []byte(name), q.Messages[0].Payload)
+	}
+}
@@ -3,24 +3,63 @@ package repository
 import (
 	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/VladSatyshev/concurrent-queue/config"
 	"github.com/VladSatyshev/concurrent-queue/internal/models"
 	"github.com/VladSatyshev/concurrent-queue/internal/queues"
 )
 
+const (
+	defaultVisibilityTimeout   = 30 * time.Second
+	defaultDeduplicationWindow = 5 * time.Minute
+)
+
 type queuesRepo struct {
-	queues map[string]models.Queue
+	mu        sync.RWMutex
+	queues    map[string]*models.Queue
+	exchanges map[string]*models.Exchange
 }
 
 func NewQueuesRepository(cfg *config.Config) queues.Repository {
-	resQueues := make(map[string]models.Queue, len(cfg.Queues))
-	return &queuesRepo{queues: resQueues}
+	return newQueuesRepo(cfg)
+}
+
+func newQueuesRepo(cfg *config.Config) *queuesRepo {
+	resQueues := make(map[string]*models.Queue, len(cfg.Queues))
+	resExchanges := make(map[string]*models.Exchange, len(cfg.Exchanges))
+	return &queuesRepo{queues: resQueues, exchanges: resExchanges}
+}
+
+// recoverer is implemented by repositories which keep state between restarts
+type recoverer interface {
+	Recover(ctx context.Context) error
 }
 
+// InitQueues restores persisted state of the repository and creates queues
+// and exchanges from config which don't exist yet
 func InitQueues(ctx context.Context, cfg *config.Config, r queues.Repository) error {
+	if rec, ok := r.(recoverer); ok {
+		if err := rec.Recover(ctx); err != nil {
+			return err
+		}
+	}
+
 	for _, queue := range cfg.Queues {
-		if _, err := r.Create(ctx, queue.Name, queue.Length, queue.SubscribersAmount); err != nil {
+		if _, err := r.GetByName(ctx, queue.Name); err == nil {
+			continue
+		}
+		if _, err := r.Create(ctx, queue); err != nil {
+			return err
+		}
+	}
+
+	for _, exchange := range cfg.Exchanges {
+		if _, err := r.GetExchange(ctx, exchange.Name); err == nil {
+			continue
+		}
+		if _, err := r.CreateExchange(ctx, exchange); err != nil {
 			return err
 		}
 	}
@@ -28,35 +67,121 @@ func InitQueues(ctx context.Context, cfg *config.Config, r queues.Repository) er
 	return nil
 }
 
-func (r *queuesRepo) Create(ctx context.Context, name string, maxLength uint, maxSubscribers uint) (models.Queue, error) {
-	if _, ok := r.queues[name]; ok {
-		return models.Queue{}, queues.NewQueueErr(queues.RepositoryErr, fmt.Sprintf("queue with name %v already exists", name))
+// healthChecker is implemented by repositories which depend on resources
+// that may fail while the server is running
+type healthChecker interface {
+	Check(ctx context.Context) error
+}
+
+// CheckHealth reports whether repository is able to serve requests, the ones
+// which keep everything in memory always are
+func CheckHealth(ctx context.Context, r queues.Repository) error {
+	if checker, ok := r.(healthChecker); ok {
+		return checker.Check(ctx)
+	}
+	return nil
+}
+
+func (r *queuesRepo) Create(ctx context.Context, queueCfg config.QueueConfig) (*models.Queue, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.queues[queueCfg.Name]; ok {
+		return nil, queues.NewQueueErr(queues.RepositoryConflictErr, fmt.Sprintf("queue with name %v already exists", queueCfg.Name))
 	}
 
-	newQueue := models.Queue{
-		Name:           name,
-		MaxLength:      maxLength,
-		MaxSubscribers: maxSubscribers,
-		Subscribers:    make(map[string]struct{}, maxSubscribers),
-		Messages:       make(map[string]models.QueueMessage, maxLength),
+	newQueue := &models.Queue{
+		Name:          queueCfg.Name,
+		Subscribers:   make(map[string]struct{}, queueCfg.SubscribersAmount),
+		Messages:      make([]*models.QueueMessage, 0, queueCfg.Length),
+		Deduplication: map[string]models.DeduplicationEntry{},
 	}
+	setLimits(newQueue, queueCfg)
 
-	r.queues[name] = newQueue
+	r.queues[queueCfg.Name] = newQueue
 
 	return newQueue, nil
 }
 
-func (r *queuesRepo) GetByName(ctx context.Context, name string) (models.Queue, error) {
+// setLimits applies limits from config to queue. Messages and subscribers above
+// the new limits are kept, but new ones are not accepted until the queue gets below them
+func setLimits(q *models.Queue, queueCfg config.QueueConfig) {
+	q.MaxLength = queueCfg.Length
+	q.MaxSubscribers = queueCfg.SubscribersAmount
+	q.VisibilityTimeout = queueCfg.VisibilityTimeoutSec * time.Second
+	if q.VisibilityTimeout <= 0 {
+		q.VisibilityTimeout = defaultVisibilityTimeout
+	}
+	q.SubscriberIdleTimeout = queueCfg.SubscriberIdleTimeoutSec * time.Second
+	q.MessageTTL = queueCfg.MessageTTLSec * time.Second
+	q.DeadLetterQueue = queueCfg.DeadLetterQueue
+	q.MaxDeliveries = queueCfg.MaxDeliveries
+	q.PriorityLevels = queueCfg.PriorityLevels
+	q.PriorityAging = queueCfg.PriorityAgingSec * time.Second
+	q.DeliveryMode = queueCfg.DeliveryMode
+	if q.DeliveryMode == "" {
+		q.DeliveryMode = models.DeliveryFanout
+	}
+	q.DeduplicationWindow = queueCfg.DeduplicationWindowSec * time.Second
+	if q.DeduplicationWindow <= 0 {
+		q.DeduplicationWindow = defaultDeduplicationWindow
+	}
+}
+
+func (r *queuesRepo) Update(ctx context.Context, queueCfg config.QueueConfig) error {
+	q, err := r.GetByName(ctx, queueCfg.Name)
+	if err != nil {
+		return err
+	}
+
+	setLimits(q, queueCfg)
+
+	return nil
+}
+
+func (r *queuesRepo) Drain(ctx context.Context, name string) error {
+	q, err := r.GetByName(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	q.Draining = true
+
+	return nil
+}
+
+func (r *queuesRepo) Delete(ctx context.Context, name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	q, ok := r.queues[name]
+	if !ok {
+		return queues.NewQueueErr(queues.RepositoryNotFoundErr, fmt.Sprintf("queue %s not found", name))
+	}
+
+	delete(r.queues, name)
+	q.MarkDeleted()
+
+	return nil
+}
+
+func (r *queuesRepo) GetByName(ctx context.Context, name string) (*models.Queue, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
 	queue, ok := r.queues[name]
 	if !ok {
-		return models.Queue{}, queues.NewQueueErr(queues.RepositoryNotFoundErr, fmt.Sprintf("queue %s not found", queue.Name))
+		return nil, queues.NewQueueErr(queues.RepositoryNotFoundErr, fmt.Sprintf("queue %s not found", name))
 	}
 
 	return queue, nil
 }
 
-func (r *queuesRepo) GetAll(ctx context.Context) []models.Queue {
-	res := make([]models.Queue, 0, len(r.queues))
+func (r *queuesRepo) GetAll(ctx context.Context) []*models.Queue {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	res := make([]*models.Queue, 0, len(r.queues))
 
 	for _, queue := range r.queues {
 		res = append(res, queue)
@@ -65,24 +190,231 @@ func (r *queuesRepo) GetAll(ctx context.Context) []models.Queue {
 	return res
 }
 
-func (r *queuesRepo) AddMessage(ctx context.Context, name string, jsonMsgBody map[string]interface{}) error {
-	q, ok := r.queues[name]
-	if !ok {
-		return queues.NewQueueErr(queues.RepositoryNotFoundErr, fmt.Sprintf("queue %s not found", name))
+func (r *queuesRepo) AddMessage(ctx context.Context, name string, message *models.QueueMessage) error {
+	q, err := r.GetByName(ctx, name)
+	if err != nil {
+		return err
 	}
 
-	q.AddMessage(jsonMsgBody)
+	q.AddMessage(message)
 
 	return nil
 }
 
-func (r *queuesRepo) AddSubscriber(ctx context.Context, queueName string, subscriberName string) error {
-	q, ok := r.queues[queueName]
+func (r *queuesRepo) AddMessages(ctx context.Context, messages map[string]*models.QueueMessage) error {
+	targets := make(map[*models.Queue]*models.QueueMessage, len(messages))
+	for name, message := range messages {
+		q, err := r.GetByName(ctx, name)
+		if err != nil {
+			return err
+		}
+		targets[q] = message
+	}
+
+	for q, message := range targets {
+		q.AddMessage(message)
+	}
+
+	return nil
+}
+
+func (r *queuesRepo) AddSubscriber(ctx context.Context, queueName string, subscriberName string, groupName string) error {
+	q, err := r.GetByName(ctx, queueName)
+	if err != nil {
+		return err
+	}
+
+	q.AddSubscriber(subscriberName, groupName)
+
+	return nil
+}
+
+func (r *queuesRepo) RemoveSubscriber(ctx context.Context, queueName string, subscriberName string) error {
+	q, err := r.GetByName(ctx, queueName)
+	if err != nil {
+		return err
+	}
+
+	q.RemoveSubscriber(subscriberName)
+
+	return nil
+}
+
+func (r *queuesRepo) LeaseMessages(ctx context.Context, queueName string, subscriberName string, messageIDs []string, leasedUntil time.Time) error {
+	q, err := r.GetByName(ctx, queueName)
+	if err != nil {
+		return err
+	}
+
+	q.LeaseMessages(subscriberName, messageIDs, leasedUntil)
+
+	return nil
+}
+
+func (r *queuesRepo) ReleaseMessages(ctx context.Context, queueName string, subscriberName string, messageIDs []string) error {
+	q, err := r.GetByName(ctx, queueName)
+	if err != nil {
+		return err
+	}
+
+	q.ReleaseMessages(subscriberName, messageIDs)
+
+	return nil
+}
+
+func (r *queuesRepo) AckMessages(ctx context.Context, queueName string, subscriberName string, messageIDs []string) error {
+	q, err := r.GetByName(ctx, queueName)
+	if err != nil {
+		return err
+	}
+
+	q.SetMessagesSeenBy(subscriberName, messageIDs)
+
+	return nil
+}
+
+func (r *queuesRepo) ExpireMessages(ctx context.Context, queueName string, messageIDs []string) error {
+	q, err := r.GetByName(ctx, queueName)
+	if err != nil {
+		return err
+	}
+
+	q.ExpireMessages(messageIDs)
+
+	return nil
+}
+
+func (r *queuesRepo) DeleteMessages(ctx context.Context, queueName string, messageIDs []string) error {
+	q, err := r.GetByName(ctx, queueName)
+	if err != nil {
+		return err
+	}
+
+	q.DeleteMessages(messageIDs)
+
+	return nil
+}
+
+func (r *queuesRepo) CreateExchange(ctx context.Context, exchangeCfg config.ExchangeConfig) (*models.Exchange, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.exchanges[exchangeCfg.Name]; ok {
+		return nil, queues.NewQueueErr(queues.RepositoryConflictErr, fmt.Sprintf("exchange with name %v already exists", exchangeCfg.Name))
+	}
+
+	newExchange := &models.Exchange{
+		Name:     exchangeCfg.Name,
+		Bindings: make([]models.Binding, 0, len(exchangeCfg.Bindings)),
+	}
+	for _, binding := range exchangeCfg.Bindings {
+		newExchange.Bind(models.Binding{Queue: binding.Queue, Pattern: binding.Pattern})
+	}
+
+	r.exchanges[exchangeCfg.Name] = newExchange
+
+	return newExchange.Copy(), nil
+}
+
+func (r *queuesRepo) DeleteExchange(ctx context.Context, name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.exchanges[name]; !ok {
+		return queues.NewQueueErr(queues.RepositoryNotFoundErr, fmt.Sprintf("exchange %s not found", name))
+	}
+
+	delete(r.exchanges, name)
+
+	return nil
+}
+
+func (r *queuesRepo) GetExchange(ctx context.Context, name string) (*models.Exchange, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	exchange, ok := r.exchanges[name]
 	if !ok {
-		return queues.NewQueueErr(queues.RepositoryNotFoundErr, fmt.Sprintf("queue %s not found", queueName))
+		return nil, queues.NewQueueErr(queues.RepositoryNotFoundErr, fmt.Sprintf("exchange %s not found", name))
+	}
+
+	return exchange, nil
+}
+
+func (r *queuesRepo) GetExchanges(ctx context.Context) []*models.Exchange {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	res := make([]*models.Exchange, 0, len(r.exchanges))
+
+	for _, exchange := range r.exchanges {
+		res = append(res, exchange)
 	}
 
-	q.Subscribers[subscriberName] = struct{}{}
+	return res
+}
+
+func (r *queuesRepo) Bind(ctx context.Context, exchangeName string, binding models.Binding) error {
+	return r.updateExchange(exchangeName, func(e *models.Exchange) { e.Bind(binding) })
+}
+
+func (r *queuesRepo) Unbind(ctx context.Context, exchangeName string, binding models.Binding) error {
+	return r.updateExchange(exchangeName, func(e *models.Exchange) { e.Unbind(binding) })
+}
+
+// updateExchange replaces exchange with its updated copy, so exchanges handed
+// out earlier never change
+func (r *queuesRepo) updateExchange(name string, update func(e *models.Exchange)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
+	exchange, ok := r.exchanges[name]
+	if !ok {
+		return queues.NewQueueErr(queues.RepositoryNotFoundErr, fmt.Sprintf("exchange %s not found", name))
+	}
+
+	updated := exchange.Copy()
+	update(updated)
+	r.exchanges[name] = updated
+
+	return nil
+}
+
+func (r *queuesRepo) Close() error {
 	return nil
 }
+
+// restore puts queue loaded from persistent storage into the repository
+func (r *queuesRepo) restore(q *models.Queue) {
+	if q.Subscribers == nil {
+		q.Subscribers = map[string]struct{}{}
+	}
+	if q.Deduplication == nil {
+		q.Deduplication = map[string]models.DeduplicationEntry{}
+	}
+	for _, message := range q.Messages {
+		if message.SeenBy == nil {
+			message.SeenBy = map[string]struct{}{}
+		}
+		if message.Deliveries == nil {
+			message.Deliveries = map[string]*models.Delivery{}
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.queues[q.Name] = q
+}
+
+// restoreExchange puts exchange loaded from persistent storage into the repository
+func (r *queuesRepo) restoreExchange(e *models.Exchange) {
+	if e.Bindings == nil {
+		e.Bindings = []models.Binding{}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.exchanges[e.Name] = e
+}
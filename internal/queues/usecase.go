@@ -2,14 +2,61 @@ package queues
 
 import (
 	"context"
+	"time"
 
+	"github.com/VladSatyshev/concurrent-queue/config"
 	"github.com/VladSatyshev/concurrent-queue/internal/models"
 )
 
 type UseCase interface {
-	GetByName(ctx context.Context, queueName string) (models.Queue, error)
-	GetAll(ctx context.Context) []models.Queue
+	CreateQueue(ctx context.Context, queueCfg config.QueueConfig) (*models.Queue, error)
+	UpdateQueue(ctx context.Context, queueName string, limits models.QueueLimits) (*models.Queue, error)
+	PurgeQueue(ctx context.Context, queueName string) error
+	DeleteQueue(ctx context.Context, queueName string, drain bool) (bool, error)
+	GetByName(ctx context.Context, queueName string) (*models.Queue, error)
+	GetAll(ctx context.Context) []*models.Queue
 	AddMessage(ctx context.Context, queueName string, jsonBody map[string]interface{}) error
+	// PublishMessage publishes payload of content type set in options, JSON
+	// payload is validated
+	PublishMessage(ctx context.Context, queueName string, payload []byte, opts models.PublishOptions) (models.PublishedMessage, error)
 	AddSubscriber(ctx context.Context, queueName string, subscriberName string) error
-	ConsumeMessages(ctx context.Context, queueName string, subscriberName string) (map[string]interface{}, error)
+	AddGroupSubscriber(ctx context.Context, queueName string, subscriberName string, groupName string) error
+	GetGroups(ctx context.Context, queueName string) ([]models.ConsumerGroup, error)
+	RemoveSubscriber(ctx context.Context, queueName string, subscriberName string) error
+	// EvictIdleSubscribers is run periodically in background
+	EvictIdleSubscribers(ctx context.Context)
+	// ExpireMessages is run periodically in background
+	ExpireMessages(ctx context.Context)
+	ConsumeMessages(ctx context.Context, queueName string, subscriberName string, wait time.Duration) ([]models.ConsumedMessage, error)
+	// ConsumeMessage leases at most one message, returns nil if there are none
+	ConsumeMessage(ctx context.Context, queueName string, subscriberName string, wait time.Duration) (*models.ConsumedMessage, error)
+	AckMessage(ctx context.Context, queueName string, subscriberName string, messageID string) error
+	NackMessage(ctx context.Context, queueName string, subscriberName string, messageID string) error
+	RejectMessage(ctx context.Context, queueName string, subscriberName string, messageID string) error
+	RedriveMessages(ctx context.Context, queueName string, limit int) (int, error)
+	OpenStream(ctx context.Context, queueName string, subscriberName string, lastSeq *uint64) (Stream, error)
+
+	CreateExchange(ctx context.Context, exchangeCfg config.ExchangeConfig) (*models.Exchange, error)
+	DeleteExchange(ctx context.Context, exchangeName string) error
+	GetExchange(ctx context.Context, exchangeName string) (*models.Exchange, error)
+	GetExchanges(ctx context.Context) []*models.Exchange
+	BindQueue(ctx context.Context, exchangeName string, binding models.Binding) error
+	UnbindQueue(ctx context.Context, exchangeName string, binding models.Binding) error
+	// PublishToExchange publishes message to all queues bound to exchange by
+	// routing key, either to all of them or to none. Returns the message as
+	// published to every queue
+	PublishToExchange(ctx context.Context, exchangeName string, routingKey string, payload []byte, opts models.PublishOptions) ([]models.PublishedMessage, error)
+
+	// Shutdown makes publishes fail, returns waiting consumers what they have
+	// got so far and ends streams, releasing messages they haven't had
+	// acknowledged. Acknowledgements are still accepted
+	Shutdown()
+}
+
+// Stream continuously delivers messages of a queue to a subscriber
+type Stream interface {
+	// Next leases messages which haven't been sent by the stream yet or whose
+	// lease has expired. If there are none, waits up to wait for them to appear.
+	// Fails once usecase is shut down
+	Next(ctx context.Context, wait time.Duration) ([]models.ConsumedMessage, error)
 }
@@ -0,0 +1,282 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/VladSatyshev/concurrent-queue/internal/models"
+	"github.com/VladSatyshev/concurrent-queue/internal/queues"
+)
+
+// move copies of messages into dead-letter queue of queue. Returns true if
+// messages may be removed from queue: either they've been moved or queue has no
+// dead-letter queue. Expects queue lock to be held. Dead-letter queue is only
+// try-locked, so queues dead-lettering into each other never deadlock; if it's
+// busy, messages are moved on the next attempt
+func (u *queuesUC) deadLetter(ctx context.Context, queue *models.Queue, messages []*models.QueueMessage, subscriberName string, reason string) (bool, error) {
+	if queue.DeadLetterQueue == "" || len(messages) == 0 {
+		return true, nil
+	}
+
+	dlq, err := u.getByName(ctx, queue.DeadLetterQueue)
+	if err != nil {
+		u.logger.Errorf("dead-letter queue %s of queue %s is not available: %s", queue.DeadLetterQueue, queue.Name, err.Error())
+		return false, nil
+	}
+
+	if !dlq.TryLock() {
+		return false, nil
+	}
+	defer dlq.Unlock()
+
+	return u.moveToDeadLetterQueue(ctx, queue, dlq, messages, subscriberName, reason)
+}
+
+// move copies of messages into dlq, returns false if it can't accept them.
+// Expects locks of both queues to be held
+func (u *queuesUC) moveToDeadLetterQueue(ctx context.Context, queue *models.Queue, dlq *models.Queue, messages []*models.QueueMessage, subscriberName string, reason string) (bool, error) {
+	if dlq.IsDeleted() || dlq.Draining {
+		u.logger.Errorf("dead-letter queue %s of queue %s is being deleted", dlq.Name, queue.Name)
+		return false, nil
+	}
+	if dlq.GetLength(u.now())+len(messages) > int(dlq.MaxLength) {
+		u.logger.Errorf("dead-letter queue %s of queue %s is full", dlq.Name, queue.Name)
+		return false, nil
+	}
+
+	now := u.now()
+	for _, message := range messages {
+		deadLetter := u.newMessage(dlq, message.Payload, models.PublishOptions{Attributes: message.Attributes})
+		deadLetter.DeadLetter = &models.DeadLetter{
+			SourceQueue:         queue.Name,
+			Reason:              reason,
+			Subscriber:          subscriberName,
+			DeliveryCount:       queue.GetDeliveryCount(message, subscriberName),
+			OriginalID:          message.ID,
+			OriginalPublishedAt: message.PublishedAt,
+			DeadLetteredAt:      now,
+			Priority:            message.Priority,
+		}
+		// TTL of scheduled message starts when it's due
+		start := now
+		if message.DeliverAt.After(now) {
+			deadLetter.DeadLetter.RemainingDelay = message.DeliverAt.Sub(now)
+			start = message.DeliverAt
+		}
+		if message.ExpiresAt.After(start) {
+			deadLetter.DeadLetter.RemainingTTL = message.ExpiresAt.Sub(start)
+		}
+		if message.Deduplication != nil {
+			deadLetter.DeadLetter.DeduplicationID = message.Deduplication.ID
+		}
+
+		if err := u.queuesRepo.AddMessage(ctx, dlq.Name, deadLetter); err != nil {
+			return false, err
+		}
+
+		u.logger.Warnf("Message %s of queue %s has been dead-lettered into queue %s: %s", message.ID, queue.Name, dlq.Name, reason)
+	}
+	u.metrics.MessagesPublished(dlq.Name, len(messages))
+
+	return true, nil
+}
+
+// dead-letter messages which have been delivered to subscriber MaxDeliveries
+// times and returns the rest. Expects queue lock to be held
+func (u *queuesUC) deadLetterExhausted(ctx context.Context, queue *models.Queue, subscriberName string, messages []*models.QueueMessage) ([]*models.QueueMessage, error) {
+	if queue.MaxDeliveries == 0 {
+		return messages, nil
+	}
+
+	res := make([]*models.QueueMessage, 0, len(messages))
+	exhausted := []*models.QueueMessage{}
+	for _, message := range messages {
+		if queue.GetDeliveryCount(message, subscriberName) >= queue.MaxDeliveries {
+			exhausted = append(exhausted, message)
+		} else {
+			res = append(res, message)
+		}
+	}
+	if len(exhausted) == 0 {
+		return res, nil
+	}
+
+	// exhausted messages are never delivered again, even if they can't be moved yet
+	moved, err := u.deadLetter(ctx, queue, exhausted, subscriberName, models.DeadLetterMaxDeliveries)
+	if err != nil || !moved {
+		return res, err
+	}
+
+	messageIDs := make([]string, 0, len(exhausted))
+	for _, message := range exhausted {
+		messageIDs = append(messageIDs, message.ID)
+	}
+
+	if err := u.queuesRepo.AckMessages(ctx, queue.Name, subscriberName, messageIDs); err != nil {
+		return nil, err
+	}
+
+	return res, u.deleteSeenByAllMessages(ctx, queue)
+}
+
+// reject message delivered to subscriber, so it's moved to dead-letter queue
+// and never redelivered to subscriber
+func (u *queuesUC) RejectMessage(ctx context.Context, queueName string, subscriberName string, messageID string) error {
+	u.logger.Info("RejectMessage UC is in action")
+	queue, dlq, err := u.lockWithDeadLetterQueue(ctx, queueName)
+	if err != nil {
+		return err
+	}
+	defer queue.Unlock()
+	if dlq != nil {
+		defer dlq.Unlock()
+	}
+
+	if err := u.checkDelivered(queue, subscriberName, messageID); err != nil {
+		return err
+	}
+
+	// message is dropped when queue has no dead-letter queue
+	moved := queue.DeadLetterQueue == ""
+	if dlq != nil {
+		moved, err = u.moveToDeadLetterQueue(ctx, queue, dlq, queue.GetMessages([]string{messageID}), subscriberName, models.DeadLetterRejected)
+		if err != nil {
+			return err
+		}
+	}
+	if !moved {
+		return queues.NewQueueErr(queues.UseCaseConflictErr, fmt.Sprintf("dead-letter queue %s can't accept messages at the moment", queue.DeadLetterQueue))
+	}
+
+	if err := u.queuesRepo.AckMessages(ctx, queue.Name, subscriberName, []string{messageID}); err != nil {
+		return err
+	}
+
+	u.logger.Infof("Message %s has been rejected by subscriber %s in queue %s", messageID, subscriberName, queue.Name)
+
+	return u.deleteSeenByAllMessages(ctx, queue)
+}
+
+// get queue and its dead-letter queue and lock both of them in the order of
+// their names, as redrive does, so they never deadlock. Dead-letter queue is
+// nil if queue has none or it doesn't exist, caller must unlock the queues
+func (u *queuesUC) lockWithDeadLetterQueue(ctx context.Context, name string) (*models.Queue, *models.Queue, error) {
+	for {
+		queue, err := u.getByName(ctx, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		queue.RLock()
+		dlqName := queue.DeadLetterQueue
+		queue.RUnlock()
+
+		var dlq *models.Queue
+		if dlqName != "" && dlqName != queue.Name {
+			if dlq, err = u.getByName(ctx, dlqName); err != nil {
+				u.logger.Errorf("dead-letter queue %s of queue %s is not available: %s", dlqName, queue.Name, err.Error())
+				dlq = nil
+			}
+		}
+
+		locked := []*models.Queue{queue}
+		if dlq != nil {
+			locked = append(locked, dlq)
+			sort.Slice(locked, func(i, j int) bool { return locked[i].Name < locked[j].Name })
+		}
+		for _, q := range locked {
+			q.Lock()
+		}
+		unlock := func() {
+			for _, q := range locked {
+				q.Unlock()
+			}
+		}
+
+		if err := u.checkNotDeleted(queue); err != nil {
+			unlock()
+			return nil, nil, err
+		}
+		// dead-letter queue has been changed meanwhile
+		if queue.DeadLetterQueue != dlqName {
+			unlock()
+			continue
+		}
+
+		return queue, dlq, nil
+	}
+}
+
+// move up to limit dead-lettered messages back to their source queues, 0 means
+// no limit. Messages whose source queue is gone or full are left in place.
+// Returns the number of moved messages
+func (u *queuesUC) RedriveMessages(ctx context.Context, queueName string, limit int) (int, error) {
+	u.logger.Info("RedriveMessages UC is in action")
+	dlq, err := u.getByName(ctx, queueName)
+	if err != nil {
+		return 0, err
+	}
+
+	dlq.RLock()
+	sourceNames := map[string]struct{}{}
+	for _, message := range dlq.Messages {
+		if message.DeadLetter != nil && message.DeadLetter.SourceQueue != dlq.Name {
+			sourceNames[message.DeadLetter.SourceQueue] = struct{}{}
+		}
+	}
+	dlq.RUnlock()
+
+	// several queues are locked in the order of their names, so concurrent
+	// redrives never deadlock
+	locked := map[string]*models.Queue{dlq.Name: dlq}
+	for name := range sourceNames {
+		if source, err := u.getByName(ctx, name); err == nil {
+			locked[name] = source
+		}
+	}
+	names := make([]string, 0, len(locked))
+	for name := range locked {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		locked[name].Lock()
+		defer locked[name].Unlock()
+	}
+
+	if err := u.checkNotDeleted(dlq); err != nil {
+		return 0, err
+	}
+
+	redriven := []string{}
+	for _, message := range dlq.Messages {
+		if limit > 0 && len(redriven) >= limit {
+			break
+		}
+		if message.DeadLetter == nil {
+			continue
+		}
+
+		source, ok := locked[message.DeadLetter.SourceQueue]
+		if !ok || source == dlq || source.IsDeleted() || source.Draining || source.GetLength(u.now()) >= int(source.MaxLength) {
+			continue
+		}
+
+		opts := message.DeadLetter.RedriveOptions(message.Attributes, source.PriorityLevels)
+		if err := u.queuesRepo.AddMessage(ctx, source.Name, u.newMessage(source, message.Payload, opts)); err != nil {
+			return len(redriven), err
+		}
+		u.metrics.MessagesPublished(source.Name, 1)
+		redriven = append(redriven, message.ID)
+	}
+
+	if len(redriven) > 0 {
+		if err := u.queuesRepo.DeleteMessages(ctx, dlq.Name, redriven); err != nil {
+			return 0, err
+		}
+	}
+
+	u.logger.Infof("%d messages have been redriven from queue %s", len(redriven), dlq.Name)
+
+	return len(redriven), u.deleteIfDrained(ctx, dlq)
+}
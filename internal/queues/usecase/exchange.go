@@ -0,0 +1,231 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/VladSatyshev/concurrent-queue/config"
+	"github.com/VladSatyshev/concurrent-queue/internal/models"
+	"github.com/VladSatyshev/concurrent-queue/internal/queues"
+)
+
+func (u *queuesUC) getExchange(ctx context.Context, name string) (*models.Exchange, error) {
+	exchange, err := u.queuesRepo.GetExchange(ctx, name)
+	if err != nil {
+		if qErr, ok := err.(*queues.QueueErr); ok {
+			if qErr.ErrType == queues.RepositoryNotFoundErr {
+				u.logger.Errorf("exchange %s was not found", name)
+				return nil, queues.NewQueueErr(queues.UseCaseNotFoundErr, "Exchange not found")
+			}
+		}
+		return nil, err
+	}
+	return exchange, nil
+}
+
+// binding pattern consists of non-empty dot-separated words
+func (u *queuesUC) validateBinding(ctx context.Context, binding models.Binding) error {
+	if binding.Queue == "" {
+		return queues.NewQueueErr(queues.UseCaseErr, "queue of binding must not be empty")
+	}
+	for _, word := range strings.Split(binding.Pattern, ".") {
+		if word == "" {
+			return queues.NewQueueErr(queues.UseCaseErr, fmt.Sprintf("binding pattern %q has empty words", binding.Pattern))
+		}
+	}
+
+	_, err := u.getByName(ctx, binding.Queue)
+	return err
+}
+
+func (u *queuesUC) CreateExchange(ctx context.Context, exchangeCfg config.ExchangeConfig) (*models.Exchange, error) {
+	u.logger.Info("CreateExchange UC is in action")
+	if exchangeCfg.Name == "" {
+		return nil, queues.NewQueueErr(queues.UseCaseErr, "exchange name must not be empty")
+	}
+	for _, binding := range exchangeCfg.Bindings {
+		if err := u.validateBinding(ctx, models.Binding{Queue: binding.Queue, Pattern: binding.Pattern}); err != nil {
+			return nil, err
+		}
+	}
+
+	exchange, err := u.queuesRepo.CreateExchange(ctx, exchangeCfg)
+	if err != nil {
+		if qErr, ok := err.(*queues.QueueErr); ok {
+			if qErr.ErrType == queues.RepositoryConflictErr {
+				u.logger.Errorf("exchange %s already exists", exchangeCfg.Name)
+				return nil, queues.NewQueueErr(queues.UseCaseConflictErr, fmt.Sprintf("exchange %s already exists", exchangeCfg.Name))
+			}
+		}
+		return nil, err
+	}
+
+	u.logger.Infof("Exchange %s has been created", exchange.Name)
+
+	return exchange, nil
+}
+
+func (u *queuesUC) DeleteExchange(ctx context.Context, name string) error {
+	u.logger.Info("DeleteExchange UC is in action")
+	if _, err := u.getExchange(ctx, name); err != nil {
+		return err
+	}
+
+	if err := u.queuesRepo.DeleteExchange(ctx, name); err != nil {
+		return err
+	}
+
+	u.logger.Infof("Exchange %s has been deleted", name)
+
+	return nil
+}
+
+func (u *queuesUC) GetExchange(ctx context.Context, name string) (*models.Exchange, error) {
+	u.logger.Info("GetExchange UC is in action")
+	return u.getExchange(ctx, name)
+}
+
+func (u *queuesUC) GetExchanges(ctx context.Context) []*models.Exchange {
+	u.logger.Info("GetExchanges UC is in action")
+	exchanges := u.queuesRepo.GetExchanges(ctx)
+	sort.Slice(exchanges, func(i, j int) bool { return exchanges[i].Name < exchanges[j].Name })
+	return exchanges
+}
+
+func (u *queuesUC) BindQueue(ctx context.Context, exchangeName string, binding models.Binding) error {
+	u.logger.Info("BindQueue UC is in action")
+	if _, err := u.getExchange(ctx, exchangeName); err != nil {
+		return err
+	}
+	if err := u.validateBinding(ctx, binding); err != nil {
+		return err
+	}
+
+	if err := u.queuesRepo.Bind(ctx, exchangeName, binding); err != nil {
+		return err
+	}
+
+	u.logger.Infof("Queue %s has been bound to exchange %s by %s", binding.Queue, exchangeName, binding.Pattern)
+
+	return nil
+}
+
+func (u *queuesUC) UnbindQueue(ctx context.Context, exchangeName string, binding models.Binding) error {
+	u.logger.Info("UnbindQueue UC is in action")
+	exchange, err := u.getExchange(ctx, exchangeName)
+	if err != nil {
+		return err
+	}
+	if !exchange.HasBinding(binding) {
+		return queues.NewQueueErr(queues.UseCaseNotFoundErr, fmt.Sprintf("exchange %s doesn't bind queue %s by %s", exchangeName, binding.Queue, binding.Pattern))
+	}
+
+	if err := u.queuesRepo.Unbind(ctx, exchangeName, binding); err != nil {
+		return err
+	}
+
+	u.logger.Infof("Queue %s has been unbound from exchange %s by %s", binding.Queue, exchangeName, binding.Pattern)
+
+	return nil
+}
+
+func (u *queuesUC) PublishToExchange(ctx context.Context, exchangeName string, routingKey string, payload []byte, opts models.PublishOptions) ([]models.PublishedMessage, error) {
+	u.logger.Info("PublishToExchange UC is in action")
+	if err := u.checkNotStopping(); err != nil {
+		return nil, err
+	}
+	if err := validateMessage(payload, opts); err != nil {
+		return nil, err
+	}
+
+	exchange, err := u.getExchange(ctx, exchangeName)
+	if err != nil {
+		return nil, err
+	}
+
+	// expired messages are dead-lettered before queues are locked all together:
+	// dead-letter queue of one of them may be another one, which couldn't be
+	// locked to move messages into it
+	names := exchange.Route(routingKey)
+	for _, name := range names {
+		queue, err := u.lockQueue(ctx, name)
+		if err != nil {
+			continue
+		}
+		err = u.expireMessages(ctx, queue)
+		queue.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// queues are locked in the order of their names, so concurrent publishes
+	// never deadlock. Bound queues which have been deleted are skipped
+	targets := make([]*models.Queue, 0, len(names))
+	for _, name := range names {
+		queue, err := u.queuesRepo.GetByName(ctx, name)
+		if err != nil {
+			u.logger.Warnf("queue %s bound to exchange %s is not available: %s", name, exchange.Name, err.Error())
+			continue
+		}
+
+		queue.Lock()
+		defer queue.Unlock()
+
+		if queue.IsDeleted() {
+			continue
+		}
+		targets = append(targets, queue)
+	}
+
+	// queues which already have the message by its deduplication ID get
+	// the original one, every other queue is checked before the message is
+	// added to any of them
+	duplicates := make(map[string]models.PublishedMessage, len(targets))
+	for _, queue := range targets {
+		if duplicate, ok := u.findDuplicate(queue, opts); ok {
+			duplicates[queue.Name] = duplicate
+			continue
+		}
+		if err := u.checkNotDraining(queue); err != nil {
+			return nil, err
+		}
+		if opts.Priority > 0 && opts.Priority >= queue.PriorityLevels {
+			return nil, queues.NewQueueErr(queues.UseCaseErr, fmt.Sprintf("priority of message must be below %d for queue %s", queue.PriorityLevels, queue.Name))
+		}
+		if queue.GetLength(u.now()) >= int(queue.MaxLength) {
+			u.metrics.PublishRejected(queue.Name)
+			msg := "too many messages: max amount of messages for queue %v is %v"
+			u.logger.Errorf(msg, queue.Name, queue.MaxLength)
+			return nil, queues.NewQueueErr(queues.UseCaseErr, fmt.Sprintf(msg, queue.Name, queue.MaxLength))
+		}
+	}
+
+	// message is added to all queues at once, so failed publish can be retried
+	// without duplicating it in some of them
+	res := make([]models.PublishedMessage, 0, len(targets))
+	messages := make(map[string]*models.QueueMessage, len(targets))
+	for _, queue := range targets {
+		if duplicate, ok := duplicates[queue.Name]; ok {
+			res = append(res, duplicate)
+			continue
+		}
+		message := u.newMessage(queue, payload, opts)
+		messages[queue.Name] = message
+		res = append(res, message.Published(queue.Name))
+	}
+	if len(messages) > 0 {
+		if err := u.queuesRepo.AddMessages(ctx, messages); err != nil {
+			return nil, err
+		}
+	}
+	for name := range messages {
+		u.metrics.MessagesPublished(name, 1)
+	}
+
+	u.logger.Infof("Message of %d bytes with routing key %s has been published to exchange %s: %d queues", len(payload), routingKey, exchange.Name, len(res))
+
+	return res, nil
+}
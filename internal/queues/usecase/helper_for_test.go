@@ -2,13 +2,16 @@ package usecase
 
 import (
 	"context"
-	"fmt"
+	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/VladSatyshev/concurrent-queue/config"
+	"github.com/VladSatyshev/concurrent-queue/internal/metrics"
 	"github.com/VladSatyshev/concurrent-queue/internal/models"
 	"github.com/VladSatyshev/concurrent-queue/internal/queues"
 	"github.com/VladSatyshev/concurrent-queue/internal/queues/mock"
+	"github.com/VladSatyshev/concurrent-queue/internal/queues/repository"
 	"github.com/VladSatyshev/concurrent-queue/pkg/logger"
 	"github.com/golang/mock/gomock"
 )
@@ -24,77 +27,75 @@ func configureEnvironment(t *testing.T, queuesCfg []config.QueueConfig) (queues.
 	apiLogger.InitLogger()
 	mockQueueRepo := mock.NewMockRepository(ctrl)
 
-	mockQueuesStorage := make(map[string]models.Queue)
-
-	mockQueueRepo.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(func(ctx context.Context, name string, maxLength uint, maxSubscribers uint) (models.Queue, error) {
-		if _, ok := mockQueuesStorage[name]; ok {
-			return models.Queue{}, queues.NewQueueErr(queues.RepositoryErr, fmt.Sprintf("queue with name %v already exists in mockQueuesStorage", name))
-		}
-
-		newQueue := models.Queue{
-			Name:           name,
-			MaxLength:      maxLength,
-			MaxSubscribers: maxSubscribers,
-			Subscribers:    make(map[string]struct{}, maxSubscribers),
-			Messages:       make(map[string]models.QueueMessage, maxLength),
-		}
-
-		mockQueuesStorage[name] = newQueue
-		return newQueue, nil
-	})
-
-	mockQueueRepo.EXPECT().GetByName(gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(func(ctx context.Context, name string) (models.Queue, error) {
-		queue, ok := mockQueuesStorage[name]
-		if !ok {
-			return models.Queue{}, queues.NewQueueErr(queues.RepositoryNotFoundErr, fmt.Sprintf("queue %s not found", queue.Name))
-		}
-
-		return queue, nil
-	})
-
-	mockQueueRepo.EXPECT().GetAll(gomock.Any()).AnyTimes().DoAndReturn(func(ctx context.Context) []models.Queue {
-		res := make([]models.Queue, 0, len(mockQueuesStorage))
-
-		for _, queue := range mockQueuesStorage {
-			res = append(res, queue)
-		}
-
-		return res
-	})
-
-	mockQueueRepo.EXPECT().AddMessage(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(func(ctx context.Context, name string, jsonBody map[string]interface{}) error {
-		q, ok := mockQueuesStorage[name]
-		if !ok {
-			return queues.NewQueueErr(queues.RepositoryNotFoundErr, fmt.Sprintf("queue %s not found", name))
-		}
-
-		q.AddMessage(jsonBody)
-
-		return nil
-	})
+	// mock repository delegates to the in-memory one, so the usecase is tested
+	// against the same locking contract as in production
+	queuesStorage := repository.NewQueuesRepository(cfg)
+
+	mockQueueRepo.EXPECT().Create(gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(queuesStorage.Create)
+	mockQueueRepo.EXPECT().Update(gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(queuesStorage.Update)
+	mockQueueRepo.EXPECT().Drain(gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(queuesStorage.Drain)
+	mockQueueRepo.EXPECT().Delete(gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(queuesStorage.Delete)
+	mockQueueRepo.EXPECT().GetByName(gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(queuesStorage.GetByName)
+	mockQueueRepo.EXPECT().GetAll(gomock.Any()).AnyTimes().DoAndReturn(queuesStorage.GetAll)
+	mockQueueRepo.EXPECT().AddMessage(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(queuesStorage.AddMessage)
+	mockQueueRepo.EXPECT().AddMessages(gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(queuesStorage.AddMessages)
+	mockQueueRepo.EXPECT().AddSubscriber(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(queuesStorage.AddSubscriber)
+	mockQueueRepo.EXPECT().RemoveSubscriber(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(queuesStorage.RemoveSubscriber)
+	mockQueueRepo.EXPECT().LeaseMessages(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(queuesStorage.LeaseMessages)
+	mockQueueRepo.EXPECT().ReleaseMessages(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(queuesStorage.ReleaseMessages)
+	mockQueueRepo.EXPECT().AckMessages(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(queuesStorage.AckMessages)
+	mockQueueRepo.EXPECT().DeleteMessages(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(queuesStorage.DeleteMessages)
+	mockQueueRepo.EXPECT().ExpireMessages(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(queuesStorage.ExpireMessages)
+	mockQueueRepo.EXPECT().CreateExchange(gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(queuesStorage.CreateExchange)
+	mockQueueRepo.EXPECT().DeleteExchange(gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(queuesStorage.DeleteExchange)
+	mockQueueRepo.EXPECT().GetExchange(gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(queuesStorage.GetExchange)
+	mockQueueRepo.EXPECT().GetExchanges(gomock.Any()).AnyTimes().DoAndReturn(queuesStorage.GetExchanges)
+	mockQueueRepo.EXPECT().Bind(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(queuesStorage.Bind)
+	mockQueueRepo.EXPECT().Unbind(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(queuesStorage.Unbind)
+	mockQueueRepo.EXPECT().Close().AnyTimes().DoAndReturn(queuesStorage.Close)
+
+	if err := repository.InitQueues(context.Background(), cfg, mockQueueRepo); err != nil {
+		panic(err)
+	}
 
-	mockQueueRepo.EXPECT().AddSubscriber(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(func(ctx context.Context, queueName string, subscriberName string) error {
-		q, ok := mockQueuesStorage[queueName]
-		if !ok {
-			return queues.NewQueueErr(queues.RepositoryNotFoundErr, fmt.Sprintf("queue %s not found", queueName))
-		}
+	queuesUC := NewQueuesUseCase(cfg, mockQueueRepo, metrics.NewMetrics(queuesStorage), apiLogger)
 
-		q.Subscribers[subscriberName] = struct{}{}
+	return queuesUC, func() {
+		// cleanup calls go here
+		ctrl.Finish()
+	}
+}
 
-		return nil
-	})
+// shiftClock moves current time of the usecase forward
+func shiftClock(uc queues.UseCase, d time.Duration) {
+	u := uc.(*queuesUC)
+	now := u.now
+	u.now = func() time.Time { return now().Add(d) }
+}
 
-	for _, q := range queuesCfg {
-		_, err := mockQueueRepo.Create(context.Background(), q.Name, q.Length, q.SubscribersAmount)
-		if err != nil {
-			panic(err)
-		}
+// publishedQueues returns names of queues message has been published to
+func publishedQueues(messages []models.PublishedMessage) []string {
+	res := make([]string, 0, len(messages))
+	for _, message := range messages {
+		res = append(res, message.Queue)
 	}
+	return res
+}
 
-	queuesUC := NewQueuesUseCase(cfg, mockQueueRepo, apiLogger)
+// jsonBody decodes JSON payload of message
+func jsonBody(t *testing.T, payload []byte) map[string]interface{} {
+	var res map[string]interface{}
+	if err := json.Unmarshal(payload, &res); err != nil {
+		t.Fatalf("payload %q is not a JSON object: %s", payload, err)
+	}
+	return res
+}
 
-	return queuesUC, func() {
-		// cleanup calls go here
-		ctrl.Finish()
+// jsonPayload encodes body of message
+func jsonPayload(t *testing.T, body map[string]interface{}) []byte {
+	res, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("failed to encode body %v: %s", body, err)
 	}
+	return res
 }
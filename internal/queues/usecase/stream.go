@@ -0,0 +1,141 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/VladSatyshev/concurrent-queue/internal/models"
+	"github.com/VladSatyshev/concurrent-queue/internal/queues"
+)
+
+type queueStream struct {
+	uc             *queuesUC
+	queue          *models.Queue
+	subscriberName string
+	// sequence number of the last message sent by the stream
+	cursor uint64
+}
+
+// open stream of messages for subscriber. When lastSeq is set, stream resumes
+// after it: messages after lastSeq are sent again even if they are leased.
+// Nothing is acknowledged on resume, as messages are sent in priority order and
+// the client may not have received some of the ones up to lastSeq: they are
+// redelivered once their lease expires unless they are acknowledged
+func (u *queuesUC) OpenStream(ctx context.Context, queueName string, subscriberName string, lastSeq *uint64) (queues.Stream, error) {
+	u.logger.Info("OpenStream UC is in action")
+	queue, err := u.lockQueue(ctx, queueName)
+	if err != nil {
+		return nil, err
+	}
+	defer queue.Unlock()
+
+	if !queue.HasSubscriber(subscriberName) {
+		return nil, queues.NewQueueErr(queues.UseCaseErr, fmt.Sprintf("queue %v doesn't have subscriber %s", queue.Name, subscriberName))
+	}
+	queue.TouchSubscriber(subscriberName, u.now())
+
+	stream := &queueStream{
+		uc:             u,
+		queue:          queue,
+		subscriberName: subscriberName,
+		cursor:         queue.LastSeq,
+	}
+
+	if lastSeq == nil {
+		return stream, nil
+	}
+
+	stream.cursor = *lastSeq
+
+	u.logger.Infof("Subscriber %s resumed stream of queue %s after message %d", subscriberName, queue.Name, *lastSeq)
+
+	return stream, nil
+}
+
+func (s *queueStream) Next(ctx context.Context, wait time.Duration) ([]models.ConsumedMessage, error) {
+	deadline := s.uc.now().Add(wait)
+	for {
+		if err := s.uc.checkNotStopping(); err != nil {
+			return nil, s.release(ctx, err)
+		}
+
+		messages, changed, nextDelivery, err := s.lease(ctx)
+		if err != nil || len(messages) > 0 {
+			return messages, err
+		}
+
+		// wait is cut short on shutdown, which is handled on the next iteration
+		if !s.uc.wait(ctx, deadline, changed, nextDelivery) && s.uc.checkNotStopping() == nil {
+			return messages, ctx.Err()
+		}
+	}
+}
+
+// release makes messages sent by the stream and not acknowledged yet
+// available to other subscribers right away instead of after their lease
+// expires, returns err unless release fails
+func (s *queueStream) release(ctx context.Context, err error) error {
+	s.queue.Lock()
+	defer s.queue.Unlock()
+
+	if s.queue.IsDeleted() {
+		return err
+	}
+
+	messageIDs := s.queue.GetLeasedMessageIDs(s.subscriberName, s.cursor, s.uc.now())
+	if len(messageIDs) == 0 {
+		return err
+	}
+	if releaseErr := s.uc.queuesRepo.ReleaseMessages(ctx, s.queue.Name, s.subscriberName, messageIDs); releaseErr != nil {
+		return releaseErr
+	}
+
+	s.uc.logger.Infof("%d messages sent to subscriber %s by stream of queue %s have been released", len(messageIDs), s.subscriberName, s.queue.Name)
+
+	return err
+}
+
+func (s *queueStream) lease(ctx context.Context) ([]models.ConsumedMessage, <-chan struct{}, time.Time, error) {
+	s.queue.Lock()
+	defer s.queue.Unlock()
+
+	if err := s.uc.checkNotDeleted(s.queue); err != nil {
+		return nil, nil, time.Time{}, err
+	}
+
+	if !s.queue.HasSubscriber(s.subscriberName) {
+		return nil, nil, time.Time{}, queues.NewQueueErr(queues.UseCaseErr, fmt.Sprintf("queue %v doesn't have subscriber %s", s.queue.Name, s.subscriberName))
+	}
+
+	now := s.uc.now()
+	s.queue.TouchSubscriber(s.subscriberName, now)
+	messages, err := s.uc.deadLetterExhausted(ctx, s.queue, s.subscriberName, s.queue.GetStreamMessages(s.subscriberName, s.cursor, now))
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	messages = s.uc.dispatch(s.queue, s.subscriberName, messages, now)
+	if len(messages) == 0 {
+		return []models.ConsumedMessage{}, s.queue.Changed(), s.queue.GetNextDeliveryTime(s.subscriberName, now), nil
+	}
+
+	messageIDs := make([]string, 0, len(messages))
+	for _, message := range messages {
+		messageIDs = append(messageIDs, message.ID)
+	}
+
+	if err := s.uc.queuesRepo.LeaseMessages(ctx, s.queue.Name, s.subscriberName, messageIDs, now.Add(s.queue.VisibilityTimeout)); err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	s.uc.metrics.MessagesConsumed(s.queue.Name, len(messageIDs))
+
+	res := make([]models.ConsumedMessage, 0, len(messages))
+	for _, message := range messages {
+		res = append(res, message.Consumed(s.subscriberName))
+		if message.Seq > s.cursor {
+			s.cursor = message.Seq
+		}
+	}
+
+	return res, nil, time.Time{}, nil
+}
@@ -2,7 +2,11 @@ package usecase
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"math"
+	"sync"
+	"time"
 
 	"github.com/VladSatyshev/concurrent-queue/config"
 	"github.com/VladSatyshev/concurrent-queue/internal/models"
@@ -10,113 +14,923 @@ import (
 	"github.com/VladSatyshev/concurrent-queue/pkg/logger"
 )
 
+// deduplication IDs are kept in memory for the whole window, so they are
+// limited in length
+const maxDeduplicationIDLength = 128
+
+// durations of queue config are numbers of seconds multiplied by time.Second,
+// so they're limited to the ones which don't overflow it
+const maxDurationSec = time.Duration(math.MaxInt64 / int64(time.Second))
+
 type queuesUC struct {
 	cfg        *config.Config
 	queuesRepo queues.Repository
+	metrics    queues.Metrics
 	logger     logger.Logger
+	// current time, replaced in tests
+	now func() time.Time
+	// closed on shutdown
+	stopping chan struct{}
+	stopOnce sync.Once
 }
 
-func NewQueuesUseCase(cfg *config.Config, queuesRepo queues.Repository, logger logger.Logger) queues.UseCase {
+func NewQueuesUseCase(cfg *config.Config, queuesRepo queues.Repository, metrics queues.Metrics, logger logger.Logger) queues.UseCase {
 	return &queuesUC{
 		cfg:        cfg,
 		queuesRepo: queuesRepo,
+		metrics:    metrics,
 		logger:     logger,
+		now:        func() time.Time { return time.Now().UTC() },
+		stopping:   make(chan struct{}),
 	}
 }
 
-func (u *queuesUC) getByName(ctx context.Context, name string) (models.Queue, error) {
+func (u *queuesUC) Shutdown() {
+	u.stopOnce.Do(func() {
+		close(u.stopping)
+		u.logger.Warn("Queues are shutting down: publishes are rejected and consumers are released")
+	})
+}
+
+// check that usecase hasn't been shut down
+func (u *queuesUC) checkNotStopping() error {
+	select {
+	case <-u.stopping:
+		return queues.NewQueueErr(queues.UseCaseUnavailableErr, "server is shutting down")
+	default:
+		return nil
+	}
+}
+
+func (u *queuesUC) getByName(ctx context.Context, name string) (*models.Queue, error) {
 	queue, err := u.queuesRepo.GetByName(ctx, name)
 	if err != nil {
 		if qErr, ok := err.(*queues.QueueErr); ok {
 			if qErr.ErrType == queues.RepositoryNotFoundErr {
 				u.logger.Errorf("queue %s was not found", name)
-				return models.Queue{}, queues.NewQueueErr(queues.UseCaseNotFoundErr, "Queue not found")
+				return nil, queues.NewQueueErr(queues.UseCaseNotFoundErr, "Queue not found")
 			}
 		}
-		return models.Queue{}, err
+		return nil, err
 	}
 	return queue, nil
 }
 
-// get queue by name
-func (u *queuesUC) GetByName(ctx context.Context, name string) (models.Queue, error) {
-	u.logger.Info("GetByName UC is in action")
+// get queue by name and lock it for writing, caller must unlock the queue
+func (u *queuesUC) lockQueue(ctx context.Context, name string) (*models.Queue, error) {
 	queue, err := u.getByName(ctx, name)
 	if err != nil {
-		return models.Queue{}, err
+		return nil, err
+	}
+
+	queue.Lock()
+	if err := u.checkNotDeleted(queue); err != nil {
+		queue.Unlock()
+		return nil, err
 	}
 
 	return queue, nil
 }
 
-// get all queues
-func (u *queuesUC) GetAll(ctx context.Context) []models.Queue {
+// queue may be deleted after it has been got from repository, expects queue lock to be held
+func (u *queuesUC) checkNotDeleted(queue *models.Queue) error {
+	if queue.IsDeleted() {
+		u.logger.Errorf("queue %s was deleted", queue.Name)
+		return queues.NewQueueErr(queues.UseCaseNotFoundErr, "Queue not found")
+	}
+	return nil
+}
+
+// create queue at runtime
+func (u *queuesUC) CreateQueue(ctx context.Context, queueCfg config.QueueConfig) (*models.Queue, error) {
+	u.logger.Info("CreateQueue UC is in action")
+	if queueCfg.Name == "" {
+		return nil, queues.NewQueueErr(queues.UseCaseErr, "queue name must not be empty")
+	}
+	limits, err := configLimits(queueCfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateLimits(limits); err != nil {
+		return nil, err
+	}
+	if err := u.validateDeadLetterQueue(ctx, queueCfg.Name, queueCfg.DeadLetterQueue); err != nil {
+		return nil, err
+	}
+	switch queueCfg.DeliveryMode {
+	case "", models.DeliveryFanout, models.DeliveryCompeting:
+	default:
+		return nil, queues.NewQueueErr(queues.UseCaseErr, fmt.Sprintf("unknown delivery mode %s", queueCfg.DeliveryMode))
+	}
+
+	queue, err := u.queuesRepo.Create(ctx, queueCfg)
+	if err != nil {
+		if qErr, ok := err.(*queues.QueueErr); ok {
+			if qErr.ErrType == queues.RepositoryConflictErr {
+				u.logger.Errorf("queue %s already exists", queueCfg.Name)
+				return nil, queues.NewQueueErr(queues.UseCaseConflictErr, fmt.Sprintf("queue %s already exists", queueCfg.Name))
+			}
+		}
+		return nil, err
+	}
+
+	u.logger.Infof("Queue %s has been created", queue.Name)
+
+	queue.RLock()
+	defer queue.RUnlock()
+
+	return queue.Snapshot(), nil
+}
+
+// change limits of queue, messages and subscribers above new limits are kept
+func (u *queuesUC) UpdateQueue(ctx context.Context, name string, limits models.QueueLimits) (*models.Queue, error) {
+	u.logger.Info("UpdateQueue UC is in action")
+	if err := validateLimits(limits); err != nil {
+		return nil, err
+	}
+	if limits.DeadLetterQueue != nil {
+		if err := u.validateDeadLetterQueue(ctx, name, *limits.DeadLetterQueue); err != nil {
+			return nil, err
+		}
+	}
+
+	queue, err := u.lockQueue(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer queue.Unlock()
+
+	queueCfg := config.QueueConfig{
+		Name:                     queue.Name,
+		Length:                   queue.MaxLength,
+		SubscribersAmount:        queue.MaxSubscribers,
+		VisibilityTimeoutSec:     queue.VisibilityTimeout / time.Second,
+		SubscriberIdleTimeoutSec: queue.SubscriberIdleTimeout / time.Second,
+		MessageTTLSec:            queue.MessageTTL / time.Second,
+		DeadLetterQueue:          queue.DeadLetterQueue,
+		MaxDeliveries:            queue.MaxDeliveries,
+		PriorityLevels:           queue.PriorityLevels,
+		PriorityAgingSec:         queue.PriorityAging / time.Second,
+		DeliveryMode:             queue.DeliveryMode,
+		DeduplicationWindowSec:   queue.DeduplicationWindow / time.Second,
+	}
+	if limits.MaxLength != nil {
+		queueCfg.Length = *limits.MaxLength
+	}
+	if limits.MaxSubscribers != nil {
+		queueCfg.SubscribersAmount = *limits.MaxSubscribers
+	}
+	if limits.VisibilityTimeout != nil {
+		queueCfg.VisibilityTimeoutSec = *limits.VisibilityTimeout / time.Second
+	}
+	if limits.SubscriberIdleTimeout != nil {
+		queueCfg.SubscriberIdleTimeoutSec = *limits.SubscriberIdleTimeout / time.Second
+	}
+	if limits.MessageTTL != nil {
+		queueCfg.MessageTTLSec = *limits.MessageTTL / time.Second
+	}
+	if limits.DeadLetterQueue != nil {
+		queueCfg.DeadLetterQueue = *limits.DeadLetterQueue
+	}
+	if limits.MaxDeliveries != nil {
+		queueCfg.MaxDeliveries = *limits.MaxDeliveries
+	}
+	if limits.PriorityLevels != nil {
+		queueCfg.PriorityLevels = *limits.PriorityLevels
+	}
+	if limits.PriorityAging != nil {
+		queueCfg.PriorityAgingSec = *limits.PriorityAging / time.Second
+	}
+	if limits.DeduplicationWindow != nil {
+		queueCfg.DeduplicationWindowSec = *limits.DeduplicationWindow / time.Second
+	}
+
+	if err := u.queuesRepo.Update(ctx, queueCfg); err != nil {
+		return nil, err
+	}
+
+	u.logger.Infof("Limits of queue %s have been updated", queue.Name)
+
+	return queue.Snapshot(), nil
+}
+
+// validateLimits checks durations set by limits. Queue config keeps them in
+// whole seconds, so they aren't rounded silently
+func validateLimits(limits models.QueueLimits) error {
+	if limits.VisibilityTimeout != nil && *limits.VisibilityTimeout < time.Second {
+		return queues.NewQueueErr(queues.UseCaseErr, "visibility timeout must be at least 1 second")
+	}
+
+	for _, d := range []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"visibility timeout", limits.VisibilityTimeout},
+		{"subscriber idle timeout", limits.SubscriberIdleTimeout},
+		{"message TTL", limits.MessageTTL},
+		{"priority aging", limits.PriorityAging},
+		{"deduplication window", limits.DeduplicationWindow},
+	} {
+		if d.value != nil && (*d.value < 0 || *d.value%time.Second != 0) {
+			return queues.NewQueueErr(queues.UseCaseErr, fmt.Sprintf("%s must be a whole non-negative number of seconds", d.name))
+		}
+	}
+
+	return nil
+}
+
+// configLimits returns durations set by queue config, zero ones are left
+// unset as they mean defaults
+func configLimits(queueCfg config.QueueConfig) (models.QueueLimits, error) {
+	limits := models.QueueLimits{}
+	for _, d := range []struct {
+		name  string
+		sec   time.Duration
+		value **time.Duration
+	}{
+		{"visibility timeout", queueCfg.VisibilityTimeoutSec, &limits.VisibilityTimeout},
+		{"subscriber idle timeout", queueCfg.SubscriberIdleTimeoutSec, &limits.SubscriberIdleTimeout},
+		{"message TTL", queueCfg.MessageTTLSec, &limits.MessageTTL},
+		{"priority aging", queueCfg.PriorityAgingSec, &limits.PriorityAging},
+		{"deduplication window", queueCfg.DeduplicationWindowSec, &limits.DeduplicationWindow},
+	} {
+		if d.sec == 0 {
+			continue
+		}
+		if d.sec < 0 || d.sec > maxDurationSec {
+			return limits, queues.NewQueueErr(queues.UseCaseErr, fmt.Sprintf("%s must be between 0 and %d seconds", d.name, maxDurationSec))
+		}
+		value := d.sec * time.Second
+		*d.value = &value
+	}
+
+	return limits, nil
+}
+
+// dead-letter queue must exist when it's set. It may be deleted later, then
+// messages wait in their queue until it's created again
+func (u *queuesUC) validateDeadLetterQueue(ctx context.Context, name string, deadLetterQueue string) error {
+	if deadLetterQueue == "" {
+		return nil
+	}
+	if deadLetterQueue == name {
+		return queues.NewQueueErr(queues.UseCaseErr, "queue can't be its own dead-letter queue")
+	}
+
+	if _, err := u.queuesRepo.GetByName(ctx, deadLetterQueue); err != nil {
+		if qErr, ok := err.(*queues.QueueErr); ok && qErr.ErrType == queues.RepositoryNotFoundErr {
+			return queues.NewQueueErr(queues.UseCaseErr, fmt.Sprintf("dead-letter queue %s doesn't exist", deadLetterQueue))
+		}
+		return err
+	}
+
+	return nil
+}
+
+// delete all messages of queue, including the ones delivered but not acknowledged yet
+func (u *queuesUC) PurgeQueue(ctx context.Context, name string) error {
+	u.logger.Info("PurgeQueue UC is in action")
+	queue, err := u.lockQueue(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer queue.Unlock()
+
+	messageIDs := queue.GetMessageIDs()
+	if len(messageIDs) > 0 {
+		if err := u.queuesRepo.DeleteMessages(ctx, queue.Name, messageIDs); err != nil {
+			return err
+		}
+	}
+
+	u.logger.Warnf("%d messages have been purged from queue %s", len(messageIDs), queue.Name)
+
+	return u.deleteIfDrained(ctx, queue)
+}
+
+// delete queue. Without drain, queue is deleted right away and its consumers get
+// not found error. With drain, queue stops accepting new messages and subscribers
+// and is deleted once all its messages are acknowledged. Reports whether queue
+// has been deleted
+func (u *queuesUC) DeleteQueue(ctx context.Context, name string, drain bool) (bool, error) {
+	u.logger.Info("DeleteQueue UC is in action")
+	queue, err := u.lockQueue(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	defer queue.Unlock()
+
+	if !drain {
+		if err := u.queuesRepo.Delete(ctx, queue.Name); err != nil {
+			return false, err
+		}
+		u.metrics.QueueDeleted(queue.Name)
+		u.logger.Warnf("Queue %s has been deleted", queue.Name)
+		return true, nil
+	}
+
+	if !queue.Draining {
+		if err := u.queuesRepo.Drain(ctx, queue.Name); err != nil {
+			return false, err
+		}
+		u.logger.Infof("Queue %s is draining", queue.Name)
+	}
+
+	// messages of queue without subscribers are never acknowledged
+	if err := u.deleteSeenByAllMessages(ctx, queue); err != nil {
+		return false, err
+	}
+
+	return queue.IsDeleted(), nil
+}
+
+// get snapshot of queue by name
+func (u *queuesUC) GetByName(ctx context.Context, name string) (*models.Queue, error) {
+	u.logger.Info("GetByName UC is in action")
+	queue, err := u.getByName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	queue.RLock()
+	res := queue.Snapshot()
+	queue.RUnlock()
+
+	res.MarkScheduled(u.now())
+
+	return res, nil
+}
+
+// get snapshots of all queues
+func (u *queuesUC) GetAll(ctx context.Context) []*models.Queue {
 	u.logger.Info("GetAll UC is in action")
 	queues := u.queuesRepo.GetAll(ctx)
-	return queues
+
+	res := make([]*models.Queue, 0, len(queues))
+	for _, queue := range queues {
+		queue.RLock()
+		snapshot := queue.Snapshot()
+		queue.RUnlock()
+
+		snapshot.MarkScheduled(u.now())
+		res = append(res, snapshot)
+	}
+
+	return res
 }
 
-// add message to queue
+// add JSON message to queue
 func (u *queuesUC) AddMessage(ctx context.Context, name string, jsonBody map[string]interface{}) error {
-	u.logger.Info("AddMessage UC is in action")
-	queue, err := u.getByName(ctx, name)
+	payload, err := json.Marshal(jsonBody)
 	if err != nil {
-		return err
+		return queues.NewQueueErr(queues.UseCaseErr, fmt.Sprintf("failed to encode message: %s", err))
 	}
 
-	if len(queue.Messages) >= int(queue.MaxLength) {
+	_, err = u.PublishMessage(ctx, name, payload, models.PublishOptions{Attributes: models.MessageAttributes{ContentType: models.ContentTypeJSON}})
+	return err
+}
+
+// add message with options to queue
+func (u *queuesUC) PublishMessage(ctx context.Context, name string, payload []byte, opts models.PublishOptions) (models.PublishedMessage, error) {
+	u.logger.Info("PublishMessage UC is in action")
+	if err := u.checkNotStopping(); err != nil {
+		return models.PublishedMessage{}, err
+	}
+	if err := validateMessage(payload, opts); err != nil {
+		return models.PublishedMessage{}, err
+	}
+
+	queue, err := u.lockQueue(ctx, name)
+	if err != nil {
+		return models.PublishedMessage{}, err
+	}
+	defer queue.Unlock()
+
+	if duplicate, ok := u.findDuplicate(queue, opts); ok {
+		u.logger.Infof("Message with deduplication ID %s has already been added to queue %s as %s", opts.DeduplicationID, queue.Name, duplicate.ID)
+		return duplicate, nil
+	}
+
+	if err := u.checkNotDraining(queue); err != nil {
+		return models.PublishedMessage{}, err
+	}
+
+	if opts.Priority > 0 && opts.Priority >= queue.PriorityLevels {
+		return models.PublishedMessage{}, queues.NewQueueErr(queues.UseCaseErr, fmt.Sprintf("priority of message must be below %d for queue %s", queue.PriorityLevels, queue.Name))
+	}
+
+	// expired messages don't take capacity even if reaper hasn't deleted them
+	// yet or dead-letter queue can't accept them now, scheduled ones do
+	if err := u.expireMessages(ctx, queue); err != nil {
+		return models.PublishedMessage{}, err
+	}
+
+	if queue.GetLength(u.now()) >= int(queue.MaxLength) {
+		u.metrics.PublishRejected(queue.Name)
 		msg := "too many messages: max amount of messages for queue %v is %v"
 		u.logger.Errorf(msg, name, queue.MaxLength)
-		return queues.NewQueueErr(queues.UseCaseErr, fmt.Sprintf(msg, name, queue.MaxLength))
+		return models.PublishedMessage{}, queues.NewQueueErr(queues.UseCaseErr, fmt.Sprintf(msg, name, queue.MaxLength))
 	}
 
-	queue.AddMessage(jsonBody)
+	message := u.newMessage(queue, payload, opts)
+	if err := u.queuesRepo.AddMessage(ctx, queue.Name, message); err != nil {
+		return models.PublishedMessage{}, err
+	}
+	u.metrics.MessagesPublished(queue.Name, 1)
 
-	u.logger.Infof("Message %v has been added to queue %s", jsonBody, queue.Name)
+	u.logger.Infof("Message %s of %d bytes has been added to queue %s", message.ID, len(payload), queue.Name)
+
+	return message.Published(queue.Name), nil
+}
 
+func validateMessage(payload []byte, opts models.PublishOptions) error {
+	if models.IsJSON(opts.Attributes.ContentType) && !json.Valid(payload) {
+		return queues.NewQueueErr(queues.UseCaseErr, fmt.Sprintf("payload of message with content type %s must be valid JSON", opts.Attributes.ContentType))
+	}
+	if opts.TTL < 0 {
+		return queues.NewQueueErr(queues.UseCaseErr, "message TTL must not be negative")
+	}
+	if opts.Delay < 0 {
+		return queues.NewQueueErr(queues.UseCaseErr, "message delay must not be negative")
+	}
+	if opts.Delay > 0 && !opts.DeliverAt.IsZero() {
+		return queues.NewQueueErr(queues.UseCaseErr, "only one of message delay and delivery time can be set")
+	}
+	for name := range opts.Attributes.Headers {
+		if name == "" {
+			return queues.NewQueueErr(queues.UseCaseErr, "message header name must not be empty")
+		}
+	}
+	if len(opts.DeduplicationID) > maxDeduplicationIDLength {
+		return queues.NewQueueErr(queues.UseCaseErr, fmt.Sprintf("deduplication ID must be at most %d characters long", maxDeduplicationIDLength))
+	}
 	return nil
 }
 
+// return message published to queue earlier with deduplication ID of options.
+// Expects queue lock to be held
+func (u *queuesUC) findDuplicate(queue *models.Queue, opts models.PublishOptions) (models.PublishedMessage, bool) {
+	if opts.DeduplicationID == "" {
+		return models.PublishedMessage{}, false
+	}
+	now := u.now()
+	queue.PruneDeduplication(now)
+	return queue.FindDuplicate(opts.DeduplicationID, now)
+}
+
+// build the next message of queue, expects queue lock to be held. Time-to-live
+// of scheduled message counts from its delivery time
+func (u *queuesUC) newMessage(queue *models.Queue, payload []byte, opts models.PublishOptions) *models.QueueMessage {
+	message := queue.NewMessage(payload)
+	message.Priority = opts.Priority
+	message.Attributes = opts.Attributes
+	if message.Attributes.ContentType == "" {
+		message.Attributes.ContentType = models.ContentTypeBytes
+	}
+
+	now := u.now()
+	deliverAt := opts.DeliverAt
+	if opts.Delay > 0 {
+		deliverAt = now.Add(opts.Delay)
+	}
+	if deliverAt.After(now) {
+		message.DeliverAt = deliverAt.UTC()
+		now = message.DeliverAt
+	}
+
+	if opts.DeduplicationID != "" {
+		message.Deduplication = &models.Deduplication{
+			ID:        opts.DeduplicationID,
+			ExpiresAt: u.now().Add(queue.DeduplicationWindow),
+		}
+	}
+
+	ttl := opts.TTL
+	if ttl == 0 {
+		ttl = queue.MessageTTL
+	}
+	if ttl > 0 {
+		message.ExpiresAt = now.Add(ttl)
+	}
+
+	return message
+}
+
 // add subscriber to queue
 func (u *queuesUC) AddSubscriber(ctx context.Context, queueName string, subscriberName string) error {
-	u.logger.Info("AddSubscriber UC is in action")
-	queue, err := u.getByName(ctx, queueName)
+	return u.AddGroupSubscriber(ctx, queueName, subscriberName, "")
+}
+
+// add subscriber to consumer group of queue, the group is created with its
+// first member. Subscriber without group forms a group of its own
+func (u *queuesUC) AddGroupSubscriber(ctx context.Context, queueName string, subscriberName string, groupName string) error {
+	u.logger.Info("AddGroupSubscriber UC is in action")
+	queue, err := u.lockQueue(ctx, queueName)
 	if err != nil {
 		return err
 	}
+	defer queue.Unlock()
 
 	if queue.HasSubscriber(subscriberName) {
-		return queues.NewQueueErr(queues.UseCaseErr, fmt.Sprintf("user %s has already subscribed to queue %s", subscriberName, queue.Name))
+		return queues.NewQueueErr(queues.UseCaseConflictErr, fmt.Sprintf("user %s has already subscribed to queue %s", subscriberName, queue.Name))
+	}
+
+	// groups and subscribers without group acknowledge messages under their names
+	if groupName == "" && queue.HasGroup(subscriberName) {
+		return queues.NewQueueErr(queues.UseCaseConflictErr, fmt.Sprintf("name %s is taken by consumer group of queue %s", subscriberName, queue.Name))
+	}
+	if groupName != "" && queue.HasSubscriber(groupName) && queue.GetGroup(groupName) == "" {
+		return queues.NewQueueErr(queues.UseCaseConflictErr, fmt.Sprintf("name %s is taken by subscriber of queue %s", groupName, queue.Name))
+	}
+
+	if err := u.checkNotDraining(queue); err != nil {
+		return err
 	}
 
-	if len(queue.Subscribers) == int(queue.MaxSubscribers) {
+	if len(queue.Subscribers) >= int(queue.MaxSubscribers) {
 		return queues.NewQueueErr(queues.UseCaseErr, fmt.Sprintf("too many subscribers: max amount of subscribers for queue %v is %v", queueName, queue.MaxSubscribers))
 	}
 
-	queue.AddSubscriber(subscriberName)
+	if err := u.queuesRepo.AddSubscriber(ctx, queue.Name, subscriberName, groupName); err != nil {
+		return err
+	}
+	queue.TouchSubscriber(subscriberName, u.now())
 
-	u.logger.Infof("Subscriber %s has been added to queue %s", subscriberName, queue.Name)
+	if groupName != "" {
+		u.logger.Infof("Subscriber %s has joined consumer group %s of queue %s", subscriberName, groupName, queue.Name)
+	} else {
+		u.logger.Infof("Subscriber %s has been added to queue %s", subscriberName, queue.Name)
+	}
 
 	return nil
 }
 
-// consume messages from queue by subscriber
-func (u *queuesUC) ConsumeMessages(ctx context.Context, queueName string, subscriberName string) (map[string]interface{}, error) {
+// get consumer groups of queue with their members and lag
+func (u *queuesUC) GetGroups(ctx context.Context, queueName string) ([]models.ConsumerGroup, error) {
+	u.logger.Info("GetGroups UC is in action")
+	queue, err := u.getByName(ctx, queueName)
+	if err != nil {
+		return nil, err
+	}
+
+	queue.RLock()
+	defer queue.RUnlock()
+
+	if err := u.checkNotDeleted(queue); err != nil {
+		return nil, err
+	}
+
+	now := u.now()
+	groupNames := queue.GetGroupNames()
+	res := make([]models.ConsumerGroup, 0, len(groupNames))
+	for _, groupName := range groupNames {
+		members := queue.GetGroupMembers(groupName)
+		res = append(res, models.ConsumerGroup{
+			Name:     groupName,
+			Members:  members,
+			Lag:      queue.GetLag(groupName),
+			InFlight: queue.GetLeasedCount(queue.GetPeers(members[0]), now),
+		})
+	}
+
+	return res, nil
+}
+
+// remove subscriber from queue, messages which have been acknowledged by the
+// rest of subscribers are deleted
+func (u *queuesUC) RemoveSubscriber(ctx context.Context, queueName string, subscriberName string) error {
+	u.logger.Info("RemoveSubscriber UC is in action")
+	queue, err := u.lockQueue(ctx, queueName)
+	if err != nil {
+		return err
+	}
+	defer queue.Unlock()
+
+	if !queue.HasSubscriber(subscriberName) {
+		return queues.NewQueueErr(queues.UseCaseNotFoundErr, "Subscriber not found")
+	}
+
+	return u.removeSubscriber(ctx, queue, subscriberName)
+}
+
+// remove subscribers which haven't consumed messages for the idle timeout of their queue
+func (u *queuesUC) EvictIdleSubscribers(ctx context.Context) {
+	for _, queue := range u.queuesRepo.GetAll(ctx) {
+		u.evictIdleSubscribers(ctx, queue)
+	}
+}
+
+func (u *queuesUC) evictIdleSubscribers(ctx context.Context, queue *models.Queue) {
+	queue.Lock()
+	defer queue.Unlock()
+
+	if queue.IsDeleted() {
+		return
+	}
+
+	for _, subscriberName := range queue.GetIdleSubscribers(u.now()) {
+		if err := u.removeSubscriber(ctx, queue, subscriberName); err != nil {
+			u.logger.Errorf("failed to evict idle subscriber %s from queue %s: %s", subscriberName, queue.Name, err.Error())
+			return
+		}
+		u.logger.Warnf("Idle subscriber %s has been evicted from queue %s", subscriberName, queue.Name)
+	}
+}
+
+// delete messages whose time-to-live has passed from all queues
+func (u *queuesUC) ExpireMessages(ctx context.Context) {
+	for _, queue := range u.queuesRepo.GetAll(ctx) {
+		queue.Lock()
+		if !queue.IsDeleted() {
+			if err := u.expireMessages(ctx, queue); err != nil {
+				u.logger.Errorf("failed to expire messages of queue %s: %s", queue.Name, err.Error())
+			}
+		}
+		queue.Unlock()
+	}
+}
+
+// expects queue lock to be held
+func (u *queuesUC) expireMessages(ctx context.Context, queue *models.Queue) error {
+	messageIDs := queue.GetExpiredMessageIDs(u.now())
+	if len(messageIDs) == 0 {
+		return nil
+	}
+
+	// expired messages are kept until dead-letter queue accepts them
+	if moved, err := u.deadLetter(ctx, queue, queue.GetMessages(messageIDs), "", models.DeadLetterExpired); err != nil || !moved {
+		return err
+	}
+
+	if err := u.queuesRepo.ExpireMessages(ctx, queue.Name, messageIDs); err != nil {
+		return err
+	}
+	u.metrics.MessagesExpired(queue.Name, len(messageIDs))
+
+	u.logger.Warnf("%d expired messages have been deleted from queue %s", len(messageIDs), queue.Name)
+
+	return u.deleteIfDrained(ctx, queue)
+}
+
+// expects queue lock to be held
+func (u *queuesUC) removeSubscriber(ctx context.Context, queue *models.Queue, subscriberName string) error {
+	if err := u.queuesRepo.RemoveSubscriber(ctx, queue.Name, subscriberName); err != nil {
+		return err
+	}
+
+	u.logger.Infof("Subscriber %s has been removed from queue %s", subscriberName, queue.Name)
+
+	// messages nobody has acknowledged are kept for future subscribers
+	if len(queue.Subscribers) == 0 && !queue.Draining {
+		return nil
+	}
+
+	return u.deleteSeenByAllMessages(ctx, queue)
+}
+
+// lease messages not acknowledged by subscriber in publish order. If there are
+// none, waits up to wait for new messages to arrive
+func (u *queuesUC) ConsumeMessages(ctx context.Context, queueName string, subscriberName string, wait time.Duration) ([]models.ConsumedMessage, error) {
 	u.logger.Info("ConsumeMessages UC is in action")
+	return u.consume(ctx, queueName, subscriberName, wait, 0)
+}
+
+// consume a single message, nil if there is none
+func (u *queuesUC) ConsumeMessage(ctx context.Context, queueName string, subscriberName string, wait time.Duration) (*models.ConsumedMessage, error) {
+	u.logger.Info("ConsumeMessage UC is in action")
+	messages, err := u.consume(ctx, queueName, subscriberName, wait, 1)
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+	return &messages[0], nil
+}
+
+// lease up to limit messages to subscriber, 0 means no limit
+func (u *queuesUC) consume(ctx context.Context, queueName string, subscriberName string, wait time.Duration, limit int) ([]models.ConsumedMessage, error) {
 	queue, err := u.getByName(ctx, queueName)
 	if err != nil {
 		return nil, err
 	}
 
+	deadline := u.now().Add(wait)
+	for {
+		messages, changed, nextDelivery, err := u.leaseMessages(ctx, queue, subscriberName, limit)
+		if err != nil || len(messages) > 0 {
+			return messages, err
+		}
+
+		if !u.wait(ctx, deadline, changed, nextDelivery) {
+			return messages, nil
+		}
+	}
+}
+
+// wait blocks until queue changes, next message becomes deliverable or deadline is reached.
+// Returns false if there is no point to check the queue again
+func (u *queuesUC) wait(ctx context.Context, deadline time.Time, changed <-chan struct{}, nextDelivery time.Time) bool {
+	timeout := deadline.Sub(u.now())
+	if timeout <= 0 {
+		return false
+	}
+	if !nextDelivery.IsZero() && nextDelivery.Sub(u.now()) < timeout {
+		timeout = nextDelivery.Sub(u.now())
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-changed:
+		return true
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-u.stopping:
+		return false
+	}
+}
+
+// lease deliverable messages to subscriber. If there are none, returns channel
+// which is closed on the next change of the queue and the time when the next
+// leased or scheduled message becomes deliverable to subscriber
+func (u *queuesUC) leaseMessages(ctx context.Context, queue *models.Queue, subscriberName string, limit int) ([]models.ConsumedMessage, <-chan struct{}, time.Time, error) {
+	queue.Lock()
+	defer queue.Unlock()
+
+	if err := u.checkNotDeleted(queue); err != nil {
+		return nil, nil, time.Time{}, err
+	}
+
 	if !queue.HasSubscriber(subscriberName) {
-		return nil, queues.NewQueueErr(queues.UseCaseErr, fmt.Sprintf("queue %v doesn't have subscriber %s", queue.Name, subscriberName))
+		return nil, nil, time.Time{}, queues.NewQueueErr(queues.UseCaseErr, fmt.Sprintf("queue %v doesn't have subscriber %s", queue.Name, subscriberName))
+	}
+
+	now := u.now()
+	queue.TouchSubscriber(subscriberName, now)
+	messages, err := u.deadLetterExhausted(ctx, queue, subscriberName, queue.GetDeliverableMessages(subscriberName, now))
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	messages = u.dispatch(queue, subscriberName, messages, now)
+	if len(messages) == 0 {
+		return []models.ConsumedMessage{}, queue.Changed(), queue.GetNextDeliveryTime(subscriberName, now), nil
+	}
+	if limit > 0 && len(messages) > limit {
+		messages = messages[:limit]
+	}
+
+	messageIDs := make([]string, 0, len(messages))
+	for _, message := range messages {
+		messageIDs = append(messageIDs, message.ID)
+	}
+
+	if err := u.queuesRepo.LeaseMessages(ctx, queue.Name, subscriberName, messageIDs, now.Add(queue.VisibilityTimeout)); err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	u.metrics.MessagesConsumed(queue.Name, len(messageIDs))
+
+	res := make([]models.ConsumedMessage, 0, len(messages))
+	for _, message := range messages {
+		res = append(res, message.Consumed(subscriberName))
+	}
+
+	return res, nil, time.Time{}, nil
+}
+
+// subscriber which shares messages with peers, in competing mode or in consumer
+// group, gets no more than its fair share of messages which are available or
+// in flight, so they are spread over the least loaded peers instead of going
+// to whoever consumes first. Subscriber which has nothing in flight always gets
+// at least one message. Expects queue lock to be held
+func (u *queuesUC) dispatch(queue *models.Queue, subscriberName string, messages []*models.QueueMessage, now time.Time) []*models.QueueMessage {
+	peers := queue.GetPeers(subscriberName)
+	if len(peers) <= 1 || len(messages) == 0 {
+		return messages
 	}
 
-	notSeenMessages := queue.GetNotSeenMessages(subscriberName)
+	total := len(messages) + queue.GetLeasedCount(peers, now)
+	own := queue.GetLeasedCount(map[string]struct{}{subscriberName: {}}, now)
 
-	queue.SetMessagesSeenBy(subscriberName)
+	share := (total+len(peers)-1)/len(peers) - own
+	if own == 0 && share < 1 {
+		share = 1
+	}
+	if share < 0 {
+		share = 0
+	}
+	if share < len(messages) {
+		messages = messages[:share]
+	}
 
-	queue.DeleteSeenByAllMessages(u.logger)
+	return messages
+}
 
-	return notSeenMessages, nil
+// acknowledge message delivered to subscriber, so it's never redelivered to it
+func (u *queuesUC) AckMessage(ctx context.Context, queueName string, subscriberName string, messageID string) error {
+	u.logger.Info("AckMessage UC is in action")
+	queue, err := u.lockQueue(ctx, queueName)
+	if err != nil {
+		return err
+	}
+	defer queue.Unlock()
+
+	if err := u.checkDelivered(queue, subscriberName, messageID); err != nil {
+		return err
+	}
+
+	if err := u.queuesRepo.AckMessages(ctx, queue.Name, subscriberName, []string{messageID}); err != nil {
+		return err
+	}
+
+	u.logger.Infof("Message %s has been acknowledged by subscriber %s in queue %s", messageID, subscriberName, queue.Name)
+
+	return u.deleteSeenByAllMessages(ctx, queue)
+}
+
+// release lease of message delivered to subscriber, so it's redelivered on next consume
+func (u *queuesUC) NackMessage(ctx context.Context, queueName string, subscriberName string, messageID string) error {
+	u.logger.Info("NackMessage UC is in action")
+	queue, err := u.lockQueue(ctx, queueName)
+	if err != nil {
+		return err
+	}
+	defer queue.Unlock()
+
+	if err := u.checkDelivered(queue, subscriberName, messageID); err != nil {
+		return err
+	}
+
+	if err := u.queuesRepo.ReleaseMessages(ctx, queue.Name, subscriberName, []string{messageID}); err != nil {
+		return err
+	}
+
+	u.logger.Infof("Message %s has been released by subscriber %s in queue %s", messageID, subscriberName, queue.Name)
+
+	// message nacked for the last time is dead-lettered right away, if
+	// dead-letter queue can't accept it now, it's moved on the next lease
+	_, err = u.deadLetterExhausted(ctx, queue, subscriberName, queue.GetMessages([]string{messageID}))
+	return err
+}
+
+// check that message has been delivered to subscriber and not acknowledged yet, expects queue lock to be held
+func (u *queuesUC) checkDelivered(queue *models.Queue, subscriberName string, messageID string) error {
+	if !queue.HasSubscriber(subscriberName) {
+		return queues.NewQueueErr(queues.UseCaseErr, fmt.Sprintf("queue %v doesn't have subscriber %s", queue.Name, subscriberName))
+	}
+	queue.TouchSubscriber(subscriberName, u.now())
+
+	message := queue.GetMessage(messageID)
+	if message == nil {
+		return queues.NewQueueErr(queues.UseCaseNotFoundErr, "Message not found")
+	}
+
+	if !message.IsDeliveredTo(subscriberName) {
+		return queues.NewQueueErr(queues.UseCaseErr, fmt.Sprintf("message %s is not delivered to subscriber %s", messageID, subscriberName))
+	}
+
+	return nil
+}
+
+// delete messages which have been seen by every subscriber, expects queue lock to be held
+func (u *queuesUC) deleteSeenByAllMessages(ctx context.Context, queue *models.Queue) error {
+	messageIDs := queue.GetSeenByAllMessageIDs()
+	if len(messageIDs) == 0 {
+		return u.deleteIfDrained(ctx, queue)
+	}
+
+	if err := u.queuesRepo.DeleteMessages(ctx, queue.Name, messageIDs); err != nil {
+		return err
+	}
+	u.metrics.MessagesDeleted(queue.Name, len(messageIDs))
+
+	for _, messageID := range messageIDs {
+		u.logger.Warnf("message with message ID %s has been deleted from queue %s", messageID, queue.Name)
+	}
+
+	return u.deleteIfDrained(ctx, queue)
+}
+
+// delete draining queue which has no messages left, expects queue lock to be held
+func (u *queuesUC) deleteIfDrained(ctx context.Context, queue *models.Queue) error {
+	if !queue.Draining || len(queue.Messages) > 0 {
+		return nil
+	}
+
+	if err := u.queuesRepo.Delete(ctx, queue.Name); err != nil {
+		return err
+	}
+	u.metrics.QueueDeleted(queue.Name)
+
+	u.logger.Warnf("Drained queue %s has been deleted", queue.Name)
+
+	return nil
+}
+
+// check that queue accepts new messages and subscribers, expects queue lock to be held
+func (u *queuesUC) checkNotDraining(queue *models.Queue) error {
+	if queue.Draining {
+		return queues.NewQueueErr(queues.UseCaseConflictErr, fmt.Sprintf("queue %s is being deleted", queue.Name))
+	}
+	return nil
 }
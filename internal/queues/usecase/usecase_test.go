@@ -2,10 +2,14 @@ package usecase
 
 import (
 	"context"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/VladSatyshev/concurrent-queue/config"
 	"github.com/VladSatyshev/concurrent-queue/internal/models"
+	"github.com/VladSatyshev/concurrent-queue/internal/queues"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -45,7 +49,7 @@ func TestQueuesUC_AddMessageToQueue(t *testing.T) {
 
 	assert.Equal(t, 1, len(actualQ.Messages))
 	for _, m := range actualQ.Messages {
-		assert.Equal(t, m.Body, msgBody)
+		assert.Equal(t, jsonBody(t, m.Payload), msgBody)
 	}
 }
 
@@ -160,15 +164,15 @@ func TestQueuesUC_SubscriberCanConsumeMessagesFromQueue(t *testing.T) {
 	err = queuesUC.AddMessage(ctx, qConfig.Name, msgBody)
 	assert.Nil(t, err)
 
-	messsages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName)
+	messsages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 0)
 	assert.Nil(t, err)
 
 	assert.Equal(t, 1, len(messsages))
 	for _, mes := range messsages {
-		assert.Equal(t, msgBody, mes)
+		assert.Equal(t, msgBody, jsonBody(t, mes.Payload))
 	}
 
-	messsages, err = queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName)
+	messsages, err = queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 0)
 	assert.Nil(t, err)
 	assert.Equal(t, 0, len(messsages))
 }
@@ -197,7 +201,7 @@ func TestQueuesUC_NonSubscriberCantConsumeMessagesFromQueue(t *testing.T) {
 	err := queuesUC.AddMessage(ctx, qConfig.Name, msgBody)
 	assert.Nil(t, err)
 
-	_, err = queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName)
+	_, err = queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 0)
 	assert.NotNil(t, err)
 }
 
@@ -231,24 +235,24 @@ func TestQueuesUC_SubscribersCanConsumeMessagesFromQueue(t *testing.T) {
 	err = queuesUC.AddMessage(ctx, qConfig.Name, msgBody)
 	assert.Nil(t, err)
 
-	messsages1, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName1)
+	messsages1, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName1, 0)
 	assert.Nil(t, err)
 	assert.Equal(t, 1, len(messsages1))
 	for _, mes := range messsages1 {
-		assert.Equal(t, msgBody, mes)
+		assert.Equal(t, msgBody, jsonBody(t, mes.Payload))
 	}
 
-	messsages2, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName2)
+	messsages2, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName2, 0)
 	assert.Nil(t, err)
 	assert.Equal(t, 1, len(messsages2))
 	for _, mes := range messsages2 {
-		assert.Equal(t, msgBody, mes)
+		assert.Equal(t, msgBody, jsonBody(t, mes.Payload))
 	}
 
-	messsages1_1, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName1)
+	messsages1_1, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName1, 0)
 	assert.Nil(t, err)
 	assert.Equal(t, 0, len(messsages1_1))
-	messsages2_1, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName1)
+	messsages2_1, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName1, 0)
 	assert.Nil(t, err)
 	assert.Equal(t, 0, len(messsages2_1))
 }
@@ -319,3 +323,2321 @@ func TestQueuesUC_CantAddSubscribersToQueueTwice(t *testing.T) {
 	err = queuesUC.AddSubscriber(ctx, qConfig.Name, subscriberName)
 	assert.NotNil(t, err)
 }
+
+func TestQueuesUC_ConcurrentAddMessageRespectsMaxLength(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            50,
+		SubscribersAmount: 1,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+	}
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	var (
+		wg        sync.WaitGroup
+		succeeded atomic.Int32
+	)
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := queuesUC.AddMessage(ctx, qConfig.Name, map[string]interface{}{"msg": i}); err == nil {
+				succeeded.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(qConfig.Length), succeeded.Load())
+
+	q, err := queuesUC.GetByName(ctx, qConfig.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, int(qConfig.Length), len(q.Messages))
+}
+
+func TestQueuesUC_ConsumeMessagesPreservesPublishOrder(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            100,
+		SubscribersAmount: 1,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+	}
+
+	subscriberName := "subscriber"
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, qConfig.Name, subscriberName)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		err = queuesUC.AddMessage(ctx, qConfig.Name, map[string]interface{}{"n": i})
+		assert.Nil(t, err)
+	}
+
+	messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(messages))
+	for i, mes := range messages {
+		assert.Equal(t, map[string]interface{}{"n": float64(i)}, jsonBody(t, mes.Payload))
+		assert.Equal(t, uint64(i+1), mes.Seq)
+		assert.NotEmpty(t, mes.ID)
+		if i > 0 {
+			assert.False(t, mes.PublishedAt.Before(messages[i-1].PublishedAt))
+		}
+	}
+}
+
+func TestQueuesUC_AckedMessageIsDeleted(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            1,
+		SubscribersAmount: 1,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+	}
+
+	subscriberName := "subscriber"
+	msgBody := map[string]interface{}{"msg": "hello"}
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, qConfig.Name, subscriberName)
+	assert.Nil(t, err)
+	err = queuesUC.AddMessage(ctx, qConfig.Name, msgBody)
+	assert.Nil(t, err)
+
+	messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(messages))
+	assert.Equal(t, uint(1), messages[0].DeliveryCount)
+
+	// leased message keeps the place in the queue until it's acknowledged
+	err = queuesUC.AddMessage(ctx, qConfig.Name, msgBody)
+	assert.NotNil(t, err)
+
+	err = queuesUC.AckMessage(ctx, qConfig.Name, subscriberName, messages[0].ID)
+	assert.Nil(t, err)
+
+	q, err := queuesUC.GetByName(ctx, qConfig.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(q.Messages))
+
+	err = queuesUC.AckMessage(ctx, qConfig.Name, subscriberName, messages[0].ID)
+	assert.NotNil(t, err)
+}
+
+func TestQueuesUC_NackedMessageIsRedelivered(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            1,
+		SubscribersAmount: 1,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+	}
+
+	subscriberName := "subscriber"
+	msgBody := map[string]interface{}{"msg": "hello"}
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, qConfig.Name, subscriberName)
+	assert.Nil(t, err)
+	err = queuesUC.AddMessage(ctx, qConfig.Name, msgBody)
+	assert.Nil(t, err)
+
+	messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(messages))
+
+	err = queuesUC.NackMessage(ctx, qConfig.Name, subscriberName, messages[0].ID)
+	assert.Nil(t, err)
+
+	redelivered, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(redelivered))
+	assert.Equal(t, messages[0].ID, redelivered[0].ID)
+	assert.Equal(t, uint(2), redelivered[0].DeliveryCount)
+}
+
+func TestQueuesUC_ExpiredLeaseIsRedelivered(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:                 "testQueue",
+		Length:               1,
+		SubscribersAmount:    1,
+		VisibilityTimeoutSec: 10,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+	}
+
+	subscriberName := "subscriber"
+	msgBody := map[string]interface{}{"msg": "hello"}
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, qConfig.Name, subscriberName)
+	assert.Nil(t, err)
+	err = queuesUC.AddMessage(ctx, qConfig.Name, msgBody)
+	assert.Nil(t, err)
+
+	messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(messages))
+
+	shiftClock(queuesUC, 9*time.Second)
+	messages, err = queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(messages))
+
+	shiftClock(queuesUC, 2*time.Second)
+	messages, err = queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(messages))
+	assert.Equal(t, uint(2), messages[0].DeliveryCount)
+}
+
+func TestQueuesUC_CantAckNotDeliveredMessage(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            1,
+		SubscribersAmount: 2,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+	}
+
+	subscriberName1 := "subscriber1"
+	subscriberName2 := "subscriber2"
+	msgBody := map[string]interface{}{"msg": "hello"}
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, qConfig.Name, subscriberName1)
+	assert.Nil(t, err)
+	err = queuesUC.AddSubscriber(ctx, qConfig.Name, subscriberName2)
+	assert.Nil(t, err)
+	err = queuesUC.AddMessage(ctx, qConfig.Name, msgBody)
+	assert.Nil(t, err)
+
+	messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName1, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(messages))
+
+	err = queuesUC.AckMessage(ctx, qConfig.Name, subscriberName2, messages[0].ID)
+	assert.NotNil(t, err)
+	err = queuesUC.NackMessage(ctx, qConfig.Name, subscriberName2, messages[0].ID)
+	assert.NotNil(t, err)
+	err = queuesUC.AckMessage(ctx, qConfig.Name, subscriberName1, "unknown")
+	assert.NotNil(t, err)
+}
+
+func TestQueuesUC_ConsumeWaitsForNewMessage(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            1,
+		SubscribersAmount: 1,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+	}
+
+	subscriberName := "subscriber"
+	msgBody := map[string]interface{}{"msg": "hello"}
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, qConfig.Name, subscriberName)
+	assert.Nil(t, err)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		assert.Nil(t, queuesUC.AddMessage(ctx, qConfig.Name, msgBody))
+	}()
+
+	start := time.Now()
+	messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 5*time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(messages))
+	assert.Equal(t, msgBody, jsonBody(t, messages[0].Payload))
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestQueuesUC_ConsumeWaitExpires(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            1,
+		SubscribersAmount: 1,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+	}
+
+	subscriberName := "subscriber"
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, qConfig.Name, subscriberName)
+	assert.Nil(t, err)
+
+	start := time.Now()
+	messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 100*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(messages))
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	// waiting is bounded by request context too
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+
+	start = time.Now()
+	messages, err = queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 5*time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(messages))
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestQueuesUC_StreamResumesAfterLastSeenMessage(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            10,
+		SubscribersAmount: 1,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+	}
+
+	subscriberName := "subscriber"
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, qConfig.Name, subscriberName)
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		err = queuesUC.AddMessage(ctx, qConfig.Name, map[string]interface{}{"n": i})
+		assert.Nil(t, err)
+	}
+
+	stream, err := queuesUC.OpenStream(ctx, qConfig.Name, subscriberName, nil)
+	assert.Nil(t, err)
+
+	messages, err := stream.Next(ctx, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(messages))
+
+	// messages published while stream is open are sent once
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		assert.Nil(t, queuesUC.AddMessage(ctx, qConfig.Name, map[string]interface{}{"n": 3}))
+	}()
+	messages, err = stream.Next(ctx, 5*time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(messages))
+	assert.Equal(t, uint64(4), messages[0].Seq)
+
+	messages, err = stream.Next(ctx, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(messages))
+
+	// client has seen messages up to 2 before reconnect
+	lastSeq := uint64(2)
+	stream, err = queuesUC.OpenStream(ctx, qConfig.Name, subscriberName, &lastSeq)
+	assert.Nil(t, err)
+
+	messages, err = stream.Next(ctx, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, uint64(3), messages[0].Seq)
+	assert.Equal(t, uint64(4), messages[1].Seq)
+	assert.Equal(t, uint(2), messages[0].DeliveryCount)
+
+	// messages up to the last seen one are not acknowledged on resume
+	q, err := queuesUC.GetByName(ctx, qConfig.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(q.Messages))
+}
+
+func TestQueuesUC_StreamResumeDoesntAckMessagesSentOutOfOrder(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:                 "testQueue",
+		Length:               10,
+		SubscribersAmount:    1,
+		VisibilityTimeoutSec: 10,
+		PriorityLevels:       3,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+	}
+
+	subscriberName := "subscriber"
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, qConfig.Name, subscriberName)
+	assert.Nil(t, err)
+	low, err := queuesUC.PublishMessage(ctx, qConfig.Name, jsonPayload(t, map[string]interface{}{"n": 1}), models.PublishOptions{})
+	assert.Nil(t, err)
+	high, err := queuesUC.PublishMessage(ctx, qConfig.Name, jsonPayload(t, map[string]interface{}{"n": 2}), models.PublishOptions{Priority: 2})
+	assert.Nil(t, err)
+
+	stream, err := queuesUC.OpenStream(ctx, qConfig.Name, subscriberName, nil)
+	assert.Nil(t, err)
+
+	// message with higher seq is sent first
+	messages, err := stream.Next(ctx, 0)
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(messages)) {
+		assert.Equal(t, high.ID, messages[0].ID)
+		assert.Equal(t, low.ID, messages[1].ID)
+	}
+
+	// client has received only the first message before it disconnected
+	lastSeq := messages[0].Seq
+	stream, err = queuesUC.OpenStream(ctx, qConfig.Name, subscriberName, &lastSeq)
+	assert.Nil(t, err)
+
+	q, err := queuesUC.GetByName(ctx, qConfig.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(q.Messages))
+
+	messages, err = stream.Next(ctx, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(messages))
+
+	// messages the client may have missed are redelivered once lease expires
+	shiftClock(queuesUC, 11*time.Second)
+
+	messages, err = stream.Next(ctx, 0)
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(messages)) {
+		assert.Equal(t, high.ID, messages[0].ID)
+		assert.Equal(t, low.ID, messages[1].ID)
+		assert.Equal(t, uint(2), messages[1].DeliveryCount)
+	}
+}
+
+func TestQueuesUC_CreateQueue(t *testing.T) {
+	t.Parallel()
+
+	queuesUC, cleanup := configureEnvironment(t, []config.QueueConfig{})
+	defer cleanup()
+
+	ctx := context.Background()
+	qConfig := config.QueueConfig{
+		Name:                 "testQueue",
+		Length:               2,
+		SubscribersAmount:    1,
+		VisibilityTimeoutSec: 10,
+	}
+
+	queue, err := queuesUC.CreateQueue(ctx, qConfig)
+	assert.Nil(t, err)
+	assert.Equal(t, qConfig.Name, queue.Name)
+	assert.Equal(t, qConfig.Length, queue.MaxLength)
+	assert.Equal(t, qConfig.SubscribersAmount, queue.MaxSubscribers)
+	assert.Equal(t, 10*time.Second, queue.VisibilityTimeout)
+
+	err = queuesUC.AddMessage(ctx, qConfig.Name, map[string]interface{}{"msg": "hello"})
+	assert.Nil(t, err)
+
+	_, err = queuesUC.CreateQueue(ctx, qConfig)
+	if assert.IsType(t, &queues.QueueErr{}, err) {
+		assert.Equal(t, queues.UseCaseConflictErr, err.(*queues.QueueErr).ErrType)
+	}
+
+	_, err = queuesUC.CreateQueue(ctx, config.QueueConfig{})
+	assert.NotNil(t, err)
+
+	// durations which overflow once multiplied by time.Second
+	for _, qConfig := range []config.QueueConfig{
+		{Name: "overflow", Length: 1, MessageTTLSec: maxDurationSec + 1},
+		{Name: "overflow", Length: 1, VisibilityTimeoutSec: -1},
+	} {
+		_, err = queuesUC.CreateQueue(ctx, qConfig)
+		if assert.IsType(t, &queues.QueueErr{}, err) {
+			assert.Equal(t, queues.UseCaseErr, err.(*queues.QueueErr).ErrType)
+		}
+	}
+	_, err = queuesUC.CreateQueue(ctx, config.QueueConfig{Name: "longest", Length: 1, MessageTTLSec: maxDurationSec})
+	assert.Nil(t, err)
+}
+
+func TestQueuesUC_UpdateQueueLimits(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            2,
+		SubscribersAmount: 1,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+	}
+
+	msgBody := map[string]interface{}{"msg": "hello"}
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddMessage(ctx, qConfig.Name, msgBody)
+	assert.Nil(t, err)
+	err = queuesUC.AddMessage(ctx, qConfig.Name, msgBody)
+	assert.Nil(t, err)
+
+	maxLength := uint(1)
+	visibilityTimeout := time.Minute
+	q, err := queuesUC.UpdateQueue(ctx, qConfig.Name, models.QueueLimits{MaxLength: &maxLength, VisibilityTimeout: &visibilityTimeout})
+	assert.Nil(t, err)
+	assert.Equal(t, uint(1), q.MaxLength)
+	assert.Equal(t, qConfig.SubscribersAmount, q.MaxSubscribers)
+	assert.Equal(t, time.Minute, q.VisibilityTimeout)
+
+	// messages above the new limit are kept
+	assert.Equal(t, 2, len(q.Messages))
+	err = queuesUC.AddMessage(ctx, qConfig.Name, msgBody)
+	assert.NotNil(t, err)
+
+	visibilityTimeout = 0
+	_, err = queuesUC.UpdateQueue(ctx, qConfig.Name, models.QueueLimits{VisibilityTimeout: &visibilityTimeout})
+	assert.NotNil(t, err)
+
+	// durations are kept in whole seconds, so fractional ones are rejected
+	// rather than rounded
+	visibilityTimeout = 1500 * time.Millisecond
+	_, err = queuesUC.UpdateQueue(ctx, qConfig.Name, models.QueueLimits{VisibilityTimeout: &visibilityTimeout})
+	assert.NotNil(t, err)
+	messageTTL := -time.Minute
+	_, err = queuesUC.UpdateQueue(ctx, qConfig.Name, models.QueueLimits{MessageTTL: &messageTTL})
+	assert.NotNil(t, err)
+
+	q, err = queuesUC.GetByName(ctx, qConfig.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Minute, q.VisibilityTimeout)
+	assert.Equal(t, time.Duration(0), q.MessageTTL)
+
+	_, err = queuesUC.UpdateQueue(ctx, "unknown", models.QueueLimits{MaxLength: &maxLength})
+	assert.NotNil(t, err)
+}
+
+func TestQueuesUC_PurgeQueue(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            2,
+		SubscribersAmount: 1,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+	}
+
+	subscriberName := "subscriber"
+	msgBody := map[string]interface{}{"msg": "hello"}
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, qConfig.Name, subscriberName)
+	assert.Nil(t, err)
+	err = queuesUC.AddMessage(ctx, qConfig.Name, msgBody)
+	assert.Nil(t, err)
+	messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(messages))
+	err = queuesUC.AddMessage(ctx, qConfig.Name, msgBody)
+	assert.Nil(t, err)
+
+	err = queuesUC.PurgeQueue(ctx, qConfig.Name)
+	assert.Nil(t, err)
+
+	q, err := queuesUC.GetByName(ctx, qConfig.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(q.Messages))
+	assert.Equal(t, 1, len(q.Subscribers))
+
+	err = queuesUC.AckMessage(ctx, qConfig.Name, subscriberName, messages[0].ID)
+	assert.NotNil(t, err)
+}
+
+func TestQueuesUC_DeleteQueueRejectsWaitingConsumer(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            1,
+		SubscribersAmount: 1,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+	}
+
+	subscriberName := "subscriber"
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, qConfig.Name, subscriberName)
+	assert.Nil(t, err)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		deleted, err := queuesUC.DeleteQueue(ctx, qConfig.Name, false)
+		assert.Nil(t, err)
+		assert.True(t, deleted)
+	}()
+
+	start := time.Now()
+	_, err = queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 5*time.Second)
+	if assert.IsType(t, &queues.QueueErr{}, err) {
+		assert.Equal(t, queues.UseCaseNotFoundErr, err.(*queues.QueueErr).ErrType)
+	}
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	_, err = queuesUC.GetByName(ctx, qConfig.Name)
+	assert.NotNil(t, err)
+
+	// name can be reused
+	_, err = queuesUC.CreateQueue(ctx, qConfig)
+	assert.Nil(t, err)
+}
+
+func TestQueuesUC_DrainedQueueIsDeletedAfterAck(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            2,
+		SubscribersAmount: 2,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+	}
+
+	subscriberName := "subscriber"
+	msgBody := map[string]interface{}{"msg": "hello"}
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, qConfig.Name, subscriberName)
+	assert.Nil(t, err)
+	err = queuesUC.AddMessage(ctx, qConfig.Name, msgBody)
+	assert.Nil(t, err)
+
+	deleted, err := queuesUC.DeleteQueue(ctx, qConfig.Name, true)
+	assert.Nil(t, err)
+	assert.False(t, deleted)
+
+	// draining queue doesn't accept new messages and subscribers
+	err = queuesUC.AddMessage(ctx, qConfig.Name, msgBody)
+	assert.NotNil(t, err)
+	err = queuesUC.AddSubscriber(ctx, qConfig.Name, "subscriber2")
+	assert.NotNil(t, err)
+
+	messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(messages))
+
+	err = queuesUC.AckMessage(ctx, qConfig.Name, subscriberName, messages[0].ID)
+	assert.Nil(t, err)
+
+	_, err = queuesUC.GetByName(ctx, qConfig.Name)
+	assert.NotNil(t, err)
+}
+
+func TestQueuesUC_DrainEmptyQueueDeletesItRightAway(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            1,
+		SubscribersAmount: 1,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+	}
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	deleted, err := queuesUC.DeleteQueue(ctx, qConfig.Name, true)
+	assert.Nil(t, err)
+	assert.True(t, deleted)
+
+	_, err = queuesUC.GetByName(ctx, qConfig.Name)
+	assert.NotNil(t, err)
+}
+
+func TestQueuesUC_UnsubscribeDeletesMessagesSeenByTheRest(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            2,
+		SubscribersAmount: 2,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+	}
+
+	msgBody := map[string]interface{}{"msg": "hello"}
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, qConfig.Name, "subscriber1")
+	assert.Nil(t, err)
+	err = queuesUC.AddSubscriber(ctx, qConfig.Name, "subscriber2")
+	assert.Nil(t, err)
+	err = queuesUC.AddMessage(ctx, qConfig.Name, msgBody)
+	assert.Nil(t, err)
+	err = queuesUC.AddMessage(ctx, qConfig.Name, msgBody)
+	assert.Nil(t, err)
+
+	messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, "subscriber1", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(messages))
+	err = queuesUC.AckMessage(ctx, qConfig.Name, "subscriber1", messages[0].ID)
+	assert.Nil(t, err)
+
+	// subscriber2 never consumes, so the acknowledged message stays
+	q, err := queuesUC.GetByName(ctx, qConfig.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(q.Messages))
+
+	err = queuesUC.RemoveSubscriber(ctx, qConfig.Name, "subscriber2")
+	assert.Nil(t, err)
+
+	q, err = queuesUC.GetByName(ctx, qConfig.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(q.Messages))
+	assert.Equal(t, messages[1].ID, q.Messages[0].ID)
+	assert.False(t, q.HasSubscriber("subscriber2"))
+
+	err = queuesUC.RemoveSubscriber(ctx, qConfig.Name, "subscriber2")
+	if assert.IsType(t, &queues.QueueErr{}, err) {
+		assert.Equal(t, queues.UseCaseNotFoundErr, err.(*queues.QueueErr).ErrType)
+	}
+
+	// the last subscriber leaves messages for future subscribers
+	err = queuesUC.RemoveSubscriber(ctx, qConfig.Name, "subscriber1")
+	assert.Nil(t, err)
+
+	q, err = queuesUC.GetByName(ctx, qConfig.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(q.Messages))
+}
+
+func TestQueuesUC_IdleSubscriberIsEvicted(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:                     "testQueue",
+		Length:                   1,
+		SubscribersAmount:        2,
+		SubscriberIdleTimeoutSec: 60,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+	}
+
+	msgBody := map[string]interface{}{"msg": "hello"}
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, qConfig.Name, "active")
+	assert.Nil(t, err)
+	err = queuesUC.AddSubscriber(ctx, qConfig.Name, "idle")
+	assert.Nil(t, err)
+	err = queuesUC.AddMessage(ctx, qConfig.Name, msgBody)
+	assert.Nil(t, err)
+
+	shiftClock(queuesUC, 40*time.Second)
+	messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, "active", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(messages))
+	err = queuesUC.AckMessage(ctx, qConfig.Name, "active", messages[0].ID)
+	assert.Nil(t, err)
+
+	queuesUC.EvictIdleSubscribers(ctx)
+	q, err := queuesUC.GetByName(ctx, qConfig.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(q.Subscribers))
+
+	shiftClock(queuesUC, 30*time.Second)
+	queuesUC.EvictIdleSubscribers(ctx)
+
+	q, err = queuesUC.GetByName(ctx, qConfig.Name)
+	assert.Nil(t, err)
+	assert.True(t, q.HasSubscriber("active"))
+	assert.False(t, q.HasSubscriber("idle"))
+	// message acknowledged by the only subscriber left is deleted
+	assert.Equal(t, 0, len(q.Messages))
+}
+
+func TestQueuesUC_ExpiredMessageIsDeleted(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            2,
+		SubscribersAmount: 2,
+		MessageTTLSec:     60,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+	}
+
+	msgBody := map[string]interface{}{"msg": "hello"}
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, qConfig.Name, "subscriber1")
+	assert.Nil(t, err)
+	err = queuesUC.AddSubscriber(ctx, qConfig.Name, "subscriber2")
+	assert.Nil(t, err)
+
+	// own TTL overrides the default one of the queue
+	_, err = queuesUC.PublishMessage(ctx, qConfig.Name, jsonPayload(t, msgBody), models.PublishOptions{TTL: 10 * time.Second})
+	assert.Nil(t, err)
+	err = queuesUC.AddMessage(ctx, qConfig.Name, msgBody)
+	assert.Nil(t, err)
+
+	messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, "subscriber1", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(messages))
+	if assert.NotNil(t, messages[0].ExpiresAt) {
+		assert.InDelta(t, 50, messages[1].ExpiresAt.Sub(*messages[0].ExpiresAt).Seconds(), 1)
+	}
+
+	// expired message isn't delivered even before reaper deletes it
+	shiftClock(queuesUC, 11*time.Second)
+	messages, err = queuesUC.ConsumeMessages(ctx, qConfig.Name, "subscriber2", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(messages))
+
+	queuesUC.ExpireMessages(ctx)
+
+	q, err := queuesUC.GetByName(ctx, qConfig.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(q.Messages))
+	assert.Equal(t, uint64(1), q.Stats.Expired)
+
+	// publish frees capacity taken by expired messages
+	err = queuesUC.AddMessage(ctx, qConfig.Name, msgBody)
+	assert.Nil(t, err)
+	shiftClock(queuesUC, 50*time.Second)
+	err = queuesUC.AddMessage(ctx, qConfig.Name, msgBody)
+	assert.Nil(t, err)
+
+	q, err = queuesUC.GetByName(ctx, qConfig.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(q.Messages))
+	assert.Equal(t, uint64(2), q.Stats.Expired)
+}
+
+func TestQueuesUC_ExpiredMessageKeptForDeadLetterQueueDoesntTakeCapacity(t *testing.T) {
+	t.Parallel()
+
+	qs := []config.QueueConfig{
+		{Name: "dlq", Length: 1, SubscribersAmount: 1},
+		{Name: "testQueue", Length: 1, SubscribersAmount: 1, DeadLetterQueue: "dlq"},
+	}
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddMessage(ctx, "dlq", map[string]interface{}{"msg": "dlq is full"})
+	assert.Nil(t, err)
+	_, err = queuesUC.PublishMessage(ctx, "testQueue", jsonPayload(t, map[string]interface{}{"msg": "expiring"}), models.PublishOptions{TTL: time.Second})
+	assert.Nil(t, err)
+
+	// full dead-letter queue can't accept expired message, so it's kept but
+	// the queue accepts a new one in its place
+	shiftClock(queuesUC, 2*time.Second)
+	err = queuesUC.AddMessage(ctx, "testQueue", map[string]interface{}{"msg": "hello"})
+	assert.Nil(t, err)
+	err = queuesUC.AddMessage(ctx, "testQueue", map[string]interface{}{"msg": "hello"})
+	assert.NotNil(t, err)
+
+	q, err := queuesUC.GetByName(ctx, "testQueue")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(q.Messages))
+	assert.Equal(t, uint64(0), q.Stats.Expired)
+
+	// expired message is moved once dead-letter queue has room for it
+	err = queuesUC.PurgeQueue(ctx, "dlq")
+	assert.Nil(t, err)
+	queuesUC.ExpireMessages(ctx)
+
+	q, err = queuesUC.GetByName(ctx, "testQueue")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(q.Messages))
+	assert.Equal(t, uint64(1), q.Stats.Expired)
+}
+
+func TestQueuesUC_OverDeliveredMessageIsDeadLettered(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            1,
+		SubscribersAmount: 1,
+		DeadLetterQueue:   "dlq",
+		MaxDeliveries:     2,
+	}
+	dlqConfig := config.QueueConfig{
+		Name:              "dlq",
+		Length:            10,
+		SubscribersAmount: 1,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+		dlqConfig,
+	}
+
+	subscriberName := "subscriber"
+	msgBody := map[string]interface{}{"msg": "hello"}
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, qConfig.Name, subscriberName)
+	assert.Nil(t, err)
+	err = queuesUC.AddSubscriber(ctx, dlqConfig.Name, subscriberName)
+	assert.Nil(t, err)
+	err = queuesUC.AddMessage(ctx, qConfig.Name, msgBody)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2; i++ {
+		messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(messages))
+		err = queuesUC.NackMessage(ctx, qConfig.Name, subscriberName, messages[0].ID)
+		assert.Nil(t, err)
+	}
+
+	messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(messages))
+
+	q, err := queuesUC.GetByName(ctx, qConfig.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(q.Messages))
+
+	deadLetters, err := queuesUC.ConsumeMessages(ctx, dlqConfig.Name, subscriberName, 0)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(deadLetters)) {
+		assert.Equal(t, msgBody, jsonBody(t, deadLetters[0].Payload))
+		if assert.NotNil(t, deadLetters[0].DeadLetter) {
+			assert.Equal(t, qConfig.Name, deadLetters[0].DeadLetter.SourceQueue)
+			assert.Equal(t, models.DeadLetterMaxDeliveries, deadLetters[0].DeadLetter.Reason)
+			assert.Equal(t, subscriberName, deadLetters[0].DeadLetter.Subscriber)
+			assert.Equal(t, uint(2), deadLetters[0].DeadLetter.DeliveryCount)
+		}
+	}
+}
+
+func TestQueuesUC_ExhaustedDeliveriesAreDeadLettered(t *testing.T) {
+	t.Parallel()
+
+	qs := []config.QueueConfig{
+		{Name: "testQueue", Length: 2, SubscribersAmount: 1, DeadLetterQueue: "dlq", MaxDeliveries: 2, VisibilityTimeoutSec: 10},
+		{Name: "dlq", Length: 10, SubscribersAmount: 1},
+	}
+	subscriberName := "subscriber"
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, "testQueue", subscriberName)
+	assert.Nil(t, err)
+	err = queuesUC.AddMessage(ctx, "testQueue", map[string]interface{}{"msg": "nacked"})
+	assert.Nil(t, err)
+
+	deadLetters := func() []*models.QueueMessage {
+		dlq, err := queuesUC.GetByName(ctx, "dlq")
+		assert.Nil(t, err)
+		return dlq.Messages
+	}
+
+	// the last nack dead-letters message without waiting for the next lease
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, 0, len(deadLetters()))
+		messages, err := queuesUC.ConsumeMessages(ctx, "testQueue", subscriberName, 0)
+		assert.Nil(t, err)
+		if assert.Equal(t, 1, len(messages)) {
+			err = queuesUC.NackMessage(ctx, "testQueue", subscriberName, messages[0].ID)
+			assert.Nil(t, err)
+		}
+	}
+	if assert.Equal(t, 1, len(deadLetters())) {
+		assert.Equal(t, models.DeadLetterMaxDeliveries, deadLetters()[0].DeadLetter.Reason)
+		assert.Equal(t, uint(2), deadLetters()[0].DeadLetter.DeliveryCount)
+	}
+
+	// message whose lease has expired for the last time is dead-lettered on
+	// the next lease
+	err = queuesUC.AddMessage(ctx, "testQueue", map[string]interface{}{"msg": "timed out"})
+	assert.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		messages, err := queuesUC.ConsumeMessages(ctx, "testQueue", subscriberName, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(messages))
+		shiftClock(queuesUC, 11*time.Second)
+	}
+	assert.Equal(t, 1, len(deadLetters()))
+
+	messages, err := queuesUC.ConsumeMessages(ctx, "testQueue", subscriberName, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(messages))
+	if assert.Equal(t, 2, len(deadLetters())) {
+		assert.Equal(t, map[string]interface{}{"msg": "timed out"}, jsonBody(t, deadLetters()[1].Payload))
+	}
+
+	q, err := queuesUC.GetByName(ctx, "testQueue")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(q.Messages))
+}
+
+func TestQueuesUC_RedriveRestoresMessageOptions(t *testing.T) {
+	t.Parallel()
+
+	qs := []config.QueueConfig{
+		{Name: "testQueue", Length: 10, SubscribersAmount: 1, DeadLetterQueue: "dlq", PriorityLevels: 3, DeduplicationWindowSec: 600},
+		{Name: "dlq", Length: 10, SubscribersAmount: 1},
+	}
+	subscriberName := "subscriber"
+
+	uc, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+	// dead-letters scheduled message directly, it can't get there before it's due otherwise
+	queuesUC := uc.(*queuesUC)
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, "testQueue", subscriberName)
+	assert.Nil(t, err)
+	_, err = queuesUC.PublishMessage(ctx, "testQueue", jsonPayload(t, map[string]interface{}{"msg": "urgent"}), models.PublishOptions{Priority: 2, TTL: time.Minute, DeduplicationID: "key1"})
+	assert.Nil(t, err)
+	err = queuesUC.AddMessage(ctx, "testQueue", map[string]interface{}{"msg": "ordinary"})
+	assert.Nil(t, err)
+
+	messages, err := queuesUC.ConsumeMessages(ctx, "testQueue", subscriberName, 0)
+	assert.Nil(t, err)
+	if !assert.Equal(t, 2, len(messages)) {
+		return
+	}
+	assert.Equal(t, uint(2), messages[0].Priority)
+	err = queuesUC.RejectMessage(ctx, "testQueue", subscriberName, messages[0].ID)
+	assert.Nil(t, err)
+
+	// scheduled message is dead-lettered before it's due
+	_, err = queuesUC.PublishMessage(ctx, "testQueue", jsonPayload(t, map[string]interface{}{"msg": "scheduled"}), models.PublishOptions{Delay: 30 * time.Second, TTL: time.Minute})
+	assert.Nil(t, err)
+	q, err := queuesUC.lockQueue(ctx, "testQueue")
+	if !assert.Nil(t, err) {
+		return
+	}
+	scheduled := q.Messages[len(q.Messages)-1]
+	moved, err := queuesUC.deadLetter(ctx, q, []*models.QueueMessage{scheduled}, "", models.DeadLetterExpired)
+	if assert.Nil(t, err) && assert.True(t, moved) {
+		err = queuesUC.queuesRepo.DeleteMessages(ctx, q.Name, []string{scheduled.ID})
+		assert.Nil(t, err)
+	}
+	q.Unlock()
+
+	dlq, err := queuesUC.GetByName(ctx, "dlq")
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(dlq.Messages)) {
+		urgent := dlq.Messages[0].DeadLetter
+		assert.Equal(t, uint(2), urgent.Priority)
+		assert.InDelta(t, time.Minute.Seconds(), urgent.RemainingTTL.Seconds(), 1)
+		assert.Equal(t, time.Duration(0), urgent.RemainingDelay)
+		assert.Equal(t, "key1", urgent.DeduplicationID)
+		// options aren't applied to the dead-lettered copy itself
+		assert.Equal(t, uint(0), dlq.Messages[0].Priority)
+		assert.Nil(t, dlq.Messages[0].Deduplication)
+
+		assert.InDelta(t, (30 * time.Second).Seconds(), dlq.Messages[1].DeadLetter.RemainingDelay.Seconds(), 1)
+		assert.InDelta(t, time.Minute.Seconds(), dlq.Messages[1].DeadLetter.RemainingTTL.Seconds(), 1)
+	}
+
+	// time spent in dead-letter queue doesn't count
+	shiftClock(queuesUC, 10*time.Minute)
+	redriven, err := queuesUC.RedriveMessages(ctx, "dlq", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, redriven)
+
+	err = queuesUC.AckMessage(ctx, "testQueue", subscriberName, messages[1].ID)
+	assert.Nil(t, err)
+
+	messages, err = queuesUC.ConsumeMessages(ctx, "testQueue", subscriberName, 0)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(messages)) {
+		assert.Equal(t, map[string]interface{}{"msg": "urgent"}, jsonBody(t, messages[0].Payload))
+		assert.Equal(t, uint(2), messages[0].Priority)
+		if assert.NotNil(t, messages[0].ExpiresAt) {
+			assert.InDelta(t, time.Minute.Seconds(), messages[0].ExpiresAt.Sub(queuesUC.now()).Seconds(), 1)
+		}
+	}
+
+	// redriven message is remembered by its deduplication ID
+	duplicate, err := queuesUC.PublishMessage(ctx, "testQueue", jsonPayload(t, map[string]interface{}{"msg": "urgent"}), models.PublishOptions{Priority: 2, DeduplicationID: "key1"})
+	assert.Nil(t, err)
+	assert.Equal(t, messages[0].ID, duplicate.ID)
+	err = queuesUC.AckMessage(ctx, "testQueue", subscriberName, messages[0].ID)
+	assert.Nil(t, err)
+
+	// scheduled message is due 30 seconds after redrive
+	shiftClock(queuesUC, 31*time.Second)
+	messages, err = queuesUC.ConsumeMessages(ctx, "testQueue", subscriberName, 0)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(messages)) {
+		assert.Equal(t, map[string]interface{}{"msg": "scheduled"}, jsonBody(t, messages[0].Payload))
+	}
+}
+
+func TestQueuesUC_RejectedAndExpiredMessagesAreRedriven(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            2,
+		SubscribersAmount: 1,
+		DeadLetterQueue:   "dlq",
+	}
+	dlqConfig := config.QueueConfig{
+		Name:              "dlq",
+		Length:            10,
+		SubscribersAmount: 1,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+		dlqConfig,
+	}
+
+	subscriberName := "subscriber"
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, qConfig.Name, subscriberName)
+	assert.Nil(t, err)
+	err = queuesUC.AddMessage(ctx, qConfig.Name, map[string]interface{}{"msg": "rejected"})
+	assert.Nil(t, err)
+	_, err = queuesUC.PublishMessage(ctx, qConfig.Name, jsonPayload(t, map[string]interface{}{"msg": "expired"}), models.PublishOptions{TTL: time.Second})
+	assert.Nil(t, err)
+
+	messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(messages))
+
+	err = queuesUC.RejectMessage(ctx, qConfig.Name, subscriberName, messages[0].ID)
+	assert.Nil(t, err)
+
+	shiftClock(queuesUC, 2*time.Second)
+	queuesUC.ExpireMessages(ctx)
+
+	q, err := queuesUC.GetByName(ctx, qConfig.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(q.Messages))
+
+	dlq, err := queuesUC.GetByName(ctx, dlqConfig.Name)
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(dlq.Messages)) {
+		assert.Equal(t, models.DeadLetterRejected, dlq.Messages[0].DeadLetter.Reason)
+		assert.Equal(t, messages[0].ID, dlq.Messages[0].DeadLetter.OriginalID)
+		assert.Equal(t, models.DeadLetterExpired, dlq.Messages[1].DeadLetter.Reason)
+		assert.Equal(t, messages[1].ID, dlq.Messages[1].DeadLetter.OriginalID)
+	}
+
+	redriven, err := queuesUC.RedriveMessages(ctx, dlqConfig.Name, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, redriven)
+
+	redriven, err = queuesUC.RedriveMessages(ctx, dlqConfig.Name, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, redriven)
+
+	dlq, err = queuesUC.GetByName(ctx, dlqConfig.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(dlq.Messages))
+
+	messages, err = queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 0)
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(messages)) {
+		assert.Equal(t, map[string]interface{}{"msg": "rejected"}, jsonBody(t, messages[0].Payload))
+		assert.Equal(t, map[string]interface{}{"msg": "expired"}, jsonBody(t, messages[1].Payload))
+		assert.Nil(t, messages[0].DeadLetter)
+	}
+}
+
+func TestQueuesUC_RejectWaitsForBusyDeadLetterQueue(t *testing.T) {
+	t.Parallel()
+
+	uc, cleanup := configureEnvironment(t, []config.QueueConfig{
+		{Name: "testQueue", Length: 1, SubscribersAmount: 1, DeadLetterQueue: "dlq"},
+		{Name: "dlq", Length: 1, SubscribersAmount: 1},
+	})
+	defer cleanup()
+	queuesUC := uc.(*queuesUC)
+
+	ctx := context.Background()
+	subscriberName := "subscriber"
+
+	err := queuesUC.AddSubscriber(ctx, "testQueue", subscriberName)
+	assert.Nil(t, err)
+	err = queuesUC.AddMessage(ctx, "testQueue", map[string]interface{}{"msg": "rejected"})
+	assert.Nil(t, err)
+	messages, err := queuesUC.ConsumeMessages(ctx, "testQueue", subscriberName, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(messages))
+
+	// dead-letter queue is held by another request, e.g. a publish
+	dlq, err := queuesUC.lockQueue(ctx, "dlq")
+	assert.Nil(t, err)
+
+	rejected := make(chan error, 1)
+	go func() {
+		rejected <- queuesUC.RejectMessage(ctx, "testQueue", subscriberName, messages[0].ID)
+	}()
+
+	select {
+	case err := <-rejected:
+		t.Fatalf("reject hasn't waited for dead-letter queue: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	dlq.Unlock()
+
+	assert.Nil(t, <-rejected)
+
+	snapshot, err := queuesUC.GetByName(ctx, "dlq")
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(snapshot.Messages)) {
+		assert.Equal(t, models.DeadLetterRejected, snapshot.Messages[0].DeadLetter.Reason)
+	}
+}
+
+func TestQueuesUC_DeadLetterQueueMustExist(t *testing.T) {
+	t.Parallel()
+
+	queuesUC, cleanup := configureEnvironment(t, []config.QueueConfig{{Name: "dlq", Length: 1}})
+	defer cleanup()
+
+	ctx := context.Background()
+	isUseCaseErr := func(err error) bool {
+		qErr, ok := err.(*queues.QueueErr)
+		return ok && qErr.ErrType == queues.UseCaseErr
+	}
+
+	_, err := queuesUC.CreateQueue(ctx, config.QueueConfig{Name: "testQueue", Length: 1, DeadLetterQueue: "testQueue"})
+	assert.True(t, isUseCaseErr(err), err)
+	_, err = queuesUC.CreateQueue(ctx, config.QueueConfig{Name: "testQueue", Length: 1, DeadLetterQueue: "unknown"})
+	assert.True(t, isUseCaseErr(err), err)
+	_, err = queuesUC.CreateQueue(ctx, config.QueueConfig{Name: "testQueue", Length: 1, DeadLetterQueue: "dlq"})
+	assert.Nil(t, err)
+
+	for _, deadLetterQueue := range []string{"testQueue", "unknown"} {
+		_, err = queuesUC.UpdateQueue(ctx, "testQueue", models.QueueLimits{DeadLetterQueue: &deadLetterQueue})
+		assert.True(t, isUseCaseErr(err), err)
+	}
+
+	// dead-letter queue can be unset
+	noDeadLetterQueue := ""
+	q, err := queuesUC.UpdateQueue(ctx, "testQueue", models.QueueLimits{DeadLetterQueue: &noDeadLetterQueue})
+	assert.Nil(t, err)
+	assert.Equal(t, "", q.DeadLetterQueue)
+}
+
+func TestQueuesUC_ScheduledMessageIsDeliveredWhenDue(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            2,
+		SubscribersAmount: 1,
+		MessageTTLSec:     10,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+	}
+
+	subscriberName := "subscriber"
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, qConfig.Name, subscriberName)
+	assert.Nil(t, err)
+	_, err = queuesUC.PublishMessage(ctx, qConfig.Name, jsonPayload(t, map[string]interface{}{"msg": "later"}), models.PublishOptions{Delay: time.Minute})
+	assert.Nil(t, err)
+	_, err = queuesUC.PublishMessage(ctx, qConfig.Name, jsonPayload(t, map[string]interface{}{"msg": "at"}), models.PublishOptions{DeliverAt: time.Now().Add(time.Hour)})
+	assert.Nil(t, err)
+
+	// scheduled messages take capacity of the queue
+	err = queuesUC.AddMessage(ctx, qConfig.Name, map[string]interface{}{"msg": "now"})
+	assert.NotNil(t, err)
+
+	_, err = queuesUC.PublishMessage(ctx, qConfig.Name, jsonPayload(t, map[string]interface{}{"msg": "both"}), models.PublishOptions{Delay: time.Minute, DeliverAt: time.Now()})
+	assert.NotNil(t, err)
+
+	q, err := queuesUC.GetByName(ctx, qConfig.Name)
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(q.Messages)) {
+		assert.True(t, q.Messages[0].Scheduled)
+		assert.True(t, q.Messages[1].Scheduled)
+		// time-to-live counts from the delivery time
+		assert.Equal(t, q.Messages[0].DeliverAt.Add(10*time.Second), q.Messages[0].ExpiresAt)
+	}
+
+	messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(messages))
+
+	shiftClock(queuesUC, 65*time.Second)
+
+	messages, err = queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 0)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(messages)) {
+		assert.Equal(t, map[string]interface{}{"msg": "later"}, jsonBody(t, messages[0].Payload))
+	}
+
+	q, err = queuesUC.GetByName(ctx, qConfig.Name)
+	assert.Nil(t, err)
+	assert.False(t, q.Messages[0].Scheduled)
+	assert.True(t, q.Messages[1].Scheduled)
+}
+
+func TestQueuesUC_WaitingConsumerGetsScheduledMessage(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            1,
+		SubscribersAmount: 1,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+	}
+
+	subscriberName := "subscriber"
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, qConfig.Name, subscriberName)
+	assert.Nil(t, err)
+	_, err = queuesUC.PublishMessage(ctx, qConfig.Name, jsonPayload(t, map[string]interface{}{"msg": "hello"}), models.PublishOptions{Delay: 200 * time.Millisecond})
+	assert.Nil(t, err)
+
+	start := time.Now()
+	messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 5*time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(messages))
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+}
+
+func TestQueuesUC_HigherPriorityMessagesAreConsumedFirst(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            10,
+		SubscribersAmount: 1,
+		PriorityLevels:    3,
+		PriorityAgingSec:  60,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+	}
+
+	subscriberName := "subscriber"
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, qConfig.Name, subscriberName)
+	assert.Nil(t, err)
+
+	_, err = queuesUC.PublishMessage(ctx, qConfig.Name, jsonPayload(t, map[string]interface{}{"msg": "too high"}), models.PublishOptions{Priority: 3})
+	assert.NotNil(t, err)
+
+	for i, priority := range []uint{0, 2, 1, 2} {
+		_, err = queuesUC.PublishMessage(ctx, qConfig.Name, jsonPayload(t, map[string]interface{}{"n": float64(i)}), models.PublishOptions{Priority: priority})
+		assert.Nil(t, err)
+	}
+
+	messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 0)
+	assert.Nil(t, err)
+	order := make([]interface{}, 0, len(messages))
+	for _, message := range messages {
+		order = append(order, jsonBody(t, message.Payload)["n"])
+	}
+	assert.Equal(t, []interface{}{float64(1), float64(3), float64(2), float64(0)}, order)
+	assert.Equal(t, uint(2), messages[0].Priority)
+
+	for _, message := range messages {
+		err = queuesUC.NackMessage(ctx, qConfig.Name, subscriberName, message.ID)
+		assert.Nil(t, err)
+	}
+
+	// after two minutes of waiting every message reaches the top level, so
+	// they are consumed in publish order
+	shiftClock(queuesUC, 2*time.Minute)
+
+	messages, err = queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 0)
+	assert.Nil(t, err)
+	order = order[:0]
+	for _, message := range messages {
+		order = append(order, jsonBody(t, message.Payload)["n"])
+	}
+	assert.Equal(t, []interface{}{float64(0), float64(1), float64(2), float64(3)}, order)
+}
+
+func TestQueuesUC_PriorityIsRejectedByQueueWithoutLevels(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            1,
+		SubscribersAmount: 1,
+	}
+
+	queuesUC, cleanup := configureEnvironment(t, []config.QueueConfig{qConfig})
+	defer cleanup()
+
+	_, err := queuesUC.PublishMessage(context.Background(), qConfig.Name, jsonPayload(t, map[string]interface{}{"msg": "hello"}), models.PublishOptions{Priority: 1})
+	assert.NotNil(t, err)
+}
+
+func TestQueuesUC_CompetingSubscribersShareMessages(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            10,
+		SubscribersAmount: 2,
+		DeliveryMode:      models.DeliveryCompeting,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+	}
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	for _, subscriberName := range []string{"subscriber1", "subscriber2"} {
+		err := queuesUC.AddSubscriber(ctx, qConfig.Name, subscriberName)
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 4; i++ {
+		err := queuesUC.AddMessage(ctx, qConfig.Name, map[string]interface{}{"n": float64(i)})
+		assert.Nil(t, err)
+	}
+
+	// every subscriber gets its fair share
+	messages1, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, "subscriber1", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(messages1))
+
+	messages2, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, "subscriber2", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(messages2))
+
+	seen := map[interface{}]struct{}{}
+	for _, message := range append(messages1, messages2...) {
+		seen[jsonBody(t, message.Payload)["n"]] = struct{}{}
+	}
+	assert.Equal(t, 4, len(seen))
+
+	messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, "subscriber1", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(messages))
+
+	// message acknowledged by one subscriber is done
+	err = queuesUC.AckMessage(ctx, qConfig.Name, "subscriber1", messages1[0].ID)
+	assert.Nil(t, err)
+
+	q, err := queuesUC.GetByName(ctx, qConfig.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(q.Messages))
+
+	// released message goes to another subscriber
+	err = queuesUC.NackMessage(ctx, qConfig.Name, "subscriber2", messages2[0].ID)
+	assert.Nil(t, err)
+
+	messages, err = queuesUC.ConsumeMessages(ctx, qConfig.Name, "subscriber1", 0)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(messages)) {
+		assert.Equal(t, messages2[0].ID, messages[0].ID)
+	}
+
+	messages, err = queuesUC.ConsumeMessages(ctx, qConfig.Name, "subscriber2", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(messages))
+}
+
+func TestQueuesUC_CompetingMessageIsRedeliveredAfterLeaseExpires(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:                 "testQueue",
+		Length:               1,
+		SubscribersAmount:    2,
+		VisibilityTimeoutSec: 10,
+		DeadLetterQueue:      "dlq",
+		MaxDeliveries:        2,
+		DeliveryMode:         models.DeliveryCompeting,
+	}
+	dlqConfig := config.QueueConfig{
+		Name:              "dlq",
+		Length:            1,
+		SubscribersAmount: 1,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+		dlqConfig,
+	}
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	for _, subscriberName := range []string{"subscriber1", "subscriber2"} {
+		err := queuesUC.AddSubscriber(ctx, qConfig.Name, subscriberName)
+		assert.Nil(t, err)
+	}
+	err := queuesUC.AddMessage(ctx, qConfig.Name, map[string]interface{}{"msg": "hello"})
+	assert.Nil(t, err)
+
+	messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, "subscriber1", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(messages))
+
+	messages, err = queuesUC.ConsumeMessages(ctx, qConfig.Name, "subscriber2", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(messages))
+
+	shiftClock(queuesUC, 11*time.Second)
+
+	messages, err = queuesUC.ConsumeMessages(ctx, qConfig.Name, "subscriber2", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(messages))
+
+	// deliveries to all subscribers count towards MaxDeliveries
+	shiftClock(queuesUC, 11*time.Second)
+
+	messages, err = queuesUC.ConsumeMessages(ctx, qConfig.Name, "subscriber1", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(messages))
+
+	q, err := queuesUC.GetByName(ctx, qConfig.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(q.Messages))
+
+	dlq, err := queuesUC.GetByName(ctx, dlqConfig.Name)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(dlq.Messages)) {
+		assert.Equal(t, uint(2), dlq.Messages[0].DeadLetter.DeliveryCount)
+	}
+}
+
+func TestQueuesUC_UnknownDeliveryModeIsRejected(t *testing.T) {
+	t.Parallel()
+
+	queuesUC, cleanup := configureEnvironment(t, []config.QueueConfig{})
+	defer cleanup()
+
+	_, err := queuesUC.CreateQueue(context.Background(), config.QueueConfig{Name: "testQueue", Length: 1, DeliveryMode: "broadcast"})
+	assert.NotNil(t, err)
+}
+
+func TestQueuesUC_ConsumerGroupsReceiveEveryMessageOnce(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            10,
+		SubscribersAmount: 4,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+	}
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddGroupSubscriber(ctx, qConfig.Name, "member1", "group1")
+	assert.Nil(t, err)
+	err = queuesUC.AddGroupSubscriber(ctx, qConfig.Name, "member2", "group1")
+	assert.Nil(t, err)
+	err = queuesUC.AddGroupSubscriber(ctx, qConfig.Name, "member3", "group2")
+	assert.Nil(t, err)
+	err = queuesUC.AddSubscriber(ctx, qConfig.Name, "subscriber")
+	assert.Nil(t, err)
+
+	for i := 0; i < 4; i++ {
+		err = queuesUC.AddMessage(ctx, qConfig.Name, map[string]interface{}{"n": float64(i)})
+		assert.Nil(t, err)
+	}
+
+	// members of group share messages
+	messages1, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, "member1", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(messages1))
+	messages2, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, "member2", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(messages2))
+
+	// other groups and subscribers receive every message
+	messages3, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, "member3", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(messages3))
+	messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, "subscriber", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(messages))
+
+	for _, message := range messages1 {
+		err = queuesUC.AckMessage(ctx, qConfig.Name, "member1", message.ID)
+		assert.Nil(t, err)
+	}
+	for _, message := range messages2 {
+		err = queuesUC.AckMessage(ctx, qConfig.Name, "member2", message.ID)
+		assert.Nil(t, err)
+	}
+
+	groups, err := queuesUC.GetGroups(ctx, qConfig.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, []models.ConsumerGroup{
+		{Name: "group1", Members: []string{"member1", "member2"}, Lag: 0, InFlight: 0},
+		{Name: "group2", Members: []string{"member3"}, Lag: 4, InFlight: 4},
+	}, groups)
+
+	for _, message := range messages3 {
+		err = queuesUC.AckMessage(ctx, qConfig.Name, "member3", message.ID)
+		assert.Nil(t, err)
+	}
+
+	q, err := queuesUC.GetByName(ctx, qConfig.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(q.Messages))
+
+	for _, message := range messages {
+		err = queuesUC.AckMessage(ctx, qConfig.Name, "subscriber", message.ID)
+		assert.Nil(t, err)
+	}
+
+	q, err = queuesUC.GetByName(ctx, qConfig.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(q.Messages))
+}
+
+func TestQueuesUC_ConsumerGroupIsRebalancedWhenMemberLeaves(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            10,
+		SubscribersAmount: 3,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+	}
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddGroupSubscriber(ctx, qConfig.Name, "member1", "group")
+	assert.Nil(t, err)
+	err = queuesUC.AddGroupSubscriber(ctx, qConfig.Name, "member2", "group")
+	assert.Nil(t, err)
+	err = queuesUC.AddSubscriber(ctx, qConfig.Name, "subscriber")
+	assert.Nil(t, err)
+
+	for i := 0; i < 2; i++ {
+		err = queuesUC.AddMessage(ctx, qConfig.Name, map[string]interface{}{"n": float64(i)})
+		assert.Nil(t, err)
+	}
+
+	messages1, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, "member1", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(messages1))
+	messages2, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, "member2", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(messages2))
+
+	err = queuesUC.AckMessage(ctx, qConfig.Name, "member2", messages2[0].ID)
+	assert.Nil(t, err)
+
+	// message in flight of leaving member goes to the rest of the group, while
+	// acknowledgements of the group are kept
+	err = queuesUC.RemoveSubscriber(ctx, qConfig.Name, "member1")
+	assert.Nil(t, err)
+
+	messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, "member2", 0)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(messages)) {
+		assert.Equal(t, messages1[0].ID, messages[0].ID)
+	}
+
+	// acknowledgements of the group are forgotten with its last member
+	err = queuesUC.RemoveSubscriber(ctx, qConfig.Name, "member2")
+	assert.Nil(t, err)
+
+	groups, err := queuesUC.GetGroups(ctx, qConfig.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(groups))
+
+	q, err := queuesUC.GetByName(ctx, qConfig.Name)
+	assert.Nil(t, err)
+	for _, message := range q.Messages {
+		assert.Equal(t, 0, len(message.SeenBy))
+	}
+}
+
+func TestQueuesUC_ConsumerGroupNamesDontClashWithSubscribers(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            1,
+		SubscribersAmount: 4,
+	}
+
+	queuesUC, cleanup := configureEnvironment(t, []config.QueueConfig{qConfig})
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, qConfig.Name, "subscriber")
+	assert.Nil(t, err)
+	err = queuesUC.AddGroupSubscriber(ctx, qConfig.Name, "member1", "subscriber")
+	assert.NotNil(t, err)
+
+	err = queuesUC.AddGroupSubscriber(ctx, qConfig.Name, "member1", "group")
+	assert.Nil(t, err)
+	err = queuesUC.AddSubscriber(ctx, qConfig.Name, "group")
+	assert.NotNil(t, err)
+}
+
+func TestQueuesUC_ExchangeRoutesByWildcardBindings(t *testing.T) {
+	t.Parallel()
+
+	qs := []config.QueueConfig{
+		{Name: "created", Length: 10, SubscribersAmount: 1},
+		{Name: "orders", Length: 10, SubscribersAmount: 1},
+		{Name: "all", Length: 10, SubscribersAmount: 1},
+	}
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	_, err := queuesUC.CreateExchange(ctx, config.ExchangeConfig{
+		Name: "events",
+		Bindings: []config.BindingConfig{
+			{Queue: "created", Pattern: "orders.*.created"},
+			{Queue: "orders", Pattern: "orders.#"},
+		},
+	})
+	assert.Nil(t, err)
+
+	_, err = queuesUC.CreateExchange(ctx, config.ExchangeConfig{Name: "events"})
+	assert.NotNil(t, err)
+	_, err = queuesUC.CreateExchange(ctx, config.ExchangeConfig{Name: "broken", Bindings: []config.BindingConfig{{Queue: "unknown", Pattern: "#"}}})
+	assert.NotNil(t, err)
+
+	cases := []struct {
+		routingKey string
+		queues     []string
+	}{
+		{"orders.eu.created", []string{"created", "orders"}},
+		{"orders.created", []string{"orders"}},
+		{"orders", []string{"orders"}},
+		{"orders.eu.de.created", []string{"orders"}},
+		{"payments.eu.created", []string{}},
+	}
+	for _, c := range cases {
+		routed, err := queuesUC.PublishToExchange(ctx, "events", c.routingKey, jsonPayload(t, map[string]interface{}{"key": c.routingKey}), models.PublishOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, c.queues, publishedQueues(routed), c.routingKey)
+	}
+
+	// bindings are changed at runtime
+	err = queuesUC.BindQueue(ctx, "events", models.Binding{Queue: "all", Pattern: "#"})
+	assert.Nil(t, err)
+	err = queuesUC.UnbindQueue(ctx, "events", models.Binding{Queue: "orders", Pattern: "orders.#"})
+	assert.Nil(t, err)
+	err = queuesUC.UnbindQueue(ctx, "events", models.Binding{Queue: "orders", Pattern: "orders.#"})
+	assert.NotNil(t, err)
+
+	routed, err := queuesUC.PublishToExchange(ctx, "events", "orders.us.created", jsonPayload(t, map[string]interface{}{"msg": "hello"}), models.PublishOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"all", "created"}, publishedQueues(routed))
+
+	counts := map[string]int{}
+	for _, q := range qs {
+		queue, err := queuesUC.GetByName(ctx, q.Name)
+		assert.Nil(t, err)
+		counts[q.Name] = len(queue.Messages)
+	}
+	assert.Equal(t, map[string]int{"created": 2, "orders": 4, "all": 1}, counts)
+
+	err = queuesUC.DeleteExchange(ctx, "events")
+	assert.Nil(t, err)
+	_, err = queuesUC.PublishToExchange(ctx, "events", "orders.us.created", jsonPayload(t, map[string]interface{}{"msg": "hello"}), models.PublishOptions{})
+	assert.NotNil(t, err)
+}
+
+func TestQueuesUC_ExchangePublishIsAtomic(t *testing.T) {
+	t.Parallel()
+
+	qs := []config.QueueConfig{
+		{Name: "roomy", Length: 10, SubscribersAmount: 1},
+		{Name: "small", Length: 1, SubscribersAmount: 1},
+	}
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	_, err := queuesUC.CreateExchange(ctx, config.ExchangeConfig{
+		Name: "events",
+		Bindings: []config.BindingConfig{
+			{Queue: "roomy", Pattern: "#"},
+			{Queue: "small", Pattern: "#"},
+		},
+	})
+	assert.Nil(t, err)
+
+	routed, err := queuesUC.PublishToExchange(ctx, "events", "a", jsonPayload(t, map[string]interface{}{"msg": "first"}), models.PublishOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"roomy", "small"}, publishedQueues(routed))
+
+	// small queue is full, so message gets into none of the queues
+	_, err = queuesUC.PublishToExchange(ctx, "events", "a", jsonPayload(t, map[string]interface{}{"msg": "second"}), models.PublishOptions{})
+	assert.NotNil(t, err)
+
+	for _, q := range qs {
+		queue, err := queuesUC.GetByName(ctx, q.Name)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(queue.Messages), q.Name)
+	}
+
+	// bound queue which has been deleted is skipped
+	_, err = queuesUC.DeleteQueue(ctx, "small", false)
+	assert.Nil(t, err)
+
+	routed, err = queuesUC.PublishToExchange(ctx, "events", "a", jsonPayload(t, map[string]interface{}{"msg": "third"}), models.PublishOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"roomy"}, publishedQueues(routed))
+}
+
+func TestQueuesUC_ExchangeDeadLettersExpiredMessagesIntoBoundQueue(t *testing.T) {
+	t.Parallel()
+
+	qs := []config.QueueConfig{
+		{Name: "dlq", Length: 10, SubscribersAmount: 1},
+		{Name: "orders", Length: 1, SubscribersAmount: 1, DeadLetterQueue: "dlq"},
+	}
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	_, err := queuesUC.CreateExchange(ctx, config.ExchangeConfig{
+		Name: "events",
+		Bindings: []config.BindingConfig{
+			{Queue: "dlq", Pattern: "#"},
+			{Queue: "orders", Pattern: "#"},
+		},
+	})
+	assert.Nil(t, err)
+
+	_, err = queuesUC.PublishToExchange(ctx, "events", "a", jsonPayload(t, map[string]interface{}{"msg": "first"}), models.PublishOptions{TTL: time.Second})
+	assert.Nil(t, err)
+
+	// expired message of full queue is moved into its dead-letter queue, which
+	// the message is published to as well
+	shiftClock(queuesUC, 2*time.Second)
+	routed, err := queuesUC.PublishToExchange(ctx, "events", "a", jsonPayload(t, map[string]interface{}{"msg": "second"}), models.PublishOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"dlq", "orders"}, publishedQueues(routed))
+
+	orders, err := queuesUC.GetByName(ctx, "orders")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(orders.Messages))
+	assert.Equal(t, uint64(1), orders.Stats.Expired)
+
+	dlq, err := queuesUC.GetByName(ctx, "dlq")
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(dlq.Messages)) {
+		assert.NotNil(t, dlq.Messages[0].DeadLetter)
+		assert.Nil(t, dlq.Messages[1].DeadLetter)
+	}
+}
+
+func TestQueuesUC_MessageAttributesArePassedToConsumers(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            10,
+		SubscribersAmount: 1,
+		DeadLetterQueue:   "dlq",
+	}
+	dlqConfig := config.QueueConfig{
+		Name:              "dlq",
+		Length:            10,
+		SubscribersAmount: 1,
+	}
+
+	subscriberName := "subscriber"
+
+	queuesUC, cleanup := configureEnvironment(t, []config.QueueConfig{qConfig, dlqConfig})
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, qConfig.Name, subscriberName)
+	assert.Nil(t, err)
+	err = queuesUC.AddSubscriber(ctx, dlqConfig.Name, subscriberName)
+	assert.Nil(t, err)
+
+	attributes := models.MessageAttributes{
+		Headers:       map[string]string{"trace": "abc"},
+		ContentType:   "application/json",
+		CorrelationID: "corr",
+		PublisherID:   "publisher",
+	}
+
+	_, err = queuesUC.PublishMessage(ctx, qConfig.Name, jsonPayload(t, map[string]interface{}{"msg": "hello"}), models.PublishOptions{
+		Attributes: models.MessageAttributes{Headers: map[string]string{"": "empty"}},
+	})
+	assert.NotNil(t, err)
+
+	published, err := queuesUC.PublishMessage(ctx, qConfig.Name, jsonPayload(t, map[string]interface{}{"msg": "hello"}), models.PublishOptions{Attributes: attributes})
+	assert.Nil(t, err)
+	assert.Equal(t, qConfig.Name, published.Queue)
+	assert.Equal(t, uint64(1), published.Seq)
+
+	messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 0)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(messages)) {
+		assert.Equal(t, published.ID, messages[0].ID)
+		assert.Equal(t, published.PublishedAt, messages[0].PublishedAt)
+		assert.Equal(t, attributes, messages[0].MessageAttributes)
+	}
+
+	// dead-lettered copy keeps attributes of the original message
+	err = queuesUC.RejectMessage(ctx, qConfig.Name, subscriberName, published.ID)
+	assert.Nil(t, err)
+
+	deadLetters, err := queuesUC.ConsumeMessages(ctx, dlqConfig.Name, subscriberName, 0)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(deadLetters)) {
+		assert.Equal(t, attributes, deadLetters[0].MessageAttributes)
+	}
+}
+
+func TestQueuesUC_PayloadIsKeptAsPublished(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:              "testQueue",
+		Length:            10,
+		SubscribersAmount: 1,
+	}
+
+	subscriberName := "subscriber"
+
+	queuesUC, cleanup := configureEnvironment(t, []config.QueueConfig{qConfig})
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, qConfig.Name, subscriberName)
+	assert.Nil(t, err)
+
+	_, err = queuesUC.PublishMessage(ctx, qConfig.Name, []byte(`{"broken"`), models.PublishOptions{Attributes: models.MessageAttributes{ContentType: "application/json"}})
+	assert.NotNil(t, err)
+
+	image := []byte{0x89, 'P', 'N', 'G', 0x00, 0xff}
+	payloads := []struct {
+		payload     []byte
+		contentType string
+	}{
+		{image, "image/png"},
+		{[]byte(`[1,"two",3.0]`), "application/json"},
+		{[]byte("plain text"), "text/plain; charset=utf-8"},
+		{[]byte{0x00, 0x01}, ""},
+	}
+	for _, p := range payloads {
+		_, err = queuesUC.PublishMessage(ctx, qConfig.Name, p.payload, models.PublishOptions{Attributes: models.MessageAttributes{ContentType: p.contentType}})
+		assert.Nil(t, err)
+	}
+
+	// single message is consumed at a time
+	for _, p := range payloads {
+		message, err := queuesUC.ConsumeMessage(ctx, qConfig.Name, subscriberName, 0)
+		assert.Nil(t, err)
+		if !assert.NotNil(t, message) {
+			return
+		}
+		assert.Equal(t, p.payload, message.Payload)
+		if p.contentType == "" {
+			assert.Equal(t, models.ContentTypeBytes, message.ContentType)
+		} else {
+			assert.Equal(t, p.contentType, message.ContentType)
+		}
+	}
+
+	message, err := queuesUC.ConsumeMessage(ctx, qConfig.Name, subscriberName, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, message)
+}
+
+func TestQueuesUC_DeduplicationIDPublishesMessageOnce(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:                   "testQueue",
+		Length:                 2,
+		SubscribersAmount:      1,
+		DeduplicationWindowSec: 60,
+	}
+	otherConfig := config.QueueConfig{
+		Name:              "otherQueue",
+		Length:            10,
+		SubscribersAmount: 1,
+	}
+
+	subscriberName := "subscriber"
+
+	queuesUC, cleanup := configureEnvironment(t, []config.QueueConfig{qConfig, otherConfig})
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := queuesUC.AddSubscriber(ctx, qConfig.Name, subscriberName)
+	assert.Nil(t, err)
+
+	_, err = queuesUC.PublishMessage(ctx, qConfig.Name, []byte("too long"), models.PublishOptions{DeduplicationID: string(make([]byte, 129))})
+	assert.NotNil(t, err)
+
+	opts := models.PublishOptions{DeduplicationID: "order-1"}
+	published, err := queuesUC.PublishMessage(ctx, qConfig.Name, []byte("first"), opts)
+	assert.Nil(t, err)
+	assert.False(t, published.Duplicate)
+
+	// repeat returns the original message and isn't added to the queue even
+	// after the original one has been acknowledged
+	repeated, err := queuesUC.PublishMessage(ctx, qConfig.Name, []byte("second"), opts)
+	assert.Nil(t, err)
+	assert.True(t, repeated.Duplicate)
+	assert.Equal(t, published.ID, repeated.ID)
+	assert.Equal(t, published.Seq, repeated.Seq)
+
+	messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, subscriberName, 0)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(messages)) {
+		assert.Equal(t, []byte("first"), messages[0].Payload)
+	}
+	err = queuesUC.AckMessage(ctx, qConfig.Name, subscriberName, published.ID)
+	assert.Nil(t, err)
+
+	repeated, err = queuesUC.PublishMessage(ctx, qConfig.Name, []byte("third"), opts)
+	assert.Nil(t, err)
+	assert.Equal(t, published.ID, repeated.ID)
+
+	// deduplication IDs are kept per queue
+	other, err := queuesUC.PublishMessage(ctx, otherConfig.Name, []byte("first"), opts)
+	assert.Nil(t, err)
+	assert.False(t, other.Duplicate)
+	assert.NotEqual(t, published.ID, other.ID)
+
+	// repeat of full queue succeeds, while a new message is rejected
+	_, err = queuesUC.PublishMessage(ctx, qConfig.Name, []byte("filler"), models.PublishOptions{})
+	assert.Nil(t, err)
+	_, err = queuesUC.PublishMessage(ctx, qConfig.Name, []byte("filler"), models.PublishOptions{DeduplicationID: "order-2"})
+	assert.Nil(t, err)
+	_, err = queuesUC.PublishMessage(ctx, qConfig.Name, []byte("filler"), models.PublishOptions{DeduplicationID: "order-3"})
+	assert.NotNil(t, err)
+	repeated, err = queuesUC.PublishMessage(ctx, qConfig.Name, []byte("filler"), models.PublishOptions{DeduplicationID: "order-2"})
+	assert.Nil(t, err)
+	assert.True(t, repeated.Duplicate)
+
+	err = queuesUC.PurgeQueue(ctx, qConfig.Name)
+	assert.Nil(t, err)
+
+	// message is published again once the window has passed
+	shiftClock(queuesUC, time.Minute)
+
+	republished, err := queuesUC.PublishMessage(ctx, qConfig.Name, []byte("again"), opts)
+	assert.Nil(t, err)
+	assert.False(t, republished.Duplicate)
+	assert.NotEqual(t, published.ID, republished.ID)
+
+	queue, err := queuesUC.GetByName(ctx, qConfig.Name)
+	assert.Nil(t, err)
+	// expired deduplication IDs are forgotten
+	assert.Equal(t, 1, len(queue.Deduplication))
+	assert.Equal(t, republished.ID, queue.Deduplication["order-1"].ID)
+}
+
+func TestQueuesUC_ExchangeDeduplicatesPerQueue(t *testing.T) {
+	t.Parallel()
+
+	first := config.QueueConfig{Name: "first", Length: 10, SubscribersAmount: 1}
+	second := config.QueueConfig{Name: "second", Length: 10, SubscribersAmount: 1}
+
+	queuesUC, cleanup := configureEnvironment(t, []config.QueueConfig{first, second})
+	defer cleanup()
+
+	ctx := context.Background()
+
+	_, err := queuesUC.CreateExchange(ctx, config.ExchangeConfig{
+		Name:     "events",
+		Bindings: []config.BindingConfig{{Queue: first.Name, Pattern: "order.*"}},
+	})
+	assert.Nil(t, err)
+
+	opts := models.PublishOptions{DeduplicationID: "event-1"}
+	published, err := queuesUC.PublishToExchange(ctx, "events", "order.created", []byte("event"), opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(published))
+
+	// queue bound later gets the message, the first one keeps the original
+	err = queuesUC.BindQueue(ctx, "events", models.Binding{Queue: second.Name, Pattern: "order.#"})
+	assert.Nil(t, err)
+
+	repeated, err := queuesUC.PublishToExchange(ctx, "events", "order.created", []byte("event"), opts)
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(repeated)) {
+		assert.Equal(t, []string{first.Name, second.Name}, publishedQueues(repeated))
+		assert.True(t, repeated[0].Duplicate)
+		assert.Equal(t, published[0].ID, repeated[0].ID)
+		assert.False(t, repeated[1].Duplicate)
+	}
+
+	queue, err := queuesUC.GetByName(ctx, first.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(queue.Messages))
+}
+
+func TestQueuesUC_ShutdownReleasesConsumers(t *testing.T) {
+	t.Parallel()
+
+	qConfig := config.QueueConfig{
+		Name:                 "testQueue",
+		Length:               10,
+		SubscribersAmount:    2,
+		VisibilityTimeoutSec: 60,
+	}
+
+	qs := []config.QueueConfig{
+		qConfig,
+	}
+
+	queuesUC, cleanup := configureEnvironment(t, qs)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	for _, subscriberName := range []string{"streamer", "poller"} {
+		err := queuesUC.AddSubscriber(ctx, qConfig.Name, subscriberName)
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 2; i++ {
+		err := queuesUC.AddMessage(ctx, qConfig.Name, map[string]interface{}{"n": i})
+		assert.Nil(t, err)
+	}
+
+	polledMessages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, "poller", 0)
+	assert.Nil(t, err)
+	for _, message := range polledMessages {
+		assert.Nil(t, queuesUC.AckMessage(ctx, qConfig.Name, "poller", message.ID))
+	}
+
+	stream, err := queuesUC.OpenStream(ctx, qConfig.Name, "streamer", nil)
+	assert.Nil(t, err)
+	streamed, err := stream.Next(ctx, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(streamed))
+
+	// acknowledged message is not released
+	err = queuesUC.AckMessage(ctx, qConfig.Name, "streamer", streamed[0].ID)
+	assert.Nil(t, err)
+
+	type result struct {
+		messages []models.ConsumedMessage
+		err      error
+	}
+	polled := make(chan result, 1)
+	go func() {
+		messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, "poller", time.Minute)
+		polled <- result{messages, err}
+	}()
+	streamedNext := make(chan result, 1)
+	go func() {
+		messages, err := stream.Next(ctx, time.Minute)
+		streamedNext <- result{messages, err}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	queuesUC.Shutdown()
+
+	// waiting consumers are answered right away
+	for _, ch := range []chan result{polled, streamedNext} {
+		select {
+		case res := <-ch:
+			assert.Equal(t, 0, len(res.messages))
+			if res.err != nil && assert.IsType(t, &queues.QueueErr{}, res.err) {
+				assert.Equal(t, queues.UseCaseUnavailableErr, res.err.(*queues.QueueErr).ErrType)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("consumer hasn't been released on shutdown")
+		}
+	}
+
+	_, err = queuesUC.PublishMessage(ctx, qConfig.Name, jsonPayload(t, map[string]interface{}{"n": 2}), models.PublishOptions{})
+	if assert.IsType(t, &queues.QueueErr{}, err) {
+		assert.Equal(t, queues.UseCaseUnavailableErr, err.(*queues.QueueErr).ErrType)
+	}
+
+	// message leased by the stream is redelivered before its lease expires
+	messages, err := queuesUC.ConsumeMessages(ctx, qConfig.Name, "streamer", 0)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(messages)) {
+		assert.Equal(t, streamed[1].ID, messages[0].ID)
+		assert.Nil(t, queuesUC.AckMessage(ctx, qConfig.Name, "streamer", messages[0].ID))
+	}
+}
@@ -2,40 +2,119 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"time"
 
+	"github.com/VladSatyshev/concurrent-queue/config"
+	"github.com/VladSatyshev/concurrent-queue/internal/auth"
+	"github.com/VladSatyshev/concurrent-queue/internal/metrics"
 	"github.com/VladSatyshev/concurrent-queue/internal/middleware"
+	"github.com/VladSatyshev/concurrent-queue/internal/queues"
+	queuesGrpc "github.com/VladSatyshev/concurrent-queue/internal/queues/delivery/grpc"
 	queuesHttp "github.com/VladSatyshev/concurrent-queue/internal/queues/delivery/http"
+	queuesWs "github.com/VladSatyshev/concurrent-queue/internal/queues/delivery/ws"
 	queuesRepo "github.com/VladSatyshev/concurrent-queue/internal/queues/repository"
 	queuesUseCase "github.com/VladSatyshev/concurrent-queue/internal/queues/usecase"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
 )
 
 func (s *Server) MapHandlers() error {
+	// init auth, misconfigured principals fail startup
+	authenticator, err := auth.NewAuthenticator(s.cfg.Auth)
+	if err != nil {
+		s.logger.Errorf("failed to init auth: %s", err.Error())
+		return err
+	}
+
 	// init repositories
-	qRepo := queuesRepo.NewQueuesRepository(s.cfg)
-	if err := queuesRepo.InitQueues(context.Background(), s.cfg, qRepo); err != nil {
-		s.logger.Errorf("failed to init queues: %s", err.Error())
+	qRepo, err := s.newQueuesRepository()
+	if err != nil {
+		s.logger.Errorf("failed to init queues storage: %s", err.Error())
 		return err
 	}
+	s.queuesRepo = qRepo
+	s.closers = append(s.closers, qRepo)
+
+	// init metrics
+	queuesMetrics := metrics.NewMetrics(qRepo)
 
 	// init usecases
-	queuesUC := queuesUseCase.NewQueuesUseCase(s.cfg, qRepo, s.logger)
+	queuesUC := queuesUseCase.NewQueuesUseCase(s.cfg, qRepo, queuesMetrics, s.logger)
+	s.queuesUC = queuesUC
+
+	// init background maintenance, it's started once queues are restored
+	s.maintenance = newMaintenance(s.cfg.Server.MaintenanceIntervalSec * time.Second)
+	s.maintenance.add(queuesUC.EvictIdleSubscribers)
+	s.maintenance.add(queuesUC.ExpireMessages)
+	s.closers = append(s.closers, s.maintenance)
 
 	// init handlers
 	queuesHandlers := queuesHttp.NewQueuesHndlers(s.cfg, queuesUC, s.logger)
+	queuesWSHandlers := queuesWs.NewQueuesWSHandlers(s.cfg, queuesUC, s.logger)
+	s.wsHandlers = queuesWSHandlers
+	queuesGRPCHandlers := queuesGrpc.NewQueuesGRPCHandlers(s.cfg, queuesUC, s.logger)
 
 	// init & use middleware
-	mw := middleware.NewMiddlewareManager(s.cfg, s.logger)
+	mw := middleware.NewMiddlewareManager(s.cfg, queuesMetrics, authenticator, s.logger)
 	s.router.Use(mw.CORSMiddleware())
-	s.router.Use(mw.TimeoutMiddleware())
+	s.router.Use(mw.MetricsMiddleware())
+
+	s.mapHealthRoutes()
+	s.router.GET("/metrics", s.requireInitialized(), gin.WrapH(queuesMetrics.Handler()))
 
-	v1 := s.router.Group("/v1")
-	internal := v1.Group("/int")
+	v1 := s.router.Group("/v1", s.requireInitialized(), mw.AuthMiddleware())
+	// request/response routes, long-lived ones are mapped to v1 directly
+	api := v1.Group("", mw.TimeoutMiddleware())
+	internal := api.Group("/int")
 
-	queueGroup := v1.Group("/queues")
+	queueGroup := api.Group("/queues")
 	intQueueGroup := internal.Group("/queues")
+	queueStreamGroup := v1.Group("/queues")
+	exchangeGroup := api.Group("/exchanges")
+	intExchangeGroup := internal.Group("/exchanges")
 
 	queuesHttp.MapQueueRoutes(queueGroup, queuesHandlers, mw)
 	queuesHttp.MapIntQueueRoutes(intQueueGroup, queuesHandlers, mw)
+	queuesHttp.MapQueueStreamRoutes(queueStreamGroup, queuesHandlers, mw)
+	queuesHttp.MapExchangeRoutes(exchangeGroup, queuesHandlers, mw)
+	queuesHttp.MapIntExchangeRoutes(intExchangeGroup, queuesHandlers, mw)
+	queuesWs.MapWSRoutes(v1, queuesWSHandlers, mw)
+
+	s.grpcServer = grpc.NewServer(
+		grpc.ChainUnaryInterceptor(mw.AuthUnaryInterceptor()),
+		grpc.ChainStreamInterceptor(mw.AuthStreamInterceptor()),
+	)
+	queuesGrpc.MapQueueService(s.grpcServer, queuesGRPCHandlers)
+
+	return nil
+}
+
+// InitQueues restores queues from storage, creates the ones from config which
+// don't exist yet and starts background maintenance. Server is ready to accept
+// traffic once it's done
+func (s *Server) InitQueues(ctx context.Context) error {
+	if err := queuesRepo.InitQueues(ctx, s.cfg, s.queuesRepo); err != nil {
+		s.logger.Errorf("failed to init queues: %s", err.Error())
+		return err
+	}
+
+	s.maintenance.start()
+	s.health.initialized.Store(true)
+
+	s.logger.Info("Queues have been initialized")
 
 	return nil
 }
+
+func (s *Server) newQueuesRepository() (queues.Repository, error) {
+	switch s.cfg.Storage.Type {
+	case config.StorageFile:
+		s.logger.Infof("Using file storage in %s", s.cfg.Storage.Dir)
+		return queuesRepo.NewFileQueuesRepository(s.cfg, s.logger)
+	case config.StorageMemory, "":
+		return queuesRepo.NewQueuesRepository(s.cfg), nil
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", s.cfg.Storage.Type)
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+
+	queuesRepo "github.com/VladSatyshev/concurrent-queue/internal/queues/repository"
+	"github.com/gin-gonic/gin"
+)
+
+// statuses of health endpoints and their components
+const (
+	healthOK           = "ok"
+	healthReady        = "ready"
+	healthNotReady     = "not_ready"
+	healthInitializing = "initializing"
+	healthFailing      = "failing"
+	healthDraining     = "draining"
+)
+
+// health is state of the server as it's seen by probes, which are answered
+// while queues are being restored and while the server is stopping
+type health struct {
+	// set once queues have been restored and created from config
+	initialized atomic.Bool
+	// set when the server starts to stop
+	draining atomic.Bool
+}
+
+type componentHealth struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type readinessResponse struct {
+	Status     string                     `json:"status"`
+	Components map[string]componentHealth `json:"components"`
+}
+
+func (s *Server) mapHealthRoutes() {
+	s.router.GET("/healthz", s.liveness())
+	s.router.GET("/readyz", s.readiness())
+}
+
+// liveness reports that the process is up and serves requests
+func (s *Server) liveness() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, componentHealth{Status: healthOK})
+	}
+}
+
+// readiness reports whether the server accepts traffic, with the state of
+// every component it depends on
+func (s *Server) readiness() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		res := readinessResponse{
+			Status: healthReady,
+			Components: map[string]componentHealth{
+				"queues":  s.queuesHealth(),
+				"storage": s.storageHealth(c.Request.Context()),
+				"server":  s.serverHealth(),
+			},
+		}
+
+		code := http.StatusOK
+		for _, component := range res.Components {
+			if component.Status != healthOK {
+				res.Status = healthNotReady
+				code = http.StatusServiceUnavailable
+			}
+		}
+
+		c.JSON(code, res)
+	}
+}
+
+func (s *Server) queuesHealth() componentHealth {
+	if !s.health.initialized.Load() {
+		return componentHealth{Status: healthInitializing}
+	}
+	return componentHealth{Status: healthOK}
+}
+
+func (s *Server) storageHealth(ctx context.Context) componentHealth {
+	// storage is opened while queues are restored
+	if !s.health.initialized.Load() {
+		return componentHealth{Status: healthInitializing}
+	}
+	if err := queuesRepo.CheckHealth(ctx, s.queuesRepo); err != nil {
+		return componentHealth{Status: healthFailing, Error: err.Error()}
+	}
+	return componentHealth{Status: healthOK}
+}
+
+func (s *Server) serverHealth() componentHealth {
+	if s.health.draining.Load() {
+		return componentHealth{Status: healthDraining}
+	}
+	return componentHealth{Status: healthOK}
+}
+
+// requireInitialized rejects requests until queues are restored, so clients
+// never see partially recovered state
+func (s *Server) requireInitialized() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.health.initialized.Load() {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, "server is starting")
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const defaultMaintenanceInterval = time.Second
+
+// maintenance periodically runs background tasks of usecases until server stops
+type maintenance struct {
+	interval time.Duration
+	tasks    []func(ctx context.Context)
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newMaintenance(interval time.Duration) *maintenance {
+	if interval <= 0 {
+		interval = defaultMaintenanceInterval
+	}
+	return &maintenance{interval: interval}
+}
+
+func (m *maintenance) add(task func(ctx context.Context)) {
+	m.tasks = append(m.tasks, task)
+}
+
+func (m *maintenance) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				for _, task := range m.tasks {
+					task(ctx)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops maintenance and waits for the running tasks to finish
+func (m *maintenance) Close() error {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	m.wg.Wait()
+	return nil
+}
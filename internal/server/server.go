@@ -1,15 +1,38 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/VladSatyshev/concurrent-queue/config"
+	"github.com/VladSatyshev/concurrent-queue/internal/queues"
 	"github.com/VladSatyshev/concurrent-queue/pkg/logger"
 	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
 )
 
+const defaultShutdownGrace = 30 * time.Second
+
 type Server struct {
-	cfg    *config.Config
-	router *gin.Engine
-	logger logger.Logger
+	cfg        *config.Config
+	router     *gin.Engine
+	grpcServer *grpc.Server
+	logger     logger.Logger
+
+	queuesRepo  queues.Repository
+	queuesUC    queues.UseCase
+	wsHandlers  queues.WSHandlers
+	maintenance *maintenance
+	health      health
+	// resources which are released when server stops
+	closers []io.Closer
 }
 
 func NewServer(cfg *config.Config, logger logger.Logger) *Server {
@@ -21,14 +44,132 @@ func NewServer(cfg *config.Config, logger logger.Logger) *Server {
 	}
 }
 
+// Run serves requests until SIGINT or SIGTERM is received, then shuts the
+// server down gracefully
 func (s *Server) Run() error {
+	defer s.close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	if err := s.MapHandlers(); err != nil {
 		return err
 	}
 
-	if err := s.router.Run(s.cfg.Server.Port); err != nil {
+	lis, err := net.Listen("tcp", s.cfg.Server.Port)
+	if err != nil {
+		s.logger.Errorf("failed to listen on HTTP port: %s", err.Error())
 		return err
 	}
 
+	return s.serve(ctx, lis)
+}
+
+// serve serves HTTP requests from lis and gRPC requests if gRPC port is set,
+// until ctx is done. Expects handlers to be mapped
+func (s *Server) serve(ctx context.Context, lis net.Listener) error {
+	// HTTP server is started before queues are restored, so probes are
+	// answered all along, while the rest of requests wait for InitQueues
+	httpServer := &http.Server{Handler: s.router.Handler()}
+
+	httpErr := make(chan error, 1)
+	go func() {
+		s.logger.Infof("HTTP server is listening on %s", lis.Addr().String())
+		httpErr <- httpServer.Serve(lis)
+	}()
+
+	if err := s.InitQueues(ctx); err != nil {
+		_ = httpServer.Close()
+		return err
+	}
+
+	grpcStopped := make(chan struct{})
+	close(grpcStopped)
+	if s.cfg.Server.GrpcPort != "" {
+		lis, err := net.Listen("tcp", s.cfg.Server.GrpcPort)
+		if err != nil {
+			s.logger.Errorf("failed to listen on gRPC port: %s", err.Error())
+			_ = httpServer.Close()
+			return err
+		}
+
+		grpcStopped = make(chan struct{})
+		go func() {
+			defer close(grpcStopped)
+			s.logger.Infof("gRPC server is listening on %s", s.cfg.Server.GrpcPort)
+			if err := s.grpcServer.Serve(lis); err != nil {
+				s.logger.Errorf("gRPC server stopped: %s", err.Error())
+			}
+		}()
+	}
+
+	select {
+	case err := <-httpErr:
+		s.grpcServer.Stop()
+		return err
+	case <-ctx.Done():
+	}
+
+	return s.shutdown(httpServer, grpcStopped)
+}
+
+// shutdown stops accepting new requests and publishes, then gives in-flight
+// requests the grace period to finish. Consumers which are still waiting for
+// messages are answered early and streams release leases of messages they
+// haven't acknowledged, so nothing stays leased to a subscriber that is gone.
+// Connections which outlive the grace period are closed
+func (s *Server) shutdown(httpServer *http.Server, grpcStopped <-chan struct{}) error {
+	grace := s.cfg.Server.ShutdownGraceSec * time.Second
+	if grace <= 0 {
+		grace = defaultShutdownGrace
+	}
+	s.logger.Infof("Shutting down, in-flight requests are given %s to finish", grace)
+
+	// readiness probe fails before publishes are rejected, so load balancer
+	// stops routing requests here as early as possible
+	s.health.draining.Store(true)
+	s.queuesUC.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	var errs []error
+
+	go s.grpcServer.GracefulStop()
+
+	if err := s.wsHandlers.Shutdown(ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := httpServer.Shutdown(ctx); err != nil {
+		errs = append(errs, err)
+		_ = httpServer.Close()
+	}
+
+	select {
+	case <-grpcStopped:
+	case <-ctx.Done():
+		s.grpcServer.Stop()
+		<-grpcStopped
+		errs = append(errs, errors.New("gRPC calls have been cancelled"))
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		s.logger.Errorf("in-flight requests haven't finished within grace period: %s", err.Error())
+		return fmt.Errorf("in-flight requests haven't finished within grace period: %w", err)
+	}
+	s.logger.Info("In-flight requests have finished")
+
 	return nil
 }
+
+// close releases resources in reverse order, so storage is flushed last
+func (s *Server) close() {
+	s.health.draining.Store(true)
+
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		if err := s.closers[i].Close(); err != nil {
+			s.logger.Errorf("failed to release resources: %s", err.Error())
+		}
+	}
+}
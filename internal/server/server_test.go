@@ -0,0 +1,1766 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VladSatyshev/concurrent-queue/config"
+	"github.com/VladSatyshev/concurrent-queue/internal/auth"
+	"github.com/VladSatyshev/concurrent-queue/pkg/api/queuespb"
+	"github.com/VladSatyshev/concurrent-queue/pkg/logger"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func newTestServer(t *testing.T, queuesCfg []config.QueueConfig) *Server {
+	gin.SetMode(gin.TestMode)
+
+	cfg := &config.Config{
+		Server: config.ServerConfig{TimeoutSec: 5},
+		Logger: config.LoggerConfig{Encoding: "json", Level: "error"},
+		Queues: queuesCfg,
+	}
+	apiLogger := logger.NewAPILogger(cfg)
+	apiLogger.InitLogger()
+
+	s := NewServer(cfg, apiLogger)
+	require.NoError(t, s.MapHandlers())
+	t.Cleanup(s.close)
+	require.NoError(t, s.InitQueues(context.Background()))
+
+	return s
+}
+
+func doRequest(s *Server, method, path, subscriber string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if subscriber != "" {
+		req.Header.Set("X-Subscriber", subscriber)
+	}
+
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+
+	return w
+}
+
+// run with -race: hundreds of goroutines publish, subscribe, consume and read the
+// internal view of the same queue at once
+func TestServer_ConcurrentPublishConsume(t *testing.T) {
+	const (
+		subscribers = 200
+		iterations  = 20
+		queueName   = "stress"
+	)
+
+	// leases must outlive the test, which takes a while with the race detector
+	s := newTestServer(t, []config.QueueConfig{
+		{Name: queueName, Length: 200, SubscribersAmount: subscribers, VisibilityTimeoutSec: 600},
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan string, subscribers*iterations*4)
+
+	for i := 0; i < subscribers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			subscriber := fmt.Sprintf("subscriber-%d", i)
+			if w := doRequest(s, http.MethodPost, "/v1/queues/"+queueName+"/subscriptions", subscriber, nil); w.Code != http.StatusOK {
+				errs <- fmt.Sprintf("subscribe %s: %d %s", subscriber, w.Code, w.Body.String())
+				return
+			}
+
+			seen := map[string]struct{}{}
+			var lastSeq uint64
+			for j := 0; j < iterations; j++ {
+				body, _ := json.Marshal(map[string]interface{}{"from": subscriber, "n": j})
+				w := doRequest(s, http.MethodPost, "/v1/queues/"+queueName+"/messages", "", body)
+				if w.Code != http.StatusOK && w.Code != http.StatusBadRequest {
+					errs <- fmt.Sprintf("publish %s: %d %s", subscriber, w.Code, w.Body.String())
+				}
+
+				w = doRequest(s, http.MethodGet, "/v1/queues/"+queueName+"/messages", subscriber, nil)
+				if w.Code != http.StatusOK {
+					errs <- fmt.Sprintf("consume %s: %d %s", subscriber, w.Code, w.Body.String())
+					continue
+				}
+
+				var messages []struct {
+					ID  string `json:"id"`
+					Seq uint64 `json:"seq"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &messages); err != nil {
+					errs <- fmt.Sprintf("consume %s: %s", subscriber, err)
+					continue
+				}
+				for _, m := range messages {
+					if _, ok := seen[m.ID]; ok {
+						errs <- fmt.Sprintf("consume %s: message %s delivered twice", subscriber, m.ID)
+					}
+					seen[m.ID] = struct{}{}
+
+					if m.Seq <= lastSeq {
+						errs <- fmt.Sprintf("consume %s: message %d delivered after %d", subscriber, m.Seq, lastSeq)
+					}
+					lastSeq = m.Seq
+				}
+
+				if len(messages) > 0 {
+					path := fmt.Sprintf("/v1/queues/%s/messages/%s/ack", queueName, messages[0].ID)
+					if w := doRequest(s, http.MethodPost, path, subscriber, nil); w.Code != http.StatusOK {
+						errs <- fmt.Sprintf("ack %s: %d %s", subscriber, w.Code, w.Body.String())
+					}
+				}
+
+				if i%20 != 0 || j%5 != 0 {
+					continue
+				}
+				if w := doRequest(s, http.MethodGet, "/v1/int/queues/"+queueName, "", nil); w.Code != http.StatusOK {
+					errs <- fmt.Sprintf("get queue: %d %s", w.Code, w.Body.String())
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	w := doRequest(s, http.MethodGet, "/v1/int/queues/"+queueName, "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var queue struct {
+		Subscribers map[string]struct{}
+		Messages    []interface{}
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &queue))
+	assert.Equal(t, subscribers, len(queue.Subscribers))
+	assert.LessOrEqual(t, len(queue.Messages), 200)
+}
+
+type sseEvent struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+func readEvent(t *testing.T, r *bufio.Reader) sseEvent {
+	var event sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "":
+			if event.Event != "" {
+				return event
+			}
+		case strings.HasPrefix(line, "id:"):
+			event.ID = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
+		case strings.HasPrefix(line, "event:"):
+			event.Event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			event.Data = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+}
+
+func openStream(t *testing.T, url, subscriber, lastEventID string) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Subscriber", subscriber)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	return resp
+}
+
+func TestServer_ConsumeRejectsInvalidWait(t *testing.T) {
+	s := newTestServer(t, []config.QueueConfig{
+		{Name: "wait", Length: 10, SubscribersAmount: 1},
+	})
+
+	w := doRequest(s, http.MethodPost, "/v1/queues/wait/subscriptions", "subscriber", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// waits which are not finite or don't fit into time.Duration
+	for _, value := range []string{"-1", "soon", "NaN", "Inf", "1e300"} {
+		w = doRequest(s, http.MethodGet, "/v1/queues/wait/messages?wait="+value, "subscriber", nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code, value)
+	}
+
+	// long wait is bounded by server timeout
+	w = doRequest(s, http.MethodPost, "/v1/queues/wait/messages", "", []byte(`{"n":1}`))
+	require.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(s, http.MethodGet, "/v1/queues/wait/messages?wait=1e9", "subscriber", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestServer_StreamDeliversPublishedMessages(t *testing.T) {
+	const queueName = "stream"
+
+	s := newTestServer(t, []config.QueueConfig{
+		{Name: queueName, Length: 10, SubscribersAmount: 1},
+	})
+	ts := httptest.NewServer(s.router)
+	defer ts.Close()
+
+	w := doRequest(s, http.MethodPost, "/v1/queues/"+queueName+"/subscriptions", "subscriber", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	publish := func(n int) {
+		body, _ := json.Marshal(map[string]interface{}{"n": n})
+		w := doRequest(s, http.MethodPost, "/v1/queues/"+queueName+"/messages", "", body)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	publish(1)
+
+	resp := openStream(t, ts.URL+"/v1/queues/"+queueName+"/stream", "subscriber", "")
+	r := bufio.NewReader(resp.Body)
+
+	event := readEvent(t, r)
+	assert.Equal(t, "message", event.Event)
+	assert.Equal(t, "1", event.ID)
+
+	publish(2)
+	publish(3)
+
+	event = readEvent(t, r)
+	assert.Equal(t, "2", event.ID)
+	event = readEvent(t, r)
+	assert.Equal(t, "3", event.ID)
+
+	var message struct {
+		Seq  uint64                 `json:"seq"`
+		Body map[string]interface{} `json:"body"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(event.Data), &message))
+	assert.Equal(t, uint64(3), message.Seq)
+	assert.Equal(t, float64(3), message.Body["n"])
+	resp.Body.Close()
+
+	// reconnecting client has missed the last message
+	resp = openStream(t, ts.URL+"/v1/queues/"+queueName+"/stream", "subscriber", "2")
+	defer resp.Body.Close()
+
+	event = readEvent(t, bufio.NewReader(resp.Body))
+	assert.Equal(t, "3", event.ID)
+}
+
+func TestServer_WebsocketPublishConsumeAck(t *testing.T) {
+	s := newTestServer(t, []config.QueueConfig{
+		{Name: "ws1", Length: 10, SubscribersAmount: 1},
+		{Name: "ws2", Length: 10, SubscribersAmount: 1},
+	})
+	ts := httptest.NewServer(s.router)
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/v1/ws?subscriber=subscriber", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	type frame struct {
+		Type      string                 `json:"type"`
+		ID        string                 `json:"id,omitempty"`
+		Queue     string                 `json:"queue,omitempty"`
+		MessageID string                 `json:"message_id,omitempty"`
+		Body      map[string]interface{} `json:"body,omitempty"`
+		Message   *struct {
+			ID   string                 `json:"id"`
+			Body map[string]interface{} `json:"body"`
+		} `json:"message,omitempty"`
+		Error string `json:"error,omitempty"`
+	}
+
+	read := func() frame {
+		var f frame
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		require.NoError(t, conn.ReadJSON(&f))
+		return f
+	}
+
+	require.NoError(t, conn.WriteJSON(frame{Type: "ping", ID: "1"}))
+	assert.Equal(t, frame{Type: "pong", ID: "1"}, read())
+
+	require.NoError(t, conn.WriteJSON(frame{Type: "subscribe", ID: "2", Queue: "ws1"}))
+	assert.Equal(t, frame{Type: "ok", ID: "2", Queue: "ws1"}, read())
+	require.NoError(t, conn.WriteJSON(frame{Type: "subscribe", ID: "3", Queue: "ws2"}))
+	assert.Equal(t, frame{Type: "ok", ID: "3", Queue: "ws2"}, read())
+
+	require.NoError(t, conn.WriteJSON(frame{Type: "publish", ID: "4", Queue: "ws2", Body: map[string]interface{}{"msg": "hello"}}))
+
+	// reply and delivery may come in any order
+	var published, delivered frame
+	for _, f := range []frame{read(), read()} {
+		switch f.Type {
+		case "ok":
+			assert.Equal(t, "4", f.ID)
+			published = f
+		case "deliver":
+			delivered = f
+		default:
+			t.Fatalf("unexpected frame %+v", f)
+		}
+	}
+	require.NotNil(t, delivered.Message)
+	assert.Equal(t, "ws2", delivered.Queue)
+	assert.Equal(t, map[string]interface{}{"msg": "hello"}, delivered.Message.Body)
+	assert.NotEmpty(t, published.MessageID)
+	assert.Equal(t, delivered.Message.ID, published.MessageID)
+
+	require.NoError(t, conn.WriteJSON(frame{Type: "ack", ID: "5", Queue: "ws2", MessageID: delivered.Message.ID}))
+	assert.Equal(t, frame{Type: "ok", ID: "5", Queue: "ws2", MessageID: delivered.Message.ID}, read())
+
+	require.NoError(t, conn.WriteJSON(frame{Type: "publish", ID: "6", Queue: "unknown", Body: map[string]interface{}{"msg": "hello"}}))
+	f := read()
+	assert.Equal(t, "error", f.Type)
+	assert.Equal(t, "6", f.ID)
+
+	w := doRequest(s, http.MethodGet, "/v1/int/queues/ws2", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var queue struct {
+		Messages []interface{}
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &queue))
+	assert.Equal(t, 0, len(queue.Messages))
+}
+
+func TestServer_WebsocketChecksOrigin(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.cfg.Server.WSAllowedOrigins = []string{"https://app.example.com"}
+	ts := httptest.NewServer(s.router)
+	defer ts.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/v1/ws?subscriber=subscriber"
+	dial := func(origin string) (*http.Response, error) {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if err == nil {
+			conn.Close()
+		}
+		return resp, err
+	}
+
+	// pages of other sites can't connect
+	resp, err := dial("https://evil.example.com")
+	require.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	for _, origin := range []string{"", ts.URL, "https://app.example.com"} {
+		_, err := dial(origin)
+		assert.NoError(t, err, origin)
+	}
+
+	s.cfg.Server.WSAllowedOrigins = []string{"*"}
+	_, err = dial("https://evil.example.com")
+	assert.NoError(t, err)
+}
+
+func dialGrpc(t *testing.T, s *Server) queuespb.QueuesClient {
+	lis := bufconn.Listen(1 << 20)
+	go func() { _ = s.grpcServer.Serve(lis) }()
+	t.Cleanup(s.grpcServer.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return queuespb.NewQueuesClient(conn)
+}
+
+func TestServer_GrpcPublishConsumeAck(t *testing.T) {
+	s := newTestServer(t, []config.QueueConfig{})
+	client := dialGrpc(t, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	queue, err := client.CreateQueue(ctx, &queuespb.CreateQueueRequest{Name: "grpc", MaxLength: 10, MaxSubscribers: 2})
+	require.NoError(t, err)
+	assert.Equal(t, "grpc", queue.Name)
+	assert.Equal(t, uint64(30), queue.VisibilityTimeoutSec)
+
+	_, err = client.CreateQueue(ctx, &queuespb.CreateQueueRequest{Name: "grpc", MaxLength: 10, MaxSubscribers: 2})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = client.CreateQueue(ctx, &queuespb.CreateQueueRequest{Name: "overflow", MaxLength: 10, VisibilityTimeoutSec: math.MaxUint64})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.Subscribe(ctx, &queuespb.SubscribeRequest{Queue: "grpc", Subscriber: "subscriber1"})
+	require.NoError(t, err)
+	_, err = client.Subscribe(ctx, &queuespb.SubscribeRequest{Queue: "grpc", Subscriber: "subscriber2"})
+	require.NoError(t, err)
+
+	_, err = client.Subscribe(ctx, &queuespb.SubscribeRequest{Queue: "unknown", Subscriber: "subscriber1"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	body, err := structpb.NewStruct(map[string]interface{}{"msg": "hello"})
+	require.NoError(t, err)
+	published, err := client.Publish(ctx, &queuespb.PublishRequest{Queue: "grpc", Body: body, Headers: map[string]string{"trace": "abc"}, CorrelationId: "corr1", DeduplicationId: "grpc-1"})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), published.Seq)
+	assert.False(t, published.Duplicate)
+
+	repeated, err := client.Publish(ctx, &queuespb.PublishRequest{Queue: "grpc", Body: body, DeduplicationId: "grpc-1"})
+	require.NoError(t, err)
+	assert.True(t, repeated.Duplicate)
+	assert.Equal(t, published.Id, repeated.Id)
+
+	consumed, err := client.Consume(ctx, &queuespb.ConsumeRequest{Queue: "grpc", Subscriber: "subscriber1"})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(consumed.Messages))
+	assert.Equal(t, published.Id, consumed.Messages[0].Id)
+	assert.Equal(t, "hello", consumed.Messages[0].Body.AsMap()["msg"])
+	assert.Equal(t, uint64(1), consumed.Messages[0].DeliveryCount)
+	assert.Equal(t, map[string]string{"trace": "abc"}, consumed.Messages[0].Headers)
+	assert.Equal(t, "corr1", consumed.Messages[0].CorrelationId)
+
+	_, err = client.Ack(ctx, &queuespb.AckRequest{Queue: "grpc", Subscriber: "subscriber1", MessageId: consumed.Messages[0].Id})
+	require.NoError(t, err)
+
+	_, err = client.Ack(ctx, &queuespb.AckRequest{Queue: "grpc", Subscriber: "subscriber1", MessageId: consumed.Messages[0].Id})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// second subscriber receives the message published before and after opening the stream
+	stream, err := client.ConsumeStream(ctx, &queuespb.ConsumeStreamRequest{Queue: "grpc", Subscriber: "subscriber2"})
+	require.NoError(t, err)
+
+	m, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), m.Seq)
+
+	_, err = client.Publish(ctx, &queuespb.PublishRequest{Queue: "grpc", Body: body})
+	require.NoError(t, err)
+
+	m, err = stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), m.Seq)
+}
+
+func TestServer_QueueManagement(t *testing.T) {
+	s := newTestServer(t, []config.QueueConfig{})
+
+	w := doRequest(s, http.MethodPost, "/v1/int/queues/", "", []byte(`{"name":"managed","max_length":1,"max_subscribers":1}`))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	w = doRequest(s, http.MethodPost, "/v1/int/queues/", "", []byte(`{"name":"managed","max_length":1,"max_subscribers":1}`))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = doRequest(s, http.MethodPost, "/v1/int/queues/", "", []byte(`{"max_length":1}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// seconds which overflow time.Duration
+	w = doRequest(s, http.MethodPost, "/v1/int/queues/", "", []byte(`{"name":"overflow","max_length":1,"message_ttl_sec":18446744073709551615}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(s, http.MethodPatch, "/v1/int/queues/managed", "", []byte(`{"message_ttl_sec":18446744073709551615}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = doRequest(s, http.MethodPost, "/v1/queues/managed/messages", "", []byte(`{"n":1}`))
+	require.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(s, http.MethodPost, "/v1/queues/managed/messages", "", []byte(`{"n":2}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = doRequest(s, http.MethodPatch, "/v1/int/queues/managed", "", []byte(`{"max_length":2}`))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = doRequest(s, http.MethodPost, "/v1/queues/managed/messages", "", []byte(`{"n":2}`))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(s, http.MethodPost, "/v1/int/queues/managed/purge", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var queue struct {
+		MaxLength uint
+		Messages  []interface{}
+	}
+	w = doRequest(s, http.MethodGet, "/v1/int/queues/managed", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &queue))
+	assert.Equal(t, uint(2), queue.MaxLength)
+	assert.Equal(t, 0, len(queue.Messages))
+
+	w = doRequest(s, http.MethodPost, "/v1/queues/managed/subscriptions", "subscriber", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(s, http.MethodDelete, "/v1/queues/managed/subscriptions/subscriber", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(s, http.MethodDelete, "/v1/queues/managed/subscriptions/subscriber", "", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = doRequest(s, http.MethodDelete, "/v1/int/queues/managed?mode=unknown", "", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = doRequest(s, http.MethodDelete, "/v1/int/queues/managed", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(s, http.MethodGet, "/v1/int/queues/managed", "", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestServer_PublishWithTTL(t *testing.T) {
+	s := newTestServer(t, []config.QueueConfig{
+		{Name: "ttl", Length: 10, SubscribersAmount: 1},
+	})
+
+	w := doRequest(s, http.MethodPost, "/v1/queues/ttl/subscriptions", "subscriber", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/queues/ttl/messages", strings.NewReader(`{"n":1}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Message-TTL", "30")
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(s, http.MethodPost, "/v1/queues/ttl/messages", "", []byte(`{"body":{"n":2},"ttl":60}`))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// not an envelope as it has unknown fields
+	w = doRequest(s, http.MethodPost, "/v1/queues/ttl/messages", "", []byte(`{"body":{"n":3},"other":1}`))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(s, http.MethodPost, "/v1/queues/ttl/messages", "", []byte(`{"body":{"n":4},"ttl":"soon"}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(s, http.MethodPost, "/v1/queues/ttl/messages", "", []byte(`{"body":{"n":4},"ttl":1e300}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// TTLs which are not finite or don't fit into time.Duration
+	for _, value := range []string{"NaN", "Inf", "-Inf", "1e300"} {
+		req = httptest.NewRequest(http.MethodPost, "/v1/queues/ttl/messages", strings.NewReader(`{"n":4}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Message-TTL", value)
+		w = httptest.NewRecorder()
+		s.router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, value)
+	}
+
+	w = doRequest(s, http.MethodGet, "/v1/queues/ttl/messages", "subscriber", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var messages []struct {
+		Body        map[string]interface{} `json:"body"`
+		PublishedAt time.Time              `json:"published_at"`
+		ExpiresAt   *time.Time             `json:"expires_at"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &messages))
+	require.Equal(t, 3, len(messages))
+
+	assert.Equal(t, map[string]interface{}{"n": float64(1)}, messages[0].Body)
+	if assert.NotNil(t, messages[0].ExpiresAt) {
+		assert.InDelta(t, 30, messages[0].ExpiresAt.Sub(messages[0].PublishedAt).Seconds(), 1)
+	}
+	assert.Equal(t, map[string]interface{}{"n": float64(2)}, messages[1].Body)
+	if assert.NotNil(t, messages[1].ExpiresAt) {
+		assert.InDelta(t, 60, messages[1].ExpiresAt.Sub(messages[1].PublishedAt).Seconds(), 1)
+	}
+	assert.Equal(t, map[string]interface{}{"body": map[string]interface{}{"n": float64(3)}, "other": float64(1)}, messages[2].Body)
+	assert.Nil(t, messages[2].ExpiresAt)
+}
+
+func TestServer_RejectAndRedrive(t *testing.T) {
+	s := newTestServer(t, []config.QueueConfig{
+		{Name: "source", Length: 10, SubscribersAmount: 1, DeadLetterQueue: "dlq"},
+		{Name: "dlq", Length: 10, SubscribersAmount: 1},
+	})
+
+	w := doRequest(s, http.MethodPost, "/v1/queues/source/subscriptions", "subscriber", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(s, http.MethodPost, "/v1/queues/dlq/subscriptions", "subscriber", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(s, http.MethodPost, "/v1/queues/source/messages", "", []byte(`{"n":1}`))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(s, http.MethodGet, "/v1/queues/source/messages", "subscriber", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var messages []struct {
+		ID         string                 `json:"id"`
+		Body       map[string]interface{} `json:"body"`
+		DeadLetter *struct {
+			SourceQueue string `json:"source_queue"`
+			Reason      string `json:"reason"`
+			Subscriber  string `json:"subscriber"`
+			OriginalID  string `json:"original_id"`
+		} `json:"dead_letter"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &messages))
+	require.Equal(t, 1, len(messages))
+	originalID := messages[0].ID
+
+	w = doRequest(s, http.MethodPost, "/v1/queues/source/messages/"+originalID+"/reject", "subscriber", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// dead-lettered message is delivered from the dlq with its metadata
+	w = doRequest(s, http.MethodGet, "/v1/queues/dlq/messages", "subscriber", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &messages))
+	require.Equal(t, 1, len(messages))
+	assert.Equal(t, map[string]interface{}{"n": float64(1)}, messages[0].Body)
+	if assert.NotNil(t, messages[0].DeadLetter) {
+		assert.Equal(t, "source", messages[0].DeadLetter.SourceQueue)
+		assert.Equal(t, "rejected", messages[0].DeadLetter.Reason)
+		assert.Equal(t, "subscriber", messages[0].DeadLetter.Subscriber)
+		assert.Equal(t, originalID, messages[0].DeadLetter.OriginalID)
+	}
+
+	w = doRequest(s, http.MethodPost, "/v1/int/queues/dlq/redrive?limit=x", "", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(s, http.MethodPost, "/v1/int/queues/dlq/redrive", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(s, http.MethodGet, "/v1/queues/source/messages", "subscriber", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	messages = nil
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &messages))
+	require.Equal(t, 1, len(messages))
+	assert.Equal(t, map[string]interface{}{"n": float64(1)}, messages[0].Body)
+	assert.Nil(t, messages[0].DeadLetter)
+
+	// dead-lettered and redriven messages are counted as published
+	w = doRequest(s, http.MethodGet, "/metrics", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `concurrent_queue_messages_published_total{queue="source"} 2`)
+	assert.Contains(t, w.Body.String(), `concurrent_queue_messages_published_total{queue="dlq"} 1`)
+}
+
+func TestServer_PublishScheduled(t *testing.T) {
+	s := newTestServer(t, []config.QueueConfig{
+		{Name: "scheduled", Length: 10, SubscribersAmount: 1},
+	})
+
+	w := doRequest(s, http.MethodPost, "/v1/queues/scheduled/subscriptions", "subscriber", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/queues/scheduled/messages", strings.NewReader(`{"n":1}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Message-Delay", "3600")
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	deliverAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	w = doRequest(s, http.MethodPost, "/v1/queues/scheduled/messages", "", []byte(`{"body":{"n":2},"deliver_at":"`+deliverAt+`"}`))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// delivery time in the past means right away
+	w = doRequest(s, http.MethodPost, "/v1/queues/scheduled/messages", "", []byte(`{"body":{"n":3},"deliver_at":"2000-01-01T00:00:00Z"}`))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(s, http.MethodPost, "/v1/queues/scheduled/messages", "", []byte(`{"body":{"n":4},"delay":-1}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(s, http.MethodPost, "/v1/queues/scheduled/messages", "", []byte(`{"body":{"n":4},"delay":1e300}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(s, http.MethodPost, "/v1/queues/scheduled/messages", "", []byte(`{"body":{"n":4},"deliver_at":"tomorrow"}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(s, http.MethodPost, "/v1/queues/scheduled/messages", "", []byte(`{"body":{"n":4},"delay":1,"deliver_at":"`+deliverAt+`"}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// delays which are not finite or don't fit into time.Duration
+	for _, value := range []string{"NaN", "Inf", "-Inf", "1e300"} {
+		req = httptest.NewRequest(http.MethodPost, "/v1/queues/scheduled/messages", strings.NewReader(`{"n":4}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Message-Delay", value)
+		w = httptest.NewRecorder()
+		s.router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, value)
+	}
+
+	w = doRequest(s, http.MethodGet, "/v1/queues/scheduled/messages", "subscriber", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var messages []struct {
+		Body map[string]interface{} `json:"body"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &messages))
+	require.Equal(t, 1, len(messages))
+	assert.Equal(t, map[string]interface{}{"n": float64(3)}, messages[0].Body)
+
+	w = doRequest(s, http.MethodGet, "/v1/int/queues/scheduled", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var queue struct {
+		Messages []struct {
+			Scheduled bool
+		}
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &queue))
+	require.Equal(t, 3, len(queue.Messages))
+	assert.True(t, queue.Messages[0].Scheduled)
+	assert.True(t, queue.Messages[1].Scheduled)
+	assert.False(t, queue.Messages[2].Scheduled)
+}
+
+func TestServer_PublishWithPriority(t *testing.T) {
+	s := newTestServer(t, []config.QueueConfig{
+		{Name: "priority", Length: 10, SubscribersAmount: 1, PriorityLevels: 5},
+	})
+
+	w := doRequest(s, http.MethodPost, "/v1/queues/priority/subscriptions", "subscriber", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(s, http.MethodPost, "/v1/queues/priority/messages", "", []byte(`{"n":1}`))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/queues/priority/messages", strings.NewReader(`{"n":2}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Message-Priority", "2")
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(s, http.MethodPost, "/v1/queues/priority/messages", "", []byte(`{"body":{"n":3},"priority":4}`))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(s, http.MethodPost, "/v1/queues/priority/messages", "", []byte(`{"body":{"n":4},"priority":1.5}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(s, http.MethodPost, "/v1/queues/priority/messages", "", []byte(`{"body":{"n":4},"priority":5}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = doRequest(s, http.MethodGet, "/v1/queues/priority/messages", "subscriber", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var messages []struct {
+		Body     map[string]interface{} `json:"body"`
+		Priority uint                   `json:"priority"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &messages))
+	require.Equal(t, 3, len(messages))
+	assert.Equal(t, map[string]interface{}{"n": float64(3)}, messages[0].Body)
+	assert.Equal(t, uint(4), messages[0].Priority)
+	assert.Equal(t, map[string]interface{}{"n": float64(2)}, messages[1].Body)
+	assert.Equal(t, map[string]interface{}{"n": float64(1)}, messages[2].Body)
+}
+
+func TestServer_CompetingConsumers(t *testing.T) {
+	s := newTestServer(t, []config.QueueConfig{})
+
+	w := doRequest(s, http.MethodPost, "/v1/int/queues/", "", []byte(`{"name":"work","max_length":10,"max_subscribers":2,"delivery_mode":"unknown"}`))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(s, http.MethodPost, "/v1/int/queues/", "", []byte(`{"name":"work","max_length":10,"max_subscribers":2,"delivery_mode":"competing"}`))
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	for _, subscriber := range []string{"worker1", "worker2"} {
+		w = doRequest(s, http.MethodPost, "/v1/queues/work/subscriptions", subscriber, nil)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+	for i := 0; i < 4; i++ {
+		w = doRequest(s, http.MethodPost, "/v1/queues/work/messages", "", []byte(fmt.Sprintf(`{"n":%d}`, i)))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	type message struct {
+		ID   string                 `json:"id"`
+		Body map[string]interface{} `json:"body"`
+	}
+	consumed := map[string][]message{}
+	seen := map[float64]struct{}{}
+	for _, subscriber := range []string{"worker1", "worker2"} {
+		w = doRequest(s, http.MethodGet, "/v1/queues/work/messages", subscriber, nil)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var messages []message
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &messages))
+		require.Equal(t, 2, len(messages))
+
+		consumed[subscriber] = messages
+		for _, m := range messages {
+			seen[m.Body["n"].(float64)] = struct{}{}
+		}
+	}
+	assert.Equal(t, 4, len(seen))
+
+	for subscriber, messages := range consumed {
+		for _, m := range messages {
+			w = doRequest(s, http.MethodPost, "/v1/queues/work/messages/"+m.ID+"/ack", subscriber, nil)
+			require.Equal(t, http.StatusOK, w.Code)
+		}
+	}
+
+	w = doRequest(s, http.MethodGet, "/v1/int/queues/work", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var queue struct {
+		DeliveryMode string
+		Messages     []interface{}
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &queue))
+	assert.Equal(t, "competing", queue.DeliveryMode)
+	assert.Equal(t, 0, len(queue.Messages))
+}
+
+func TestServer_ConsumerGroups(t *testing.T) {
+	s := newTestServer(t, []config.QueueConfig{
+		{Name: "groups", Length: 10, SubscribersAmount: 3},
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/queues/groups/subscriptions", nil)
+	req.Header.Set("X-Subscriber", "member1")
+	req.Header.Set("X-Consumer-Group", "workers")
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(s, http.MethodPost, "/v1/queues/groups/subscriptions", "member2", []byte(`{"group":"workers"}`))
+	require.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(s, http.MethodPost, "/v1/queues/groups/subscriptions", "auditor", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(s, http.MethodPost, "/v1/queues/groups/subscriptions", "member3", []byte(`{"group":"auditor"}`))
+	require.Equal(t, http.StatusConflict, w.Code)
+
+	for i := 0; i < 2; i++ {
+		w = doRequest(s, http.MethodPost, "/v1/queues/groups/messages", "", []byte(fmt.Sprintf(`{"n":%d}`, i)))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	consumed := map[string]int{}
+	for _, subscriber := range []string{"member1", "member2", "auditor"} {
+		w = doRequest(s, http.MethodGet, "/v1/queues/groups/messages", subscriber, nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		var messages []interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &messages))
+		consumed[subscriber] = len(messages)
+	}
+	assert.Equal(t, map[string]int{"member1": 1, "member2": 1, "auditor": 2}, consumed)
+
+	w = doRequest(s, http.MethodGet, "/v1/int/queues/groups/groups", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var groups []struct {
+		Name     string   `json:"name"`
+		Members  []string `json:"members"`
+		Lag      int      `json:"lag"`
+		InFlight int      `json:"in_flight"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &groups))
+	require.Equal(t, 1, len(groups))
+	assert.Equal(t, "workers", groups[0].Name)
+	assert.Equal(t, []string{"member1", "member2"}, groups[0].Members)
+	assert.Equal(t, 2, groups[0].Lag)
+	assert.Equal(t, 2, groups[0].InFlight)
+
+	w = doRequest(s, http.MethodGet, "/v1/int/queues/unknown/groups", "", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestServer_Exchanges(t *testing.T) {
+	s := newTestServer(t, []config.QueueConfig{
+		{Name: "created", Length: 10, SubscribersAmount: 1},
+		{Name: "audit", Length: 10, SubscribersAmount: 1},
+	})
+
+	w := doRequest(s, http.MethodPost, "/v1/int/exchanges/", "", []byte(`{"name":"events","bindings":[{"queue":"created","pattern":"orders.*.created"}]}`))
+	require.Equal(t, http.StatusCreated, w.Code)
+	w = doRequest(s, http.MethodPost, "/v1/int/exchanges/", "", []byte(`{"name":"events"}`))
+	require.Equal(t, http.StatusConflict, w.Code)
+
+	w = doRequest(s, http.MethodPost, "/v1/int/exchanges/events/bindings", "", []byte(`{"queue":"audit","pattern":"#"}`))
+	require.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(s, http.MethodPost, "/v1/int/exchanges/events/bindings", "", []byte(`{"queue":"unknown","pattern":"#"}`))
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = doRequest(s, http.MethodGet, "/v1/int/exchanges/events", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var exchange struct {
+		Name     string
+		Bindings []struct{ Queue, Pattern string }
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &exchange))
+	assert.Equal(t, "events", exchange.Name)
+	assert.Equal(t, 2, len(exchange.Bindings))
+
+	w = doRequest(s, http.MethodPost, "/v1/exchanges/events/messages", "", []byte(`{"msg":"hello"}`))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	publish := func(routingKey string) []string {
+		req := httptest.NewRequest(http.MethodPost, "/v1/exchanges/events/messages", bytes.NewReader([]byte(`{"body":{"msg":"hello"},"priority":0}`)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Routing-Key", routingKey)
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var res struct {
+			Queues []string `json:"queues"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		return res.Queues
+	}
+
+	assert.Equal(t, []string{"audit", "created"}, publish("orders.eu.created"))
+	assert.Equal(t, []string{"audit"}, publish("orders.eu.shipped"))
+
+	w = doRequest(s, http.MethodDelete, "/v1/int/exchanges/events/bindings?queue=audit&pattern=%23", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{}, publish("orders.eu.shipped"))
+
+	w = doRequest(s, http.MethodDelete, "/v1/int/exchanges/events", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(s, http.MethodGet, "/v1/int/exchanges/events", "", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestServer_PublishWithAttributes(t *testing.T) {
+	s := newTestServer(t, []config.QueueConfig{
+		{Name: "attrs", Length: 10, SubscribersAmount: 1},
+	})
+
+	w := doRequest(s, http.MethodPost, "/v1/queues/attrs/subscriptions", "subscriber", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	type published struct {
+		Queue       string    `json:"queue"`
+		ID          string    `json:"id"`
+		Seq         uint64    `json:"seq"`
+		PublishedAt time.Time `json:"published_at"`
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/queues/attrs/messages", strings.NewReader(`{"n":1}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Message-Header-Trace-Id", "abc")
+	req.Header.Set("X-Message-Content-Type", "application/vnd.order+json")
+	req.Header.Set("X-Correlation-ID", "corr1")
+	req.Header.Set("X-Publisher-ID", "billing")
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var first published
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &first))
+	assert.Equal(t, "attrs", first.Queue)
+	assert.NotEmpty(t, first.ID)
+	assert.Equal(t, uint64(1), first.Seq)
+	assert.False(t, first.PublishedAt.IsZero())
+
+	w = doRequest(s, http.MethodPost, "/v1/queues/attrs/messages", "", []byte(`{"body":{"n":2},"headers":{"tenant":"acme"},"correlation_id":"corr2"}`))
+	require.Equal(t, http.StatusOK, w.Code)
+	var second published
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &second))
+
+	w = doRequest(s, http.MethodPost, "/v1/queues/attrs/messages", "", []byte(`{"body":{"n":3},"headers":{"tenant":1}}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = doRequest(s, http.MethodGet, "/v1/queues/attrs/messages", "subscriber", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var messages []struct {
+		ID            string                 `json:"id"`
+		Body          map[string]interface{} `json:"body"`
+		Headers       map[string]string      `json:"headers"`
+		ContentType   string                 `json:"content_type"`
+		CorrelationID string                 `json:"correlation_id"`
+		PublisherID   string                 `json:"publisher_id"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &messages))
+	require.Equal(t, 2, len(messages))
+
+	assert.Equal(t, first.ID, messages[0].ID)
+	assert.Equal(t, map[string]string{"Trace-Id": "abc"}, messages[0].Headers)
+	assert.Equal(t, "application/vnd.order+json", messages[0].ContentType)
+	assert.Equal(t, "corr1", messages[0].CorrelationID)
+	assert.Equal(t, "billing", messages[0].PublisherID)
+
+	assert.Equal(t, second.ID, messages[1].ID)
+	assert.Equal(t, map[string]interface{}{"n": float64(2)}, messages[1].Body)
+	assert.Equal(t, map[string]string{"tenant": "acme"}, messages[1].Headers)
+	assert.Equal(t, "corr2", messages[1].CorrelationID)
+}
+
+func TestServer_ArbitraryPayloads(t *testing.T) {
+	s := newTestServer(t, []config.QueueConfig{
+		{Name: "payloads", Length: 10, SubscribersAmount: 2},
+	})
+
+	for _, subscriber := range []string{"list", "raw"} {
+		w := doRequest(s, http.MethodPost, "/v1/queues/payloads/subscriptions", subscriber, nil)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	image := []byte{0x89, 'P', 'N', 'G', 0x00, 0xff}
+	publish := func(contentType string, payload []byte) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/queues/payloads/messages", bytes.NewReader(payload))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		req.Header.Set("X-Message-Header-Origin", "test")
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+
+	publish("image/png", image)
+	publish("application/json", []byte(`[1, 2, 3]`))
+	publish("text/plain", []byte("hello"))
+	publish("", []byte{0x00})
+
+	w := doRequest(s, http.MethodPost, "/v1/queues/payloads/messages", "", []byte(`{"broken"`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = doRequest(s, http.MethodGet, "/v1/queues/payloads/messages", "list", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var messages []struct {
+		Body        json.RawMessage `json:"body"`
+		BodyBase64  []byte          `json:"body_base64"`
+		ContentType string          `json:"content_type"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &messages))
+	require.Equal(t, 4, len(messages))
+
+	assert.Equal(t, image, messages[0].BodyBase64)
+	assert.Equal(t, "image/png", messages[0].ContentType)
+	assert.JSONEq(t, `[1, 2, 3]`, string(messages[1].Body))
+	assert.Nil(t, messages[1].BodyBase64)
+	assert.Equal(t, []byte("hello"), messages[2].BodyBase64)
+	assert.Equal(t, []byte{0x00}, messages[3].BodyBase64)
+	assert.Equal(t, "application/octet-stream", messages[3].ContentType)
+
+	// raw consume returns a single message as is
+	w = doRequest(s, http.MethodGet, "/v1/queues/payloads/messages?raw=true", "raw", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, image, w.Body.Bytes())
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.Equal(t, "1", w.Header().Get("X-Message-Seq"))
+	assert.Equal(t, "test", w.Header().Get("X-Message-Header-Origin"))
+	assert.NotEmpty(t, w.Header().Get("X-Message-ID"))
+
+	w = doRequest(s, http.MethodPost, "/v1/queues/payloads/messages/"+w.Header().Get("X-Message-ID")+"/ack", "raw", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	for i := 0; i < 3; i++ {
+		w = doRequest(s, http.MethodGet, "/v1/queues/payloads/messages?raw=true", "raw", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+	w = doRequest(s, http.MethodGet, "/v1/queues/payloads/messages?raw=true", "raw", nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = doRequest(s, http.MethodGet, "/v1/queues/payloads/messages?raw=maybe", "raw", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestServer_PublishedMessageSizeIsLimited(t *testing.T) {
+	s := newTestServer(t, []config.QueueConfig{
+		{Name: "limited", Length: 10, SubscribersAmount: 1},
+	})
+	s.cfg.Server.MaxMessageBytes = 16
+
+	w := doRequest(s, http.MethodPost, "/v1/int/exchanges/", "", []byte(`{"name":"events","bindings":[{"queue":"limited","pattern":"#"}]}`))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	publish := func(path string, payload []byte) int {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "text/plain")
+		req.Header.Set("X-Routing-Key", "orders")
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for _, path := range []string{"/v1/queues/limited/messages", "/v1/exchanges/events/messages"} {
+		assert.Equal(t, http.StatusOK, publish(path, bytes.Repeat([]byte("a"), 16)), path)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, publish(path, bytes.Repeat([]byte("a"), 17)), path)
+	}
+
+	w = doRequest(s, http.MethodGet, "/v1/int/queues/limited", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var queue struct {
+		Messages []interface{}
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &queue))
+	assert.Equal(t, 2, len(queue.Messages))
+}
+
+func TestServer_PublishWithIdempotencyKey(t *testing.T) {
+	s := newTestServer(t, []config.QueueConfig{
+		{Name: "orders", Length: 10, SubscribersAmount: 1},
+	})
+
+	w := doRequest(s, http.MethodPost, "/v1/queues/orders/subscriptions", "subscriber", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	type published struct {
+		ID        string `json:"id"`
+		Seq       uint64 `json:"seq"`
+		Duplicate bool   `json:"duplicate"`
+	}
+
+	publishWithKey := func(header, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/queues/orders/messages", strings.NewReader(body))
+		req.Header.Set("Content-Type", "text/plain")
+		req.Header.Set(header, key)
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, req)
+		return w
+	}
+
+	w = publishWithKey("Idempotency-Key", "order-1", "first")
+	require.Equal(t, http.StatusOK, w.Code)
+	var first published
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &first))
+	assert.False(t, first.Duplicate)
+
+	// both headers name the same deduplication ID
+	w = publishWithKey("X-Message-Deduplication-ID", "order-1", "second")
+	require.Equal(t, http.StatusOK, w.Code)
+	var second published
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &second))
+	assert.True(t, second.Duplicate)
+	assert.Equal(t, first.ID, second.ID)
+	assert.Equal(t, first.Seq, second.Seq)
+
+	w = doRequest(s, http.MethodPost, "/v1/queues/orders/messages", "", []byte(`{"body":{"n":1},"deduplication_id":"order-1"}`))
+	require.Equal(t, http.StatusOK, w.Code)
+	var third published
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &third))
+	assert.Equal(t, first.ID, third.ID)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/queues/orders/messages", strings.NewReader("conflict"))
+	req.Header.Set("Idempotency-Key", "order-2")
+	req.Header.Set("X-Message-Deduplication-ID", "order-3")
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = doRequest(s, http.MethodGet, "/v1/queues/orders/messages", "subscriber", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var messages []struct {
+		ID string `json:"id"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &messages))
+	if assert.Equal(t, 1, len(messages)) {
+		assert.Equal(t, first.ID, messages[0].ID)
+	}
+}
+
+func TestServer_Metrics(t *testing.T) {
+	s := newTestServer(t, []config.QueueConfig{
+		{Name: "metered", Length: 2, SubscribersAmount: 2},
+	})
+
+	w := doRequest(s, http.MethodPost, "/v1/queues/metered/subscriptions", "subscriber1", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(s, http.MethodPost, "/v1/queues/metered/subscriptions", "subscriber2", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	for i := 0; i < 3; i++ {
+		doRequest(s, http.MethodPost, "/v1/queues/metered/messages", "", []byte(`{"n":1}`))
+	}
+
+	w = doRequest(s, http.MethodGet, "/v1/queues/metered/messages", "subscriber1", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var messages []struct {
+		ID string `json:"id"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &messages))
+	require.Equal(t, 2, len(messages))
+
+	// message acknowledged by both subscribers is deleted
+	w = doRequest(s, http.MethodGet, "/v1/queues/metered/messages", "subscriber2", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	for _, sub := range []string{"subscriber1", "subscriber2"} {
+		w = doRequest(s, http.MethodPost, "/v1/queues/metered/messages/"+messages[0].ID+"/ack", sub, nil)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	w = doRequest(s, http.MethodGet, "/metrics", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+
+	for _, line := range []string{
+		`concurrent_queue_messages_published_total{queue="metered"} 2`,
+		`concurrent_queue_publish_rejected_full_total{queue="metered"} 1`,
+		`concurrent_queue_messages_consumed_total{queue="metered"} 4`,
+		`concurrent_queue_messages_deleted_total{queue="metered"} 1`,
+		`concurrent_queue_queue_depth{queue="metered"} 1`,
+		`concurrent_queue_queue_max_length_utilization{queue="metered"} 0.5`,
+		`concurrent_queue_queue_subscribers{queue="metered"} 2`,
+		`concurrent_queue_subscriber_lag{queue="metered",subscriber="subscriber1"} 1`,
+		`concurrent_queue_http_request_duration_seconds_count{method="POST",queue="metered",route="/v1/queues/:queue_name/messages",status="400"} 1`,
+		`concurrent_queue_http_request_duration_seconds_count{method="POST",queue="metered",route="/v1/queues/:queue_name/messages",status="200"} 2`,
+	} {
+		assert.Contains(t, body, line)
+	}
+	assert.Contains(t, body, `concurrent_queue_queue_oldest_message_age_seconds{queue="metered"}`)
+
+	// unknown queues don't create series
+	w = doRequest(s, http.MethodGet, "/v1/queues/unknown/messages", "subscriber1", nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+	w = doRequest(s, http.MethodGet, "/metrics", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), `queue="unknown"`)
+	assert.Contains(t, w.Body.String(), `concurrent_queue_http_request_duration_seconds_count{method="GET",queue="",route="/v1/queues/:queue_name/messages",status="404"} 1`)
+
+	// metrics of deleted queue are dropped
+	w = doRequest(s, http.MethodDelete, "/v1/int/queues/metered", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(s, http.MethodGet, "/metrics", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), `concurrent_queue_queue_depth{queue="metered"}`)
+	assert.NotContains(t, w.Body.String(), `concurrent_queue_messages_published_total{queue="metered"}`)
+	assert.NotContains(t, w.Body.String(), `queue="metered"`)
+}
+
+func TestServer_HealthAndReadiness(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := &config.Config{
+		Server:  config.ServerConfig{TimeoutSec: 5},
+		Logger:  config.LoggerConfig{Encoding: "json", Level: "error"},
+		Queues:  []config.QueueConfig{{Name: "probed", Length: 10, SubscribersAmount: 1}},
+		Storage: config.StorageConfig{Type: config.StorageFile, Dir: filepath.Join(t.TempDir(), "data")},
+	}
+	apiLogger := logger.NewAPILogger(cfg)
+	apiLogger.InitLogger()
+
+	s := NewServer(cfg, apiLogger)
+	require.NoError(t, s.MapHandlers())
+	t.Cleanup(s.close)
+
+	type readiness struct {
+		Status     string `json:"status"`
+		Components map[string]struct {
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		} `json:"components"`
+	}
+	readyz := func() (int, readiness) {
+		w := doRequest(s, http.MethodGet, "/readyz", "", nil)
+		var res readiness
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		return w.Code, res
+	}
+
+	// process is alive but not ready while queues are being restored
+	w := doRequest(s, http.MethodGet, "/healthz", "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	code, res := readyz()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "not_ready", res.Status)
+	assert.Equal(t, "initializing", res.Components["queues"].Status)
+	assert.Equal(t, "ok", res.Components["server"].Status)
+
+	w = doRequest(s, http.MethodGet, "/v1/int/queues/probed", "", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	require.NoError(t, s.InitQueues(context.Background()))
+
+	code, res = readyz()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ready", res.Status)
+	for _, component := range []string{"queues", "storage", "server"} {
+		assert.Equal(t, "ok", res.Components[component].Status, component)
+	}
+
+	w = doRequest(s, http.MethodGet, "/v1/int/queues/probed", "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// storage which has lost its directory fails readiness
+	require.NoError(t, os.Rename(cfg.Storage.Dir, cfg.Storage.Dir+".moved"))
+	code, res = readyz()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "failing", res.Components["storage"].Status)
+	assert.NotEmpty(t, res.Components["storage"].Error)
+	require.NoError(t, os.Rename(cfg.Storage.Dir+".moved", cfg.Storage.Dir))
+
+	// stopping server is not ready anymore
+	s.health.draining.Store(true)
+	code, res = readyz()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "draining", res.Components["server"].Status)
+}
+
+func TestServer_GracefulShutdown(t *testing.T) {
+	const queueName = "draining"
+
+	gin.SetMode(gin.TestMode)
+
+	cfg := &config.Config{
+		Server: config.ServerConfig{TimeoutSec: 60, ShutdownGraceSec: 5},
+		Logger: config.LoggerConfig{Encoding: "json", Level: "error"},
+		Queues: []config.QueueConfig{{Name: queueName, Length: 10, SubscribersAmount: 2, VisibilityTimeoutSec: 60}},
+	}
+	apiLogger := logger.NewAPILogger(cfg)
+	apiLogger.InitLogger()
+
+	s := NewServer(cfg, apiLogger)
+	require.NoError(t, s.MapHandlers())
+	t.Cleanup(s.close)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	url := "http://" + lis.Addr().String()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- s.serve(ctx, lis)
+	}()
+
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(url + "/readyz")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for _, subscriber := range []string{"streamer", "poller"} {
+		w := doRequest(s, http.MethodPost, "/v1/queues/"+queueName+"/subscriptions", subscriber, nil)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+	w := doRequest(s, http.MethodPost, "/v1/queues/"+queueName+"/messages", "", []byte(`{"n": 1}`))
+	require.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(s, http.MethodGet, "/v1/queues/"+queueName+"/messages", "poller", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var polled []struct {
+		ID string `json:"id"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &polled))
+	require.Equal(t, 1, len(polled))
+	w = doRequest(s, http.MethodPost, "/v1/queues/"+queueName+"/messages/"+polled[0].ID+"/ack", "poller", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// stream leaves its message unacknowledged
+	resp := openStream(t, url+"/v1/queues/"+queueName+"/stream", "streamer", "")
+	defer resp.Body.Close()
+	events := bufio.NewReader(resp.Body)
+	assert.Equal(t, "message", readEvent(t, events).Event)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+lis.Addr().String()+"/v1/ws?subscriber=ws", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	polling := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, url+"/v1/queues/"+queueName+"/messages?wait=50", nil)
+		req.Header.Set("X-Subscriber", "poller")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			polling <- 0
+			return
+		}
+		resp.Body.Close()
+		polling <- resp.StatusCode
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	cancel()
+
+	// long-poll is answered early and stream is told why it ends
+	assert.Equal(t, http.StatusOK, <-polling)
+	event := readEvent(t, events)
+	assert.Equal(t, "error", event.Event)
+	assert.Contains(t, event.Data, "shutting down")
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	for {
+		if _, _, err = conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), err.Error())
+
+	select {
+	case err := <-served:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server hasn't stopped within grace period")
+	}
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	w = doRequest(s, http.MethodPost, "/v1/queues/"+queueName+"/messages", "", []byte(`{"n": 2}`))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	// message of the stream is released and redelivered right away
+	w = doRequest(s, http.MethodGet, "/v1/queues/"+queueName+"/messages", "streamer", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &polled))
+	assert.Equal(t, 1, len(polled))
+}
+
+func TestServer_ShutdownFailsWhenRequestsOutliveGracePeriod(t *testing.T) {
+	const queueName = "draining"
+
+	gin.SetMode(gin.TestMode)
+
+	cfg := &config.Config{
+		Server: config.ServerConfig{TimeoutSec: 60, ShutdownGraceSec: 1},
+		Logger: config.LoggerConfig{Encoding: "json", Level: "error"},
+		Queues: []config.QueueConfig{{Name: queueName, Length: 10, SubscribersAmount: 2}},
+	}
+	apiLogger := logger.NewAPILogger(cfg)
+	apiLogger.InitLogger()
+
+	s := NewServer(cfg, apiLogger)
+	require.NoError(t, s.MapHandlers())
+	t.Cleanup(s.close)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- s.serve(ctx, lis)
+	}()
+
+	require.Eventually(t, func() bool {
+		return doRequest(s, http.MethodGet, "/readyz", "", nil).Code == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// publish whose body never arrives in full stays in flight
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("POST /v1/queues/" + queueName + "/messages HTTP/1.1\r\nHost: test\r\nContent-Type: application/json\r\nContent-Length: 100\r\n\r\n{"))
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	cancel()
+
+	// server isn't ready while publishes are rejected
+	require.Eventually(t, func() bool {
+		return doRequest(s, http.MethodPost, "/v1/queues/"+queueName+"/messages", "", []byte(`{"n": 1}`)).Code == http.StatusServiceUnavailable
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, http.StatusServiceUnavailable, doRequest(s, http.MethodGet, "/readyz", "", nil).Code)
+
+	select {
+	case err := <-served:
+		assert.ErrorContains(t, err, "grace period")
+	case <-time.After(5 * time.Second):
+		t.Fatal("server hasn't stopped after grace period")
+	}
+}
+
+func TestServer_AuthAndACLs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := &config.Config{
+		Server: config.ServerConfig{TimeoutSec: 5},
+		Logger: config.LoggerConfig{Encoding: "json", Level: "error"},
+		Queues: []config.QueueConfig{
+			{Name: "orders.created", Length: 10, SubscribersAmount: 2},
+			{Name: "billing", Length: 10, SubscribersAmount: 2},
+		},
+		Auth: config.AuthConfig{
+			Enabled: true,
+			Principals: []config.PrincipalConfig{
+				{
+					Name:        "orders",
+					APIKeys:     []string{"orders-key"},
+					Subscribers: []string{"orders-*"},
+					Permissions: []config.PermissionConfig{
+						{Queues: []string{"orders.*"}, Actions: []string{"publish", "consume", "subscribe"}},
+					},
+				},
+				{
+					Name:           "signer",
+					SigningSecrets: []string{"signer-secret"},
+					Permissions: []config.PermissionConfig{
+						{Queues: []string{"orders.*"}, Actions: []string{"publish"}},
+					},
+				},
+				{
+					Name:    "admin",
+					APIKeys: []string{"admin-key"},
+					Permissions: []config.PermissionConfig{
+						{Queues: []string{"*"}, Actions: []string{"admin"}},
+					},
+				},
+			},
+		},
+	}
+	apiLogger := logger.NewAPILogger(cfg)
+	apiLogger.InitLogger()
+
+	s := NewServer(cfg, apiLogger)
+	require.NoError(t, s.MapHandlers())
+	t.Cleanup(s.close)
+	require.NoError(t, s.InitQueues(context.Background()))
+
+	request := func(method, path, key, subscriber string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		if subscriber != "" {
+			req.Header.Set("X-Subscriber", subscriber)
+		}
+
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, req)
+		return w
+	}
+	message := []byte(`{"msg": "hello"}`)
+
+	// probes are not authenticated
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/healthz", "", "", nil).Code)
+
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost, "/v1/queues/orders.created/messages", "", "", message).Code)
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost, "/v1/queues/orders.created/messages", "wrong-key", "", message).Code)
+
+	assert.Equal(t, http.StatusOK, request(http.MethodPost, "/v1/queues/orders.created/messages", "orders-key", "", message).Code)
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/v1/queues/billing/messages", "orders-key", "", message).Code)
+
+	// subscriber is bound to principal
+	assert.Equal(t, http.StatusOK, request(http.MethodPost, "/v1/queues/orders.created/subscriptions", "orders-key", "orders-1", nil).Code)
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/v1/queues/orders.created/subscriptions", "orders-key", "billing-1", nil).Code)
+	assert.Equal(t, http.StatusForbidden, request(http.MethodGet, "/v1/queues/orders.created/messages", "orders-key", "admin", nil).Code)
+	assert.Equal(t, http.StatusForbidden, request(http.MethodDelete, "/v1/queues/orders.created/subscriptions/billing-1", "orders-key", "", nil).Code)
+
+	w := request(http.MethodGet, "/v1/queues/orders.created/messages", "orders-key", "orders-1", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var consumed []interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &consumed))
+	assert.Equal(t, 1, len(consumed))
+
+	// internal routes with message bodies need admin
+	assert.Equal(t, http.StatusForbidden, request(http.MethodGet, "/v1/int/queues/orders.created", "orders-key", "", nil).Code)
+	assert.Equal(t, http.StatusForbidden, request(http.MethodGet, "/v1/int/queues/", "orders-key", "", nil).Code)
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/v1/int/queues/orders.created", "admin-key", "", nil).Code)
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/v1/int/queues/", "admin-key", "", nil).Code)
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/v1/queues/orders.created/messages", "admin-key", "", message).Code)
+
+	signed := func(body []byte, signedBody []byte, timestamp time.Time) int {
+		path := "/v1/queues/orders.created/messages"
+		ts := strconv.FormatInt(timestamp.Unix(), 10)
+		signature := hex.EncodeToString(auth.Sign([]byte("signer-secret"), []byte(auth.StringToSign(http.MethodPost, path, ts, signedBody))))
+
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "HMAC-SHA256 signer:"+signature)
+		req.Header.Set("X-Auth-Timestamp", ts)
+
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, signed(message, message, time.Now()))
+	assert.Equal(t, http.StatusUnauthorized, signed([]byte(`{"msg": "tampered"}`), message, time.Now()))
+	assert.Equal(t, http.StatusUnauthorized, signed(message, message, time.Now().Add(-time.Hour)))
+
+	// requests rejected by auth don't label series with queue
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost, "/v1/queues/no-such-queue/messages", "wrong-key", "", message).Code)
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/v1/queues/billing/messages", "orders-key", "", message).Code)
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), `queue="no-such-queue"`)
+	assert.NotContains(t, w.Body.String(), `queue="billing",route="/v1/queues/:queue_name/messages",status="403"`)
+
+	// websocket frames are authorized by principal of the connection
+	ts := httptest.NewServer(s.router)
+	defer ts.Close()
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/v1/ws?subscriber="
+	header := http.Header{"X-Api-Key": []string{"orders-key"}}
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL+"billing-1", header)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"orders-2", header)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var f struct {
+		Type  string `json:"type"`
+		Error string `json:"error"`
+	}
+	require.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "publish", "id": "1", "queue": "billing", "body": map[string]string{"msg": "hello"}}))
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	require.NoError(t, conn.ReadJSON(&f))
+	assert.Equal(t, "error", f.Type)
+	assert.Contains(t, f.Error, "permission denied")
+
+	// gRPC calls are authenticated by API key in metadata
+	client := dialGrpc(t, s)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	body, err := structpb.NewStruct(map[string]interface{}{"msg": "hello"})
+	require.NoError(t, err)
+
+	_, err = client.Publish(ctx, &queuespb.PublishRequest{Queue: "orders.created", Body: body})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", "orders-key")
+	_, err = client.Publish(ctx, &queuespb.PublishRequest{Queue: "orders.created", Body: body})
+	assert.NoError(t, err)
+	_, err = client.Publish(ctx, &queuespb.PublishRequest{Queue: "billing", Body: body})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.Consume(ctx, &queuespb.ConsumeRequest{Queue: "orders.created", Subscriber: "billing-1"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestServer_JWTAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	hmacKey := []byte("jwt-hmac-secret")
+
+	jwks, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{
+			"kty": "RSA", "kid": "rsa1", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+		},
+		{"kty": "oct", "kid": "hs1", "k": base64.RawURLEncoding.EncodeToString(hmacKey)},
+	}})
+	require.NoError(t, err)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(jwksFile, jwks, 0o600))
+
+	cfg := &config.Config{
+		Server: config.ServerConfig{TimeoutSec: 5},
+		Logger: config.LoggerConfig{Encoding: "json", Level: "error"},
+		Queues: []config.QueueConfig{
+			{Name: "orders.created", Length: 10, SubscribersAmount: 2},
+			{Name: "billing", Length: 10, SubscribersAmount: 2},
+		},
+		Auth: config.AuthConfig{
+			Enabled: true,
+			JWT: config.JWTConfig{
+				Enabled:         true,
+				JWKSFile:        jwksFile,
+				Issuer:          "https://id.example.com",
+				Audience:        "concurrent-queue",
+				SubscriberClaim: "subscriber",
+				ScopesClaim:     "scope",
+			},
+		},
+	}
+	apiLogger := logger.NewAPILogger(cfg)
+	apiLogger.InitLogger()
+
+	s := NewServer(cfg, apiLogger)
+	require.NoError(t, s.MapHandlers())
+	t.Cleanup(s.close)
+	require.NoError(t, s.InitQueues(context.Background()))
+
+	sign := func(method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+		base := jwt.MapClaims{
+			"iss": "https://id.example.com",
+			"aud": "concurrent-queue",
+			"sub": "orders-service",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+		for name, value := range claims {
+			base[name] = value
+		}
+		token := jwt.NewWithClaims(method, base)
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(key)
+		require.NoError(t, err)
+		return signed
+	}
+	request := func(method, path, token, subscriber string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		if subscriber != "" {
+			req.Header.Set("X-Subscriber", subscriber)
+		}
+
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, req)
+		return w
+	}
+	message := []byte(`{"msg": "hello"}`)
+
+	orders := sign(jwt.SigningMethodRS256, "rsa1", rsaKey, jwt.MapClaims{
+		"subscriber": "orders-1",
+		"scope":      "publish:queue:orders.* consume:queue:orders.* subscribe:queue:orders.* profile:read",
+	})
+
+	// subscriber is taken from the claim, X-Subscriber can't override it
+	assert.Equal(t, http.StatusOK, request(http.MethodPost, "/v1/queues/orders.created/subscriptions", orders, "", nil).Code)
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/v1/queues/orders.created/subscriptions", orders, "orders-2", nil).Code)
+	queue, err := s.queuesUC.GetByName(context.Background(), "orders.created")
+	require.NoError(t, err)
+	assert.Contains(t, queue.Subscribers, "orders-1")
+
+	assert.Equal(t, http.StatusOK, request(http.MethodPost, "/v1/queues/orders.created/messages", orders, "", message).Code)
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/v1/queues/billing/messages", orders, "", message).Code)
+	assert.Equal(t, http.StatusForbidden, request(http.MethodGet, "/v1/int/queues/orders.created", orders, "", nil).Code)
+
+	w := request(http.MethodGet, "/v1/queues/orders.created/messages", orders, "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var consumed []interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &consumed))
+	assert.Equal(t, 1, len(consumed))
+
+	// scopes can be an array and tokens can be signed by symmetric key
+	billing := sign(jwt.SigningMethodHS256, "hs1", hmacKey, jwt.MapClaims{
+		"subscriber": "billing-1",
+		"scope":      []string{"publish:queue:billing"},
+	})
+	assert.Equal(t, http.StatusOK, request(http.MethodPost, "/v1/queues/billing/messages", billing, "", message).Code)
+
+	invalid := map[string]string{
+		"expired":        sign(jwt.SigningMethodRS256, "rsa1", rsaKey, jwt.MapClaims{"subscriber": "orders-1", "exp": time.Now().Add(-time.Hour).Unix()}),
+		"wrong audience": sign(jwt.SigningMethodRS256, "rsa1", rsaKey, jwt.MapClaims{"subscriber": "orders-1", "aud": "other"}),
+		"no subscriber":  sign(jwt.SigningMethodRS256, "rsa1", rsaKey, jwt.MapClaims{}),
+		"unknown kid":    sign(jwt.SigningMethodHS256, "other", []byte("other-secret"), jwt.MapClaims{"subscriber": "orders-1"}),
+		// RSA key is never used as HMAC secret
+		"algorithm confusion": sign(jwt.SigningMethodHS256, "rsa1", rsaKey.PublicKey.N.Bytes(), jwt.MapClaims{"subscriber": "orders-1"}),
+	}
+	for name, token := range invalid {
+		assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost, "/v1/queues/orders.created/messages", token, "", message).Code, name)
+	}
+
+	// gRPC calls carry token in authorization metadata
+	client := dialGrpc(t, s)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+orders)
+
+	_, err = client.Consume(ctx, &queuespb.ConsumeRequest{Queue: "orders.created", Subscriber: "orders-1"})
+	assert.NoError(t, err)
+	_, err = client.Consume(ctx, &queuespb.ConsumeRequest{Queue: "orders.created", Subscriber: "orders-2"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
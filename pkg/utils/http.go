@@ -2,6 +2,11 @@ package utils
 
 import (
 	"errors"
+	"math"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -13,7 +18,17 @@ func GetConfigPath(configPath string) string {
 	return configPath
 }
 
+// SubscriberKey is the key of gin context under which auth keeps subscriber
+// bound to credentials of request
+const SubscriberKey = "subscriber"
+
+// GetSubscriber returns subscriber bound to credentials of request, or the one
+// from X-Subscriber header if credentials don't name any
 func GetSubscriber(c *gin.Context) (string, error) {
+	if subscriberName := c.GetString(SubscriberKey); subscriberName != "" {
+		return subscriberName, nil
+	}
+
 	subscriberName, ok := c.Request.Header["X-Subscriber"]
 	if !ok {
 		return "", errors.New("failed to parse X-Subscriber header")
@@ -24,3 +39,196 @@ func GetSubscriber(c *gin.Context) (string, error) {
 
 	return subscriberName[0], nil
 }
+
+// GetConsumerGroup returns X-Consumer-Group header, empty string if there is no header
+func GetConsumerGroup(c *gin.Context) (string, error) {
+	groupName, ok := c.Request.Header["X-Consumer-Group"]
+	if !ok {
+		return "", nil
+	}
+	if len(groupName) != 1 || groupName[0] == "" {
+		return "", errors.New("exactly one non-empty consumer group in X-Consumer-Group header is allowed")
+	}
+
+	return groupName[0], nil
+}
+
+// GetRoutingKey returns X-Routing-Key header of message published to exchange
+func GetRoutingKey(c *gin.Context) (string, error) {
+	routingKey, ok := c.Request.Header["X-Routing-Key"]
+	if !ok || len(routingKey) != 1 {
+		return "", errors.New("exactly one routing key in X-Routing-Key header is required")
+	}
+
+	return routingKey[0], nil
+}
+
+// GetDeduplicationID returns deduplication ID of published message from
+// Idempotency-Key or X-Message-Deduplication-ID header, both of them can be set
+// only to the same value
+func GetDeduplicationID(c *gin.Context) (string, error) {
+	idempotencyKey := c.GetHeader("Idempotency-Key")
+	deduplicationID := c.GetHeader("X-Message-Deduplication-ID")
+	if idempotencyKey != "" && deduplicationID != "" && idempotencyKey != deduplicationID {
+		return "", errors.New("Idempotency-Key and X-Message-Deduplication-ID headers must be equal when both are set")
+	}
+	if idempotencyKey != "" {
+		return idempotencyKey, nil
+	}
+
+	return deduplicationID, nil
+}
+
+// MessageHeaderPrefix is prefix of HTTP headers which carry message headers
+const MessageHeaderPrefix = "X-Message-Header-"
+
+// GetMessageHeaders returns headers of message from X-Message-Header-<name>
+// headers. Names are canonicalized as HTTP header names, several values of the
+// same header are joined with comma
+func GetMessageHeaders(c *gin.Context) map[string]string {
+	var res map[string]string
+	for key, values := range c.Request.Header {
+		name := strings.TrimPrefix(textproto.CanonicalMIMEHeaderKey(key), MessageHeaderPrefix)
+		if len(name) == len(key) || name == "" {
+			continue
+		}
+		if res == nil {
+			res = make(map[string]string)
+		}
+		res[name] = strings.Join(values, ", ")
+	}
+
+	return res
+}
+
+// GetRawConsume parses raw query parameter, which asks for a single message
+// with its payload as response body
+func GetRawConsume(c *gin.Context) (bool, error) {
+	rawParam := c.Query("raw")
+	if rawParam == "" {
+		return false, nil
+	}
+
+	raw, err := strconv.ParseBool(rawParam)
+	if err != nil {
+		return false, errors.New("raw must be a boolean")
+	}
+
+	return raw, nil
+}
+
+// maxDurationSec is the number of seconds time.Duration can't reach
+const maxDurationSec = float64(math.MaxInt64) / float64(time.Second)
+
+// SecondsToDuration converts non-negative number of seconds to duration, it
+// fails for NaN, infinities and numbers which don't fit into time.Duration
+func SecondsToDuration(sec float64) (time.Duration, bool) {
+	if math.IsNaN(sec) || sec < 0 || sec >= maxDurationSec {
+		return 0, false
+	}
+	return time.Duration(sec * float64(time.Second)), true
+}
+
+func parseSeconds(value string) (time.Duration, bool) {
+	sec, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, false
+	}
+	return SecondsToDuration(sec)
+}
+
+// GetWaitTime parses wait query parameter in seconds and bounds it by maxWait
+func GetWaitTime(c *gin.Context, maxWait time.Duration) (time.Duration, error) {
+	waitParam := c.Query("wait")
+	if waitParam == "" {
+		return 0, nil
+	}
+
+	wait, ok := parseSeconds(waitParam)
+	if !ok {
+		return 0, errors.New("wait must be a non-negative number of seconds")
+	}
+
+	if wait > maxWait {
+		wait = maxWait
+	}
+
+	return wait, nil
+}
+
+// GetLastEventID parses Last-Event-ID header of reconnecting server-sent events
+// client, returns nil if there is no header
+func GetLastEventID(c *gin.Context) (*uint64, error) {
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		return nil, nil
+	}
+
+	seq, err := strconv.ParseUint(lastEventID, 10, 64)
+	if err != nil {
+		return nil, errors.New("Last-Event-ID must be a message sequence number")
+	}
+
+	return &seq, nil
+}
+
+// GetMessageTTL parses X-Message-TTL header in seconds, returns 0 if there is no header
+func GetMessageTTL(c *gin.Context) (time.Duration, error) {
+	ttlHeader := c.GetHeader("X-Message-TTL")
+	if ttlHeader == "" {
+		return 0, nil
+	}
+
+	ttl, ok := parseSeconds(ttlHeader)
+	if !ok || ttl <= 0 {
+		return 0, errors.New("X-Message-TTL must be a positive number of seconds")
+	}
+
+	return ttl, nil
+}
+
+// GetMessagePriority parses X-Message-Priority header, returns 0 if there is no header
+func GetMessagePriority(c *gin.Context) (uint, error) {
+	priorityHeader := c.GetHeader("X-Message-Priority")
+	if priorityHeader == "" {
+		return 0, nil
+	}
+
+	priority, err := strconv.ParseUint(priorityHeader, 10, 32)
+	if err != nil {
+		return 0, errors.New("X-Message-Priority must be a non-negative integer")
+	}
+
+	return uint(priority), nil
+}
+
+// GetMessageDelay parses X-Message-Delay header in seconds, returns 0 if there is no header
+func GetMessageDelay(c *gin.Context) (time.Duration, error) {
+	delayHeader := c.GetHeader("X-Message-Delay")
+	if delayHeader == "" {
+		return 0, nil
+	}
+
+	delay, ok := parseSeconds(delayHeader)
+	if !ok {
+		return 0, errors.New("X-Message-Delay must be a non-negative number of seconds")
+	}
+
+	return delay, nil
+}
+
+// GetDeliverAt parses X-Deliver-At header in RFC 3339 format, returns zero
+// time if there is no header
+func GetDeliverAt(c *gin.Context) (time.Time, error) {
+	deliverAtHeader := c.GetHeader("X-Deliver-At")
+	if deliverAtHeader == "" {
+		return time.Time{}, nil
+	}
+
+	deliverAt, err := time.Parse(time.RFC3339, deliverAtHeader)
+	if err != nil {
+		return time.Time{}, errors.New("X-Deliver-At must be a time in RFC 3339 format")
+	}
+
+	return deliverAt, nil
+}